@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"kvmgo/cli"
+	"kvmgo/config"
+	"kvmgo/daemon"
+	"kvmgo/lib/connection"
+)
+
+/*
+kvmetald serves VM lifecycle, exposure, snapshot and cluster operations on a unix socket.
+
+	sudo kvmetald --socket=/run/kvmetal/kvmetald.sock
+	KVMETAL_SOCKET=/run/kvmetal/kvmetald.sock kvmetal vm list
+
+Set socket: in /etc/kvmetal/config.yaml so the daemon and every client agree on it.
+*/
+func main() {
+	log.SetFlags(log.Ldate | log.Ltime | log.Lshortfile)
+
+	socket := flag.String("socket", "", "Unix socket to listen on (default socket: from the config)")
+	connectURI := flag.String("connect", "", "Libvirt connection URI")
+	pathFlags := config.RegisterFlags(flag.CommandLine)
+	flag.Parse()
+
+	if err := pathFlags.Apply(); err != nil {
+		log.Fatalf("Invalid configuration ERROR:%s", err)
+	}
+	if *connectURI != "" {
+		connection.SetURI(*connectURI)
+	}
+	if *socket == "" {
+		*socket = config.Current().Socket
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	// one connection for the life of the daemon - every operation reuses it
+	if err := connection.Share(); err != nil {
+		log.Fatalf("Failed to connect to libvirt at %s ERROR:%s", connection.URI(), err)
+	}
+	defer connection.Unshare()
+
+	var wg sync.WaitGroup
+
+	srv := daemon.NewServer(cli.LocalBackend(ctx, &wg), *socket)
+	if err := srv.ListenAndServe(ctx); err != nil {
+		log.Printf("kvmetald stopped ERROR:%s", err)
+		os.Exit(1)
+	}
+
+	// background work started by presets finishes before exit
+	wg.Wait()
+	log.Println("kvmetald stopped")
+}
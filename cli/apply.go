@@ -0,0 +1,349 @@
+package cli
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	kvmconfig "kvmgo/config"
+	"kvmgo/constants"
+	"kvmgo/lib"
+	"kvmgo/lib/connection"
+	"kvmgo/network"
+	"kvmgo/state"
+	"kvmgo/types/nic"
+	"kvmgo/utils"
+	kvm "kvmgo/vm"
+
+	"github.com/jedib0t/go-pretty/table"
+	libvirtxml "libvirt.org/libvirt-go-xml"
+)
+
+// ApplyStatus is the outcome of reconciling a single VMSpec
+type ApplyStatus string
+
+const (
+	Created   ApplyStatus = "created"
+	Unchanged ApplyStatus = "unchanged"
+	Drifted   ApplyStatus = "drifted"
+	Failed    ApplyStatus = "failed"
+)
+
+// ApplyResult records what apply did for a VM and any drift found
+type ApplyResult struct {
+	Name   string
+	Status ApplyStatus
+	Drift  []string
+	Err    error
+}
+
+/*
+applyCommand handles kvmetal apply -f cluster.yaml
+
+Usage:
+
+	go run main.go apply -f cluster.yaml
+	go run main.go apply -f cluster.yaml --connect=qemu+ssh://host/system
+
+Exits 1 if any VM failed to launch - drift alone is not a failure.
+*/
+func applyCommand() *Command {
+	return &Command{
+		Name:  "apply",
+		Short: "Create the VMs in a manifest and report drift for existing ones",
+		Setup: func(fs *flag.FlagSet) RunFunc {
+			file := fs.String("f", "", "Path to the cluster manifest (yaml or json)")
+
+			return func(env *Env, args []string) error {
+				if *file == "" {
+					return usageErrorf("apply requires -f <manifest>")
+				}
+
+				manifest, err := LoadManifest(*file)
+				if err != nil {
+					return err
+				}
+
+				// --connect takes precedence over uri: in the manifest
+				if fs.Lookup("connect").Value.String() == "" && manifest.URI != "" {
+					connection.SetURI(manifest.URI)
+				}
+
+				results := Apply(env.Ctx, env.WG, manifest)
+
+				fmt.Fprint(env.Out, ApplyResultsTable(results))
+
+				var failed []string
+				for _, res := range results {
+					if res.Status == Failed {
+						failed = append(failed, res.Name)
+					}
+				}
+				if len(failed) > 0 {
+					return fmt.Errorf("failed to apply %s", strings.Join(failed, ", "))
+				}
+				return nil
+			}
+		},
+	}
+}
+
+/*
+Apply reconciles the Manifest against libvirt.
+
+  - Domains missing from libvirt are created with vm.LaunchNewVM and their exposures applied
+  - Domains already defined are left alone - differences in cpu, memory and disks are
+    reported as drift
+*/
+func Apply(ctx context.Context, wg *sync.WaitGroup, manifest *Manifest) []ApplyResult {
+	fmt.Println(utils.LogMainAction(fmt.Sprintf("Applying manifest with %d VMs", len(manifest.VMs))))
+
+	vms, err := kvm.Inventory()
+	if err != nil {
+		log.Printf("Error listing VMs: %v\n", err)
+	}
+
+	defined := make(map[string]kvm.VMStatus)
+	for _, vm := range vms {
+		if vm.Defined() {
+			defined[vm.Name] = vm
+		}
+	}
+
+	client, err := lib.ConnectLibvirt()
+	if err != nil {
+		log.Printf("Failed to connect to libvirt - drift detection disabled. ERROR:%s", err)
+	} else {
+		defer client.Close()
+	}
+
+	var results []ApplyResult
+
+	for _, spec := range manifest.VMs {
+		if ctx.Err() != nil {
+			results = append(results, ApplyResult{Name: spec.Name, Status: Failed, Err: ctx.Err()})
+			continue
+		}
+
+		if current, ok := defined[spec.Name]; ok {
+			res := ApplyResult{Name: spec.Name, Status: Unchanged}
+			if current.Record != nil {
+				res.Drift = RecordDrift(current.Record, spec)
+			}
+			if client != nil {
+				drift, err := DetectDrift(client, DesiredVMConfig(spec))
+				if err != nil {
+					res.Err = err
+				}
+				res.Drift = append(res.Drift, drift...)
+			}
+			if len(res.Drift) > 0 {
+				res.Status = Drifted
+			}
+			log.Printf(" %s %s (%s)", utils.TICK_GREEN, spec.Name, res.Status)
+			results = append(results, res)
+			continue
+		}
+
+		// userdata is only rendered for VMs being created - presets such as kafka-kraft schedule work on wg
+		vmConfig, err := SpecToVMConfig(ctx, wg, spec)
+		if err != nil {
+			log.Printf("Failed to build the config of %s ERROR:%s", spec.Name, err)
+			results = append(results, ApplyResult{Name: spec.Name, Status: Failed, Err: err})
+			continue
+		}
+		if _, err := kvm.LaunchNewVM(vmConfig); err != nil {
+			log.Printf("Failed vm.LaunchNewVM(%s) ERROR:%s", spec.Name, err)
+			results = append(results, ApplyResult{Name: spec.Name, Status: Failed, Err: err})
+			continue
+		}
+
+		res := ApplyResult{Name: spec.Name, Status: Created}
+		for _, exp := range spec.Expose {
+			extIP := exp.ExternalIP
+			if extIP == "" {
+				extIP = "0.0.0.0"
+			}
+			portMap, portRange, err := network.CreatePortMappings([]string{exp.MapSpec()})
+			if err == nil {
+				err = HandleVMPortMappings(spec.Name, extIP, portMap, portRange)
+			}
+			if err != nil {
+				log.Printf("Failed To Create Forwarding Config for %s ERROR:%s", spec.Name, err)
+				res.Err = err
+			}
+		}
+		results = append(results, res)
+	}
+
+	return results
+}
+
+// SpecToVMConfig builds the same VMConfig the flag based launch path uses for a VMSpec
+func SpecToVMConfig(ctx context.Context, wg *sync.WaitGroup, spec VMSpec) (*kvm.VMConfig, error) {
+	config := specConfig(spec)
+	config.Userdata = spec.InlineUserdata
+
+	key, err := os.ReadFile(kvmconfig.Current().SSHPublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read ssh public key: %v", err)
+	}
+	config.SSH = string(key)
+
+	if config.Preset != "" {
+		config.Userdata = CreateUserdataFromPreset(ctx, wg, config.Distro, config.Preset, config.Name, config.SSH, nic.StaticIPv4(config.Interfaces))
+	}
+
+	if spec.UserData != "" {
+		if config.UserdataFile, err = ResolvePath(spec.UserData, "user_data"); err != nil {
+			return nil, fmt.Errorf("failed to resolve user_data %s: %v", spec.UserData, err)
+		}
+		if err := layerUserdataFile(&config); err != nil {
+			return nil, err
+		}
+	}
+
+	return specDisks(spec, CreateVMConfig(config)), nil
+}
+
+/*
+DesiredVMConfig is the cpu, memory and disks of a spec - all drift detection compares. Nothing is
+read or rendered for it, unlike SpecToVMConfig which renders the preset's userdata.
+*/
+func DesiredVMConfig(spec VMSpec) *kvm.VMConfig {
+	config := specConfig(spec)
+	vmConfig := kvm.NewVMConfig(config.Name).
+		SetCores(config.CPU).
+		SetMemory(config.Memory).
+		SetPreset(string(config.Preset))
+
+	return specDisks(spec, withPresetDisks(vmConfig, config.Preset))
+}
+
+// specConfig maps the spec onto the flag Config - LoadManifest validated the distro and preset
+func specConfig(spec VMSpec) Config {
+	config := Config{
+		Name:       spec.Name,
+		Action:     New,
+		CPU:        spec.CPUCores,
+		Memory:     spec.Memory,
+		Interfaces: spec.Interfaces,
+	}
+	if spec.Distro != "" {
+		config.Distro, _ = constants.ParseDistro(spec.Distro)
+	}
+	if spec.Preset != "" {
+		config.Preset, _ = StringToPreset(spec.Preset)
+	}
+	return config
+}
+
+func specDisks(spec VMSpec, vmConfig *kvm.VMConfig) *kvm.VMConfig {
+	for _, disk := range spec.Disks {
+		diskConfig, err := kvm.NewDiskConfig(disk.DiskPath(spec.Name), disk.Size)
+		if err != nil {
+			log.Printf("Failed to create disk config %s for %s ERROR:%s", disk.Name, spec.Name, err)
+			continue
+		}
+		diskConfig.DiskName = disk.Name
+		vmConfig.AddDisk(*diskConfig)
+	}
+
+	return vmConfig
+}
+
+// DetectDrift compares a defined domain against the desired VMConfig
+func DetectDrift(client *lib.VirtClient, desired *kvm.VMConfig) ([]string, error) {
+	domcfg, err := client.ParseXML(desired.VMName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read domain %s: %v", desired.VMName, err)
+	}
+
+	return DomainDrift(domcfg, desired), nil
+}
+
+// RecordDrift compares what was recorded at launch with the spec - covers what libvirt cannot report
+func RecordDrift(rec *state.VMRecord, spec VMSpec) []string {
+	var drift []string
+
+	if rec.Preset != spec.Preset {
+		drift = append(drift, fmt.Sprintf("preset: %q (want %q)", rec.Preset, spec.Preset))
+	}
+
+	return drift
+}
+
+// DomainDrift lists the differences between a domain definition and the desired VMConfig
+func DomainDrift(domcfg *libvirtxml.Domain, desired *kvm.VMConfig) []string {
+	var drift []string
+
+	if domcfg.VCPU != nil && int(domcfg.VCPU.Value) != desired.CPUCores {
+		drift = append(drift, fmt.Sprintf("cpu_cores: %d (want %d)", domcfg.VCPU.Value, desired.CPUCores))
+	}
+
+	if domcfg.Memory != nil {
+		if memMiB := memoryMiB(domcfg.Memory); memMiB != desired.Memory {
+			drift = append(drift, fmt.Sprintf("memory: %d (want %d)", memMiB, desired.Memory))
+		}
+	}
+
+	attached := make(map[string]bool)
+	if domcfg.Devices != nil {
+		for _, disk := range domcfg.Devices.Disks {
+			if disk.Source != nil && disk.Source.File != nil {
+				attached[filepath.Clean(disk.Source.File.File)] = true
+			}
+		}
+	}
+
+	for _, disk := range desired.Disks {
+		if !attached[filepath.Clean(disk.DiskPathFP.Abs())] {
+			drift = append(drift, fmt.Sprintf("disk missing: %s", disk.DiskPathFP.Get()))
+		}
+	}
+
+	return drift
+}
+
+// memoryMiB normalizes the libvirt memory element to MiB
+func memoryMiB(mem *libvirtxml.DomainMemory) int {
+	value := int(mem.Value)
+
+	switch strings.ToLower(mem.Unit) {
+	case "b", "bytes":
+		return value / (1024 * 1024)
+	case "mib", "m":
+		return value
+	case "gib", "g":
+		return value * 1024
+	default: // KiB is the libvirt default
+		return value / 1024
+	}
+}
+
+// ApplyResultsTable renders the outcome of Apply
+func ApplyResultsTable(results []ApplyResult) string {
+	var stringBuilder strings.Builder
+	t := table.NewWriter()
+	t.SetOutputMirror(&stringBuilder)
+	t.SetStyle(table.StyleLight)
+
+	t.AppendHeader(table.Row{"VM Name", "Status", "Details"})
+
+	for _, res := range results {
+		details := strings.Join(res.Drift, "\n")
+		if res.Err != nil {
+			details = strings.TrimSpace(details + "\n" + res.Err.Error())
+		}
+		t.AppendRow(table.Row{res.Name, res.Status, details})
+	}
+
+	t.Render()
+
+	return stringBuilder.String()
+}
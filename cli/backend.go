@@ -0,0 +1,301 @@
+package cli
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	kvmconfig "kvmgo/config"
+	"kvmgo/constants"
+	"kvmgo/daemon"
+	"kvmgo/jobs"
+	"kvmgo/kube/join"
+	"kvmgo/network"
+	"kvmgo/state"
+	"kvmgo/utils"
+	kvm "kvmgo/vm"
+)
+
+/*
+Backend picks where VM operations run - through kvmetald when its socket answers, otherwise in
+this process. Image and forwarding listings read local files and never go through the daemon.
+
+--connect, --config, --data-dir and --ssh-key only change this process, so with any of them the
+operation runs here even when kvmetald is up - it would act on its own libvirt, state and key.
+*/
+func (env *Env) Backend() daemon.Backend {
+	if env.backend == nil {
+		client := daemon.NewClient(kvmconfig.Current().Socket)
+		switch {
+		case env.local:
+			if client.Available(env.Ctx) {
+				utils.LogWarning("kvmetald is running but does not take --connect or path flags - running in process")
+			}
+			env.backend = LocalBackend(env.Ctx, env.WG)
+		case client.Available(env.Ctx):
+			env.backend = client
+		default:
+			env.backend = LocalBackend(env.Ctx, env.WG)
+		}
+	}
+	return env.backend
+}
+
+/*
+LocalBackend runs operations in process - kvmetald serves it, the CLI falls back to it.
+
+Submitted launches run under ctx rather than the request that started them, so for the daemon
+they stop only on shutdown or an explicit cancel.
+*/
+func LocalBackend(ctx context.Context, wg *sync.WaitGroup) daemon.Backend {
+	return &localBackend{ctx: ctx, wg: wg, engine: jobs.NewEngine()}
+}
+
+type localBackend struct {
+	ctx    context.Context
+	wg     *sync.WaitGroup // presets such as kafka-kraft schedule background forwarding on it
+	engine *jobs.Engine
+}
+
+func (b *localBackend) ListVMs(ctx context.Context) ([]kvm.VMStatus, error) {
+	return kvm.Inventory()
+}
+
+func (b *localBackend) GetVM(ctx context.Context, name string) (*kvm.VMStatus, error) {
+	vms, err := kvm.Inventory()
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range vms {
+		if v.Name == name {
+			return &v, nil
+		}
+	}
+	return nil, notFoundf("VM %s does not exist", name)
+}
+
+func (b *localBackend) CreateVM(ctx context.Context, req daemon.CreateVMRequest) (*daemon.CreateVMResponse, error) {
+	config, err := b.launchConfig(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	if config.DryRun {
+		return &daemon.CreateVMResponse{Plan: CreateVMConfig(*config).LaunchPlan()}, nil
+	}
+
+	// synchronous creates are tracked as jobs too, so job list shows them
+	if _, err := b.engine.Run(ctx, "launch", req.Name, CreateVMConfig(*config).LaunchStages()); err != nil {
+		return nil, err
+	}
+
+	vm, err := b.GetVM(ctx, req.Name)
+	if err != nil {
+		return nil, err
+	}
+	return &daemon.CreateVMResponse{VM: vm}, nil
+}
+
+func (b *localBackend) SubmitVM(ctx context.Context, req daemon.CreateVMRequest) (*jobs.Job, error) {
+	if req.DryRun {
+		return nil, usageErrorf("a dry run is not submitted as a job - create the VM without async")
+	}
+
+	config, err := b.launchConfig(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	job := b.engine.Submit(b.ctx, "launch", req.Name, CreateVMConfig(*config).LaunchStages())
+	return &job, nil
+}
+
+// launchConfig validates the request and resolves its preset and userdata
+func (b *localBackend) launchConfig(ctx context.Context, req daemon.CreateVMRequest) (*Config, error) {
+	if err := daemon.ValidVMName(req.Name); err != nil {
+		return nil, usageErrorf("%v", err)
+	}
+
+	config := &Config{
+		Name:            req.Name,
+		Action:          New,
+		CPU:             req.CPU,
+		Memory:          req.Memory,
+		UserdataOverlay: req.Userdata,
+		BootScript:      req.BootScript,
+		DryRun:          req.DryRun,
+		Interfaces:      req.Interfaces,
+
+		KeepOnFailure: req.KeepOnFailure,
+	}
+
+	if req.Distro != "" {
+		d, err := constants.ParseDistro(req.Distro)
+		if err != nil {
+			return nil, usageErrorf("%v", err)
+		}
+		config.Distro = d
+	}
+
+	if req.Preset != "" {
+		p, err := StringToPreset(req.Preset)
+		if err != nil {
+			return nil, usageErrorf("unknown preset %q", req.Preset)
+		}
+		config.Preset = p
+	}
+
+	if err := checkInterfaces(config.Interfaces, config.Distro); err != nil {
+		return nil, usageErrorf("%v", err)
+	}
+
+	if err := resolveUserdata(ctx, b.wg, config); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// DeleteVM removes a defined VM, or drops the record of one libvirt no longer has
+func (b *localBackend) DeleteVM(ctx context.Context, name string, dryRun bool) (*kvm.Plan, error) {
+	vm, err := b.GetVM(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	if !vm.Defined() {
+		if dryRun {
+			return &kvm.Plan{VM: name, Operation: "cleanup", Steps: []kvm.PlanStep{
+				{Action: "delete", Kind: "state", Target: name, Detail: "domain missing - drop the state record"},
+			}}, nil
+		}
+		if err := state.Default().Delete(name); err != nil {
+			return nil, fmt.Errorf("failed to remove %s from state: %v", name, err)
+		}
+		return nil, nil
+	}
+
+	if dryRun {
+		return kvm.RemovalPlan(name), nil
+	}
+	return nil, kvm.RemoveVMCompletely(name)
+}
+
+func (b *localBackend) VMAddress(ctx context.Context, name string) (*daemon.VMAddress, error) {
+	addrs, err := network.ResolveVMAddresses(ctx, name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get IP for %s: %v", name, err)
+	}
+
+	primary, _ := network.NewIPResolver().Primary(addrs)
+	addr := &daemon.VMAddress{VM: name, IP: primary.IP, Addresses: addrs}
+	if hostIP, err := network.GetHostIP(); err == nil {
+		addr.HostIP = hostIP.IP.String()
+	}
+	return addr, nil
+}
+
+func (b *localBackend) Expose(ctx context.Context, req daemon.ExposeRequest) error {
+	if (req.Port == 0 || req.HostPort == 0) && len(req.Maps) == 0 {
+		return usageErrorf("port and hostport, or a map, are required")
+	}
+	if req.ExternalIP == "" {
+		req.ExternalIP = "0.0.0.0"
+	}
+	if req.Protocol == "" {
+		req.Protocol = "tcp"
+	}
+
+	specs := req.Maps
+	if req.Port != 0 && req.HostPort != 0 {
+		specs = append([]string{fmt.Sprintf("%d:%d/%s", req.HostPort, req.Port, req.Protocol)}, specs...)
+	}
+	portMap, portRange, err := network.CreatePortMappings(specs)
+	if err != nil {
+		return usageErrorf("%v", err)
+	}
+
+	err = HandleVMPortMappings(req.VM, req.ExternalIP, portMap, portRange)
+	if errors.Is(err, network.ErrPortCollision) {
+		return usageErrorf("%v", err)
+	}
+	return err
+}
+
+func (b *localBackend) Unexpose(ctx context.Context, name string, hostPort int, protocol string) error {
+	return unexposeVM(name, hostPort, protocol)
+}
+
+func (b *localBackend) ListSnapshots(ctx context.Context, vm string) ([]kvm.SnapshotInfo, error) {
+	snaps, err := kvm.ListSnapshots(vm)
+	if err != nil {
+		return nil, snapshotError(err)
+	}
+	if snaps == nil {
+		snaps = []kvm.SnapshotInfo{}
+	}
+	return snaps, nil
+}
+
+func (b *localBackend) CreateSnapshot(ctx context.Context, vm string, req daemon.SnapshotRequest) error {
+	return snapshotError(kvm.CreateSnapshot(vm, req.Name, req.Description))
+}
+
+func (b *localBackend) RevertSnapshot(ctx context.Context, vm, snapshot string) error {
+	return snapshotError(kvm.RevertSnapshot(vm, snapshot))
+}
+
+func (b *localBackend) DeleteSnapshot(ctx context.Context, vm, snapshot string) error {
+	return snapshotError(kvm.DeleteSnapshot(vm, snapshot))
+}
+
+func (b *localBackend) CreateCluster(ctx context.Context, req daemon.ClusterRequest) ([]*kvm.Plan, error) {
+	if req.DryRun {
+		plans := []*kvm.Plan{GetKubeLaunchConfig(req.Control, true).LaunchPlan()}
+		for _, w := range req.Workers {
+			plans = append(plans, GetKubeLaunchConfig(w, false).LaunchPlan())
+		}
+		return plans, nil
+	}
+	if err := launchClusterNew(req.Control, req.Workers); err != nil {
+		return nil, err
+	}
+	return []*kvm.Plan{}, nil
+}
+
+func (b *localBackend) JoinCluster(ctx context.Context, nodes []string) error {
+	_, err := join.JoinNodesCluster(nodes)
+	return err
+}
+
+func (b *localBackend) ClusterStatus(ctx context.Context, nodes []string) ([]kvm.VMStatus, error) {
+	return clusterNodes(nodes)
+}
+
+func (b *localBackend) ListJobs(ctx context.Context) ([]jobs.Job, error) {
+	return b.engine.List(), nil
+}
+
+func (b *localBackend) GetJob(ctx context.Context, id string) (*jobs.Job, error) {
+	job, err := b.engine.Get(id)
+	if err != nil {
+		return nil, jobError(err)
+	}
+	return &job, nil
+}
+
+func (b *localBackend) CancelJob(ctx context.Context, id string) error {
+	return jobError(b.engine.Cancel(id))
+}
+
+func (b *localBackend) WatchJob(ctx context.Context, id string, fn func(jobs.Event) error) error {
+	return jobError(b.engine.Watch(ctx, id, fn))
+}
+
+// jobError maps an unknown job id to ExitNotFound / 404
+func jobError(err error) error {
+	if errors.Is(err, jobs.ErrUnknownJob) {
+		return &ExitError{Code: ExitNotFound, Err: err}
+	}
+	return err
+}
@@ -0,0 +1,134 @@
+package cli
+
+import (
+	"flag"
+	"strings"
+
+	"kvmgo/daemon"
+	kvm "kvmgo/vm"
+)
+
+/*
+kvmetal cluster create|join|status
+
+	kvmetal cluster create --control=control --workers=worker1,worker2
+	kvmetal cluster create --dry-run --output=json
+	kvmetal cluster join control worker1 worker2
+	kvmetal cluster status --output=yaml
+*/
+func clusterCommand() *Command {
+	return &Command{
+		Name:  "cluster",
+		Short: "Launch and join Kubernetes control plane and worker VMs",
+		Sub: []*Command{
+			{
+				Name:  "create",
+				Short: "Launch a control plane and workers and join them into a cluster",
+				Setup: func(fs *flag.FlagSet) RunFunc {
+					control := fs.String("control", "control", "Control plane VM name")
+					workers := fs.String("workers", "worker", "Comma separated worker VM names")
+					dryRun := fs.Bool("dry-run", false, "Print the plan for every node without making changes")
+					output := outputFlag(fs)
+					return func(env *Env, args []string) error {
+						if err := requireArgs(args, 0, 0, "no arguments - use --control and --workers"); err != nil {
+							return err
+						}
+						if err := validOutput(*output); err != nil {
+							return err
+						}
+
+						workerNodes := splitNames(*workers)
+						if *control == "" || len(workerNodes) == 0 {
+							return usageErrorf("--control and at least one of --workers are required")
+						}
+
+						plans, err := env.Backend().CreateCluster(env.Ctx, daemon.ClusterRequest{Control: *control, Workers: workerNodes, DryRun: *dryRun})
+						if err != nil || !*dryRun {
+							return err
+						}
+						return printPlans(*output, plans...)
+					}
+				},
+			},
+			{
+				Name:  "join",
+				Args:  "<control> <worker>...",
+				Short: "Join running workers to a control plane",
+				Setup: func(fs *flag.FlagSet) RunFunc {
+					return func(env *Env, args []string) error {
+						// cluster join control,worker1 is accepted as well as separate args
+						nodes := splitNames(strings.Join(args, ","))
+						if len(nodes) < 2 {
+							return usageErrorf("expected <control> <worker>...")
+						}
+						return env.Backend().JoinCluster(env.Ctx, nodes)
+					}
+				},
+			},
+			{
+				Name:  "status",
+				Args:  "[name...]",
+				Short: "Show the state of cluster nodes - every kube preset VM when no names are given",
+				Setup: func(fs *flag.FlagSet) RunFunc {
+					output := outputFlag(fs)
+					return func(env *Env, args []string) error {
+						if err := validOutput(*output); err != nil {
+							return err
+						}
+
+						nodes, err := env.Backend().ClusterStatus(env.Ctx, args)
+						if err != nil {
+							return err
+						}
+						return writeOutput(env.Out, *output, nodes, func() string { return kvm.InventoryTable(nodes) })
+					}
+				},
+			},
+		},
+	}
+}
+
+// clusterNodes filters the inventory to names, or to VMs launched from a kube preset
+func clusterNodes(names []string) ([]kvm.VMStatus, error) {
+	vms, err := kvm.Inventory()
+	if err != nil {
+		return nil, err
+	}
+
+	wanted := make(map[string]bool, len(names))
+	for _, name := range names {
+		wanted[name] = true
+	}
+
+	nodes := []kvm.VMStatus{}
+	for _, v := range vms {
+		if len(names) > 0 {
+			if wanted[v.Name] {
+				nodes = append(nodes, v)
+				delete(wanted, v.Name)
+			}
+			continue
+		}
+		if v.Record != nil && isk8(Preset(v.Record.Preset)) {
+			nodes = append(nodes, v)
+		}
+	}
+
+	for _, name := range names {
+		if wanted[name] {
+			return nil, notFoundf("VM %s does not exist", name)
+		}
+	}
+
+	return nodes, nil
+}
+
+func splitNames(list string) []string {
+	var names []string
+	for _, name := range strings.Split(list, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
@@ -0,0 +1,299 @@
+package cli
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	kvmconfig "kvmgo/config"
+	"kvmgo/daemon"
+	"kvmgo/lib/connection"
+)
+
+/*
+Subcommand tree for kvmetal - each leaf owns a flag.FlagSet so help and validation are per command.
+
+	kvmetal vm create kafka --preset=kafka --mem=8192 --cpu=4
+	kvmetal vm list --output=json
+	kvmetal net expose kafka --port=9095 --hostport=9094 --external-ip=192.168.1.225
+	kvmetal cluster status --output=yaml
+	kvmetal help vm create
+
+Exit codes:
+
+	0 success
+	1 the operation failed
+	2 usage error - unknown command, bad flag or missing argument
+	3 the named VM, image or snapshot does not exist
+
+Flags may appear before or after positional arguments. --connect, --config, --data-dir and
+--ssh-key are accepted by every command.
+*/
+type Command struct {
+	Name  string
+	Args  string // positional synopsis - "<name>", "<vm> <snapshot>"
+	Short string
+	Long  string
+
+	// Setup registers flags on fs and returns the function run once they are parsed.
+	// Commands with subcommands leave it nil.
+	Setup func(fs *flag.FlagSet) RunFunc
+
+	Sub []*Command
+
+	parent *Command
+}
+
+// RunFunc executes a command with its positional arguments
+type RunFunc func(env *Env, args []string) error
+
+// Env is passed to every command - results are written to Out, logs go to stderr
+type Env struct {
+	Ctx context.Context
+	WG  *sync.WaitGroup
+	Out io.Writer
+
+	backend daemon.Backend // resolved on first use by Backend()
+	local   bool           // --connect or a path flag was given - kvmetald would not honor them
+}
+
+const (
+	ExitOK       = 0
+	ExitFailure  = 1
+	ExitUsage    = 2
+	ExitNotFound = 3
+)
+
+// ExitError carries the process exit code for a failed command
+type ExitError struct {
+	Code int
+	Err  error
+}
+
+func (e *ExitError) Error() string { return e.Err.Error() }
+
+func (e *ExitError) Unwrap() error { return e.Err }
+
+// Is lets kvmetald map command errors to HTTP statuses
+func (e *ExitError) Is(target error) bool {
+	switch target {
+	case daemon.ErrNotFound:
+		return e.Code == ExitNotFound
+	case daemon.ErrInvalid:
+		return e.Code == ExitUsage
+	}
+	return false
+}
+
+func usageErrorf(format string, args ...any) error {
+	return &ExitError{Code: ExitUsage, Err: fmt.Errorf(format, args...)}
+}
+
+func notFoundf(format string, args ...any) error {
+	return &ExitError{Code: ExitNotFound, Err: fmt.Errorf(format, args...)}
+}
+
+// ExitCode maps an error returned by a command to the process exit code
+func ExitCode(err error) int {
+	if err == nil {
+		return ExitOK
+	}
+	var exitErr *ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.Code
+	}
+
+	// errors relayed by kvmetald
+	switch {
+	case errors.Is(err, daemon.ErrNotFound):
+		return ExitNotFound
+	case errors.Is(err, daemon.ErrInvalid):
+		return ExitUsage
+	}
+	return ExitFailure
+}
+
+// Path is the full command path - "kvmetal vm create"
+func (c *Command) Path() string {
+	if c.parent == nil {
+		return c.Name
+	}
+	return c.parent.Path() + " " + c.Name
+}
+
+func (c *Command) link() *Command {
+	for _, sub := range c.Sub {
+		sub.parent = c
+		sub.link()
+	}
+	return c
+}
+
+func (c *Command) find(name string) *Command {
+	for _, sub := range c.Sub {
+		if sub.Name == name {
+			return sub
+		}
+	}
+	return nil
+}
+
+/*
+RunCommand resolves args against the command tree and runs the matching leaf.
+
+Usage:
+
+	os.Exit(cli.RunCommand(ctx, wg, os.Args[1:]))
+*/
+func RunCommand(ctx context.Context, wg *sync.WaitGroup, args []string) int {
+	env := &Env{Ctx: ctx, WG: wg, Out: os.Stdout}
+
+	err := Root().Execute(env, args)
+	if err != nil && !errors.Is(err, flag.ErrHelp) {
+		fmt.Fprintf(os.Stderr, "kvmetal: %s\n", err)
+	}
+	if errors.Is(err, flag.ErrHelp) {
+		return ExitOK
+	}
+	return ExitCode(err)
+}
+
+// Execute walks args down the tree and runs the leaf command
+func (c *Command) Execute(env *Env, args []string) error {
+	if len(c.Sub) > 0 {
+		if len(args) == 0 {
+			c.PrintHelp(os.Stderr)
+			return &ExitError{Code: ExitUsage, Err: fmt.Errorf("%s requires a subcommand", c.Path())}
+		}
+
+		switch args[0] {
+		case "-h", "--help", "-help":
+			c.PrintHelp(env.Out)
+			return flag.ErrHelp
+		case "help":
+			return c.help(env, args[1:])
+		}
+
+		sub := c.find(args[0])
+		if sub == nil {
+			c.PrintHelp(os.Stderr)
+			return usageErrorf("unknown command %q for %s", args[0], c.Path())
+		}
+		return sub.Execute(env, args[1:])
+	}
+
+	fs := flag.NewFlagSet(c.Path(), flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+
+	run := c.Setup(fs)
+	connectURI := fs.String("connect", "", "Libvirt connection URI")
+	pathFlags := kvmconfig.RegisterFlags(fs)
+
+	positional, err := parseInterspersed(fs, args)
+	if errors.Is(err, flag.ErrHelp) {
+		c.PrintHelp(env.Out)
+		return err
+	}
+	if err != nil {
+		c.PrintHelp(os.Stderr)
+		return &ExitError{Code: ExitUsage, Err: err}
+	}
+
+	if err := pathFlags.Apply(); err != nil {
+		return &ExitError{Code: ExitUsage, Err: err}
+	}
+	if *connectURI != "" {
+		connection.SetURI(*connectURI)
+	}
+	env.local = env.local || *connectURI != "" || pathFlags.Given()
+
+	return run(env, positional)
+}
+
+// help handles "kvmetal help vm create" as "kvmetal vm create --help"
+func (c *Command) help(env *Env, args []string) error {
+	target := c
+	for _, name := range args {
+		next := target.find(name)
+		if next == nil {
+			return usageErrorf("unknown command %q for %s", name, target.Path())
+		}
+		target = next
+	}
+	target.PrintHelp(env.Out)
+	return flag.ErrHelp
+}
+
+// parseInterspersed allows flags after positional args - "vm create test --mem=1024".
+// Everything after "--" is passed through untouched - "vm ssh test -- tail -n 5 log"
+func parseInterspersed(fs *flag.FlagSet, args []string) ([]string, error) {
+	var passthrough []string
+	for i, arg := range args {
+		if arg == "--" {
+			args, passthrough = args[:i], args[i+1:]
+			break
+		}
+	}
+
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		args = fs.Args()
+		if len(args) == 0 {
+			return append(positional, passthrough...), nil
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
+
+// PrintHelp writes usage, subcommands and flags for the command
+func (c *Command) PrintHelp(w io.Writer) {
+	if c.Short != "" {
+		fmt.Fprintf(w, "%s\n\n", c.Short)
+	}
+	if c.Long != "" {
+		fmt.Fprintf(w, "%s\n\n", strings.TrimSpace(c.Long))
+	}
+
+	if len(c.Sub) > 0 {
+		fmt.Fprintf(w, "Usage:\n  %s <command> [flags]\n\nCommands:\n", c.Path())
+
+		subs := append([]*Command(nil), c.Sub...)
+		sort.Slice(subs, func(i, j int) bool { return subs[i].Name < subs[j].Name })
+		for _, sub := range subs {
+			fmt.Fprintf(w, "  %-12s %s\n", sub.Name, sub.Short)
+		}
+		fmt.Fprintf(w, "\nRun '%s help <command>' for details.\n", c.Path())
+		return
+	}
+
+	synopsis := c.Path()
+	if c.Args != "" {
+		synopsis += " " + c.Args
+	}
+	fmt.Fprintf(w, "Usage:\n  %s [flags]\n\nFlags:\n", synopsis)
+
+	fs := flag.NewFlagSet(c.Path(), flag.ContinueOnError)
+	c.Setup(fs)
+	fs.String("connect", "", "Libvirt connection URI")
+	kvmconfig.RegisterFlags(fs)
+	fs.SetOutput(w)
+	fs.PrintDefaults()
+}
+
+// requireArgs validates the positional argument count for a command
+func requireArgs(args []string, min, max int, synopsis string) error {
+	if len(args) < min || (max >= 0 && len(args) > max) {
+		return usageErrorf("expected %s", synopsis)
+	}
+	return nil
+}
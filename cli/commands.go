@@ -0,0 +1,22 @@
+package cli
+
+// Root is the kvmetal command tree - every subcommand is registered here
+func Root() *Command {
+	return (&Command{
+		Name:  "kvmetal",
+		Short: "Launch and manage KVM virtual machines, clusters and port forwarding",
+		Sub: []*Command{
+			vmCommand(),
+			netCommand(),
+			exposeCommand(),
+			clusterCommand(),
+			imageCommand(),
+			snapshotCommand(),
+			applyCommand(),
+			jobCommand(),
+			gcCommand(),
+			hooksCommand(),
+			userdataCommand(),
+		},
+	}).link()
+}
@@ -0,0 +1,167 @@
+package cli
+
+import (
+	"flag"
+	"strings"
+
+	"kvmgo/daemon"
+	"kvmgo/network"
+	"kvmgo/network/qemu_hooks"
+	"kvmgo/utils"
+)
+
+/*
+kvmetal expose list|rm|set - the port forwards of the forwarding config, one at a time
+
+	kvmetal expose list
+	kvmetal expose list kafka --output=json
+	kvmetal expose set kafka --port=9095 --hostport=9094 --external-ip=192.168.1.225
+	kvmetal expose set kafka --map 8000-8010:9000-9010/tcp --map 53:5353/udp
+	kvmetal expose rm kafka --hostport=9094
+
+set and rm update the rules of a running VM right away and save the change for the qemu hook.
+set replaces a forward on the same host port and protocol instead of adding a second one.
+*/
+func exposeCommand() *Command {
+	return &Command{
+		Name:  "expose",
+		Short: "List, add, change and remove the host ports forwarded to VMs",
+		Sub: []*Command{
+			{
+				Name:  "list",
+				Args:  "[vm]",
+				Short: "List the forwarding config of every VM, or of one",
+				Setup: func(fs *flag.FlagSet) RunFunc {
+					output := outputFlag(fs)
+					return func(env *Env, args []string) error {
+						if err := requireArgs(args, 0, 1, "[vm]"); err != nil {
+							return err
+						}
+						if err := validOutput(*output); err != nil {
+							return err
+						}
+
+						configs, err := exposedConfigs(args)
+						if err != nil {
+							return err
+						}
+						return writeOutput(env.Out, *output, configs, func() string { return exposedTable(configs) })
+					}
+				},
+			},
+			{
+				Name:  "set",
+				Args:  "<vm>",
+				Short: "Forward a host port to the VM - replacing the forward on that host port",
+				Setup: func(fs *flag.FlagSet) RunFunc {
+					vmPort := fs.Int("port", 0, "VM port to be exposed")
+					hostPort := fs.Int("hostport", 0, "Host port to map to the VM port")
+					externalIP := fs.String("external-ip", "0.0.0.0", "External IP allowed to connect - 0.0.0.0 for any")
+					protocol := fs.String("protocol", "tcp", "tcp or udp")
+					var maps mapFlags
+					fs.Var(&maps, "map", mapUsage)
+					return func(env *Env, args []string) error {
+						if err := requireArgs(args, 1, 1, "<vm>"); err != nil {
+							return err
+						}
+						if err := exposeRequired(*vmPort, *hostPort, maps); err != nil {
+							return err
+						}
+						if err := validProtocol(*protocol); err != nil {
+							return err
+						}
+						return env.Backend().Expose(env.Ctx, daemon.ExposeRequest{
+							VM: args[0], Port: *vmPort, HostPort: *hostPort, Maps: maps, ExternalIP: *externalIP, Protocol: *protocol,
+						})
+					}
+				},
+			},
+			{
+				Name:  "rm",
+				Args:  "<vm>",
+				Short: "Remove the forward on a host port",
+				Setup: func(fs *flag.FlagSet) RunFunc {
+					hostPort := fs.Int("hostport", 0, "Host port of the forward to remove")
+					protocol := fs.String("protocol", "tcp", "tcp or udp")
+					return func(env *Env, args []string) error {
+						if err := requireArgs(args, 1, 1, "<vm>"); err != nil {
+							return err
+						}
+						if *hostPort == 0 {
+							return usageErrorf("--hostport is required - net unexpose removes every forward of a VM")
+						}
+						if err := validProtocol(*protocol); err != nil {
+							return err
+						}
+						return env.Backend().Unexpose(env.Ctx, args[0], *hostPort, *protocol)
+					}
+				},
+			},
+		},
+	}
+}
+
+const mapUsage = "Forward hostport:vmport/protocol - ranges as 8000-8010:9000-9010/tcp, repeat for more"
+
+// mapFlags collects repeated --map specs - each is checked as it is parsed, the set again when exposed
+type mapFlags []string
+
+func (m *mapFlags) String() string { return strings.Join(*m, ",") }
+
+func (m *mapFlags) Set(spec string) error {
+	if _, _, err := network.CreatePortMappings([]string{spec}); err != nil {
+		return err
+	}
+	*m = append(*m, spec)
+	return nil
+}
+
+func exposeRequired(vmPort, hostPort int, maps []string) error {
+	if len(maps) == 0 && (vmPort == 0 || hostPort == 0) {
+		return usageErrorf("--port and --hostport, or --map, are required")
+	}
+	if (vmPort == 0) != (hostPort == 0) {
+		return usageErrorf("--port and --hostport go together")
+	}
+	return nil
+}
+
+func validProtocol(protocol string) error {
+	switch network.NetProtocol(protocol) {
+	case network.TCP, network.UDP:
+		return nil
+	}
+	return usageErrorf("invalid --protocol %q: must be tcp or udp", protocol)
+}
+
+// exposedConfigs reads the forwarding configs - only the named VM's when one is given
+func exposedConfigs(args []string) ([]network.ForwardingConfig, error) {
+	configs, err := qemu_hooks.ReadConfigsFromFile()
+	if err != nil {
+		return nil, err
+	}
+	if len(args) == 0 {
+		if configs.Configs == nil {
+			return []network.ForwardingConfig{}, nil
+		}
+		return configs.Configs, nil
+	}
+
+	for _, cfg := range configs.Configs {
+		if cfg.VMName == args[0] {
+			return []network.ForwardingConfig{cfg}, nil
+		}
+	}
+	return nil, notFoundf("%s has no exposed ports", args[0])
+}
+
+func exposedTable(configs []network.ForwardingConfig) string {
+	if len(configs) == 0 {
+		return utils.TurnSuccess("No exposed ports") + "\n"
+	}
+	var stringBuilder strings.Builder
+	for _, cfg := range configs {
+		stringBuilder.WriteString(network.CreateTableFromConfig(cfg))
+	}
+	return stringBuilder.String()
+}
@@ -7,13 +7,6 @@ import (
 	"errors"
 	"flag"
 	"fmt"
-	"kvmgo/configuration/presets"
-	"kvmgo/constants"
-	"kvmgo/constants/kafka"
-	"kvmgo/kube/join"
-	"kvmgo/network"
-	"kvmgo/network/qemu_hooks"
-	"kvmgo/utils"
 	"log"
 	"os"
 	"path/filepath"
@@ -22,10 +15,30 @@ import (
 	"sync"
 	"time"
 
+	"kvmgo/cloudinit"
+	kvmconfig "kvmgo/config"
+	"kvmgo/configuration"
+	"kvmgo/configuration/presets"
+	"kvmgo/constants"
+	"kvmgo/constants/kafka"
+	"kvmgo/coreos"
+	"kvmgo/daemon"
+	"kvmgo/kube/join"
+	"kvmgo/lib/connection"
+	"kvmgo/network"
+	"kvmgo/types/nic"
+	"kvmgo/utils"
 	kvm "kvmgo/vm"
 )
 
 /*
+-- Subcommands ( kvmetal help lists all of them - flags below are the legacy form )
+
+	go run main.go vm create kafka --preset=kafka --mem=8192 --cpu=4
+	go run main.go vm list --output=json
+	go run main.go net expose kafka --port=9095 --hostport=9094 --external-ip=192.168.1.225
+	go run main.go cluster create --control=kubecontrol --workers=kubeworker1,kubeworker2
+
 -- Presets
 
 -- Kubernetes Control Plane + Worker
@@ -57,6 +70,9 @@ import (
 -- Expose a VM
 go run main.go --expose-vm=hadoop --port=8081 --hostport=8003 --external-ip=192.168.1.224 --protocol=tcp
 
+-- Expose port ranges and udp ( hostport:vmport/protocol, repeatable )
+go run main.go --expose-vm=kafka --map 8000-8010:9000-9010/tcp --map 53:5353/udp
+
 go run main.go --ii aexpose-vm=worker \
 --port=8088 \
 --hostport=9000 \
@@ -69,8 +85,25 @@ go run main.go --expose-vm=kafkatest \
 --external-ip=192.168.1.225 \
 --protocol=tcp
 
+-- Declarative Cluster Manifest ( creates missing VMs, reports drift for existing ones )
+
+	go run main.go apply -f cluster.yaml
+
+-- Remote or session hypervisors ( --connect works with every action, env: KVMETAL_LIBVIRT_URI )
+
+	go run main.go --running --connect=qemu+ssh://kuro@192.168.1.10/system
+	go run main.go --launch-vm=test --mem=1024 --cpu=1 --connect=qemu:///session
+
+-- Paths ( images, artifacts, state, hook logs and the ssh key are resolved by kvmgo/config )
+
+	go run main.go --running --config=/etc/kvmetal/config.yaml
+	go run main.go --launch-vm=test --data-dir=$PWD/data --ssh-key=$PWD/data/keys/id_rsa
+	KVMETAL_DATA_DIR=/var/lib/kvmetal go run main.go --launch-vm=test
+
 -- Clean up running VMs ( -y for no confirmation )
 
+	go run main.go --cleanup=kafka --dry-run --output=json
+
 	go run main.go --cleanup=redpanda -y
 	go run main.go --cleanup=kubecontrol,kubeworker
 	go run main.go --cleanup=spark
@@ -80,7 +113,9 @@ go run main.go --expose-vm=kafkatest \
 
 	go run main.go --launch-vm=kubecontrol --mem=4086 --cpu=4 --userdata=data/userdata/kube/control.txt
 
--- Launch a new VM
+-- Launch a new VM ( --dry-run prints the images, disks, artifacts and domain that would be created )
+
+		go run main.go --launch-vm=test --mem=1024 --cpu=1 --dry-run
 
 		go run main.go --launch-vm=test   --mem=1024 --cpu=1
 		go run main.go --launch-vm=consul   --mem=2048 --cpu=2
@@ -126,37 +161,184 @@ go run main.go --expose-vm=kraft \
 */
 
 func Evaluate(ctx context.Context, wg *sync.WaitGroup) {
-	// 1. Parse Flags and take appropriate action
+	// kvmetal vm create ... / kvmetal apply -f cluster.yaml - subcommand tree
+	if len(os.Args) > 1 && !strings.HasPrefix(os.Args[1], "-") {
+		if code := RunCommand(ctx, wg, os.Args[1:]); code != ExitOK {
+			os.Exit(code)
+		}
+		return
+	}
+
+	// 1. Parse Flags - no side effects happen while parsing
 	config, err := ParseFlags(ctx, wg)
 	if err != nil {
-		log.Print("Parsing Failed - Exiting")
-		os.Exit(1)
+		log.Printf("Parsing Failed - Exiting. ERROR:%s", err)
+		os.Exit(ExitUsage)
 	}
 
+	// 2. Take the appropriate action - through kvmetald when it is running
+	env := &Env{Ctx: ctx, WG: wg, Out: os.Stdout, local: config.Local}
+	if err := runFlags(env, config); err != nil {
+		log.Print(utils.TurnError(err.Error()))
+		os.Exit(ExitCode(err))
+	}
+}
+
+// runFlags performs what the legacy flags asked for - one-off operations first, then the Action
+func runFlags(env *Env, config *Config) error {
 	if config.Help {
 		utils.MockANSIPrint()
 	}
 
+	if config.GetIP != "" {
+		if err := printVMIP(env, config.GetIP, OutputTable); err != nil {
+			log.Printf("Failed to get VM IP Address. ERROR:%s", err)
+		}
+	}
+
+	if config.Expose != nil {
+		if err := env.Backend().Expose(env.Ctx, *config.Expose); err != nil {
+			log.Printf("Failed To Create Forwarding Config ERROR:%s,", err)
+			return err
+		}
+	}
+
+	if config.DisableBridgeFiltering {
+		if err := disableBridgeFiltering(); err != nil {
+			return err
+		}
+	}
+
 	switch config.Action {
 	case Launch: // k8 cluster
-
 		// TestLaunchConf("control")
-		if err := launchClusterNew("control", []string{"worker"}); err != nil {
+		plans, err := env.Backend().CreateCluster(env.Ctx, daemon.ClusterRequest{Control: config.Control, Workers: config.Workers, DryRun: config.DryRun})
+		if err != nil {
 			fmt.Println(utils.TurnError("Cluster operations pending..."))
+			return err
+		}
+		if config.DryRun {
+			return printPlans(config.Output, plans...)
 		}
 		// launchCluster(config.Control, config.Workers)
 	case Join:
 		// join.JoinNodes(config.KubeJoin)
-		join.JoinNodesCluster(config.KubeJoin)
+		return env.Backend().JoinCluster(env.Ctx, config.KubeJoin)
 	case Cleanup:
-		cleanupNodes(config.Cleanup, config.Confirm)
+		return cleanupNodes(env, config.Cleanup, config.Confirm, config.DryRun, config.Output)
 	case Running:
-		_, _ = utils.ListVMs(2, true)
+		return listVMs(env, config.Output)
 	case New: // new from Presets
-		launchVM(*config)
+		req := daemon.CreateVMRequest{
+			Name:          config.Name,
+			Preset:        string(config.Preset),
+			Distro:        config.Distro.String(),
+			CPU:           config.CPU,
+			Memory:        config.Memory,
+			DryRun:        config.DryRun,
+			KeepOnFailure: config.KeepOnFailure,
+		}
+		var err error
+		if req.Userdata, err = readClientFile(config.UserdataFile, "--userdata"); err != nil {
+			return err
+		}
+		if req.BootScript, err = readClientFile(config.BootScript, "--boot"); err != nil {
+			return err
+		}
+		resp, err := env.Backend().CreateVM(env.Ctx, req)
+		if err != nil {
+			return err
+		}
+		if resp.Plan != nil {
+			return printPlans(config.Output, resp.Plan)
+		}
 	default:
-		log.Println("No action specified or recognized.")
+		if config.GetIP == "" && config.Expose == nil && !config.DisableBridgeFiltering && !config.Help {
+			log.Println("No action specified or recognized.")
+			return usageErrorf("no action specified - run kvmetal help")
+		}
+	}
+
+	return nil
+}
+
+// resolveUserdata reads the ssh key and renders preset userdata - kept out of flag parsing as
+// presets such as kafka-kraft schedule background work on wg
+func resolveUserdata(ctx context.Context, wg *sync.WaitGroup, config *Config) error {
+	sshPub, err := os.ReadFile(kvmconfig.Current().SSHPublicKey)
+	if err != nil {
+		return fmt.Errorf("failed to read ssh public key: %v", err)
+	}
+	config.SSH = string(sshPub)
+
+	if config.Preset != "" {
+		// a nil WaitGroup keeps presets from scheduling background forwarding during --dry-run
+		presetWg := wg
+		if config.DryRun {
+			presetWg = nil
+		}
+		config.Userdata = CreateUserdataFromPreset(ctx, presetWg, config.Distro, config.Preset, config.Name, config.SSH, nic.StaticIPv4(config.Interfaces))
+	}
+
+	return layerUserdataFile(config)
+}
+
+/*
+layerUserdataFile merges the --userdata file over the preset's userdata - packages and keys are
+added, the file's runcmds run after the preset's, and its hostname or power_state win.
+Without a preset the file is used as is once it parses.
+*/
+func layerUserdataFile(config *Config) error {
+	if config.UserdataFile == "" && config.UserdataOverlay == "" {
+		return nil
+	}
+	if config.Distro.UsesIgnition() {
+		return usageErrorf("--userdata takes a cloud-config file - %s is provisioned with Ignition", config.Distro)
+	}
+
+	data := config.UserdataOverlay
+	name := "--userdata"
+	if config.UserdataFile != "" {
+		contents, err := os.ReadFile(config.UserdataFile)
+		if err != nil {
+			return fmt.Errorf("failed to read userdata file: %v", err)
+		}
+		data, name = string(contents), config.UserdataFile
+	}
+	if err := cloudinit.Validate(data); err != nil {
+		return usageErrorf("%s:\n%v", name, err)
+	}
+	overlay, err := cloudinit.Parse(data)
+	if err != nil {
+		return usageErrorf("%s: %v", name, err)
+	}
+
+	if config.Userdata == "" {
+		config.Userdata = data
+		return nil
+	}
+
+	base, err := cloudinit.Parse(config.Userdata)
+	if err != nil {
+		return fmt.Errorf("failed to parse %s userdata: %v", config.Preset, err)
+	}
+	base.Merge(overlay)
+	config.Userdata = base.String()
+
+	log.Printf("Merged %s over the %s preset userdata", name, config.Preset)
+	return nil
+}
+
+// readClientFile reads a file named on the command line - the daemon gets its contents, never the path
+func readClientFile(path, flagName string) (string, error) {
+	if path == "" {
+		return "", nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", usageErrorf("failed to read %s: %v", flagName, err)
 	}
+	return string(data), nil
 }
 
 type Action int
@@ -175,6 +357,7 @@ const (
 type Config struct {
 	SSH          string
 	Preset       Preset
+	Distro       constants.Distro
 	UserdataFile string // userdatafile Optional file on disk with userdata
 	Control      string
 	Userdata     string // userdata Inline Userdata from presets
@@ -189,6 +372,22 @@ type Config struct {
 	Help         bool
 	Cluster      bool
 	Confirm      bool
+	DryRun       bool
+	Output       string // table, json or yaml - used by --running and --dry-run
+
+	KeepOnFailure bool // skip the rollback of a failed launch
+
+	Local bool // --connect or a path flag was given - run in process instead of through kvmetald
+
+	// UserdataOverlay is --userdata's contents when they came in a request - as is BootScript then
+	UserdataOverlay string
+
+	Interfaces []nic.Interface // --nic - a single DHCP NIC on network=default when empty
+
+	// one-off operations requested alongside (or instead of) an Action
+	GetIP                  string
+	Expose                 *daemon.ExposeRequest
+	DisableBridgeFiltering bool
 }
 
 type Preset string
@@ -229,12 +428,13 @@ func ParseFlags(ctx context.Context, wg *sync.WaitGroup) (*Config, error) {
 	help := flag.Bool("help", false, "View Help for kVM application")
 	join := flag.String("join", "", "Join Kubernetes Nodes")
 	preset := flag.String("preset", "", "Choose from a preconfigured Setup such as Hadoop, Spark, Kubernetes")
+	distro := flag.String("distro", "ubuntu", "Guest distro for --launch-vm: "+strings.Join(constants.DistroNames, ", "))
 	memory := flag.String("mem", "", "Specify Memory for the VM")
 	vmPort := flag.Int("port", 0, "VM port to be exposed")
 	cluster := flag.Bool("cluster", false, "Launch a cluster with control and worker nodes")
 	cleanup := flag.String("cleanup", "", "Cleanup nodes by name, comma-separated")
-	control := flag.String("control", "", "Name of the control node")
-	workers := flag.String("workers", "", "Names of the worker nodes, comma-separated")
+	control := flag.String("control", "control", "Name of the control node")
+	workers := flag.String("workers", "worker", "Names of the worker nodes, comma-separated")
 	getIp := flag.String("getip", "", "Get Running VM/Domain IP Addr")
 	confirm := flag.Bool("y", false, "Confirm command to skip confirmation prompts.")
 	running := flag.Bool("running", false, "View virtual machines running")
@@ -242,36 +442,28 @@ func ParseFlags(ctx context.Context, wg *sync.WaitGroup) (*Config, error) {
 	userdata := flag.String("userdata", "", "Path to the User Data Cloud init script to be used Directly")
 	protocol := flag.String("protocol", "tcp", "Protocol for the port mapping, defaults to tcp")
 	exposeVM := flag.String("expose-vm", "", "Name of the VM to expose ports for")
+	var maps mapFlags
+	flag.Var(&maps, "map", mapUsage)
 	launch_vm := flag.String("launch-vm", "", "Launch a new VM with the specified name")
 	bootScript := flag.String("boot", "", "Path to the custom boot script")
 	externalIP := flag.String("external-ip", "0.0.0.0", "External IP to map the port to, defaults to 0.0.0.0")
 	DisableBridgeFiltering := flag.Bool("disable-bridge-filtering", false, "Disable bridge filtering for Port Forwarding")
+	dryRun := flag.Bool("dry-run", false, "Print the plan for --launch-vm, --cluster or --cleanup without making changes")
+	output := flag.String("output", "table", "Output format for --running and --dry-run: table, json or yaml")
+	keepOnFailure := flag.Bool("keep-on-failure", false, "Leave the disks, artifacts and domain of a failed --launch-vm in place for debugging")
+	connectURI := flag.String("connect", "", "Libvirt connection URI (defaults to $KVMETAL_LIBVIRT_URI, then qemu:///system)")
+	pathFlags := kvmconfig.RegisterFlags(flag.CommandLine)
 
 	flag.Parse()
 
-	if *getIp != "" {
-		vmIp, err := network.GetVMIPAddr(*getIp)
-		if err != nil {
-			log.Printf("Failed to get VM IP Address. ERROR:%s", err)
-		}
-		hostIp, _ := network.GetHostIP()
-		fmt.Print(utils.TurnBoldBlueDelimited(fmt.Sprintf(" %s IP : %s | Host IP : %s", *getIp, vmIp.IP.String(), hostIp.IP.String())))
-	}
-
-	if *exposeVM != "" && *hostPort != 0 && *vmPort != 0 {
-		err := HandleVMNetworkExposure(*exposeVM, *vmPort, *hostPort, *externalIP, *protocol)
-		if err != nil {
-			log.Printf("Failed To Create Forwarding Config ERROR:%s,", err)
-		}
+	if err := pathFlags.Apply(); err != nil {
+		return nil, err
 	}
 
-	if *DisableBridgeFiltering {
-		err := qemu_hooks.DisableBridgeFiltering()
-		if err != nil {
-			log.Printf("Failed to Disable Bridge Filtering for Port Forwarding Enablement. ERROR:%s", err)
-		}
-		log.Print(utils.TurnSuccess("Successfully Disabled Bridge Filtering"))
+	if *connectURI != "" {
+		connection.SetURI(*connectURI)
 	}
+	local := *connectURI != "" || pathFlags.Given()
 
 	if *cluster {
 		action = Launch // Launch Kube control + workers
@@ -291,22 +483,52 @@ func ParseFlags(ctx context.Context, wg *sync.WaitGroup) (*Config, error) {
 		Action:  action,
 		Cluster: *cluster,
 		Control: *control,
-		Workers: strings.Split(*workers, ","),
+		Workers: splitNames(*workers),
 		Help:    *help,
 		Confirm: *confirm,
+		DryRun:  *dryRun,
+		Output:  *output,
+		GetIP:   *getIp,
+
+		KeepOnFailure:          *keepOnFailure,
+		DisableBridgeFiltering: *DisableBridgeFiltering,
+		Local:                  local,
+	}
+
+	if err := validOutput(config.Output); err != nil {
+		return nil, err
+	}
+	if *cluster && (config.Control == "" || len(config.Workers) == 0) {
+		return nil, fmt.Errorf("--cluster requires --control and at least one of --workers")
+	}
+
+	if *exposeVM != "" && (*hostPort != 0 && *vmPort != 0 || len(maps) > 0) {
+		config.Expose = &daemon.ExposeRequest{
+			VM:         *exposeVM,
+			Port:       *vmPort,
+			HostPort:   *hostPort,
+			Maps:       maps,
+			ExternalIP: *externalIP,
+			Protocol:   *protocol,
+		}
 	}
 
 	mem, vcpu := ParseMemoryCPU(*memory, *cpu)
 	config.CPU = vcpu
 	config.Memory = mem
-	config.SSH = utils.ReadFileFatal(constants.SshPub)
+
+	parsedDistro, err := constants.ParseDistro(*distro)
+	if err != nil {
+		return nil, err
+	}
+	config.Distro = parsedDistro
 
 	if *preset != "" {
 		Preset, err := StringToPreset(*preset)
 		if err != nil {
 			return nil, err
 		}
-		config.Userdata = CreateUserdataFromPreset(ctx, wg, Preset, config.Name, config.SSH)
+		config.Preset = Preset
 	}
 
 	if *join != "" {
@@ -318,13 +540,15 @@ func ParseFlags(ctx context.Context, wg *sync.WaitGroup) (*Config, error) {
 	}
 
 	if *userdata != "" {
-		resolvedPath, _ := ResolvePath(*userdata, "--userdata")
-		config.UserdataFile = resolvedPath
+		if config.UserdataFile, err = ResolvePath(*userdata, "--userdata"); err != nil {
+			return nil, fmt.Errorf("invalid --userdata %q: %v", *userdata, err)
+		}
 	}
 
 	if *bootScript != "" {
-		resolvedPath, _ := ResolvePath(*bootScript, "--boot")
-		config.BootScript = resolvedPath
+		if config.BootScript, err = ResolvePath(*bootScript, "--boot"); err != nil {
+			return nil, fmt.Errorf("invalid --boot %q: %v", *bootScript, err)
+		}
 	}
 
 	if *cleanup != "" {
@@ -345,12 +569,14 @@ func joinKubeNodes(joinStr string) error {
 }
 
 // launchVM launches a VM from a Preset Config using the config
-func launchVM(launchConfig Config) {
+func launchVM(launchConfig Config) error {
 	vmConfig := CreateVMConfig(launchConfig)
 
 	if _, err := kvm.LaunchNewVM(vmConfig); err != nil {
 		log.Printf("Failed vm.LaunchNewVM(vmConfig) go_err ERROR:%s,", err)
+		return err
 	}
+	return nil
 }
 
 func TestLaunchConf(controlNode string) error {
@@ -431,10 +657,6 @@ func launchClusterNew(controlNode string, workerNodes []string) error {
 //   - config.SshPub
 //   - config.Preset
 func CreateVMConfig(config Config) *kvm.VMConfig {
-	if config.UserdataFile != "" && config.Userdata != "" {
-		utils.LogWarning("Both User Data and --preset cannot be used. --preset overrides.")
-	}
-
 	imgsPath, artifactsPath, err := ResolveArtifactsPath(config.Name)
 	if err != nil {
 		log.Fatalf("Failure Resolving Paths:%s", err)
@@ -481,27 +703,42 @@ func CreateVMConfig(config Config) *kvm.VMConfig {
 	// https://cloud-images.ubuntu.com/releases/jammy/release/ubuntu-22.04-server-cloudimg-amd64.img
 	// https://cloud-images.ubuntu.com/releases/noble/release/ubuntu-24.04-server-cloudimg-amd64.img
 
+	distro, err := configuration.GetImage(config.Distro)
+	if err != nil {
+		log.Fatalf("Failure Resolving Distro:%s", err)
+	}
+
 	vmConfig := kvm.NewVMConfig(config.Name).
-		SetImageURL("https://cloud-images.ubuntu.com/releases/jammy/release/ubuntu-22.04-server-cloudimg-amd64.img").
+		SetImageURL(distro.GetImageUrl()).
+		SetOSVariant(distro.GetOSVariant()).
+		SetDistro(config.Distro).
+		SetPreset(string(config.Preset)).
 		SetImagesDir(imgsPath.Abs()).
 		SetArtifactsDir(artifactsPath.Abs()).
 		SetUserData(config.UserdataFile).
 		SetCores(config.CPU).     // defaults to 1
 		SetMemory(config.Memory). // defaults to 2048
-		SetPubkey(constants.SshPub).
+		SetPubkey(kvmconfig.Current().SSHPublicKey).
 		SetCloudInitDataInline(config.Userdata).
 		SetArtifactPath(*artifactsPath).
-		SetImagePath(*imgsPath)
+		SetImagePath(*imgsPath).
+		SetKeepOnFailure(config.KeepOnFailure).
+		SetInterfaces(config.Interfaces)
 
 	log.Printf("Preset is %s", config.Preset)
 
-	if isk8(config.Preset) { // for OpenEBS disk management
+	return withPresetDisks(vmConfig, config.Preset)
+}
+
+// withPresetDisks adds the disks a preset needs besides the manifest's
+func withPresetDisks(vmConfig *kvm.VMConfig, preset Preset) *kvm.VMConfig {
+	if isk8(preset) { // for OpenEBS disk management
 		// Path created as data/artifacts/vm1/vm1-openebs-disk.qcow2
 		openEbsDisk, err := kvm.NewDiskConfig(
 			// Defines path for extra disks - data/artifacts/<vm>/disk/...
 
 			// fix this - shud be %s/disk/%s
-			fmt.Sprintf("data/artifacts/%s/%s-openebs-disk.qcow2", config.Name, config.Name),
+			filepath.Join(kvmconfig.Current().ArtifactsPath(vmConfig.VMName), vmConfig.VMName+"-openebs-disk.qcow2"),
 
 			// fmt.Sprintf("%s/%s-openebs-disk.qcow2", artifactsBasePath, config.Name),
 			10,
@@ -522,13 +759,14 @@ func GetDomainConfig(domain string) {
 	//  vmConfig.PullImage()
 	// vmConfig.CreateBaseImage()
 	//	This servers as the primary image - in data/images/control-vm-disk.qcow2
-	baseImgPath := "data/images/" + domain + "-vm-disk.qcow2"
+	cfg := kvmconfig.Current()
+	baseImgPath := filepath.Join(cfg.ImagesDir, domain+"-vm-disk.qcow2")
 
 	// 2. Create additional Disks if they are present
 	// vmConfig.CreateDisks()
 	// for each vmConfig.disks - a Disk is created specified by the path on
 	// data/artifacts/vm/disks/
-	additionalDisks := "data/artifacts/" + domain + "/<disks>"
+	additionalDisks := filepath.Join(cfg.ArtifactsPath(domain), "<disks>")
 
 	// 3. Mount the Disks for the VM on system to copy systemd and boot files
 	// sudo guestmount -a d/i/vm.qcow2 -i --rw /mnt/control
@@ -541,72 +779,105 @@ func GetDomainConfig(domain string) {
 
 	// 4. Generate user-data.txt + meta-data , then use that to generate user-data.img
 	// vmConfig.GenerateCloudInitImgFromPath
-	userdata := "data/artifacts/" + domain + "/userdata/"
+	userdata := cfg.ArtifactsPath(domain) + "/userdata/"
 
 	userData, metadata := userdata+"user-data.txt", userdata+"meta-data"
 	userDataImg := userdata + "user-data.img"
 
 	log.Printf("Creating %s with init config , %s with Metadata for Discovery - and using both to generate user data img at %s", userData, metadata, userDataImg)
 
-	// 5. Create the VM using virt-install.
+	// 5. Define and start the domain through libvirt.
 	// no artifacts produced for this
 	// currently disks generated in data/artifacts/vm/
 
 	log.Println("View attached disks: virsh dumpxml control")
 }
 
-func cleanupNodes(nodes []string, confirm bool) {
-	vms, err := utils.ListVMs(2, false)
+func cleanupNodes(env *Env, nodes []string, confirm, dryRun bool, output string) error {
+	backend := env.Backend()
+
+	vms, err := backend.ListVMs(env.Ctx)
 	if err != nil {
 		log.Printf("Error listing VMs: %v\n", err)
-		return
+		return err
 	}
 
-	vmMap := make(map[string]string)
+	vmMap := make(map[string]kvm.VMStatus)
 	for _, vm := range vms {
-		vmMap[vm.Name] = vm.State
+		vmMap[vm.Name] = vm
 	}
 
-	var foundVMNames []string
+	var foundVMNames, staleRecords []string
 
 	log.Printf("Clean up Virtual Machines:")
 	for _, nodeName := range nodes {
-		state, exists := vmMap[nodeName]
-		if nodeName != "" && exists {
-			log.Printf(" %s %s (%s)\n", utils.TICK_GREEN, nodeName, state)
+		vm, exists := vmMap[nodeName]
+		switch {
+		case nodeName != "" && exists && vm.Defined():
+			log.Printf(" %s %s (%s)\n", utils.TICK_GREEN, nodeName, vm.State)
 			foundVMNames = append(foundVMNames, nodeName)
-		} else {
+		case exists:
+			log.Printf(" %s %s (domain missing - dropping state record)\n", utils.TICK_GREEN, nodeName)
+			staleRecords = append(staleRecords, nodeName)
+		default:
 			log.Printf("VM not found: %s %s\n", nodeName, utils.CROSS_RED)
 		}
 	}
 
-	// Function to perform cleanup
-	performCleanup := func() {
+	if dryRun {
+		var plans []*kvm.Plan
 		for _, vmName := range foundVMNames {
-			fmt.Printf("Cleaning up node: %s\n", vmName)
-			err := kvm.RemoveVMCompletely(vmName)
+			plan, err := backend.DeleteVM(env.Ctx, vmName, true)
 			if err != nil {
-				fmt.Printf("Failed to clean up VM %s: %v\n", vmName, err)
+				return err
 			}
+			plans = append(plans, plan)
 		}
+		return printPlans(output, plans...)
+	}
+
+	// stale records only drop the state entry - no confirmation needed
+	for _, vmName := range staleRecords {
+		if _, err := backend.DeleteVM(env.Ctx, vmName, false); err != nil {
+			log.Printf("Failed to remove %s from state: %v", vmName, err)
+		}
+	}
+
+	// Function to perform cleanup
+	performCleanup := func() error {
+		var failed []string
+		for _, vmName := range foundVMNames {
+			fmt.Fprintf(os.Stderr, "Cleaning up node: %s\n", vmName)
+			if _, err := backend.DeleteVM(env.Ctx, vmName, false); err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to clean up VM %s: %v\n", vmName, err)
+				failed = append(failed, vmName)
+			}
+		}
+		if len(failed) > 0 {
+			return fmt.Errorf("failed to clean up %s", strings.Join(failed, ", "))
+		}
+		return nil
 	}
 
 	if len(foundVMNames) > 0 {
 		if confirm {
 			// If confirm flag is true, directly proceed with cleanup
-			performCleanup()
-		} else {
-			// Otherwise, ask for confirmation before proceeding
-			log.Printf("Proceed? (y/n)")
-			if askForConfirmation() {
-				performCleanup()
-			} else {
-				fmt.Println("Cleanup aborted.")
-			}
+			return performCleanup()
 		}
-	} else {
-		fmt.Println("No valid VMs were specified for cleanup.")
+		// Otherwise, ask for confirmation before proceeding
+		log.Printf("Proceed? (y/n)")
+		if askForConfirmation() {
+			return performCleanup()
+		}
+		fmt.Fprintln(os.Stderr, "Cleanup aborted.")
+		return nil
 	}
+
+	if len(staleRecords) > 0 {
+		return nil
+	}
+	fmt.Fprintln(os.Stderr, "No valid VMs were specified for cleanup.")
+	return notFoundf("no VMs named %s", strings.Join(nodes, ", "))
 }
 
 // askForConfirmation prompts the user for a yes/no answer and returns true for yes.
@@ -629,7 +900,7 @@ func GetKubeLaunchConfig(domain string, control bool) *kvm.VMConfig {
 		CPU:    4,
 		Memory: 4096,
 	}
-	config.SSH = utils.ReadFileFatal(constants.SshPub)
+	config.SSH = utils.ReadFileFatal(kvmconfig.Current().SSHPublicKey)
 
 	if control {
 		config.Preset = "kubecontrol"
@@ -648,37 +919,50 @@ func GetKubeLaunchConfig(domain string, control bool) *kvm.VMConfig {
 // GetKubePreset for launching nodes
 func GetKubePreset(control bool, domain, sshpub string) string {
 	if control {
-		return presets.CreateKubeControlPlaneUserData("ubuntu", "password", domain, sshpub, true)
+		return presets.CreateKubeControlPlaneUserData(constants.Ubuntu, "ubuntu", "password", domain, sshpub, "", true)
 	}
-	return presets.CreateKubeWorkerUserData("ubuntu", "password", domain, sshpub)
+	return presets.CreateKubeWorkerUserData(constants.Ubuntu, "ubuntu", "password", domain, sshpub)
 }
 
 // Generates the VM according to Presets such as Kubernetes, Spark, Hadoop, and more
-func CreateUserdataFromPreset(ctx context.Context, wg *sync.WaitGroup, preset Preset, launch_vm, sshpub string) string {
+//
+// address is the VM's static IPv4 from --nic - Kafka advertises it and kubeadm binds the API server
+// to it. Empty for DHCP guests, which keep advertising <vm>.<domain>.
+func CreateUserdataFromPreset(ctx context.Context, wg *sync.WaitGroup, distro constants.Distro, preset Preset, launch_vm, sshpub, address string) string {
 	log.Print(utils.TurnValBoldColor("Preset: ", string(preset), utils.PURP_HI))
 
+	if distro.UsesIgnition() {
+		return createIgnitionFromPreset(distro, preset, launch_vm, sshpub)
+	}
+
 	switch preset {
 	case "kafka":
-		return presets.CreateKafkaUserData("ubuntu", "password", launch_vm, sshpub)
+		return presets.CreateKafkaUserData(distro, "ubuntu", "password", launch_vm, sshpub)
 	case "clickhouse":
-		return presets.CreateClickhouseUserData("ubuntu", "password", launch_vm, sshpub)
+		return presets.CreateClickhouseUserData(distro, "ubuntu", "password", launch_vm, sshpub)
 	case "hadoop":
-		return presets.CreateHadoopUserData("ubuntu", "password", launch_vm, sshpub)
+		return presets.CreateHadoopUserData(distro, "ubuntu", "password", launch_vm, sshpub)
 	case "kubecontrol":
-		return presets.CreateKubeControlPlaneUserData("ubuntu", "password", launch_vm, sshpub, true)
+		return presets.CreateKubeControlPlaneUserData(distro, "ubuntu", "password", launch_vm, sshpub, address, true)
 	case "kubeworker":
-		return presets.CreateKubeWorkerUserData("ubuntu", "password", launch_vm, sshpub)
+		return presets.CreateKubeWorkerUserData(distro, "ubuntu", "password", launch_vm, sshpub)
 	case "kafka-kraft":
-		wg.Add(1)
-		go WaitForVMThenGenerateFwdingConfig(ctx, wg, launch_vm, KafkaVMPort, KafkaHostPort, ExtIP, "tcp")
+		if wg != nil {
+			wg.Add(1)
+			go WaitForVMThenGenerateFwdingConfig(ctx, wg, launch_vm, KafkaVMPort, KafkaHostPort, ExtIP, "tcp")
+		}
 
-		return presets.CreateKafkaKraftCluster("ubuntu", "password", launch_vm, sshpub,
+		return presets.CreateKafkaKraftCluster(distro, "ubuntu", "password", launch_vm, sshpub, address,
 			KafkaVMPort, network.GetHostIPFatal(), KafkaHostPort, ExtIP,
 			1, kafka.BrokerController)
 
 	case "redpanda":
-		return presets.CreateRedpandaUserdata("ubuntu", "password", launch_vm, sshpub,
-			fmt.Sprintf("%s.kuro.com", launch_vm), fmt.Sprintf("%d", RedPandaVMPort),
+		vmIP := address
+		if vmIP == "" {
+			vmIP = kvmconfig.Current().FQDN(launch_vm)
+		}
+		return presets.CreateRedpandaUserdata(distro, "ubuntu", "password", launch_vm, sshpub,
+			vmIP, fmt.Sprintf("%d", RedPandaVMPort),
 			network.GetHostIPFatal(), fmt.Sprintf("%d", RedPandaHostPort))
 
 	default:
@@ -687,6 +971,56 @@ func CreateUserdataFromPreset(ctx context.Context, wg *sync.WaitGroup, preset Pr
 	}
 }
 
+// checkPresetDistro rejects presets Fedora CoreOS and Flatcar have no Ignition definition for
+func checkPresetDistro(preset Preset, distro constants.Distro) error {
+	if preset != "" && distro.UsesIgnition() && !isk8(preset) {
+		return fmt.Errorf("preset %s is not available on %s - only kubecontrol and kubeworker are", preset, distro)
+	}
+	return nil
+}
+
+// checkInterfaces validates --nic interfaces - Ignition guests get the NICs but no network-config, so only DHCP
+func checkInterfaces(ifaces []nic.Interface, distro constants.Distro) error {
+	if err := nic.ValidateAll(ifaces); err != nil {
+		return err
+	}
+	if !distro.UsesIgnition() {
+		return nil
+	}
+	for n, iface := range ifaces {
+		if iface.Static() || len(iface.DNS) > 0 || len(iface.Search) > 0 || iface.VLAN != 0 {
+			return fmt.Errorf("interface %d: static addressing, dns and vlan are written as cloud-init network-config - %s is provisioned with Ignition", n, distro)
+		}
+	}
+	return nil
+}
+
+// createIgnitionFromPreset is CreateUserdataFromPreset for the Ignition distros - returns the config.ign JSON
+func createIgnitionFromPreset(distro constants.Distro, preset Preset, launch_vm, sshpub string) string {
+	var deps []constants.Dependency
+	switch preset {
+	case KubeControl:
+		deps = []constants.Dependency{constants.KubernetesControlCalico}
+	case KubeWorker:
+		deps = []constants.Dependency{constants.KubeWorker}
+	default:
+		utils.LogError(checkPresetDistro(preset, distro).Error())
+		return ""
+	}
+
+	builder, err := coreos.NewConfigBuilder(distro, deps, nil, "ubuntu", "password", launch_vm, sshpub)
+	if err != nil {
+		utils.LogError(fmt.Sprintf("Failed to build Ignition config ERROR:%s", err))
+		return ""
+	}
+	ignition, err := builder.CreateIgnitionData()
+	if err != nil {
+		utils.LogError(fmt.Sprintf("Failed to build Ignition config ERROR:%s", err))
+		return ""
+	}
+	return ignition
+}
+
 func ParseMemoryCPU(mem, cpu string) (int, int) {
 	memory := 2048
 	vcpu := 2
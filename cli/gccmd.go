@@ -0,0 +1,105 @@
+package cli
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"strings"
+
+	"kvmgo/gc"
+	"kvmgo/utils"
+
+	"github.com/jedib0t/go-pretty/table"
+)
+
+/*
+kvmetal gc - lists what interrupted launches left behind, removes it with --delete
+
+	kvmetal gc
+	kvmetal gc --output=json
+	kvmetal gc --delete --min-age=30m
+*/
+func gcCommand() *Command {
+	return &Command{
+		Name:  "gc",
+		Short: "Find orphaned images, volumes, mounts, forwarding rules and chains - dry run unless --delete",
+		Setup: func(fs *flag.FlagSet) RunFunc {
+			output := outputFlag(fs)
+			del := fs.Bool("delete", false, "Remove the orphans instead of only listing them")
+			minAge := fs.Duration("min-age", gc.DefaultMinAge, "Skip files modified more recently - protects launches in progress")
+			return func(env *Env, args []string) error {
+				if err := requireArgs(args, 0, 0, "no arguments"); err != nil {
+					return err
+				}
+				if err := validOutput(*output); err != nil {
+					return err
+				}
+				if *minAge < 0 {
+					return usageErrorf("invalid --min-age %s: must not be negative", *minAge)
+				}
+
+				inv, err := gc.Collect(*minAge)
+				if err != nil {
+					return err
+				}
+				orphans := gc.Find(inv)
+				if orphans == nil {
+					orphans = []gc.Orphan{}
+				}
+
+				if err := writeOutput(env.Out, *output, orphans, func() string { return orphansTable(orphans) }); err != nil {
+					return err
+				}
+				if !*del {
+					if len(orphans) > 0 {
+						log.Print(utils.TurnBold("Dry run - pass --delete to remove them"))
+					}
+					return nil
+				}
+				return removeOrphans(orphans)
+			}
+		},
+	}
+}
+
+// removeOrphans keeps going past failures so one stuck mount does not block the rest
+func removeOrphans(orphans []gc.Orphan) error {
+	var errs []error
+	for _, o := range orphans {
+		if err := gc.Remove(o); err != nil {
+			log.Printf(" %s %s %s: %s", utils.CROSS_RED, o.Kind, o.Path, err)
+			errs = append(errs, fmt.Errorf("%s %s: %v", o.Kind, o.Path, err))
+			continue
+		}
+		log.Printf(" %s %s %s", utils.TICK_GREEN, o.Kind, o.Path)
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to remove %d of %d orphans:\n%v", len(errs), len(orphans), errors.Join(errs...))
+	}
+	return nil
+}
+
+func orphansTable(orphans []gc.Orphan) string {
+	if len(orphans) == 0 {
+		return utils.TurnSuccess("No orphaned resources found") + "\n"
+	}
+
+	var stringBuilder strings.Builder
+	t := table.NewWriter()
+	t.SetOutputMirror(&stringBuilder)
+	t.SetStyle(table.StyleLight)
+
+	t.AppendHeader(table.Row{"Kind", "VM", "Path", "Size", "Detail"})
+	for _, o := range orphans {
+		size := ""
+		if o.Size > 0 {
+			size = humanSize(o.Size)
+		}
+		t.AppendRow(table.Row{o.Kind, o.VM, o.Path, size, o.Detail})
+	}
+	t.AppendFooter(table.Row{"", "", "Reclaimable", humanSize(gc.TotalSize(orphans)), ""})
+	t.Render()
+
+	return stringBuilder.String()
+}
@@ -0,0 +1,180 @@
+package cli
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"strings"
+
+	"kvmgo/network/qemu_hooks"
+	"kvmgo/utils"
+
+	"github.com/jedib0t/go-pretty/table"
+)
+
+/*
+kvmetal hooks install|uninstall|status - the libvirt qemu hook that applies port forwarding
+
+	sudo kvmetal hooks install --data-dir ~/.local/share/kvmetal
+	kvmetal hooks status --output=json
+	sudo kvmetal hooks uninstall
+	kvmetal hooks run kafka start --print-only
+
+The hook runs as root - install pins the forwarding config of the config it runs with, status
+reports when that is not yours. An existing qemu hook is kept and run before kvmetal's, uninstall puts it back. libvirt only
+looks for hooks when it starts, so install and uninstall restart it unless --no-restart.
+*/
+func hooksCommand() *Command {
+	return &Command{
+		Name:  "hooks",
+		Short: "Install, remove and inspect the libvirt qemu hook that applies port forwarding",
+		Sub: []*Command{
+			{
+				Name:  "install",
+				Short: "Install kvmetal as the qemu hook, chaining any hook already there",
+				Setup: func(fs *flag.FlagSet) RunFunc {
+					dir, noRestart := hooksFlags(fs)
+					return func(env *Env, args []string) error {
+						if err := requireArgs(args, 0, 0, "no arguments"); err != nil {
+							return err
+						}
+
+						status, err := qemu_hooks.NewHookInstaller().SetDir(*dir).Install()
+						if err != nil {
+							return err
+						}
+						log.Printf("%s Installed %s - version %s", utils.TICK_GREEN, status.Hook, status.Current)
+						log.Printf("%s The hook reads the forwarding config %s", utils.TICK_GREEN, status.ForwardingConfig)
+						if status.Previous != "" {
+							log.Printf("%s Chained the previous hook %s", utils.TICK_GREEN, status.Previous)
+						}
+						for _, problem := range status.Problems {
+							utils.LogWarning(problem)
+						}
+						return restartLibvirt(*noRestart)
+					}
+				},
+			},
+			{
+				Name:  "uninstall",
+				Short: "Remove the kvmetal qemu hook and restore the previous one",
+				Setup: func(fs *flag.FlagSet) RunFunc {
+					dir, noRestart := hooksFlags(fs)
+					return func(env *Env, args []string) error {
+						if err := requireArgs(args, 0, 0, "no arguments"); err != nil {
+							return err
+						}
+
+						err := qemu_hooks.NewHookInstaller().SetDir(*dir).Uninstall()
+						if errors.Is(err, qemu_hooks.ErrHookNotInstalled) {
+							return notFoundf("%v", err)
+						}
+						if err != nil {
+							return err
+						}
+						log.Printf("%s Removed the kvmetal qemu hook from %s", utils.TICK_GREEN, *dir)
+						return restartLibvirt(*noRestart)
+					}
+				},
+			},
+			{
+				Name:  "status",
+				Short: "Show whether the hook is installed, its version and permission problems",
+				Setup: func(fs *flag.FlagSet) RunFunc {
+					output := outputFlag(fs)
+					dir := fs.String("hooks-dir", qemu_hooks.DefaultHooksDir, "Directory libvirt loads hooks from")
+					return func(env *Env, args []string) error {
+						if err := requireArgs(args, 0, 0, "no arguments"); err != nil {
+							return err
+						}
+						if err := validOutput(*output); err != nil {
+							return err
+						}
+
+						status, err := qemu_hooks.NewHookInstaller().SetDir(*dir).Status()
+						if err != nil {
+							return err
+						}
+						return writeOutput(env.Out, *output, status, func() string { return hookStatusTable(status) })
+					}
+				},
+			},
+			{
+				Name:  "run",
+				Args:  "<domain> <action> [sub-action] [-]",
+				Short: "Apply the forwarding for a qemu hook event - what libvirt calls through the hook",
+				Setup: func(fs *flag.FlagSet) RunFunc {
+					printOnly := fs.Bool("print-only", false, "Print the forwarding commands for the event instead of applying them")
+					return func(env *Env, args []string) error {
+						if err := requireArgs(args, 2, 4, "<domain> <action> [sub-action] [-]"); err != nil {
+							return err
+						}
+						if *printOnly {
+							return qemu_hooks.PrintHookEvent(env.Out, args[0], args[1])
+						}
+						return qemu_hooks.RunHookEvent(args[0], args[1])
+					}
+				},
+			},
+		},
+	}
+}
+
+func hooksFlags(fs *flag.FlagSet) (dir *string, noRestart *bool) {
+	dir = fs.String("hooks-dir", qemu_hooks.DefaultHooksDir, "Directory libvirt loads hooks from")
+	noRestart = fs.Bool("no-restart", false, "Do not restart libvirt - the change applies the next time it starts")
+	return dir, noRestart
+}
+
+func restartLibvirt(skip bool) error {
+	if skip {
+		log.Print(utils.TurnBold("Restart libvirt for the hook change to take effect"))
+		return nil
+	}
+	unit, err := qemu_hooks.RestartLibvirt()
+	if err != nil {
+		return err
+	}
+	if unit == "" {
+		utils.LogWarning("libvirt is not running - the hook is picked up when it starts")
+		return nil
+	}
+	log.Printf("%s Restarted %s", utils.TICK_GREEN, unit)
+	return nil
+}
+
+func hookStatusTable(status *qemu_hooks.HookStatus) string {
+	var stringBuilder strings.Builder
+	t := table.NewWriter()
+	t.SetOutputMirror(&stringBuilder)
+	t.SetStyle(table.StyleLight)
+
+	installed := utils.CROSS_RED + " no"
+	switch {
+	case status.Installed:
+		installed = utils.TICK_GREEN + " yes"
+	case status.Foreign:
+		installed = utils.CROSS_RED + " no - another qemu hook is in place"
+	}
+	upToDate := "-"
+	if status.Installed {
+		upToDate = fmt.Sprint(status.UpToDate)
+	}
+
+	t.AppendRows([]table.Row{
+		{"Hook", status.Hook},
+		{"Installed", installed},
+		{"Installed Version", status.Version},
+		{"Current Version", status.Current},
+		{"Up To Date", upToDate},
+		{"Previous Hook", status.Previous},
+		{"Forwarding Config", status.ForwardingConfig},
+	})
+	for _, problem := range status.Problems {
+		t.AppendRow(table.Row{"Problem", problem})
+	}
+	t.Render()
+
+	return stringBuilder.String()
+}
@@ -0,0 +1,214 @@
+package cli
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	kvmconfig "kvmgo/config"
+	"kvmgo/configuration"
+	"kvmgo/constants"
+	"kvmgo/utils"
+	kvm "kvmgo/vm"
+
+	"github.com/jedib0t/go-pretty/table"
+)
+
+const vmDiskSuffix = "-vm-disk.qcow2"
+
+/*
+kvmetal image pull|list|rm - images live in images_dir
+
+	kvmetal image pull
+	kvmetal image pull --distro=fedora
+	kvmetal image pull https://cloud-images.ubuntu.com/releases/noble/release/ubuntu-24.04-server-cloudimg-amd64.img
+	kvmetal image list --output=json
+	kvmetal image rm ubuntu-24.04-server-cloudimg-amd64.img
+*/
+func imageCommand() *Command {
+	return &Command{
+		Name:  "image",
+		Short: "Download, list and remove base cloud images",
+		Sub: []*Command{
+			{
+				Name:  "pull",
+				Args:  "[url]",
+				Short: "Download a cloud image into images_dir - skipped when it already exists",
+				Setup: func(fs *flag.FlagSet) RunFunc {
+					distroName := fs.String("distro", "ubuntu", "Pull the image vm create --distro launches from when no url is given")
+					return func(env *Env, args []string) error {
+						if err := requireArgs(args, 0, 1, "[url]"); err != nil {
+							return err
+						}
+						d, err := constants.ParseDistro(*distroName)
+						if err != nil {
+							return usageErrorf("%v", err)
+						}
+						distro, err := configuration.GetImage(d)
+						if err != nil {
+							return err
+						}
+						url := distro.GetImageUrl()
+						if len(args) == 1 {
+							url = args[0]
+						}
+
+						imagesDir := kvmconfig.Current().ImagesDir
+						if err := os.MkdirAll(imagesDir, 0o755); err != nil {
+							return fmt.Errorf("failed to create %s: %v", imagesDir, err)
+						}
+						if err := utils.PullImage(url, imagesDir); err != nil {
+							return fmt.Errorf("failed to pull %s: %v", url, err)
+						}
+						return nil
+					}
+				},
+			},
+			{
+				Name:  "list",
+				Short: "List base images and VM disks in images_dir",
+				Setup: func(fs *flag.FlagSet) RunFunc {
+					output := outputFlag(fs)
+					return func(env *Env, args []string) error {
+						if err := requireArgs(args, 0, 0, "no arguments"); err != nil {
+							return err
+						}
+						if err := validOutput(*output); err != nil {
+							return err
+						}
+
+						images, err := listImages(kvmconfig.Current().ImagesDir)
+						if err != nil {
+							return err
+						}
+						return writeOutput(env.Out, *output, images, func() string { return imagesTable(images) })
+					}
+				},
+			},
+			{
+				Name:  "rm",
+				Args:  "<name>",
+				Short: "Remove an image - refused while a defined VM uses it",
+				Setup: func(fs *flag.FlagSet) RunFunc {
+					force := fs.Bool("force", false, "Remove even if a defined VM uses the image")
+					return func(env *Env, args []string) error {
+						if err := requireArgs(args, 1, 1, "<name>"); err != nil {
+							return err
+						}
+						return removeImage(kvmconfig.Current().ImagesDir, args[0], *force)
+					}
+				},
+			},
+		},
+	}
+}
+
+// ImageInfo is an image file in images_dir
+type ImageInfo struct {
+	Name     string    `json:"name"`
+	Path     string    `json:"path"`
+	Size     int64     `json:"size_bytes"`
+	Modified time.Time `json:"modified"`
+	VM       string    `json:"vm,omitempty"` // set for <vm>-vm-disk.qcow2 disks
+}
+
+func listImages(dir string) ([]ImageInfo, error) {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return []ImageInfo{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", dir, err)
+	}
+
+	images := []ImageInfo{}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+
+		img := ImageInfo{
+			Name:     entry.Name(),
+			Path:     filepath.Join(dir, entry.Name()),
+			Size:     info.Size(),
+			Modified: info.ModTime(),
+		}
+		if vmName, ok := strings.CutSuffix(entry.Name(), vmDiskSuffix); ok {
+			img.VM = vmName
+		}
+		images = append(images, img)
+	}
+
+	sort.Slice(images, func(i, j int) bool { return images[i].Name < images[j].Name })
+	return images, nil
+}
+
+func imagesTable(images []ImageInfo) string {
+	var stringBuilder strings.Builder
+	t := table.NewWriter()
+	t.SetOutputMirror(&stringBuilder)
+	t.SetStyle(table.StyleLight)
+
+	t.AppendHeader(table.Row{"Image", "Size", "Modified", "VM"})
+	for _, img := range images {
+		t.AppendRow(table.Row{img.Name, humanSize(img.Size), img.Modified.Local().Format("2006-01-02 15:04"), img.VM})
+	}
+	t.Render()
+
+	return stringBuilder.String()
+}
+
+// removeImage deletes an image unless a defined VM boots from it or was cloned from it
+func removeImage(dir, name string, force bool) error {
+	path := filepath.Join(dir, filepath.Base(name))
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return notFoundf("image %s does not exist in %s", name, dir)
+	}
+
+	if !force {
+		vms, err := kvm.Inventory()
+		if err != nil {
+			return fmt.Errorf("failed to check which VMs use %s: %v", name, err)
+		}
+		for _, v := range vms {
+			if !v.Defined() {
+				continue
+			}
+			uses := filepath.Base(path) == utils.ModifiedImageName(v.Name)
+			if v.Record != nil && (v.Record.Image.BaseImage == path || v.Record.Image.VMImage == path) {
+				uses = true
+			}
+			if uses {
+				return fmt.Errorf("image %s is used by VM %s - delete the VM first or pass --force", name, v.Name)
+			}
+		}
+	}
+
+	if err := os.Remove(path); err != nil {
+		return fmt.Errorf("failed to remove %s: %v", path, err)
+	}
+
+	fmt.Println(utils.TurnSuccess(fmt.Sprintf("Removed %s", path)))
+	return nil
+}
+
+func humanSize(bytes int64) string {
+	const unit = 1024
+	if bytes < unit {
+		return fmt.Sprintf("%d B", bytes)
+	}
+	div, exp := int64(unit), 0
+	for n := bytes / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(bytes)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,251 @@
+package cli
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"kvmgo/jobs"
+	"kvmgo/utils"
+
+	"github.com/jedib0t/go-pretty/table"
+)
+
+/*
+kvmetal job list|get|watch|cancel
+
+Launches submitted to kvmetald run as jobs - one stage per launch step. vm create follows its job
+until it finishes, these commands inspect jobs started elsewhere or with vm create --detach.
+
+	kvmetal job list
+	kvmetal job get 4f1c2a9e7b3d --output=json
+	kvmetal job watch 4f1c2a9e7b3d
+	kvmetal job watch 4f1c2a9e7b3d --output=json | jq -r 'select(.type=="stage_failed") .error'
+	kvmetal job cancel 4f1c2a9e7b3d
+*/
+func jobCommand() *Command {
+	return &Command{
+		Name:  "job",
+		Short: "Follow and cancel background VM launches",
+		Sub: []*Command{
+			{
+				Name:  "list",
+				Short: "List recent jobs, newest first",
+				Setup: func(fs *flag.FlagSet) RunFunc {
+					output := outputFlag(fs)
+					return func(env *Env, args []string) error {
+						if err := requireArgs(args, 0, 0, "no arguments"); err != nil {
+							return err
+						}
+						if err := validOutput(*output); err != nil {
+							return err
+						}
+
+						list, err := env.Backend().ListJobs(env.Ctx)
+						if err != nil {
+							return err
+						}
+						return writeOutput(env.Out, *output, list, func() string { return jobsTable(list) })
+					}
+				},
+			},
+			{
+				Name:  "get",
+				Args:  "<id>",
+				Short: "Show the stages of a job",
+				Setup: func(fs *flag.FlagSet) RunFunc {
+					output := outputFlag(fs)
+					return func(env *Env, args []string) error {
+						if err := requireArgs(args, 1, 1, "<id>"); err != nil {
+							return err
+						}
+						if err := validOutput(*output); err != nil {
+							return err
+						}
+
+						job, err := env.Backend().GetJob(env.Ctx, args[0])
+						if err != nil {
+							return err
+						}
+						return writeOutput(env.Out, *output, job, func() string { return stagesTable(*job) })
+					}
+				},
+			},
+			{
+				Name:  "watch",
+				Args:  "<id>",
+				Short: "Follow a job until it finishes - --output=json streams one event per line",
+				Setup: func(fs *flag.FlagSet) RunFunc {
+					output := outputFlag(fs)
+					return func(env *Env, args []string) error {
+						if err := requireArgs(args, 1, 1, "<id>"); err != nil {
+							return err
+						}
+						if *output == OutputYAML {
+							return usageErrorf("job watch streams table or json output")
+						}
+						if err := validOutput(*output); err != nil {
+							return err
+						}
+						return followJob(env, args[0], *output, false)
+					}
+				},
+			},
+			{
+				Name:  "cancel",
+				Args:  "<id>",
+				Short: "Stop a running job - remaining stages are skipped",
+				Setup: func(fs *flag.FlagSet) RunFunc {
+					return func(env *Env, args []string) error {
+						if err := requireArgs(args, 1, 1, "<id>"); err != nil {
+							return err
+						}
+						return env.Backend().CancelJob(env.Ctx, args[0])
+					}
+				},
+			},
+		},
+	}
+}
+
+/*
+followJob renders the job's events until it finishes and returns the job's error.
+
+With owned set the job belongs to this command - interrupting it (Ctrl-C) cancels the job rather
+than only detaching from it.
+*/
+func followJob(env *Env, id, output string, owned bool) error {
+	render := progressRenderer(os.Stderr)
+	if output == OutputJSON {
+		render = eventStream(env.Out)
+	}
+
+	err := env.Backend().WatchJob(env.Ctx, id, render)
+	if err != nil && env.Ctx.Err() != nil {
+		if owned {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			if cerr := env.Backend().CancelJob(ctx, id); cerr != nil {
+				log.Printf("Failed to cancel job %s ERROR:%s", id, cerr)
+			}
+		}
+		return fmt.Errorf("stopped following job %s: %w", id, env.Ctx.Err())
+	}
+	if err != nil {
+		return err
+	}
+
+	job, err := env.Backend().GetJob(env.Ctx, id)
+	if err != nil {
+		return err
+	}
+	return job.Err()
+}
+
+// eventStream writes every event as one JSON object per line
+func eventStream(w io.Writer) func(jobs.Event) error {
+	enc := json.NewEncoder(w)
+	return func(ev jobs.Event) error { return enc.Encode(ev) }
+}
+
+/*
+progressRenderer prints a line per stage transition
+
+	[2/7] create-base-image ...
+	[2/7] create-base-image ✓ 1.4s
+*/
+func progressRenderer(w io.Writer) func(jobs.Event) error {
+	return func(ev jobs.Event) error {
+		step := fmt.Sprintf("[%d/%d] %s", ev.Index+1, ev.Total, ev.Stage)
+		elapsed := (time.Duration(ev.DurationMS) * time.Millisecond).Round(100 * time.Millisecond)
+
+		var line string
+		switch ev.Type {
+		case jobs.JobStarted:
+			line = utils.TurnBold(fmt.Sprintf("Job %s: launching %s in %d stages", ev.JobID, ev.Target, ev.Total))
+		case jobs.StageStarted:
+			line = step + " ...\n"
+		case jobs.StageSucceeded:
+			line = fmt.Sprintf("%s %s %s\n", step, utils.TICK_GREEN, elapsed)
+		case jobs.StageFailed, jobs.StageCancelled:
+			line = fmt.Sprintf("%s %s %s: %s\n", step, utils.CROSS_RED, elapsed, ev.Error)
+		case jobs.StageRolledBack:
+			line = fmt.Sprintf("%s rolled back\n", step)
+		case jobs.StageRollbackFailed:
+			line = utils.TurnError(fmt.Sprintf("%s rollback failed: %s", step, ev.Error))
+		case jobs.JobSucceeded:
+			line = utils.TurnSuccess(fmt.Sprintf("%s launched in %s", ev.Target, elapsed))
+		case jobs.JobFailed, jobs.JobCancelled:
+			line = utils.TurnError(fmt.Sprintf("Job %s for %s %s after %s", ev.JobID, ev.Target, strings.TrimPrefix(string(ev.Type), "job_"), elapsed))
+		}
+
+		_, err := fmt.Fprint(w, line)
+		return err
+	}
+}
+
+func jobsTable(list []jobs.Job) string {
+	var stringBuilder strings.Builder
+	t := table.NewWriter()
+	t.SetOutputMirror(&stringBuilder)
+	t.SetStyle(table.StyleLight)
+
+	t.AppendHeader(table.Row{"ID", "Kind", "Target", "Status", "Stage", "Created", "Duration"})
+	for _, job := range list {
+		t.AppendRow(table.Row{job.ID, job.Kind, job.Target, job.Status, currentStage(job), job.CreatedAt.Local().Format("2006-01-02 15:04:05"), jobDuration(job)})
+	}
+
+	t.Render()
+	return stringBuilder.String()
+}
+
+func stagesTable(job jobs.Job) string {
+	var stringBuilder strings.Builder
+	t := table.NewWriter()
+	t.SetOutputMirror(&stringBuilder)
+	t.SetStyle(table.StyleLight)
+
+	t.SetTitle(fmt.Sprintf("Job %s - %s %s : %s", job.ID, job.Kind, job.Target, job.Status))
+	t.AppendHeader(table.Row{"#", "Stage", "Status", "Duration", "Error"})
+	for i, st := range job.Stages {
+		duration := ""
+		if st.FinishedAt != nil {
+			duration = (time.Duration(st.DurationMS) * time.Millisecond).String()
+		}
+		errMsg := st.Error
+		if st.RollbackError != "" {
+			errMsg = strings.TrimSpace(errMsg + "\nrollback: " + st.RollbackError)
+		}
+		t.AppendRow(table.Row{i + 1, st.Name, st.Status, duration, errMsg})
+	}
+
+	t.Render()
+	return stringBuilder.String()
+}
+
+// currentStage is the running stage, the one the job stopped in, or empty once it succeeded
+func currentStage(job jobs.Job) string {
+	if failed := job.FailedStage(); failed != nil {
+		return failed.Name
+	}
+	for _, st := range job.Stages {
+		if st.Status == jobs.Running {
+			return st.Name
+		}
+	}
+	return ""
+}
+
+func jobDuration(job jobs.Job) string {
+	end := time.Now()
+	if job.FinishedAt != nil {
+		end = *job.FinishedAt
+	}
+	return end.Sub(job.CreatedAt).Round(time.Second).String()
+}
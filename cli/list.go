@@ -0,0 +1,26 @@
+package cli
+
+import (
+	"log"
+
+	kvm "kvmgo/vm"
+)
+
+// listVMs prints tracked and defined VMs for vm list and --running - recorded details come from the state store
+func listVMs(env *Env, output string) error {
+	if err := validOutput(output); err != nil {
+		return err
+	}
+
+	vms, err := env.Backend().ListVMs(env.Ctx)
+	if err != nil {
+		return err
+	}
+
+	if len(vms) == 0 && output == OutputTable {
+		log.Printf("No Virtual Machines Running")
+		return nil
+	}
+
+	return writeOutput(env.Out, output, vms, func() string { return kvm.InventoryTable(vms) })
+}
@@ -0,0 +1,263 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"kvmgo/cloudinit"
+	kvmconfig "kvmgo/config"
+	"kvmgo/constants"
+	"kvmgo/network"
+	"kvmgo/types/nic"
+
+	"gopkg.in/yaml.v2"
+)
+
+/*
+Manifest is the declarative description of a set of VMs consumed by kvmetal apply.
+
+Accepts either a top level vms: key or a bare list - JSON is valid YAML so both
+formats are parsed by the same decoder.
+
+	uri: qemu:///system   # optional
+	vms:
+	  - name: control
+	    preset: kubecontrol
+	    cpu_cores: 4
+	    memory: 4096
+	  - name: kafka
+	    preset: kafka
+	    cpu_cores: 4
+	    memory: 8192
+	    disks:
+	      - name: data
+	        size: 20
+	    expose:
+	      - port: 9095
+	        hostport: 9094
+	        external_ip: 192.168.1.225
+	        protocol: tcp
+	      - map: 8000-8010:9000-9010/tcp   # hostport:vmport/protocol as for --map
+	      - map: 53:5353/udp
+	    interfaces:
+	      - network: default
+	        addresses: [192.168.122.50/24]
+	        gateway4: 192.168.122.1
+	        dns: [192.168.122.1]
+
+Field names follow the yaml/json tags of vm.VMConfig so a saved
+<artifacts_dir>/<vm>/userdata/<vm>-vmconfig.yaml reads the same way.
+*/
+type Manifest struct {
+	URI string   `json:"uri,omitempty" yaml:"uri,omitempty"` // libvirt connection URI - --connect takes precedence
+	VMs []VMSpec `json:"vms" yaml:"vms"`
+}
+
+// VMSpec is the desired state of a single VM in a Manifest
+type VMSpec struct {
+	Name           string       `json:"name" yaml:"name"`
+	Preset         string       `json:"preset,omitempty" yaml:"preset,omitempty"`
+	Distro         string       `json:"distro,omitempty" yaml:"distro,omitempty"`
+	CPUCores       int          `json:"cpu_cores,omitempty" yaml:"cpu_cores,omitempty"`
+	Memory         int          `json:"memory,omitempty" yaml:"memory,omitempty"`
+	Disks          []DiskSpec   `json:"disks,omitempty" yaml:"disks,omitempty"`
+	Expose         []ExposeSpec `json:"expose,omitempty" yaml:"expose,omitempty"`
+	UserData       string       `json:"user_data,omitempty" yaml:"user_data,omitempty"`
+	InlineUserdata string       `json:"inline_userdata,omitempty" yaml:"inline_userdata,omitempty"`
+
+	Interfaces []nic.Interface `json:"interfaces,omitempty" yaml:"interfaces,omitempty"`
+}
+
+// DiskSpec is an additional qcow2 disk - Size in GB
+type DiskSpec struct {
+	Name string `json:"name" yaml:"name"`
+	Size int    `json:"size" yaml:"size"`
+}
+
+// ExposeSpec is a port exposure applied once the VM is running - port and hostport, or a map as for --map
+type ExposeSpec struct {
+	Port       int    `json:"port,omitempty" yaml:"port,omitempty"`
+	HostPort   int    `json:"hostport,omitempty" yaml:"hostport,omitempty"`
+	Map        string `json:"map,omitempty" yaml:"map,omitempty"` // 8000-8010:9000-9010/tcp
+	ExternalIP string `json:"external_ip,omitempty" yaml:"external_ip,omitempty"`
+	Protocol   string `json:"protocol,omitempty" yaml:"protocol,omitempty"`
+}
+
+// MapSpec is the exposure in --map form
+func (e ExposeSpec) MapSpec() string {
+	if e.Map != "" {
+		return e.Map
+	}
+	protocol := strings.ToLower(e.Protocol)
+	if protocol == "" {
+		protocol = "tcp"
+	}
+	return fmt.Sprintf("%d:%d/%s", e.HostPort, e.Port, protocol)
+}
+
+// PortMappings are all the exposures of the VM - CreatePortMappings rejects host ports exposed twice
+func (s VMSpec) PortMappings() ([]network.PortMapping, []network.PortRange, error) {
+	specs := make([]string, 0, len(s.Expose))
+	for _, exp := range s.Expose {
+		specs = append(specs, exp.MapSpec())
+	}
+	return network.CreatePortMappings(specs)
+}
+
+// LoadManifest reads a YAML or JSON manifest from disk and validates it
+func LoadManifest(path string) (*Manifest, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read manifest %s: %v", path, err)
+	}
+
+	manifest, err := ParseManifest(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid manifest %s: %v", path, err)
+	}
+
+	// relative userdata paths are resolved against the manifest location and checked before
+	// anything is created - apply would otherwise stop halfway through the manifest
+	var errs []string
+	for i := range manifest.VMs {
+		spec := &manifest.VMs[i]
+		if spec.UserData == "" {
+			continue
+		}
+		if !filepath.IsAbs(spec.UserData) {
+			spec.UserData = filepath.Join(filepath.Dir(path), spec.UserData)
+		}
+		data, err := os.ReadFile(spec.UserData)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: failed to read user_data: %v", spec.Name, err))
+			continue
+		}
+		if err := cloudinit.Validate(string(data)); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: user_data %s:\n%v", spec.Name, spec.UserData, err))
+		}
+	}
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("invalid manifest %s: %s", path, strings.Join(errs, "; "))
+	}
+
+	return manifest, nil
+}
+
+// ParseManifest decodes a manifest from bytes and validates it
+func ParseManifest(data []byte) (*Manifest, error) {
+	manifest := &Manifest{}
+
+	var list []VMSpec
+	if err := yaml.UnmarshalStrict(data, &list); err == nil {
+		manifest.VMs = list
+	} else if err := yaml.UnmarshalStrict(data, manifest); err != nil {
+		return nil, err
+	}
+
+	if err := manifest.Validate(); err != nil {
+		return nil, err
+	}
+
+	return manifest, nil
+}
+
+// Validate checks names are unique and presets, disks and exposures are usable
+func (m *Manifest) Validate() error {
+	if len(m.VMs) == 0 {
+		return fmt.Errorf("no vms defined")
+	}
+
+	var errs []string
+	seen := make(map[string]bool)
+	var exposed network.ForwardingConfigs
+
+	for i, spec := range m.VMs {
+		if spec.Name == "" {
+			errs = append(errs, fmt.Sprintf("vms[%d]: name is required", i))
+			continue
+		}
+		if seen[spec.Name] {
+			errs = append(errs, fmt.Sprintf("%s: duplicate vm name", spec.Name))
+		}
+		seen[spec.Name] = true
+
+		if spec.Preset != "" {
+			if _, err := StringToPreset(spec.Preset); err != nil {
+				errs = append(errs, fmt.Sprintf("%s: unknown preset %q", spec.Name, spec.Preset))
+			}
+		}
+		if spec.Distro != "" {
+			if d, err := constants.ParseDistro(spec.Distro); err != nil {
+				errs = append(errs, fmt.Sprintf("%s: %v", spec.Name, err))
+			} else if err := checkPresetDistro(Preset(spec.Preset), d); err != nil {
+				errs = append(errs, fmt.Sprintf("%s: %v", spec.Name, err))
+			} else if spec.UserData != "" && d.UsesIgnition() {
+				errs = append(errs, fmt.Sprintf("%s: user_data is cloud-config - %s is provisioned with Ignition", spec.Name, d))
+			}
+		}
+		d, _ := constants.ParseDistro(spec.Distro) // reported above - ubuntu when empty
+		if err := checkInterfaces(spec.Interfaces, d); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", spec.Name, err))
+		}
+		if spec.Preset != "" && spec.InlineUserdata != "" {
+			errs = append(errs, fmt.Sprintf("%s: preset and inline_userdata are mutually exclusive", spec.Name))
+		}
+		if spec.CPUCores < 0 || spec.Memory < 0 {
+			errs = append(errs, fmt.Sprintf("%s: cpu_cores and memory must be positive", spec.Name))
+		}
+
+		disks := make(map[string]bool)
+		for _, disk := range spec.Disks {
+			if disk.Name == "" || disk.Size <= 0 {
+				errs = append(errs, fmt.Sprintf("%s: disks require a name and a size in GB", spec.Name))
+			}
+			if disks[disk.Name] {
+				errs = append(errs, fmt.Sprintf("%s: duplicate disk %q", spec.Name, disk.Name))
+			}
+			disks[disk.Name] = true
+		}
+
+		exposeErrs := len(errs)
+		for _, exp := range spec.Expose {
+			if exp.Map != "" {
+				if exp.Port != 0 || exp.HostPort != 0 || exp.Protocol != "" {
+					errs = append(errs, fmt.Sprintf("%s: expose map %q carries its ports and protocol - drop port, hostport and protocol", spec.Name, exp.Map))
+				}
+				continue
+			}
+			if exp.Port <= 0 || exp.Port > 65535 || exp.HostPort <= 0 || exp.HostPort > 65535 {
+				errs = append(errs, fmt.Sprintf("%s: expose port %d -> hostport %d out of range", spec.Name, exp.Port, exp.HostPort))
+			}
+			if p := strings.ToLower(exp.Protocol); p != "" && p != "tcp" && p != "udp" {
+				errs = append(errs, fmt.Sprintf("%s: expose protocol %q must be tcp or udp", spec.Name, exp.Protocol))
+			}
+		}
+		if len(errs) > exposeErrs {
+			continue
+		}
+
+		// two VMs of the manifest on one host port would only ever reach the first
+		portMap, portRange, err := spec.PortMappings()
+		if err == nil {
+			err = network.CheckPortCollisions(exposed, spec.Name, portMap, portRange)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", spec.Name, err))
+			continue
+		}
+		exposed.Configs = append(exposed.Configs, network.ForwardingConfig{VMName: spec.Name, PortMap: portMap, PortRange: portRange})
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+
+	return nil
+}
+
+// DiskPath is the path of an additional disk - matches the layout used for the OpenEBS disk
+func (d DiskSpec) DiskPath(vmName string) string {
+	return filepath.Join(kvmconfig.Current().ArtifactsPath(vmName), fmt.Sprintf("%s-%s-disk.qcow2", vmName, d.Name))
+}
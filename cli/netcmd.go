@@ -0,0 +1,381 @@
+package cli
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"strings"
+
+	"kvmgo/daemon"
+	"kvmgo/lib"
+	"kvmgo/lib/connection"
+	"kvmgo/network"
+	"kvmgo/network/qemu_hooks"
+	"kvmgo/state"
+	"kvmgo/types/nic"
+	"kvmgo/utils"
+
+	"github.com/jedib0t/go-pretty/table"
+)
+
+/*
+kvmetal net create|delete|list|expose|unexpose|forwards|disable-bridge-filtering
+
+	kvmetal net create cluster1 --mode=isolated --cidr=10.20.0.0/24 --domain=cluster1.local
+	kvmetal net create lab --cidr=10.30.0.0/24 --dhcp=10.30.0.100-10.30.0.199 --host=52:54:00:12:34:56,control,10.30.0.10
+	kvmetal net delete cluster1 -y
+	kvmetal net list --output=json
+	kvmetal net expose kafka --port=9095 --hostport=9094 --external-ip=192.168.1.225 --protocol=tcp
+	kvmetal net expose kafka --map 8000-8010:9000-9010/tcp --map 53:5353/udp
+	kvmetal net unexpose kafka --hostport=9094
+	kvmetal net forwards --output=json
+*/
+func netCommand() *Command {
+	return &Command{
+		Name:  "net",
+		Short: "Manage libvirt networks, expose VM ports on the host and inspect forwarding",
+		Sub: []*Command{
+			{
+				Name:  "create",
+				Args:  "<name>",
+				Short: "Define and start a libvirt network - attach VMs with vm create --nic network=<name>",
+				Setup: netCreate,
+			},
+			{
+				Name:  "delete",
+				Args:  "<name>...",
+				Short: "Stop and undefine libvirt networks",
+				Setup: func(fs *flag.FlagSet) RunFunc {
+					confirm := fs.Bool("y", false, "Skip the confirmation prompt")
+					force := fs.Bool("force", false, "Delete even when VMs are attached or the network is default")
+					return func(env *Env, args []string) error {
+						if err := requireArgs(args, 1, -1, "at least one network name"); err != nil {
+							return err
+						}
+						return deleteNetworks(args, *confirm, *force)
+					}
+				},
+			},
+			{
+				Name:  "list",
+				Short: "List libvirt networks",
+				Setup: func(fs *flag.FlagSet) RunFunc {
+					output := outputFlag(fs)
+					return func(env *Env, args []string) error {
+						if err := requireArgs(args, 0, 0, "no arguments"); err != nil {
+							return err
+						}
+						if err := validOutput(*output); err != nil {
+							return err
+						}
+						conn, err := connection.Connect()
+						if err != nil {
+							return err
+						}
+						networks, err := lib.ListNetworks(conn)
+						if err != nil {
+							return err
+						}
+						return writeOutput(env.Out, *output, networks, func() string { return networksTable(networks) })
+					}
+				},
+			},
+			{
+				Name:  "expose",
+				Args:  "<vm>",
+				Short: "Forward a host port to a port on the VM",
+				Setup: func(fs *flag.FlagSet) RunFunc {
+					vmPort := fs.Int("port", 0, "VM port to be exposed")
+					hostPort := fs.Int("hostport", 0, "Host port to map to the VM port")
+					externalIP := fs.String("external-ip", "0.0.0.0", "External IP to map the port to")
+					protocol := fs.String("protocol", "tcp", "tcp or udp")
+					var maps mapFlags
+					fs.Var(&maps, "map", mapUsage)
+					return func(env *Env, args []string) error {
+						if err := requireArgs(args, 1, 1, "<vm>"); err != nil {
+							return err
+						}
+						if err := exposeRequired(*vmPort, *hostPort, maps); err != nil {
+							return err
+						}
+						return env.Backend().Expose(env.Ctx, daemon.ExposeRequest{
+							VM: args[0], Port: *vmPort, HostPort: *hostPort, Maps: maps, ExternalIP: *externalIP, Protocol: *protocol,
+						})
+					}
+				},
+			},
+			{
+				Name:  "unexpose",
+				Args:  "<vm>",
+				Short: "Remove a port forward - all of the VM's forwards without --hostport",
+				Setup: func(fs *flag.FlagSet) RunFunc {
+					hostPort := fs.Int("hostport", 0, "Host port of the forward to remove")
+					protocol := fs.String("protocol", "tcp", "tcp or udp")
+					return func(env *Env, args []string) error {
+						if err := requireArgs(args, 1, 1, "<vm>"); err != nil {
+							return err
+						}
+						return env.Backend().Unexpose(env.Ctx, args[0], *hostPort, *protocol)
+					}
+				},
+			},
+			{
+				Name:  "forwards",
+				Short: "List port forwards from the forwarding config",
+				Setup: func(fs *flag.FlagSet) RunFunc {
+					output := outputFlag(fs)
+					return func(env *Env, args []string) error {
+						if err := requireArgs(args, 0, 0, "no arguments"); err != nil {
+							return err
+						}
+						rows, err := forwardingRows()
+						if err != nil {
+							return err
+						}
+						return writeOutput(env.Out, *output, rows, func() string { return forwardingTable(rows) })
+					}
+				},
+			},
+			{
+				Name:  "disable-bridge-filtering",
+				Short: "Stop bridged traffic from traversing iptables so forwards reach VMs",
+				Setup: func(fs *flag.FlagSet) RunFunc {
+					return func(env *Env, args []string) error {
+						return disableBridgeFiltering()
+					}
+				},
+			},
+		},
+	}
+}
+
+func netCreate(fs *flag.FlagSet) RunFunc {
+	mode := fs.String("mode", lib.NetworkNAT, "Network mode: "+strings.Join(lib.NetworkModes, ", "))
+	cidr := fs.String("cidr", "", "Subnet such as 10.20.0.0/24 - the host takes the first address unless given, 10.20.0.254/24")
+	dhcp := fs.String("dhcp", "", "DHCP range start-end, none to disable - the upper half of the subnet by default")
+	domain := fs.String("domain", "", "DNS domain the network's dnsmasq answers for, e.g. cluster1.local")
+	bridge := fs.String("bridge", "", "Bridge name - libvirt picks virbrN when empty")
+	forwardDev := fs.String("forward-dev", "", "Host interface nat and route traffic leaves through")
+	var hosts hostFlags
+	fs.Var(&hosts, "host", "DHCP reservation mac,name,ip - repeat for more hosts")
+	dryRun := fs.Bool("dry-run", false, "Print the network XML without defining it")
+
+	return func(env *Env, args []string) error {
+		if err := requireArgs(args, 1, 1, "<name>"); err != nil {
+			return err
+		}
+		if *cidr == "" {
+			return usageErrorf("--cidr is required")
+		}
+
+		cfg := lib.NewNetworkConfig(args[0]).
+			SetMode(*mode).
+			SetCIDR(*cidr).
+			SetDomain(*domain).
+			SetBridge(*bridge).
+			SetForwardDev(*forwardDev)
+
+		switch {
+		case *dhcp == "none":
+			cfg.DisableDHCP()
+		case *dhcp != "":
+			start, end, ok := strings.Cut(*dhcp, "-")
+			if !ok {
+				return usageErrorf("--dhcp %q must be start-end", *dhcp)
+			}
+			cfg.SetDHCPRange(start, end)
+		}
+		cfg.Hosts = hosts
+
+		networkXML, err := cfg.GenerateNetworkXML()
+		if err != nil {
+			return usageErrorf("%v", err)
+		}
+		if *dryRun {
+			fmt.Fprintln(env.Out, networkXML)
+			return nil
+		}
+
+		conn, err := connection.Connect()
+		if err != nil {
+			return err
+		}
+		if err := cfg.CreateAndStartNetwork(conn); err != nil {
+			return err
+		}
+		log.Print(utils.TurnSuccess(fmt.Sprintf("Created network %s - launch VMs on it with --nic network=%s", cfg.Name, cfg.Name)))
+		return nil
+	}
+}
+
+// hostFlags collects repeated --host mac,name,ip reservations
+type hostFlags []lib.DHCPHost
+
+func (h *hostFlags) String() string { return fmt.Sprint(*h) }
+
+func (h *hostFlags) Set(spec string) error {
+	fields := strings.Split(spec, ",")
+	if len(fields) != 3 {
+		return fmt.Errorf("host %q must be mac,name,ip", spec)
+	}
+	*h = append(*h, lib.DHCPHost{MAC: fields[0], Name: fields[1], IP: fields[2]})
+	return nil
+}
+
+// deleteNetworks refuses networks VMs are still attached to unless forced - they would lose their link
+func deleteNetworks(names []string, confirm, force bool) error {
+	conn, err := connection.Connect()
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		if name == nic.DefaultNetwork && !force {
+			return usageErrorf("refusing to delete the default network without --force")
+		}
+		users, err := lib.NetworkUsers(conn, name)
+		if err != nil {
+			return err
+		}
+		if len(users) > 0 && !force {
+			return usageErrorf("network %s is used by %s - delete them first or pass --force", name, strings.Join(users, ", "))
+		}
+	}
+
+	if !confirm {
+		log.Printf("Delete networks %s?", strings.Join(names, ", "))
+		if !askForConfirmation() {
+			log.Println("Aborted")
+			return nil
+		}
+	}
+
+	for _, name := range names {
+		if err := lib.DeleteNetwork(conn, name); err != nil {
+			if strings.Contains(err.Error(), "does not exist") {
+				return notFoundf("%v", err)
+			}
+			return err
+		}
+		log.Print(utils.TurnSuccess("Deleted network " + name))
+	}
+	return nil
+}
+
+func networksTable(networks []lib.NetworkInfo) string {
+	var stringBuilder strings.Builder
+	t := table.NewWriter()
+	t.SetOutputMirror(&stringBuilder)
+	t.SetStyle(table.StyleLight)
+
+	t.AppendHeader(table.Row{"Name", "Mode", "CIDR", "DHCP", "Reserved", "Domain", "Bridge", "Active", "Autostart"})
+	for _, n := range networks {
+		t.AppendRow(table.Row{n.Name, n.Mode, n.CIDR, n.DHCP, n.Hosts, n.Domain, n.Bridge, n.Active, n.Autostart})
+	}
+	t.Render()
+
+	return stringBuilder.String()
+}
+
+// ForwardRow is one port forward from the forwarding config
+type ForwardRow struct {
+	VM         string `json:"vm"`
+	Protocol   string `json:"protocol"`
+	HostPort   string `json:"hostport"`
+	VMPort     string `json:"port"`
+	HostIP     string `json:"host_ip,omitempty"`
+	VMIP       string `json:"vm_ip,omitempty"`
+	ExternalIP string `json:"external_ip,omitempty"`
+}
+
+func forwardingRows() ([]ForwardRow, error) {
+	configs, err := qemu_hooks.ReadConfigsFromFile()
+	if err != nil {
+		return nil, err
+	}
+
+	rows := []ForwardRow{}
+	for _, cfg := range configs.Configs {
+		row := ForwardRow{VM: cfg.VMName}
+		if cfg.HostIP != nil {
+			row.HostIP = cfg.HostIP.String()
+		}
+		if cfg.PrivateIP != nil {
+			row.VMIP = cfg.PrivateIP.String()
+		}
+		if cfg.ExternalIP != nil {
+			row.ExternalIP = cfg.ExternalIP.String()
+		}
+
+		for _, pm := range cfg.PortMap {
+			r := row
+			r.Protocol, r.HostPort, r.VMPort = string(pm.Protocol), fmt.Sprint(pm.HostPort), fmt.Sprint(pm.VMPort)
+			rows = append(rows, r)
+		}
+		for _, pr := range cfg.PortRange {
+			r := row
+			r.Protocol = string(pr.Protocol)
+			r.HostPort = fmt.Sprintf("%d-%d", pr.HostStartPortNum, pr.HostEndPortNum)
+			r.VMPort = fmt.Sprintf("%d-%d", pr.VMStartPort, pr.VMEndPortNum)
+			rows = append(rows, r)
+		}
+	}
+
+	return rows, nil
+}
+
+func forwardingTable(rows []ForwardRow) string {
+	var stringBuilder strings.Builder
+	t := table.NewWriter()
+	t.SetOutputMirror(&stringBuilder)
+	t.SetStyle(table.StyleLight)
+
+	t.AppendHeader(table.Row{"VM Name", "Protocol", "Host Port", "VM Port", "Host IP", "VM IP", "External IP"})
+	for _, r := range rows {
+		t.AppendRow(table.Row{r.VM, r.Protocol, r.HostPort, r.VMPort, r.HostIP, r.VMIP, r.ExternalIP})
+	}
+	t.Render()
+
+	return stringBuilder.String()
+}
+
+// unexposeVM removes forwards from the config the qemu hook reads and from a running VM's rules
+func unexposeVM(vmName string, hostPort int, protocol string) error {
+	before, after, err := qemu_hooks.RemovePortMapping(vmName, hostPort, network.NetProtocol(protocol))
+	if errors.Is(err, qemu_hooks.ErrNoForward) {
+		return notFoundf("%v", err)
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := state.Default().RemoveExposures(vmName, hostPort, protocol); err != nil {
+		log.Printf("Failed to update exposures for %s in state ERROR:%s", vmName, err)
+	}
+
+	return applyForwardingChange(vmName, before, after)
+}
+
+// applyForwardingChange updates the rules of a running VM after its forwarding config changed
+func applyForwardingChange(vmName string, before, after *network.ForwardingConfig) error {
+	running, err := qemu_hooks.ApplyForwardingChange(before, after)
+	if err != nil {
+		return fmt.Errorf("failed to apply the forwarding of %s: %v - the hook applies it on the next start", vmName, err)
+	}
+	if running {
+		log.Print(utils.TurnSuccess(fmt.Sprintf("Updated the forwarding of running VM %s", vmName)))
+		return nil
+	}
+	log.Print(utils.TurnSuccess(fmt.Sprintf("Saved the forwarding of %s - the qemu hook applies it when the VM starts", vmName)))
+	return nil
+}
+
+func disableBridgeFiltering() error {
+	if err := qemu_hooks.DisableBridgeFiltering(); err != nil {
+		log.Printf("Failed to Disable Bridge Filtering for Port Forwarding Enablement. ERROR:%s", err)
+		return err
+	}
+	log.Print(utils.TurnSuccess("Successfully Disabled Bridge Filtering"))
+	return nil
+}
@@ -5,21 +5,24 @@ import (
 	"fmt"
 	"log"
 	"net"
+	"path/filepath"
 	"sync"
 	"time"
 
+	kvmconfig "kvmgo/config"
 	"kvmgo/lib"
 	// dom "kvmgo/lib/domain"
 	"kvmgo/network"
 	"kvmgo/network/qemu_hooks"
+	"kvmgo/state"
 	"kvmgo/utils"
 )
 
 type NetworkExposeConfig struct {
-	VM          string
-	ExternalIP  net.IP
-	PortMapping network.PortMapping
-	PortRange   network.PortRange
+	VM         string
+	ExternalIP net.IP
+	PortMap    []network.PortMapping
+	PortRange  []network.PortRange
 }
 
 /*
@@ -49,7 +52,7 @@ func PrintNetworkQuickHelp(vmName, vmIp string, vmPort, hostPort int, hostIp str
 	log.Printf("%s\n    %s\n    %s\n    %s\n    %s\n     Checking Fwding Rules iptables:\nsudo iptables -t nat -L -n -v | grep %d\n",
 		utils.TurnBoldColor("Port Forwarding Quick Help:", utils.COOLBLUE),
 		utils.TurnUnderline("Launch a nc server on the VM")+utils.TurnBold(fmt.Sprintf("\n    nc -l %d", vmPort)),
-		utils.TurnUnderline("Host <-> VM")+utils.TurnBold(fmt.Sprintf("\n    nc %s.kuro.com %d", vmName, vmPort)),
+		utils.TurnUnderline("Host <-> VM")+utils.TurnBold(fmt.Sprintf("\n    nc %s %d", kvmconfig.Current().FQDN(vmName), vmPort)),
 		utils.TurnUnderline("External Device <-> Host")+utils.TurnBold(fmt.Sprintf("\n    nc %s %d", hostIp, hostPort)),
 		utils.TurnUnderline("Connect to the VM server from Host")+utils.TurnBold(fmt.Sprintf("\n    nc 192.168.122.x %d", vmPort)),
 		vmPort,
@@ -75,33 +78,70 @@ func HandleVMNetworkExposure(
 	vmPort, hostPort int,
 	externalIp string, protocol string,
 ) error {
-	netConfig := ParseNetExposeFlags(vmName, vmPort, hostPort, externalIp, protocol)
+	return HandleVMPortMappings(vmName, externalIp, []network.PortMapping{{
+		Protocol: network.NetProtocol(protocol),
+		HostPort: hostPort,
+		VMPort:   vmPort,
+	}}, nil)
+}
 
-	if netConfig != nil {
-		if err := CreateAndSetNetExposeConfig(*netConfig); err != nil {
-			log.Printf("Failed To Create Forwarding Config ERROR:%s,", err)
-			return err
+/*
+HandleVMPortMappings exposes several ports and port ranges of a VM at once - what --map produces
+
+Usage:
+
+	portMap, portRange, err := network.CreatePortMappings([]string{"8000-8010:9000-9010/tcp", "53:5353/udp"})
+	err = HandleVMPortMappings("kafka", "0.0.0.0", portMap, portRange)
+*/
+func HandleVMPortMappings(vmName, externalIp string, portMap []network.PortMapping, portRange []network.PortRange) error {
+	netConfig := ParseNetExposeFlags(vmName, externalIp, portMap, portRange)
+	if netConfig == nil {
+		return fmt.Errorf("invalid external ip %q", externalIp)
+	}
+
+	for _, warning := range network.PrivilegedPortWarnings(portMap, portRange) {
+		utils.LogWarning(warning)
+	}
+
+	if err := CreateAndSetNetExposeConfig(*netConfig); err != nil {
+		log.Printf("Failed To Create Forwarding Config ERROR:%s,", err)
+		return err
+	}
+
+	exposures := make([]state.Exposure, 0, len(portMap)+len(portRange))
+	for _, pm := range portMap {
+		exposures = append(exposures, state.Exposure{
+			HostPort: pm.HostPort, VMPort: pm.VMPort, Protocol: string(pm.Protocol), ExternalIP: externalIp,
+		})
+	}
+	for _, pr := range portRange {
+		exposures = append(exposures, state.Exposure{
+			HostPort: pr.HostStartPortNum, HostEndPort: pr.HostEndPortNum,
+			VMPort: pr.VMStartPort, VMEndPort: pr.VMEndPortNum,
+			Protocol: string(pr.Protocol), ExternalIP: externalIp,
+		})
+	}
+	for _, exp := range exposures {
+		if err := state.Default().AddExposure(vmName, exp); err != nil {
+			log.Printf("Failed to record exposure for %s in state ERROR:%s", vmName, err)
 		}
 	}
 	return nil
 }
 
-func ParseNetExposeFlags(vmName string, vmPort, hostPort int, externalIp string, protocol string) *NetworkExposeConfig {
+func ParseNetExposeFlags(vmName string, externalIp string, portMap []network.PortMapping, portRange []network.PortRange) *NetworkExposeConfig {
 	externalIP := net.ParseIP(externalIp)
 
 	if externalIP == nil {
-		log.Print(utils.TurnError(fmt.Sprintf("Failed to Parse External IP %s", externalIP)))
+		log.Print(utils.TurnError(fmt.Sprintf("Failed to Parse External IP %s", externalIp)))
 		return nil
 	}
 
 	return &NetworkExposeConfig{
 		VM:         vmName,
 		ExternalIP: externalIP,
-		PortMapping: network.PortMapping{
-			Protocol: network.NetProtocol(protocol),
-			HostPort: int(hostPort),
-			VMPort:   int(vmPort),
-		},
+		PortMap:    portMap,
+		PortRange:  portRange,
 	}
 }
 
@@ -113,11 +153,11 @@ Usage:
 	config := NetworkExposeConfig{
 		VM:         "myvm",
 		ExternalIP: 191.58.123.44, // External IP ex. personal device
-		PortMapping: network.PortMapping{
+		PortMap: []network.PortMapping{{
 			Protocol: NetProtocol.TCP,
 			HostPort: 9001, // Host Port ex. Port on the Machine running VMs
 			VMPort:   8088, // Port of the actual VM
-		},
+		}},
 	}
 
 	err := CreateAndSetNetExposeConfig(config)
@@ -126,10 +166,10 @@ Additionally this will Cache the Config on Disk - in case we want to enable Auto
 
 To Expose the VM - run commands located in
 
-	data/artifacts/<vmname>/iptables_expose
+	<artifacts_dir>/<vmname>/networking/iptables_expose
 */
 func CreateAndSetNetExposeConfig(config NetworkExposeConfig) error {
-	artifactPath, err := utils.CreateAbsPathFromRoot("data/artifacts/" + config.VM + "/networking/iptables_expose")
+	artifactPath, err := utils.CreateAbsPathFromRoot(filepath.Join(kvmconfig.Current().ArtifactsPath(config.VM), "networking", "iptables_expose"))
 	if err != nil {
 		log.Printf("Failed to Generate Artifact Path ERROR:%s", err)
 		return fmt.Errorf("Failed Path Generation for Artifact")
@@ -139,13 +179,20 @@ func CreateAndSetNetExposeConfig(config NetworkExposeConfig) error {
 
 	fwdingConfig, err := network.GeneratePortForwardingConfigExtractDomainIP(config.VM,
 		config.ExternalIP,
-		[]network.PortMapping{config.PortMapping},
-		nil)
+		config.PortMap,
+		config.PortRange)
 	if err != nil {
 		log.Printf("Failed to Generate Config ERROR:%s", err)
 		return err
 	}
 
+	// rejects host ports another VM forwards before anything is written
+	before, after, err := qemu_hooks.SetPortMapping(*fwdingConfig)
+	if err != nil {
+		log.Printf("Error writing config: %s", err)
+		return err
+	}
+
 	table := network.CreateTableFromConfig(*fwdingConfig)
 	fmt.Println(table)
 
@@ -159,15 +206,20 @@ func CreateAndSetNetExposeConfig(config NetworkExposeConfig) error {
 		return err
 	}
 
-	if err := qemu_hooks.UpdateConfig(*fwdingConfig); err != nil {
-		log.Printf("Error writing config: %s", err)
+	if err := applyForwardingChange(config.VM, before, after); err != nil {
 		return err
 	}
 
+	vmPort, hostPort := 0, 0
+	if len(config.PortMap) > 0 {
+		vmPort, hostPort = config.PortMap[0].VMPort, config.PortMap[0].HostPort
+	} else if len(config.PortRange) > 0 {
+		vmPort, hostPort = config.PortRange[0].VMStartPort, config.PortRange[0].HostStartPortNum
+	}
 	PrintNetworkQuickHelp(fwdingConfig.VMName,
 		fwdingConfig.PrivateIP.String(),
-		config.PortMapping.VMPort,
-		config.PortMapping.HostPort,
+		vmPort,
+		hostPort,
 		fwdingConfig.HostIP.String())
 
 	return nil
@@ -194,7 +246,7 @@ func CreateUpdateForwarding(
 	vmPort, hostPort int,
 	fwdingConfig network.ForwardingConfig,
 ) error {
-	artifactPath, err := utils.CreateAbsPathFromRoot("data/artifacts/" + domain + "/networking/iptables_expose")
+	artifactPath, err := utils.CreateAbsPathFromRoot(filepath.Join(kvmconfig.Current().ArtifactsPath(domain), "networking", "iptables_expose"))
 	if err != nil {
 		log.Printf("Failed to Create Abs Artifact Path ERROR:%s", err)
 		return err
@@ -0,0 +1,75 @@
+package cli
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+
+	"gopkg.in/yaml.v2"
+)
+
+/*
+Read commands render through writeOutput so scripts can rely on --output=json or yaml
+instead of scraping the colored table.
+
+	kvmetal vm list --output=json | jq '.[].name'
+*/
+const (
+	OutputTable = "table"
+	OutputJSON  = "json"
+	OutputYAML  = "yaml"
+)
+
+// outputFlag registers --output on a read command
+func outputFlag(fs *flag.FlagSet) *string {
+	return fs.String("output", OutputTable, "Output format: table, json or yaml")
+}
+
+func validOutput(format string) error {
+	switch format {
+	case OutputTable, OutputJSON, OutputYAML:
+		return nil
+	default:
+		return usageErrorf("invalid --output %q: must be table, json or yaml", format)
+	}
+}
+
+/*
+writeOutput renders v as json or yaml, or calls table for the human readable form.
+
+yaml is produced from the json encoding so both formats share the json field names.
+*/
+func writeOutput(w io.Writer, format string, v any, table func() string) error {
+	if err := validOutput(format); err != nil {
+		return err
+	}
+
+	switch format {
+	case OutputJSON:
+		data, err := json.MarshalIndent(v, "", "  ")
+		if err != nil {
+			return fmt.Errorf("failed to marshal output: %v", err)
+		}
+		_, err = fmt.Fprintln(w, string(data))
+		return err
+	case OutputYAML:
+		data, err := json.Marshal(v)
+		if err != nil {
+			return fmt.Errorf("failed to marshal output: %v", err)
+		}
+		var generic any
+		if err := yaml.Unmarshal(data, &generic); err != nil {
+			return fmt.Errorf("failed to convert output to yaml: %v", err)
+		}
+		out, err := yaml.Marshal(generic)
+		if err != nil {
+			return fmt.Errorf("failed to marshal output: %v", err)
+		}
+		_, err = w.Write(out)
+		return err
+	default:
+		_, err := fmt.Fprint(w, table())
+		return err
+	}
+}
@@ -0,0 +1,20 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+
+	"kvmgo/utils"
+	kvm "kvmgo/vm"
+)
+
+// printPlans renders --dry-run plans as a table, or as json/yaml with --output
+func printPlans(output string, plans ...*kvm.Plan) error {
+	if plans == nil {
+		plans = []*kvm.Plan{}
+	}
+	if output == "" || output == OutputTable {
+		fmt.Fprintln(os.Stderr, utils.LogMainAction("Dry Run - no changes will be made"))
+	}
+	return writeOutput(os.Stdout, output, plans, func() string { return kvm.PlansTable(plans) })
+}
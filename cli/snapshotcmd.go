@@ -0,0 +1,114 @@
+package cli
+
+import (
+	"errors"
+	"flag"
+	"strings"
+
+	"kvmgo/daemon"
+	kvm "kvmgo/vm"
+
+	"github.com/jedib0t/go-pretty/table"
+)
+
+/*
+kvmetal snapshot create|list|revert|delete
+
+	kvmetal snapshot create spark spark_hadoop --description="Spark,Hadoop,Java,Scala configured"
+	kvmetal snapshot list spark --output=json
+	kvmetal snapshot revert spark spark_hadoop
+	kvmetal snapshot delete spark spark_hadoop
+*/
+func snapshotCommand() *Command {
+	return &Command{
+		Name:  "snapshot",
+		Short: "Take, list, revert and delete point in time VM snapshots",
+		Sub: []*Command{
+			{
+				Name:  "create",
+				Args:  "<vm> <snapshot>",
+				Short: "Snapshot the qcow2 disks of a VM",
+				Setup: func(fs *flag.FlagSet) RunFunc {
+					desc := fs.String("description", "", "Snapshot description")
+					return func(env *Env, args []string) error {
+						if err := requireArgs(args, 2, 2, "<vm> <snapshot>"); err != nil {
+							return err
+						}
+						return env.Backend().CreateSnapshot(env.Ctx, args[0], daemon.SnapshotRequest{Name: args[1], Description: *desc})
+					}
+				},
+			},
+			{
+				Name:  "list",
+				Args:  "<vm>",
+				Short: "List the snapshots of a VM",
+				Setup: func(fs *flag.FlagSet) RunFunc {
+					output := outputFlag(fs)
+					return func(env *Env, args []string) error {
+						if err := requireArgs(args, 1, 1, "<vm>"); err != nil {
+							return err
+						}
+						if err := validOutput(*output); err != nil {
+							return err
+						}
+
+						snaps, err := env.Backend().ListSnapshots(env.Ctx, args[0])
+						if err != nil {
+							return err
+						}
+						return writeOutput(env.Out, *output, snaps, func() string { return snapshotsTable(snaps) })
+					}
+				},
+			},
+			{
+				Name:  "revert",
+				Args:  "<vm> <snapshot>",
+				Short: "Restore a VM to a snapshot",
+				Setup: func(fs *flag.FlagSet) RunFunc {
+					return func(env *Env, args []string) error {
+						if err := requireArgs(args, 2, 2, "<vm> <snapshot>"); err != nil {
+							return err
+						}
+						return env.Backend().RevertSnapshot(env.Ctx, args[0], args[1])
+					}
+				},
+			},
+			{
+				Name:  "delete",
+				Args:  "<vm> <snapshot>",
+				Short: "Permanently delete a snapshot",
+				Setup: func(fs *flag.FlagSet) RunFunc {
+					return func(env *Env, args []string) error {
+						if err := requireArgs(args, 2, 2, "<vm> <snapshot>"); err != nil {
+							return err
+						}
+						return env.Backend().DeleteSnapshot(env.Ctx, args[0], args[1])
+					}
+				},
+			},
+		},
+	}
+}
+
+// snapshotError maps a missing domain or snapshot to ExitNotFound
+func snapshotError(err error) error {
+	if errors.Is(err, kvm.ErrDomainNotFound) || errors.Is(err, kvm.ErrSnapshotNotFound) {
+		return &ExitError{Code: ExitNotFound, Err: err}
+	}
+	return err
+}
+
+func snapshotsTable(snaps []kvm.SnapshotInfo) string {
+	var stringBuilder strings.Builder
+	t := table.NewWriter()
+	t.SetOutputMirror(&stringBuilder)
+	t.SetStyle(table.StyleLight)
+
+	t.AppendHeader(table.Row{"Snapshot", "State", "Created", "Description"})
+	for _, s := range snaps {
+		t.AppendRow(table.Row{s.Name, s.State, s.CreatedAt.Local().Format("2006-01-02 15:04"), s.Description})
+	}
+	t.Render()
+
+	return stringBuilder.String()
+}
@@ -0,0 +1,112 @@
+package cli
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"kvmgo/cloudinit"
+	kvmconfig "kvmgo/config"
+	"kvmgo/constants"
+	"kvmgo/types/nic"
+	"kvmgo/utils"
+)
+
+/*
+kvmetal userdata render - prints the user-data vm create would hand to the VM, so preset changes
+can be reviewed as a document instead of as Go string concatenation
+
+	kvmetal userdata render --preset=kafka --name=kafka
+	kvmetal userdata render --preset=kubeworker --name=w1 --distro=rocky --userdata=extra.yaml
+	kvmetal userdata render --userdata=extra.yaml --name=dev   # only validate the file
+	kvmetal userdata render --preset=kubecontrol --name=control --nic ip=192.168.122.10/24,gw=192.168.122.1
+*/
+func userdataCommand() *Command {
+	return &Command{
+		Name:  "userdata",
+		Short: "Render and validate cloud-init user-data",
+		Sub: []*Command{
+			{
+				Name:  "render",
+				Short: "Print the final user-data for a preset and --userdata file - fails when it does not validate",
+				Setup: func(fs *flag.FlagSet) RunFunc {
+					name := fs.String("name", "", "VM name the hostname and fqdn are rendered for")
+					preset := fs.String("preset", "", "Preset: kubecontrol, kubeworker, kafka, kafka-kraft, hadoop, redpanda")
+					distro := fs.String("distro", "ubuntu", "Guest distro: "+strings.Join(constants.DistroNames, ", "))
+					userdata := fs.String("userdata", "", "Path to a cloud-config file merged over the preset's userdata")
+					var nics nicFlags
+					fs.Var(&nics, "nic", "Network interface as for vm create - presets advertise its static address")
+					return func(env *Env, args []string) error {
+						if err := requireArgs(args, 0, 0, "no arguments"); err != nil {
+							return err
+						}
+						if *name == "" {
+							return usageErrorf("--name is required")
+						}
+						if *preset == "" && *userdata == "" {
+							return usageErrorf("--preset or --userdata is required")
+						}
+
+						config := &Config{Name: *name, Action: New, DryRun: true}
+						d, err := constants.ParseDistro(*distro)
+						if err != nil {
+							return usageErrorf("%v", err)
+						}
+						config.Distro = d
+						if config.Interfaces, err = nics.interfaces(d); err != nil {
+							return err
+						}
+						if *preset != "" {
+							if config.Preset, err = StringToPreset(*preset); err != nil {
+								return usageErrorf("unknown preset %q", *preset)
+							}
+							if err := checkPresetDistro(config.Preset, d); err != nil {
+								return usageErrorf("%v", err)
+							}
+						}
+						if *userdata != "" {
+							if config.UserdataFile, err = ResolvePath(*userdata, "--userdata"); err != nil {
+								return usageErrorf("invalid --userdata %q: %v", *userdata, err)
+							}
+						}
+
+						return renderUserdata(env, config)
+					}
+				},
+			},
+		},
+	}
+}
+
+// renderUserdata resolves userdata like vm create without scheduling the presets' background work
+func renderUserdata(env *Env, config *Config) error {
+	sshPub, err := os.ReadFile(kvmconfig.Current().SSHPublicKey)
+	if err != nil {
+		utils.LogWarning(fmt.Sprintf("Rendering without an ssh key - %v", err))
+	}
+	config.SSH = string(sshPub)
+
+	if config.Preset != "" {
+		config.Userdata = CreateUserdataFromPreset(env.Ctx, nil, config.Distro, config.Preset, config.Name, config.SSH, nic.StaticIPv4(config.Interfaces))
+		if config.Userdata == "" {
+			return fmt.Errorf("preset %s produced no userdata for %s", config.Preset, config.Distro)
+		}
+	}
+	if err := layerUserdataFile(config); err != nil {
+		return err
+	}
+
+	fmt.Fprint(env.Out, config.Userdata)
+	if !strings.HasSuffix(config.Userdata, "\n") {
+		fmt.Fprintln(env.Out)
+	}
+
+	if config.Distro.UsesIgnition() { // Ignition JSON - checked when it is generated
+		return nil
+	}
+	if err := cloudinit.Validate(config.Userdata); err != nil {
+		return fmt.Errorf("rendered user-data does not validate:\n%v", err)
+	}
+	return nil
+}
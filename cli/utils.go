@@ -4,21 +4,24 @@ import (
 	"fmt"
 	"strings"
 
+	kvmconfig "kvmgo/config"
 	"kvmgo/types/fpath"
 )
 
-// ResolveArtifactsPath gets the Artifacts Path for the VM - i.e Resolves data/images
-// and appends the VM name & gets the images path where all Images are cached
-// ex. /abs/path/data/images  , /abs/data/artifacts/<vmanme>
+// ResolveArtifactsPath gets the Artifacts Path for the VM - i.e Resolves the configured images dir
+// and appends the VM name to the artifacts dir
+// ex. ~/.local/share/kvmetal/images , ~/.local/share/kvmetal/artifacts/<vmname>
 func ResolveArtifactsPath(vmName string) (imagesPath, artifactsPath *fpath.FilePath, ferr error) {
+	cfg := kvmconfig.Current()
+
 	// Resolve Images path - i.e VM/OS images are stored/cached here
-	imgsPath, err := fpath.NewPath("data/images", false)
+	imgsPath, err := fpath.NewPath(cfg.ImagesDir, false)
 	if err != nil {
 		return nil, nil, fmt.Errorf("Failed to Resolve VM Images Path. Error:%s", err)
 	}
 
 	// Artifacts Path & Validation for the File Path being resolvable
-	artifactPath, err := fpath.NewPath(fmt.Sprintf("data/artifacts/%s", vmName), false)
+	artifactPath, err := fpath.NewPath(cfg.ArtifactsPath(vmName), false)
 	if err != nil {
 		return imgsPath, nil, fmt.Errorf("Artifacts path could not be resolved from cwd. Error :%s", err)
 	}
@@ -0,0 +1,276 @@
+package cli
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	kvmconfig "kvmgo/config"
+	"kvmgo/constants"
+	"kvmgo/daemon"
+	"kvmgo/types/nic"
+	"kvmgo/utils"
+	kvm "kvmgo/vm"
+)
+
+/*
+kvmetal vm create|list|delete|ssh|ip
+
+	kvmetal vm create kafka --preset=kafka --mem=8192 --cpu=4
+	kvmetal vm create rhel-repro --distro=rocky
+	kvmetal vm create test --mem=1024 --cpu=1 --dry-run --output=json
+	kvmetal vm create ci-1 --preset=kafka --detach
+	kvmetal vm create broken --userdata=wip.yaml --keep-on-failure
+	kvmetal vm create kafka --preset=kafka-kraft --nic network=default,ip=192.168.122.50/24,gw=192.168.122.1,dns=192.168.122.1
+	kvmetal vm list --output=yaml
+	kvmetal vm delete kafka redpanda -y
+	kvmetal vm ssh kafka -- sudo tail /var/log/cloud-init-output.log
+	kvmetal vm ip kafka --output=json
+*/
+func vmCommand() *Command {
+	return &Command{
+		Name:  "vm",
+		Short: "Create, list, delete and connect to virtual machines",
+		Sub: []*Command{
+			{
+				Name:  "create",
+				Args:  "<name>",
+				Short: "Launch a new VM, optionally from a preset",
+				Setup: vmCreate,
+			},
+			{
+				Name:  "list",
+				Short: "List VMs known to kvmetal and libvirt",
+				Setup: func(fs *flag.FlagSet) RunFunc {
+					output := outputFlag(fs)
+					return func(env *Env, args []string) error {
+						if err := requireArgs(args, 0, 0, "no arguments"); err != nil {
+							return err
+						}
+						return listVMs(env, *output)
+					}
+				},
+			},
+			{
+				Name:  "delete",
+				Args:  "<name>...",
+				Short: "Shut down and undefine VMs and remove their storage",
+				Setup: func(fs *flag.FlagSet) RunFunc {
+					confirm := fs.Bool("y", false, "Skip the confirmation prompt")
+					dryRun := fs.Bool("dry-run", false, "Print what would be removed without making changes")
+					output := outputFlag(fs)
+					return func(env *Env, args []string) error {
+						if err := requireArgs(args, 1, -1, "at least one VM name"); err != nil {
+							return err
+						}
+						if err := validOutput(*output); err != nil {
+							return err
+						}
+						return cleanupNodes(env, args, *confirm, *dryRun, *output)
+					}
+				},
+			},
+			{
+				Name:  "ssh",
+				Args:  "<name> [-- command...]",
+				Short: "Open an ssh session to a VM using the configured key",
+				Setup: func(fs *flag.FlagSet) RunFunc {
+					user := fs.String("user", "ubuntu", "Login user")
+					return func(env *Env, args []string) error {
+						if err := requireArgs(args, 1, -1, "<name>"); err != nil {
+							return err
+						}
+						return sshToVM(env, args[0], *user, args[1:])
+					}
+				},
+			},
+			{
+				Name:  "ip",
+				Args:  "<name>",
+				Short: "Print the IP addresses of a running VM",
+				Setup: func(fs *flag.FlagSet) RunFunc {
+					output := outputFlag(fs)
+					return func(env *Env, args []string) error {
+						if err := requireArgs(args, 1, 1, "<name>"); err != nil {
+							return err
+						}
+						return printVMIP(env, args[0], *output)
+					}
+				},
+			},
+		},
+	}
+}
+
+func vmCreate(fs *flag.FlagSet) RunFunc {
+	mem := fs.Int("mem", 2048, "Memory in MiB")
+	cpu := fs.Int("cpu", 2, "vCPUs")
+	preset := fs.String("preset", "", "Preset: kubecontrol, kubeworker, kafka, kafka-kraft, hadoop, redpanda")
+	distro := fs.String("distro", "ubuntu", "Guest distro: "+strings.Join(constants.DistroNames, ", "))
+	userdata := fs.String("userdata", "", "Path to a cloud-config file - merged over the preset's userdata")
+	boot := fs.String("boot", "", "Path to a custom boot script")
+	var nics nicFlags
+	fs.Var(&nics, "nic", "Network interface as network=,mac=,ip=CIDR,gw=,gw6=,dns=,search=,vlan= - repeat for more NICs")
+	dryRun := fs.Bool("dry-run", false, "Print the images, disks, artifacts and domain that would be created")
+	keep := fs.Bool("keep-on-failure", false, "Leave the disks, artifacts and domain of a failed launch in place for debugging")
+	detach := fs.Bool("detach", false, "Return once kvmetald accepts the launch and print the job - follow it with job watch")
+	output := outputFlag(fs)
+
+	return func(env *Env, args []string) error {
+		if err := requireArgs(args, 1, 1, "<name>"); err != nil {
+			return err
+		}
+		if err := validOutput(*output); err != nil {
+			return err
+		}
+
+		req := daemon.CreateVMRequest{
+			Name:   args[0],
+			Preset: *preset,
+			Distro: *distro,
+			CPU:    *cpu,
+			Memory: *mem,
+			DryRun: *dryRun,
+
+			KeepOnFailure: *keep,
+		}
+
+		var p Preset
+		if *preset != "" {
+			var err error
+			if p, err = StringToPreset(*preset); err != nil {
+				return usageErrorf("unknown preset %q", *preset)
+			}
+		}
+		d, err := constants.ParseDistro(*distro)
+		if err != nil {
+			return usageErrorf("%v", err)
+		}
+		if err := checkPresetDistro(p, d); err != nil {
+			return usageErrorf("%v", err)
+		}
+		if *userdata != "" && d.UsesIgnition() {
+			return usageErrorf("--userdata takes a cloud-config file - %s is provisioned with Ignition", d)
+		}
+		if req.Interfaces, err = nics.interfaces(d); err != nil {
+			return err
+		}
+		// resolved here as the daemon may run from another working directory
+		// read here - kvmetald gets the contents, it does not open client paths
+		if req.Userdata, err = readClientFile(*userdata, "--userdata"); err != nil {
+			return err
+		}
+		if req.BootScript, err = readClientFile(*boot, "--boot"); err != nil {
+			return err
+		}
+
+		if *dryRun {
+			if *detach {
+				return usageErrorf("--detach cannot be combined with --dry-run")
+			}
+			resp, err := env.Backend().CreateVM(env.Ctx, req)
+			if err != nil {
+				return err
+			}
+			return printPlans(*output, resp.Plan)
+		}
+
+		backend := env.Backend()
+		if _, viaDaemon := backend.(*daemon.Client); *detach && !viaDaemon {
+			// an in process launch would die with the CLI
+			return usageErrorf("--detach requires kvmetald to be running")
+		}
+
+		job, err := backend.SubmitVM(env.Ctx, req)
+		if err != nil {
+			return err
+		}
+		if *detach {
+			return writeOutput(env.Out, *output, job, func() string { return stagesTable(*job) })
+		}
+
+		// progress goes to stderr so --output=json stays parseable
+		if err := followJob(env, job.ID, OutputTable, true); err != nil {
+			return err
+		}
+
+		vm, err := backend.GetVM(env.Ctx, req.Name)
+		if err != nil {
+			return err
+		}
+		return writeOutput(env.Out, *output, vm, func() string { return kvm.InventoryTable([]kvm.VMStatus{*vm}) })
+	}
+}
+
+// nicFlags collects repeated --nic flags
+type nicFlags []string
+
+func (n *nicFlags) String() string { return strings.Join(*n, " ") }
+
+func (n *nicFlags) Set(spec string) error {
+	*n = append(*n, spec)
+	return nil
+}
+
+// interfaces parses the flags for distro - usage errors as they are all user input
+func (n nicFlags) interfaces(distro constants.Distro) ([]nic.Interface, error) {
+	ifaces, err := nic.ParseAll(n)
+	if err != nil {
+		return nil, usageErrorf("%v", err)
+	}
+	if err := checkInterfaces(ifaces, distro); err != nil {
+		return nil, usageErrorf("--nic: %v", err)
+	}
+	return ifaces, nil
+}
+
+func printVMIP(env *Env, vmName, output string) error {
+	if err := validOutput(output); err != nil {
+		return err
+	}
+
+	addr, err := env.Backend().VMAddress(env.Ctx, vmName)
+	if err != nil {
+		return err
+	}
+
+	return writeOutput(env.Out, output, addr, func() string {
+		var sb strings.Builder
+		sb.WriteString(utils.TurnBoldBlueDelimited(fmt.Sprintf(" %s IP : %s | Host IP : %s", addr.VM, addr.IP, addr.HostIP)))
+		for _, a := range addr.Addresses {
+			sb.WriteString(fmt.Sprintf("  %-8s %-40s %s\n", a.Interface, a.CIDR(), a.Source))
+		}
+		return sb.String()
+	})
+}
+
+// sshToVM runs ssh with the configured private key - the ssh exit status becomes ours
+func sshToVM(env *Env, vmName, user string, command []string) error {
+	addr, err := env.Backend().VMAddress(env.Ctx, vmName)
+	if err != nil {
+		return err
+	}
+
+	sshArgs := []string{
+		"-i", kvmconfig.Current().SSHPrivateKey,
+		"-o", "StrictHostKeyChecking=no",
+		"-o", "UserKnownHostsFile=/dev/null",
+		fmt.Sprintf("%s@%s", user, addr.IP),
+	}
+	sshArgs = append(sshArgs, command...)
+
+	cmd := exec.Command("ssh", sshArgs...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+
+	if err := cmd.Run(); err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			return &ExitError{Code: exitErr.ExitCode(), Err: fmt.Errorf("ssh %s exited with %d", vmName, exitErr.ExitCode())}
+		}
+		return fmt.Errorf("failed to run ssh: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,268 @@
+/*
+Package cloudinit models the #cloud-config user-data documents kvmetal hands to VMs.
+
+Presets populate a Config through configuration.ConfigBuilder and a --userdata file is layered on
+top of it with Merge - the result always marshals to a valid document.
+
+Usage:
+
+	cfg, _ := cloudinit.Parse(constants.DefaultUserdata)
+	cfg.SetIdentity("kafka", "kafka.kuro.com", "ubuntu", sshpub)
+	cfg.AddPackages("zsh", "git")
+	cfg.RunCmd = append(cfg.RunCmd, cloudinit.Shell("systemctl enable --now kafka"))
+
+	userdata := cfg.String() // #cloud-config\nhostname: kafka\n...
+*/
+package cloudinit
+
+import (
+	"fmt"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Header is the first line cloud-init requires to treat user-data as cloud-config
+const Header = "#cloud-config"
+
+// long runcmd lines stay on one line in user-data.txt instead of being folded at 80 columns
+func init() { yaml.FutureLineWrap() }
+
+/*
+Config holds the cloud-config modules kvmetal uses - keys it does not model are kept in Extra and
+written back unchanged, so parsing and rendering a user supplied file loses nothing but comments.
+*/
+type Config struct {
+	Hostname          string      `yaml:"hostname,omitempty"`
+	FQDN              string      `yaml:"fqdn,omitempty"`
+	Users             []User      `yaml:"users,omitempty"`
+	Password          string      `yaml:"password,omitempty"`
+	Chpasswd          *Chpasswd   `yaml:"chpasswd,omitempty"`
+	SSHPwauth         *bool       `yaml:"ssh_pwauth,omitempty"`
+	SSHAuthorizedKeys []string    `yaml:"ssh_authorized_keys,omitempty"`
+	PackageUpdate     *bool       `yaml:"package_update,omitempty"`
+	PackageUpgrade    *bool       `yaml:"package_upgrade,omitempty"`
+	Packages          []string    `yaml:"packages,omitempty"`
+	BootCmd           []Command   `yaml:"bootcmd,omitempty"`
+	WriteFiles        []WriteFile `yaml:"write_files,omitempty"`
+	Mounts            [][]string  `yaml:"mounts,omitempty"`
+	NTP               *NTP        `yaml:"ntp,omitempty"`
+	RunCmd            []Command   `yaml:"runcmd,omitempty"`
+	PowerState        *PowerState `yaml:"power_state,omitempty"`
+	FinalMessage      string      `yaml:"final_message,omitempty"`
+
+	Extra map[string]interface{} `yaml:",inline"`
+}
+
+/*
+User is an entry of users: - the image's default user is the bare string "default"
+
+	users:
+	  - default
+	  - name: ubuntu
+	    sudo: ['ALL=(ALL) NOPASSWD:ALL']
+*/
+type User struct {
+	Default           bool       `yaml:"-"`
+	Name              string     `yaml:"name,omitempty"`
+	Gecos             string     `yaml:"gecos,omitempty"`
+	Groups            StringList `yaml:"groups,omitempty"`
+	Sudo              StringList `yaml:"sudo,omitempty"`
+	Shell             string     `yaml:"shell,omitempty"`
+	LockPasswd        *bool      `yaml:"lock_passwd,omitempty"`
+	PlainTextPasswd   string     `yaml:"plain_text_passwd,omitempty"`
+	Passwd            string     `yaml:"passwd,omitempty"`
+	SSHAuthorizedKeys []string   `yaml:"ssh_authorized_keys,omitempty"`
+
+	Extra map[string]interface{} `yaml:",inline"`
+}
+
+type plainUser User
+
+func (u User) MarshalYAML() (interface{}, error) {
+	if u.Default {
+		return "default", nil
+	}
+	return plainUser(u), nil
+}
+
+func (u *User) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var name string
+	if err := unmarshal(&name); err == nil {
+		*u = User{Default: name == "default"}
+		if !u.Default {
+			u.Name = name
+		}
+		return nil
+	}
+	return unmarshal((*plainUser)(u))
+}
+
+// StringList accepts a single string or a list - sudo and groups take either form
+type StringList []string
+
+func (s *StringList) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var single string
+	if err := unmarshal(&single); err == nil {
+		*s = StringList{single}
+		return nil
+	}
+	var list []string
+	if err := unmarshal(&list); err != nil {
+		return err
+	}
+	*s = list
+	return nil
+}
+
+// Command is a runcmd or bootcmd entry - run by the shell, or exec'd directly when Args is set
+type Command struct {
+	Shell string
+	Args  []string
+}
+
+// Shell is a command run with sh -c
+func Shell(cmd string) Command { return Command{Shell: cmd} }
+
+func (c Command) MarshalYAML() (interface{}, error) {
+	if c.Args != nil {
+		return c.Args, nil
+	}
+	return c.Shell, nil
+}
+
+func (c *Command) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var shell string
+	if err := unmarshal(&shell); err == nil {
+		*c = Command{Shell: shell}
+		return nil
+	}
+	var args []string
+	if err := unmarshal(&args); err != nil {
+		return fmt.Errorf("command must be a string or a list of strings: %v", err)
+	}
+	*c = Command{Args: args}
+	return nil
+}
+
+type Chpasswd struct {
+	Expire *bool `yaml:"expire,omitempty"`
+
+	Extra map[string]interface{} `yaml:",inline"`
+}
+
+type WriteFile struct {
+	Path        string `yaml:"path"`
+	Content     string `yaml:"content,omitempty"`
+	Owner       string `yaml:"owner,omitempty"`
+	Permissions string `yaml:"permissions,omitempty"`
+	Encoding    string `yaml:"encoding,omitempty"`
+	Append      bool   `yaml:"append,omitempty"`
+	Defer       bool   `yaml:"defer,omitempty"`
+}
+
+type NTP struct {
+	Enabled *bool    `yaml:"enabled,omitempty"`
+	Servers []string `yaml:"servers,omitempty"`
+	Pools   []string `yaml:"pools,omitempty"`
+}
+
+type PowerState struct {
+	Mode      string      `yaml:"mode"`
+	Message   string      `yaml:"message,omitempty"`
+	Delay     string      `yaml:"delay,omitempty"`
+	Timeout   int         `yaml:"timeout,omitempty"`
+	Condition interface{} `yaml:"condition,omitempty"` // bool, a shell string or an argv list
+}
+
+// Parse reads a cloud-config document or a fragment of one - the #cloud-config header is optional
+func Parse(userdata string) (*Config, error) {
+	cfg := &Config{}
+	if err := yaml.Unmarshal([]byte(userdata), cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse cloud-config: %v", err)
+	}
+	return cfg, nil
+}
+
+/*
+ParseRunCmd reads a runcmd fragment - the list items the constants packages define without
+the runcmd: key
+
+	# Install Java
+	- sudo apt-get install -y openjdk-11-jdk
+	- |
+	  multi line script
+*/
+func ParseRunCmd(fragment string) ([]Command, error) {
+	var doc struct {
+		RunCmd []Command `yaml:"runcmd"`
+	}
+	if err := yaml.Unmarshal([]byte("runcmd:\n"+fragment), &doc); err != nil {
+		return nil, fmt.Errorf("failed to parse runcmd: %v", err)
+	}
+	return doc.RunCmd, nil
+}
+
+// YAML renders the document with the #cloud-config header
+func (c *Config) YAML() (string, error) {
+	data, err := yaml.Marshal(c)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal cloud-config: %v", err)
+	}
+	return Header + "\n" + string(data), nil
+}
+
+// String is YAML for callers that only log or write the document
+func (c *Config) String() string {
+	userdata, err := c.YAML()
+	if err != nil {
+		return Header + "\n# " + err.Error() + "\n"
+	}
+	return userdata
+}
+
+/*
+SetIdentity sets hostname and fqdn and installs the ssh key - on the named user when the document
+declares it under users:, otherwise top level for the image's default user.
+*/
+func (c *Config) SetIdentity(hostname, fqdn, username, sshPubKey string) {
+	c.Hostname = hostname
+	c.FQDN = fqdn
+
+	key := strings.TrimSpace(sshPubKey)
+	if key == "" {
+		return
+	}
+	for i := range c.Users {
+		if !c.Users[i].Default && c.Users[i].Name == username {
+			c.Users[i].SSHAuthorizedKeys = appendMissing(c.Users[i].SSHAuthorizedKeys, key)
+			return
+		}
+	}
+	c.SSHAuthorizedKeys = appendMissing(c.SSHAuthorizedKeys, key)
+}
+
+// AddPackages appends packages not already listed - empty names are skipped
+func (c *Config) AddPackages(pkgs ...string) {
+	for _, pkg := range pkgs {
+		if pkg != "" {
+			c.Packages = appendMissing(c.Packages, pkg)
+		}
+	}
+}
+
+func appendMissing(list []string, items ...string) []string {
+	for _, item := range items {
+		found := false
+		for _, existing := range list {
+			if existing == item {
+				found = true
+				break
+			}
+		}
+		if !found {
+			list = append(list, item)
+		}
+	}
+	return list
+}
@@ -0,0 +1,107 @@
+package cloudinit
+
+/*
+Merge layers overlay on top of c - how a --userdata file is applied over a --preset.
+
+  - hostname, fqdn, password, final_message and the boolean switches: set in overlay wins
+  - packages and ssh_authorized_keys: appended, duplicates dropped
+  - bootcmd, runcmd, write_files and mounts: appended - the preset's commands run first
+  - users: entries with the same name are merged field by field, new users are appended
+  - chpasswd, ntp and power_state: replaced as a whole when overlay sets them
+  - keys outside the model: overlay wins
+
+This matches cloud-init's own list(append)+dict(recurse_array) merge for the lists, without
+relying on the guest's merge_how support.
+*/
+func (c *Config) Merge(overlay *Config) {
+	if overlay == nil {
+		return
+	}
+
+	c.Hostname = orString(overlay.Hostname, c.Hostname)
+	c.FQDN = orString(overlay.FQDN, c.FQDN)
+	c.Password = orString(overlay.Password, c.Password)
+	c.FinalMessage = orString(overlay.FinalMessage, c.FinalMessage)
+	c.SSHPwauth = orBool(overlay.SSHPwauth, c.SSHPwauth)
+	c.PackageUpdate = orBool(overlay.PackageUpdate, c.PackageUpdate)
+	c.PackageUpgrade = orBool(overlay.PackageUpgrade, c.PackageUpgrade)
+
+	c.AddPackages(overlay.Packages...)
+	c.SSHAuthorizedKeys = appendMissing(c.SSHAuthorizedKeys, overlay.SSHAuthorizedKeys...)
+
+	c.BootCmd = append(c.BootCmd, overlay.BootCmd...)
+	c.RunCmd = append(c.RunCmd, overlay.RunCmd...)
+	c.WriteFiles = append(c.WriteFiles, overlay.WriteFiles...)
+	c.Mounts = append(c.Mounts, overlay.Mounts...)
+
+	for _, user := range overlay.Users {
+		c.mergeUser(user)
+	}
+
+	if overlay.Chpasswd != nil {
+		c.Chpasswd = overlay.Chpasswd
+	}
+	if overlay.NTP != nil {
+		c.NTP = overlay.NTP
+	}
+	if overlay.PowerState != nil {
+		c.PowerState = overlay.PowerState
+	}
+
+	c.Extra = mergeExtra(c.Extra, overlay.Extra)
+}
+
+func (c *Config) mergeUser(user User) {
+	for i := range c.Users {
+		existing := &c.Users[i]
+		if user.Default && existing.Default {
+			return
+		}
+		if user.Default || existing.Default || existing.Name != user.Name {
+			continue
+		}
+
+		existing.Gecos = orString(user.Gecos, existing.Gecos)
+		existing.Shell = orString(user.Shell, existing.Shell)
+		existing.PlainTextPasswd = orString(user.PlainTextPasswd, existing.PlainTextPasswd)
+		existing.Passwd = orString(user.Passwd, existing.Passwd)
+		existing.LockPasswd = orBool(user.LockPasswd, existing.LockPasswd)
+		if user.Groups != nil {
+			existing.Groups = user.Groups
+		}
+		if user.Sudo != nil {
+			existing.Sudo = user.Sudo
+		}
+		existing.SSHAuthorizedKeys = appendMissing(existing.SSHAuthorizedKeys, user.SSHAuthorizedKeys...)
+		existing.Extra = mergeExtra(existing.Extra, user.Extra)
+		return
+	}
+	c.Users = append(c.Users, user)
+}
+
+func mergeExtra(base, overlay map[string]interface{}) map[string]interface{} {
+	if len(overlay) == 0 {
+		return base
+	}
+	if base == nil {
+		base = map[string]interface{}{}
+	}
+	for k, v := range overlay {
+		base[k] = v
+	}
+	return base
+}
+
+func orString(overlay, base string) string {
+	if overlay != "" {
+		return overlay
+	}
+	return base
+}
+
+func orBool(overlay, base *bool) *bool {
+	if overlay != nil {
+		return overlay
+	}
+	return base
+}
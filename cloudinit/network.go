@@ -0,0 +1,104 @@
+package cloudinit
+
+import (
+	"fmt"
+
+	"kvmgo/types/nic"
+
+	"gopkg.in/yaml.v2"
+)
+
+/*
+netplan v2 as cloud-init reads it from the seed's network-config - cloud-init renders it for
+netplan, NetworkManager, networkd or ENI depending on the distro, so one document serves all of them.
+
+	version: 2
+	ethernets:
+	  eth0:
+	    match:
+	      macaddress: "52:54:00:3a:1f:9c"
+	    set-name: eth0
+	    addresses: [192.168.122.50/24]
+	    gateway4: 192.168.122.1
+	    nameservers:
+	      addresses: [192.168.122.1]
+	vlans:
+	  eth1.100:
+	    id: 100
+	    link: eth1
+	    dhcp4: true
+*/
+type netplan struct {
+	Version   int           `yaml:"version"`
+	Ethernets yaml.MapSlice `yaml:"ethernets"`
+	VLANs     yaml.MapSlice `yaml:"vlans,omitempty"`
+}
+
+type netplanDevice struct {
+	Match       *netplanMatch       `yaml:"match,omitempty"`
+	SetName     string              `yaml:"set-name,omitempty"`
+	ID          int                 `yaml:"id,omitempty"`
+	Link        string              `yaml:"link,omitempty"`
+	DHCP4       bool                `yaml:"dhcp4"`
+	Addresses   []string            `yaml:"addresses,omitempty"`
+	Gateway4    string              `yaml:"gateway4,omitempty"`
+	Gateway6    string              `yaml:"gateway6,omitempty"`
+	Nameservers *netplanNameservers `yaml:"nameservers,omitempty"`
+}
+
+type netplanMatch struct {
+	MACAddress string `yaml:"macaddress"`
+}
+
+type netplanNameservers struct {
+	Addresses []string `yaml:"addresses,omitempty"`
+	Search    []string `yaml:"search,omitempty"`
+}
+
+/*
+NetworkConfig renders the network-config for the interfaces - each is matched by MAC and named
+eth0, eth1.. in order. Interfaces need their MACs set, see nic.AssignMACs. With a VLAN the NIC
+only carries the tagged link and the addressing moves to <nic>.<vlan>.
+*/
+func NetworkConfig(ifaces []nic.Interface) (string, error) {
+	if err := nic.ValidateAll(ifaces); err != nil {
+		return "", err
+	}
+
+	doc := netplan{Version: 2}
+	for n, iface := range ifaces {
+		if iface.MAC == "" {
+			return "", fmt.Errorf("interface %d has no mac to match the guest's NIC by", n)
+		}
+		name := nic.Name(n)
+		ethernet := netplanDevice{Match: &netplanMatch{MACAddress: iface.MAC}, SetName: name}
+
+		if iface.VLAN == 0 {
+			addressing(&ethernet, iface)
+			doc.Ethernets = append(doc.Ethernets, yaml.MapItem{Key: name, Value: ethernet})
+			continue
+		}
+
+		doc.Ethernets = append(doc.Ethernets, yaml.MapItem{Key: name, Value: ethernet})
+		vlan := netplanDevice{ID: iface.VLAN, Link: name}
+		addressing(&vlan, iface)
+		doc.VLANs = append(doc.VLANs, yaml.MapItem{Key: fmt.Sprintf("%s.%d", name, iface.VLAN), Value: vlan})
+	}
+
+	data, err := yaml.Marshal(doc)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal network-config: %v", err)
+	}
+	return string(data), nil
+}
+
+// addressing sets static addresses, gateways and nameservers - DHCP for the families left out
+func addressing(dev *netplanDevice, iface nic.Interface) {
+	dev.Addresses = iface.Addresses
+	dev.DHCP4 = iface.IPv4() == ""
+	dev.Gateway4 = iface.Gateway4
+	dev.Gateway6 = iface.Gateway6
+	if len(iface.DNS) > 0 || len(iface.Search) > 0 {
+		dev.Nameservers = &netplanNameservers{Addresses: iface.DNS, Search: iface.Search}
+	}
+}
@@ -0,0 +1,253 @@
+package cloudinit
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// SeedLabel is the volume label cloud-init's NoCloud datasource looks for
+const SeedLabel = "cidata"
+
+// DefaultInstanceID is the meta-data cloud-localds writes when none is given
+const DefaultInstanceID = "iid-local01"
+
+/*
+Seed is a NoCloud seed image - the files cloud-init reads from a volume labelled cidata.
+
+It replaces cloud-localds: the image is an ISO 9660 filesystem written in process, so launches do
+not need cloud-image-utils and the same Seed always produces the same bytes.
+
+	seed := cloudinit.Seed{UserData: userdata, MetaData: "instance-id: kafka\nlocal-hostname: kafka\n"}
+	err := seed.WriteFile("data/artifacts/kafka/userdata/user-data.img")
+*/
+type Seed struct {
+	UserData      string
+	MetaData      string
+	NetworkConfig string // optional - netplan v2 or ENI, omitted from the image when empty
+	VendorData    string // optional
+
+	// ModTime is recorded for the volume and its files - left zero the dates are written as unset
+	ModTime time.Time
+}
+
+const sectorSize = 2048
+
+// fixed layout: system area, primary descriptor, terminator, both path tables, root directory, files
+const (
+	pvdSector       = 16
+	terminatorLBA   = 17
+	lPathTableLBA   = 18
+	mPathTableLBA   = 19
+	rootDirLBA      = 20
+	firstFileSector = 21
+)
+
+type seedFile struct {
+	name   string // user-data - Rock Ridge name, the ISO 9660 identifier is USER-DATA;1
+	data   []byte
+	extent uint32
+}
+
+func (f seedFile) identifier() string { return strings.ToUpper(f.name) + ";1" }
+
+func (s Seed) files() []seedFile {
+	metadata := s.MetaData
+	if metadata == "" {
+		metadata = "instance-id: " + DefaultInstanceID + "\n"
+	}
+
+	files := []seedFile{
+		{name: "user-data", data: []byte(s.UserData)},
+		{name: "meta-data", data: []byte(metadata)},
+	}
+	if s.NetworkConfig != "" {
+		files = append(files, seedFile{name: "network-config", data: []byte(s.NetworkConfig)})
+	}
+	if s.VendorData != "" {
+		files = append(files, seedFile{name: "vendor-data", data: []byte(s.VendorData)})
+	}
+
+	sort.Slice(files, func(i, j int) bool { return files[i].identifier() < files[j].identifier() })
+
+	next := uint32(firstFileSector)
+	for i := range files {
+		files[i].extent = next
+		next += sectors(len(files[i].data))
+	}
+	return files
+}
+
+// WriteFile writes the seed image to path, replacing it
+func (s Seed) WriteFile(path string) error {
+	var buf bytes.Buffer
+	if err := s.WriteISO(&buf); err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, buf.Bytes(), 0o644); err != nil {
+		return fmt.Errorf("failed to write seed image: %v", err)
+	}
+	return nil
+}
+
+// WriteISO writes the seed as an ISO 9660 image labelled cidata
+func (s Seed) WriteISO(w io.Writer) error {
+	files := s.files()
+
+	total := uint32(firstFileSector)
+	for _, f := range files {
+		total += sectors(len(f.data))
+	}
+
+	image := make([]byte, int(total)*sectorSize)
+	s.primaryDescriptor(image[pvdSector*sectorSize:], total)
+	copy(image[terminatorLBA*sectorSize:], []byte{255, 'C', 'D', '0', '0', '1', 1})
+	pathTable(image[lPathTableLBA*sectorSize:], binary.LittleEndian)
+	pathTable(image[mPathTableLBA*sectorSize:], binary.BigEndian)
+
+	root := image[rootDirLBA*sectorSize:]
+	self := append(rockRidgeStart(), posixAttributes(dirMode)...)
+	off := s.dirRecord(root, "\x00", rootDirLBA, sectorSize, true, self)
+	off += s.dirRecord(root[off:], "\x01", rootDirLBA, sectorSize, true, posixAttributes(dirMode))
+	for _, f := range files {
+		su := append(alternateName(f.name), posixAttributes(fileMode)...)
+		off += s.dirRecord(root[off:], f.identifier(), f.extent, len(f.data), false, su)
+		copy(image[int(f.extent)*sectorSize:], f.data)
+	}
+
+	if _, err := w.Write(image); err != nil {
+		return fmt.Errorf("failed to write seed image: %v", err)
+	}
+	return nil
+}
+
+func (s Seed) primaryDescriptor(b []byte, totalSectors uint32) {
+	b[0] = 1
+	copy(b[1:6], "CD001")
+	b[6] = 1
+	padded(b[8:40], "LINUX")
+	padded(b[40:72], SeedLabel)
+	bothEndian32(b[80:88], totalSectors)
+	bothEndian16(b[120:124], 1) // volume set size
+	bothEndian16(b[124:128], 1) // volume sequence number
+	bothEndian16(b[128:132], sectorSize)
+	bothEndian32(b[132:140], 10) // path table holding only the root
+	binary.LittleEndian.PutUint32(b[140:144], lPathTableLBA)
+	binary.BigEndian.PutUint32(b[148:152], mPathTableLBA)
+	s.dirRecord(b[156:190], "\x00", rootDirLBA, sectorSize, true, nil)
+	padded(b[190:318], "") // volume set
+	padded(b[318:446], "") // publisher
+	padded(b[446:574], "") // data preparer
+	padded(b[574:702], "KVMETAL")
+	padded(b[702:813], "")   // copyright, abstract and bibliographic files
+	s.volumeDate(b[813:830]) // created
+	s.volumeDate(b[830:847]) // modified
+	unsetDate(b[847:864])    // expires
+	s.volumeDate(b[864:881]) // effective
+	b[881] = 1
+}
+
+// dirRecord writes a directory record with the system use entries su and returns its length
+func (s Seed) dirRecord(b []byte, name string, extent uint32, size int, dir bool, su []byte) int {
+	n := 33 + len(name)
+	if n%2 == 1 {
+		n++
+	}
+	copy(b[n:], su)
+	n += len(su)
+	if n%2 == 1 {
+		n++
+	}
+	b[0] = byte(n)
+	bothEndian32(b[2:10], extent)
+	bothEndian32(b[10:18], uint32(size))
+	if !s.ModTime.IsZero() {
+		t := s.ModTime.UTC()
+		copy(b[18:25], []byte{byte(t.Year() - 1900), byte(t.Month()), byte(t.Day()), byte(t.Hour()), byte(t.Minute()), byte(t.Second()), 0})
+	}
+	if dir {
+		b[25] = 2
+	}
+	bothEndian16(b[28:32], 1)
+	b[32] = byte(len(name))
+	copy(b[33:], name)
+	return n
+}
+
+/*
+Rock Ridge keeps the names lower case and gives the files a mode, as genisoimage -rock does for
+cloud-localds - Linux maps plain identifiers the same way, other readers show USER-DATA.
+*/
+const (
+	dirMode  = 0o040755
+	fileMode = 0o100644
+)
+
+// rockRidgeStart is the SP and ER entries that mark the root's "." record as using Rock Ridge
+func rockRidgeStart() []byte {
+	id := "RRIP_1991A"
+	return append([]byte{'S', 'P', 7, 1, 0xBE, 0xEF, 0,
+		'E', 'R', byte(8 + len(id)), 1, byte(len(id)), 0, 0, 1}, id...)
+}
+
+// alternateName is the NM entry holding the file's real name
+func alternateName(name string) []byte {
+	return append([]byte{'N', 'M', byte(5 + len(name)), 1, 0}, name...)
+}
+
+// posixAttributes is the PX entry - mode, one link, owned by root
+func posixAttributes(mode uint32) []byte {
+	b := make([]byte, 36)
+	copy(b, []byte{'P', 'X', 36, 1})
+	bothEndian32(b[4:12], mode)
+	bothEndian32(b[12:20], 1)
+	return b
+}
+
+func (s Seed) volumeDate(b []byte) {
+	if s.ModTime.IsZero() {
+		unsetDate(b)
+		return
+	}
+	copy(b, s.ModTime.UTC().Format("20060102150405")+"00")
+	b[16] = 0 // GMT
+}
+
+// unsetDate is sixteen ASCII zeros and a zero offset - ECMA-119's "not specified"
+func unsetDate(b []byte) {
+	copy(b, strings.Repeat("0", 16))
+	b[16] = 0
+}
+
+func pathTable(b []byte, order binary.ByteOrder) {
+	b[0] = 1 // identifier length
+	order.PutUint32(b[2:6], rootDirLBA)
+	order.PutUint16(b[6:8], 1) // the root is its own parent
+}
+
+func padded(b []byte, s string) {
+	copy(b, s+strings.Repeat(" ", len(b)-len(s)))
+}
+
+func bothEndian16(b []byte, v uint16) {
+	binary.LittleEndian.PutUint16(b[0:2], v)
+	binary.BigEndian.PutUint16(b[2:4], v)
+}
+
+func bothEndian32(b []byte, v uint32) {
+	binary.LittleEndian.PutUint32(b[0:4], v)
+	binary.BigEndian.PutUint32(b[4:8], v)
+}
+
+// sectors is how many sectors size bytes occupy - empty files still get one so extents stay distinct
+func sectors(size int) uint32 {
+	if size == 0 {
+		return 1
+	}
+	return uint32((size + sectorSize - 1) / sectorSize)
+}
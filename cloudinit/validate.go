@@ -0,0 +1,305 @@
+package cloudinit
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// ValidationError is a problem in a user-data or meta-data document - Line is 1 based, 0 when unknown
+type ValidationError struct {
+	Line int
+	Msg  string
+}
+
+func (e ValidationError) Error() string {
+	if e.Line == 0 {
+		return e.Msg
+	}
+	return fmt.Sprintf("line %d: %s", e.Line, e.Msg)
+}
+
+// ValidationErrors is every problem found in a document, in line order
+type ValidationErrors []ValidationError
+
+func (e ValidationErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+/*
+knownKeys are the top level keys of the cloud-config modules shipped with cloud-init - anything else
+is silently ignored by the guest, which is how a typo such as package-update goes unnoticed.
+*/
+var knownKeys = map[string]bool{}
+
+func init() {
+	for _, key := range strings.Fields(`
+		ansible apk_repos apt apt_pipelining autoinstall bootcmd byobu_by_default ca_certs chef
+		chpasswd create_hostname_file device_aliases disable_ec2_metadata disable_root
+		disable_root_opts disk_setup drivers fan final_message fqdn fs_setup groups growpart
+		grub_dpkg hostname keyboard landscape locale locale_configfile lxd manage_etc_hosts
+		manage_resolv_conf mcollective merge_how merge_type mount_default_fields mounts
+		no_ssh_fingerprints ntp output package_reboot_if_required package_update package_upgrade
+		packages password phone_home power_state prefer_fqdn_over_hostname preserve_hostname
+		puppet random_seed reporting resize_rootfs resolv_conf rh_subscription rsyslog runcmd
+		salt_minion snap spacewalk ssh ssh_authorized_keys ssh_deletekeys ssh_fp_console_blacklist
+		ssh_genkeytypes ssh_import_id ssh_key_console_blacklist ssh_keys ssh_publish_hostkeys
+		ssh_pwauth ssh_quiet_keygen swap timezone ubuntu_advantage ubuntu_pro updates user users
+		vendor_data wireguard write_files yum_repo_dir yum_repos zypper`) {
+		knownKeys[key] = true
+	}
+}
+
+var yamlErrLine = regexp.MustCompile(`line (\d+): `)
+
+// yaml.v2 reports these parser problems with the 0 based line of the offending token - scanner problems are 1 based
+var zeroBasedProblems = []string{
+	"did not find expected key",
+	"did not find expected node content",
+	"did not find expected '-' indicator",
+	"did not find expected ','",
+	"found undefined tag handle",
+}
+
+/*
+Validate checks user-data before it is written to the seed image - the #cloud-config header, that
+the document parses, that every top level key belongs to a cloud-init module and the shape of
+runcmd, bootcmd, packages, users and write_files. All problems are returned as ValidationErrors.
+
+	if err := cloudinit.Validate(userdata); err != nil {
+		return fmt.Errorf("invalid user-data:\n%v", err)
+	}
+*/
+func Validate(userdata string) error {
+	var errs ValidationErrors
+
+	if first, _, _ := strings.Cut(userdata, "\n"); strings.TrimSpace(first) != Header {
+		errs = append(errs, ValidationError{1, fmt.Sprintf("first line must be %s, got %q", Header, first)})
+	}
+
+	var doc yaml.MapSlice
+	if err := yaml.Unmarshal([]byte(userdata), &doc); err != nil {
+		return append(errs, yamlError(err)...)
+	}
+	if len(doc) == 0 {
+		return append(errs, ValidationError{0, "document is empty"})
+	}
+
+	lines := newLineIndex(userdata)
+	seen := map[string]int{}
+	for _, item := range doc {
+		key, ok := item.Key.(string)
+		if !ok {
+			errs = append(errs, ValidationError{0, fmt.Sprintf("top level key %v is not a string", item.Key)})
+			continue
+		}
+		line := lines.nth(key, seen[key])
+		seen[key]++
+		if seen[key] > 1 { // cloud-init keeps the last one
+			errs = append(errs, ValidationError{line, fmt.Sprintf("duplicate key %q overrides line %d", key, lines.key(key))})
+		}
+		if !knownKeys[key] {
+			errs = append(errs, ValidationError{line, fmt.Sprintf("unknown key %q", key)})
+			continue
+		}
+
+		switch key {
+		case "runcmd", "bootcmd":
+			errs = append(errs, checkCommands(key, item.Value, lines)...)
+		case "packages":
+			errs = append(errs, checkList(key, item.Value, lines, func(v interface{}) string {
+				switch v.(type) {
+				case string, []interface{}:
+					return ""
+				}
+				return "must be a package name or a [name, version] pair"
+			})...)
+		case "users":
+			errs = append(errs, checkList(key, item.Value, lines, func(v interface{}) string {
+				switch u := v.(type) {
+				case string:
+					return ""
+				case yaml.MapSlice:
+					if name, _ := lookup(u, "name").(string); name != "" {
+						return ""
+					}
+					return "user has no name"
+				}
+				return "must be default or a mapping with a name"
+			})...)
+		case "write_files":
+			errs = append(errs, checkList(key, item.Value, lines, func(v interface{}) string {
+				f, ok := v.(yaml.MapSlice)
+				if !ok {
+					return "must be a mapping"
+				}
+				if path, _ := lookup(f, "path").(string); path == "" {
+					return "file has no path"
+				}
+				return ""
+			})...)
+		case "hostname", "fqdn", "password", "final_message":
+			if _, ok := item.Value.(string); !ok && item.Value != nil {
+				errs = append(errs, ValidationError{line, fmt.Sprintf("%s must be a string", key)})
+			}
+		}
+	}
+
+	sort.SliceStable(errs, func(i, j int) bool { return errs[i].Line < errs[j].Line })
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+// ValidateMetaData checks the NoCloud meta-data - instance-id is required, local-hostname must be a name
+func ValidateMetaData(metadata string) error {
+	var doc yaml.MapSlice
+	if err := yaml.Unmarshal([]byte(metadata), &doc); err != nil {
+		return yamlError(err)
+	}
+
+	lines := newLineIndex(metadata)
+	var errs ValidationErrors
+	if id, _ := lookup(doc, "instance-id").(string); id == "" {
+		errs = append(errs, ValidationError{lines.key("instance-id"), "instance-id is required"})
+	}
+	if host, ok := lookup(doc, "local-hostname").(string); ok && strings.ContainsAny(host, " \t/") {
+		errs = append(errs, ValidationError{lines.key("local-hostname"), fmt.Sprintf("local-hostname %q is not a valid hostname", host)})
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+// checkCommands accepts a shell string or an argv list per entry - cloud-init runs both forms
+func checkCommands(key string, value interface{}, lines lineIndex) ValidationErrors {
+	return checkList(key, value, lines, func(v interface{}) string {
+		switch cmd := v.(type) {
+		case nil, string:
+			return ""
+		case []interface{}:
+			for _, arg := range cmd {
+				switch arg.(type) {
+				case string, int, float64, bool:
+				default:
+					return "argv entries must be scalars"
+				}
+			}
+			return ""
+		}
+		return "must be a shell string or a list of arguments"
+	})
+}
+
+// checkList requires value to be a list and reports each item check rejects on the item's line
+func checkList(key string, value interface{}, lines lineIndex, check func(interface{}) string) ValidationErrors {
+	items, ok := value.([]interface{})
+	if !ok {
+		return ValidationErrors{{lines.key(key), fmt.Sprintf("%s must be a list", key)}}
+	}
+
+	var errs ValidationErrors
+	for i, item := range items {
+		if msg := check(item); msg != "" {
+			errs = append(errs, ValidationError{lines.item(key, i), fmt.Sprintf("%s[%d] %s", key, i, msg)})
+		}
+	}
+	return errs
+}
+
+func lookup(m yaml.MapSlice, key string) interface{} {
+	for _, item := range m {
+		if item.Key == key {
+			return item.Value
+		}
+	}
+	return nil
+}
+
+// yamlError turns yaml.v2's "yaml: line 4: ..." messages into ValidationErrors
+func yamlError(err error) ValidationErrors {
+	msgs := []string{err.Error()}
+	if typeErr, ok := err.(*yaml.TypeError); ok {
+		msgs = typeErr.Errors
+	}
+
+	var errs ValidationErrors
+	for _, msg := range msgs {
+		msg = strings.TrimPrefix(msg, "yaml: ")
+		line := 0
+		if m := yamlErrLine.FindStringSubmatchIndex(msg); m != nil {
+			line, _ = strconv.Atoi(msg[m[2]:m[3]])
+			msg = msg[:m[0]] + msg[m[1]:]
+			for _, problem := range zeroBasedProblems {
+				if strings.HasPrefix(msg, problem) {
+					line++
+					break
+				}
+			}
+		}
+		errs = append(errs, ValidationError{line, msg})
+	}
+	return errs
+}
+
+// lineIndex finds where top level keys and their list items are in the source - yaml.v2 keeps no positions
+type lineIndex []string
+
+func newLineIndex(doc string) lineIndex { return strings.Split(doc, "\n") }
+
+// key is the line of a top level key, 0 when it cannot be found
+func (l lineIndex) key(key string) int { return l.nth(key, 0) }
+
+// nth is the line of the n-th occurrence of a top level key
+func (l lineIndex) nth(key string, n int) int {
+	for i, line := range l {
+		if strings.HasPrefix(line, key+":") {
+			if n == 0 {
+				return i + 1
+			}
+			n--
+		}
+	}
+	return 0
+}
+
+// item is the line of the i-th entry of a block list under a top level key - the key's line for flow lists
+func (l lineIndex) item(key string, i int) int {
+	keyLine := l.key(key)
+	if keyLine == 0 {
+		return 0
+	}
+
+	indent := -1
+	n := 0
+	for j := keyLine; j < len(l); j++ {
+		line := l[j]
+		trimmed := strings.TrimLeft(line, " ")
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		depth := len(line) - len(trimmed)
+		if depth == 0 && !strings.HasPrefix(trimmed, "-") {
+			break // next top level key
+		}
+		if !strings.HasPrefix(trimmed, "-") || (indent >= 0 && depth != indent) {
+			continue
+		}
+		indent = depth
+		if n == i {
+			return j + 1
+		}
+		n++
+	}
+	return keyLine
+}
@@ -0,0 +1,454 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+/*
+Resolves every location kvmetal reads or writes - images, artifacts, state, hook logs,
+the forwarding config and the ssh keypair injected into VMs.
+
+Each setting is resolved once, later sources overriding earlier ones:
+
+ 1. XDG defaults
+ 2. config file - $KVMETAL_CONFIG, $XDG_CONFIG_HOME/kvmetal/config.yaml, then /etc/kvmetal/config.yaml
+ 3. KVMETAL_* environment variables
+ 4. flags registered through RegisterFlags
+
+Defaults:
+
+	data_dir        $XDG_DATA_HOME/kvmetal            (~/.local/share/kvmetal)
+	images_dir      <data_dir>/images
+	artifacts_dir   <data_dir>/artifacts              (<artifacts_dir>/<vm>/userdata/user-data.img ...)
+	network_dir     <data_dir>/network                (kvmfwding_config.json)
+	state_dir       $XDG_STATE_HOME/kvmetal           (~/.local/state/kvmetal)
+	log_dir         <state_dir>/logs                  (libvirtHookEvents.log, cmds)
+	ssh_private_key ~/.ssh/id_rsa
+	ssh_public_key  <ssh_private_key>.pub
+	socket          $XDG_RUNTIME_DIR/kvmetal/kvmetald.sock (<state_dir>/kvmetald.sock without a runtime dir)
+	domain          kuro.com                          (VMs are <vm>.<domain> - fqdn, DHCP and DNS entries)
+	ip_sources      [lease, agent, arp]               (where a VM's address is looked up, in order)
+	ip_timeout      2m
+	forwarding      iptables                          (or nftables - the firewall exposed ports are forwarded with)
+
+Running from a checkout with the previous data/ layout:
+
+	# ~/.config/kvmetal/config.yaml
+	data_dir: /home/kuro/Documents/Code/Go/kvmgo/data
+	ssh_private_key: /home/kuro/Documents/Code/Go/kvmgo/data/keys/id_rsa
+
+The libvirt qemu hook runs as root with a scrubbed environment - point both at the
+same file with /etc/kvmetal/config.yaml so the hook and the CLI agree on network_dir.
+
+Usage:
+
+	cfg := config.Current()
+
+	cfg.ArtifactsPath("kafka")     // ~/.local/share/kvmetal/artifacts/kafka
+	cfg.ForwardingConfigFile()     // ~/.local/share/kvmetal/network/kvmfwding_config.json
+*/
+type Config struct {
+	DataDir       string `json:"data_dir" yaml:"data_dir"`
+	ImagesDir     string `json:"images_dir" yaml:"images_dir"`
+	ArtifactsDir  string `json:"artifacts_dir" yaml:"artifacts_dir"`
+	NetworkDir    string `json:"network_dir" yaml:"network_dir"`
+	StateDir      string `json:"state_dir" yaml:"state_dir"`
+	LogDir        string `json:"log_dir" yaml:"log_dir"`
+	SSHPrivateKey string `json:"ssh_private_key" yaml:"ssh_private_key"`
+	SSHPublicKey  string `json:"ssh_public_key" yaml:"ssh_public_key"`
+	URI           string `json:"uri,omitempty" yaml:"uri,omitempty"` // libvirt URI - below KVMETAL_LIBVIRT_URI and --connect
+	Socket        string `json:"socket" yaml:"socket"`               // kvmetald listens here and the CLI dials it
+	Domain        string `json:"domain" yaml:"domain"`               // suffix of every VM's fqdn
+
+	// how vm ip, ssh, expose and cluster join find a VM's addresses - see network.IPResolver
+	IPSources []string `json:"ip_sources" yaml:"ip_sources"` // lease, agent, arp - asked in this order
+	IPTimeout string   `json:"ip_timeout" yaml:"ip_timeout"` // how long to wait for a booting VM's address
+	IPv6      bool     `json:"ipv6" yaml:"ipv6"`             // prefer a VM's IPv6 address when it has both
+
+	// the firewall exposed ports are forwarded with - see qemu_hooks.ForwardingBackend
+	Forwarding string `json:"forwarding" yaml:"forwarding"` // iptables or nftables
+
+	// File is the config file that was read, empty if none was found
+	File string `json:"-" yaml:"-"`
+}
+
+const (
+	EnvConfig     = "KVMETAL_CONFIG"
+	EnvDataDir    = "KVMETAL_DATA_DIR"
+	EnvImagesDir  = "KVMETAL_IMAGES_DIR"
+	EnvArtifacts  = "KVMETAL_ARTIFACTS_DIR"
+	EnvNetworkDir = "KVMETAL_NETWORK_DIR"
+	EnvStateDir   = "KVMETAL_STATE_DIR"
+	EnvLogDir     = "KVMETAL_LOG_DIR"
+	EnvSSHKey     = "KVMETAL_SSH_KEY"
+	EnvSSHPubKey  = "KVMETAL_SSH_PUBKEY"
+	EnvSocket     = "KVMETAL_SOCKET"
+	EnvDomain     = "KVMETAL_DOMAIN"
+	EnvIPSources  = "KVMETAL_IP_SOURCES" // comma separated
+	EnvIPTimeout  = "KVMETAL_IP_TIMEOUT"
+	EnvForwarding = "KVMETAL_FORWARDING"
+
+	SystemConfigFile = "/etc/kvmetal/config.yaml"
+
+	DefaultDomain    = "kuro.com"
+	DefaultIPTimeout = "2m"
+
+	ForwardingIPTables = "iptables" // a DNAT, SNAT and FWD chain per VM - the default
+	ForwardingNFTables = "nftables" // one kvmetal-<vm> table per VM, replaced atomically with nft -f
+)
+
+// IPSourceNames are the address sources ip_sources may list, in the default order
+var IPSourceNames = []string{"lease", "agent", "arp"}
+
+var (
+	mu      sync.RWMutex
+	current *Config
+)
+
+// Current returns the process configuration - loaded from file and env on first use
+func Current() *Config {
+	mu.RLock()
+	cfg := current
+	mu.RUnlock()
+	if cfg != nil {
+		return cfg
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if current == nil {
+		loaded, err := Load("")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "kvmetal: %s - using defaults\n", err)
+			loaded = Defaults()
+		}
+		current = loaded
+	}
+	return current
+}
+
+// Set replaces the process configuration - used by the CLI after flags are parsed and by tests
+func Set(cfg *Config) {
+	mu.Lock()
+	defer mu.Unlock()
+	cfg.fill()
+	current = cfg
+}
+
+// Defaults returns the XDG based configuration before any file or env is applied
+func Defaults() *Config {
+	home, _ := os.UserHomeDir()
+
+	dataHome := os.Getenv("XDG_DATA_HOME")
+	if dataHome == "" {
+		dataHome = filepath.Join(home, ".local", "share")
+	}
+
+	stateHome := os.Getenv("XDG_STATE_HOME")
+	if stateHome == "" {
+		stateHome = filepath.Join(home, ".local", "state")
+	}
+
+	cfg := &Config{
+		DataDir:       filepath.Join(dataHome, "kvmetal"),
+		StateDir:      filepath.Join(stateHome, "kvmetal"),
+		SSHPrivateKey: filepath.Join(home, ".ssh", "id_rsa"),
+		Socket:        runtimeSocket(),
+	}
+	cfg.fill()
+
+	return cfg
+}
+
+/*
+Load resolves the configuration from path (or the default search path when empty) and env.
+
+A missing file at the default locations is not an error - an explicit path must exist.
+*/
+func Load(path string) (*Config, error) {
+	cfg := &Config{}
+	defaults := Defaults()
+
+	explicit := path != ""
+	if !explicit {
+		path = os.Getenv(EnvConfig)
+		explicit = path != ""
+	}
+
+	files := []string{path}
+	if !explicit {
+		files = []string{UserConfigFile(), SystemConfigFile}
+	}
+
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if os.IsNotExist(err) && !explicit {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read config %s: %v", file, err)
+		}
+		if err := yaml.UnmarshalStrict(data, cfg); err != nil {
+			return nil, fmt.Errorf("invalid config %s: %v", file, err)
+		}
+		cfg.File = file
+		break
+	}
+
+	cfg.applyEnv()
+
+	// anything still unset falls back to XDG - derived dirs follow an overridden data_dir
+	if cfg.DataDir == "" {
+		cfg.DataDir = defaults.DataDir
+	}
+	if cfg.StateDir == "" {
+		cfg.StateDir = defaults.StateDir
+	}
+	if cfg.SSHPrivateKey == "" {
+		cfg.SSHPrivateKey = defaults.SSHPrivateKey
+	}
+	if cfg.Socket == "" {
+		cfg.Socket = runtimeSocket() // otherwise derived from state_dir
+	}
+	cfg.fill()
+
+	if err := cfg.validate(); err != nil {
+		return nil, fmt.Errorf("invalid config: %v", err)
+	}
+	return cfg, nil
+}
+
+// validate checks the values yaml cannot - unknown keys are already rejected while reading the file
+func (c *Config) validate() error {
+	for _, source := range c.IPSources {
+		known := false
+		for _, name := range IPSourceNames {
+			known = known || source == name
+		}
+		if !known {
+			return fmt.Errorf("unknown ip source %q - must be one of %s", source, strings.Join(IPSourceNames, ", "))
+		}
+	}
+	if d, err := time.ParseDuration(c.IPTimeout); err != nil || d <= 0 {
+		return fmt.Errorf("ip_timeout %q must be a duration such as 90s or 2m", c.IPTimeout)
+	}
+	if c.Forwarding != ForwardingIPTables && c.Forwarding != ForwardingNFTables {
+		return fmt.Errorf("forwarding %q must be %s or %s", c.Forwarding, ForwardingIPTables, ForwardingNFTables)
+	}
+	return nil
+}
+
+// runtimeSocket is the socket under $XDG_RUNTIME_DIR, empty when there is no runtime dir
+func runtimeSocket() string {
+	runtimeDir := os.Getenv("XDG_RUNTIME_DIR")
+	if runtimeDir == "" {
+		return ""
+	}
+	return filepath.Join(runtimeDir, "kvmetal", "kvmetald.sock")
+}
+
+// UserConfigFile is $XDG_CONFIG_HOME/kvmetal/config.yaml
+func UserConfigFile() string {
+	configHome := os.Getenv("XDG_CONFIG_HOME")
+	if configHome == "" {
+		home, _ := os.UserHomeDir()
+		configHome = filepath.Join(home, ".config")
+	}
+	return filepath.Join(configHome, "kvmetal", "config.yaml")
+}
+
+func (c *Config) applyEnv() {
+	for env, field := range map[string]*string{
+		EnvDataDir:    &c.DataDir,
+		EnvImagesDir:  &c.ImagesDir,
+		EnvArtifacts:  &c.ArtifactsDir,
+		EnvNetworkDir: &c.NetworkDir,
+		EnvStateDir:   &c.StateDir,
+		EnvLogDir:     &c.LogDir,
+		EnvSSHKey:     &c.SSHPrivateKey,
+		EnvSSHPubKey:  &c.SSHPublicKey,
+		EnvSocket:     &c.Socket,
+		EnvDomain:     &c.Domain,
+		EnvIPTimeout:  &c.IPTimeout,
+		EnvForwarding: &c.Forwarding,
+	} {
+		if v := os.Getenv(env); v != "" {
+			*field = v
+		}
+	}
+	if v := os.Getenv(EnvIPSources); v != "" {
+		c.IPSources = nil
+		for _, source := range strings.Split(v, ",") {
+			c.IPSources = append(c.IPSources, strings.TrimSpace(source))
+		}
+	}
+}
+
+// fill derives unset directories from data_dir/state_dir and makes every path absolute
+func (c *Config) fill() {
+	derive := func(field *string, parent, name string) {
+		if *field == "" && parent != "" {
+			*field = filepath.Join(parent, name)
+		}
+	}
+
+	for _, field := range []*string{&c.DataDir, &c.StateDir, &c.SSHPrivateKey} {
+		*field = absPath(*field)
+	}
+
+	derive(&c.ImagesDir, c.DataDir, "images")
+	derive(&c.ArtifactsDir, c.DataDir, "artifacts")
+	derive(&c.NetworkDir, c.DataDir, "network")
+	derive(&c.LogDir, c.StateDir, "logs")
+	derive(&c.Socket, c.StateDir, "kvmetald.sock")
+
+	if c.SSHPublicKey == "" && c.SSHPrivateKey != "" {
+		c.SSHPublicKey = c.SSHPrivateKey + ".pub"
+	}
+	if c.Domain == "" {
+		c.Domain = DefaultDomain
+	}
+	c.Domain = strings.Trim(c.Domain, ".")
+	if len(c.IPSources) == 0 {
+		c.IPSources = append([]string{}, IPSourceNames...)
+	}
+	if c.IPTimeout == "" {
+		c.IPTimeout = DefaultIPTimeout
+	}
+	if c.Forwarding == "" {
+		c.Forwarding = ForwardingIPTables
+	}
+
+	for _, field := range []*string{&c.ImagesDir, &c.ArtifactsDir, &c.NetworkDir, &c.LogDir, &c.SSHPublicKey, &c.Socket} {
+		*field = absPath(*field)
+	}
+}
+
+func absPath(path string) string {
+	if path == "" {
+		return ""
+	}
+	if strings.HasPrefix(path, "~/") {
+		if home, err := os.UserHomeDir(); err == nil {
+			path = filepath.Join(home, path[2:])
+		}
+	}
+	if abs, err := filepath.Abs(path); err == nil {
+		return abs
+	}
+	return path
+}
+
+// ArtifactsPath is the per VM artifacts dir - userdata, extra disks, networking commands
+func (c *Config) ArtifactsPath(vmName string) string {
+	return filepath.Join(c.ArtifactsDir, vmName)
+}
+
+// FQDN is the name a VM is given and registered under in its network's DNS - kafka.kuro.com
+func (c *Config) FQDN(vmName string) string {
+	return vmName + "." + c.Domain
+}
+
+// IPWait is ip_timeout as a duration - how long a VM's address is waited for
+func (c *Config) IPWait() time.Duration {
+	d, err := time.ParseDuration(c.IPTimeout)
+	if err != nil || d <= 0 {
+		d, _ = time.ParseDuration(DefaultIPTimeout)
+	}
+	return d
+}
+
+// ForwardingConfigFile is the json the qemu hook reads port forwards from
+func (c *Config) ForwardingConfigFile() string {
+	return filepath.Join(c.NetworkDir, "kvmfwding_config.json")
+}
+
+// HookLogFile is where qemu hook events are appended
+func (c *Config) HookLogFile() string {
+	return filepath.Join(c.LogDir, "libvirtHookEvents.log")
+}
+
+// CmdsFile holds the last set of forwarding commands generated by the hook
+func (c *Config) CmdsFile() string {
+	return filepath.Join(c.LogDir, "cmds")
+}
+
+// StateFile is the state store document
+func (c *Config) StateFile() string {
+	return filepath.Join(c.StateDir, "state.json")
+}
+
+// YAML renders the resolved configuration - written as a config file it reproduces the same paths
+func (c *Config) YAML() (string, error) {
+	data, err := yaml.Marshal(c)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal config: %v", err)
+	}
+	return string(data), nil
+}
+
+// Flags holds the values of the path flags registered by RegisterFlags
+type Flags struct {
+	ConfigFile *string
+	DataDir    *string
+	SSHKey     *string
+}
+
+/*
+RegisterFlags adds --config, --data-dir and --ssh-key to fs. Call Apply after parsing.
+
+	fs := flag.NewFlagSet("kvmetal", flag.ContinueOnError)
+	pathFlags := config.RegisterFlags(fs)
+	_ = fs.Parse(args)
+	if err := pathFlags.Apply(); err != nil { ... }
+*/
+func RegisterFlags(fs *flag.FlagSet) *Flags {
+	return &Flags{
+		ConfigFile: fs.String("config", "", "Path to config.yaml (default $XDG_CONFIG_HOME/kvmetal/config.yaml)"),
+		DataDir:    fs.String("data-dir", "", "Directory for images and artifacts (default $XDG_DATA_HOME/kvmetal)"),
+		SSHKey:     fs.String("ssh-key", "", "Private key whose .pub is injected into VMs (default ~/.ssh/id_rsa)"),
+	}
+}
+
+// Given reports whether any of the flags was set
+func (f *Flags) Given() bool {
+	return *f.ConfigFile != "" || *f.DataDir != "" || *f.SSHKey != ""
+}
+
+// Apply loads the config named by --config (if any), layers the flag values on top and makes it Current
+func (f *Flags) Apply() error {
+	cfg, err := Load(*f.ConfigFile)
+	if err != nil {
+		return err
+	}
+
+	if *f.DataDir != "" {
+		dataDir := absPath(*f.DataDir)
+		// dirs derived from the old data_dir follow the flag - explicitly configured ones stay put
+		prev := cfg.DataDir
+		cfg.DataDir = dataDir
+		for _, field := range []*string{&cfg.ImagesDir, &cfg.ArtifactsDir, &cfg.NetworkDir} {
+			if rel, err := filepath.Rel(prev, *field); err == nil && !strings.HasPrefix(rel, "..") {
+				*field = filepath.Join(dataDir, rel)
+			}
+		}
+	}
+
+	if *f.SSHKey != "" {
+		if cfg.SSHPublicKey == cfg.SSHPrivateKey+".pub" {
+			cfg.SSHPublicKey = ""
+		}
+		cfg.SSHPrivateKey = absPath(*f.SSHKey)
+	}
+
+	Set(cfg)
+	return nil
+}
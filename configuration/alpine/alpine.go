@@ -0,0 +1,75 @@
+package alpine
+
+import (
+	"log"
+
+	"kvmgo/constants"
+	"kvmgo/constants/kafka"
+	"kvmgo/constants/kube"
+	"kvmgo/constants/shell"
+)
+
+/*
+AlpineConfig targets the nocloud cloud-init image - apk packages and OpenRC, so only the
+dependencies that do not rely on apt, dnf or systemd have run commands.
+*/
+type AlpineConfig struct{}
+
+func (a *AlpineConfig) DefaultCloudInit() string {
+	return constants.DefaultUserdataAlpine
+}
+
+func (a *AlpineConfig) GetImageUrl() string {
+	return "https://dl-cdn.alpinelinux.org/alpine/v3.20/releases/cloud/nocloud_alpine-3.20.3-x86_64-bios-cloudinit-r0.qcow2"
+}
+
+func (a *AlpineConfig) GetVersion() string {
+	return "3.20.3_nocloud_x86_64"
+}
+
+func (a *AlpineConfig) GetOSVariant() string {
+	return "alpinelinux3.20"
+}
+
+func (a *AlpineConfig) GetPackage(dep constants.CloudInitPkg) string {
+	switch dep {
+	case constants.OpenJDK11:
+		return "openjdk11-jdk"
+	case constants.DefaultJre:
+		return "openjdk17-jre-headless"
+	case constants.BuildTools:
+		return "build-base"
+	case constants.TransportHttps:
+		return ""
+	default: // kubelet, kubeadm, kubectl and containerd keep their names in the community repo
+		return string(dep)
+	}
+}
+
+func (a *AlpineConfig) GetRunCmd(dep constants.Dependency) string {
+	switch dep {
+	case constants.Zsh:
+		return shell.ZSH_UBUNTU_RUNCMD
+	case constants.GuestAgent:
+		return shell.GUEST_AGENT_OPENRC_RUNCMD
+	case constants.Kafka:
+		return kafka.KAFKA_KRAFT_RUNCMD
+	case constants.Calico:
+		return kube.CALICO_LINUX_RUNCMD
+	case constants.Cilium:
+		return kube.CILIUM_LINUX_RUNCMD
+	default:
+		log.Printf("No Run Command found for Dependency %s on Alpine", dep)
+		return ""
+	}
+}
+
+func (a *AlpineConfig) GetInitSvc(dep constants.InitSvc) string {
+	switch dep {
+	case constants.Restart:
+		return constants.RebootCloudInit
+	default:
+		log.Printf("No Init Svc found for Cloud init Svc")
+		return ""
+	}
+}
@@ -0,0 +1,38 @@
+package debian
+
+import (
+	"kvmgo/configuration/ubuntu"
+	"kvmgo/constants"
+)
+
+// DebianConfig reuses the Ubuntu runcmds - both are apt based - and swaps the image and packages
+type DebianConfig struct {
+	ubuntu.UbuntuConfig
+}
+
+func (d *DebianConfig) DefaultCloudInit() string {
+	return constants.DefaultUserdataUbuntuUser
+}
+
+func (d *DebianConfig) GetImageUrl() string {
+	return "https://cloud.debian.org/images/cloud/bookworm/latest/debian-12-generic-amd64.qcow2"
+}
+
+func (d *DebianConfig) GetVersion() string {
+	return "12_Bookworm_amd64"
+}
+
+func (d *DebianConfig) GetOSVariant() string {
+	return "debian12"
+}
+
+func (d *DebianConfig) GetPackage(dep constants.CloudInitPkg) string {
+	switch dep {
+	case constants.OpenJDK11: // bookworm ships 17 only
+		return "openjdk-17-jdk"
+	case constants.BuildTools:
+		return "build-essential"
+	default:
+		return string(dep)
+	}
+}
@@ -0,0 +1,93 @@
+package fedora
+
+import (
+	"log"
+
+	"kvmgo/constants"
+	"kvmgo/constants/bigdata"
+	"kvmgo/constants/db"
+	"kvmgo/constants/jvm"
+	"kvmgo/constants/kafka"
+	"kvmgo/constants/kube"
+	"kvmgo/constants/shell"
+)
+
+type FedoraConfig struct{}
+
+func (f *FedoraConfig) DefaultCloudInit() string {
+	return constants.DefaultUserdataUbuntuUser
+}
+
+func (f *FedoraConfig) GetImageUrl() string {
+	return "https://download.fedoraproject.org/pub/fedora/linux/releases/40/Cloud/x86_64/images/Fedora-Cloud-Base-Generic.x86_64-40-1.14.qcow2"
+}
+
+func (f *FedoraConfig) GetVersion() string {
+	return "40_Cloud_Base_x86_64"
+}
+
+func (f *FedoraConfig) GetOSVariant() string {
+	return "fedora40"
+}
+
+// GetPackage maps the apt package names presets use to their dnf names - empty when Fedora has none
+func (f *FedoraConfig) GetPackage(dep constants.CloudInitPkg) string {
+	switch dep {
+	case constants.OpenJDK11:
+		return "java-11-openjdk-devel"
+	case constants.DefaultJre:
+		return "java-latest-openjdk-headless"
+	case constants.BuildTools:
+		return "@development-tools"
+	case constants.TransportHttps: // apt only
+		return ""
+	case constants.Kubelet:
+		return "kubernetes-node"
+	case constants.Kubeadm:
+		return "kubernetes-kubeadm"
+	case constants.Kubectl:
+		return "kubernetes-client"
+	default:
+		return string(dep)
+	}
+}
+
+func (f *FedoraConfig) GetRunCmd(dep constants.Dependency) string {
+	switch dep {
+	case constants.Zsh:
+		return shell.ZSH_UBUNTU_RUNCMD
+	case constants.GuestAgent:
+		return shell.GUEST_AGENT_RUNCMD
+	case constants.JDK_SCALA:
+		return jvm.JDK_SCALA_RPM_RUNCMD
+	case constants.Kafka:
+		return kafka.KAFKA_KRAFT_RUNCMD
+	case constants.Spark:
+		return bigdata.SPARK_UBUNTU_RUNCMD
+	case constants.KubernetesControlCalico:
+		return kube.KUBE_CONTROL_CALICO_RPM_RUNCMD
+	case constants.KubernetesControlCilium:
+		return kube.KUBE_CONTROL_CILIUM_RPM_RUNCMD
+	case constants.KubeWorker:
+		return kube.KUBE_WORKER_RPM_RUNCMD
+	case constants.Calico:
+		return kube.CALICO_LINUX_RUNCMD
+	case constants.Cilium:
+		return kube.CILIUM_LINUX_RUNCMD
+	case constants.Clickhouse:
+		return db.CLICKHOUSE_RPM_RUNCMD
+	default:
+		log.Printf("No Run Command found for Dependency %s on Fedora", dep)
+		return ""
+	}
+}
+
+func (f *FedoraConfig) GetInitSvc(dep constants.InitSvc) string {
+	switch dep {
+	case constants.Restart:
+		return constants.RebootCloudInit
+	default:
+		log.Printf("No Init Svc found for Cloud init Svc")
+		return ""
+	}
+}
@@ -3,15 +3,27 @@ package configuration
 import (
 	"fmt"
 	"log"
-	"strings"
 
+	"kvmgo/cloudinit"
+	kvmconfig "kvmgo/config"
+	"kvmgo/configuration/alpine"
+	"kvmgo/configuration/debian"
+	"kvmgo/configuration/fedora"
+	"kvmgo/configuration/rocky"
 	"kvmgo/configuration/ubuntu"
 	"kvmgo/constants"
+	"kvmgo/coreos"
 )
 
-type Distro interface {
+// Image is the cloud image a distro boots from
+type Image interface {
 	GetImageUrl() string
 	GetVersion() string
+	GetOSVariant() string // virt-install --os-variant short id such as ubuntu22.04
+}
+
+type Distro interface {
+	Image
 	DefaultCloudInit() string
 	GetRunCmd(constants.Dependency) string
 	GetPackage(dep constants.CloudInitPkg) string
@@ -49,14 +61,10 @@ func NewConfigBuilder(
 	password,
 	hostname, sshkey string,
 ) (*ConfigBuilder, error) {
-	var osdistro Distro
-
-	switch distro {
-	case constants.Ubuntu:
-		osdistro = &ubuntu.UbuntuConfig{}
-	default:
+	osdistro, err := GetDistro(distro)
+	if err != nil {
 		log.Printf("Unknown Distro Passed")
-		return nil, fmt.Errorf("Unknown Distribution")
+		return nil, err
 	}
 
 	return &ConfigBuilder{
@@ -64,6 +72,7 @@ func NewConfigBuilder(
 		distro:    osdistro,
 		deps:      deps,
 		pkgs:      pkgs,
+		initsvc:   initSvc,
 		username:  username,
 		password:  password,
 		hostname:  hostname,
@@ -71,77 +80,150 @@ func NewConfigBuilder(
 	}, nil
 }
 
-func (c *ConfigBuilder) CreateCloudInitData() string {
-	var userDataBuilder strings.Builder
-	baseUserData := SubstituteHostNameAndFqdnUserdataSSHPublicKey(
-		c.distro.DefaultCloudInit(),
-		c.hostname,
-		c.sshpubkey)
-
-	userDataBuilder.WriteString(baseUserData + "\n")
-	userDataBuilder.WriteString(c.BuildInitSvc())
+/*
+GetDistro returns the image, package and run command definitions for a distro
 
-	userDataBuilder.WriteString(c.BuildPackages())
-	userDataBuilder.WriteString(c.BuildRunCmds())
+	distro, _ := configuration.GetDistro(constants.Fedora)
+	distro.GetImageUrl() // Fedora-Cloud-Base-Generic...qcow2
+*/
+func GetDistro(distro constants.Distro) (Distro, error) {
+	switch distro {
+	case constants.Ubuntu:
+		return &ubuntu.UbuntuConfig{}, nil
+	case constants.Debian:
+		return &debian.DebianConfig{}, nil
+	case constants.Fedora:
+		return &fedora.FedoraConfig{}, nil
+	case constants.Rocky:
+		return &rocky.RockyConfig{}, nil
+	case constants.Alpine:
+		return &alpine.AlpineConfig{}, nil
+	case constants.FedoraCoreOS, constants.Flatcar:
+		return nil, fmt.Errorf("%s is provisioned with Ignition - use coreos.NewConfigBuilder", distro)
+	default:
+		return nil, fmt.Errorf("Unknown Distribution %s", distro)
+	}
+}
 
-	return c.Component.Substitutions(userDataBuilder.String())
+// GetImage returns the image for any distro - including the Ignition ones GetDistro rejects
+func GetImage(distro constants.Distro) (Image, error) {
+	switch distro {
+	case constants.FedoraCoreOS:
+		return &coreos.FedoraCoreOSConfig{}, nil
+	case constants.Flatcar:
+		return &coreos.FlatcarConfig{}, nil
+	default:
+		return GetDistro(distro)
+	}
+}
 
-	// return userDataBuilder.String()
+// CreateCloudInitData renders the cloud-config - empty when a run command fails to parse
+func (c *ConfigBuilder) CreateCloudInitData() string {
+	cfg, err := c.CloudConfig()
+	if err != nil {
+		log.Printf("Failed to build cloud-config ERROR:%s", err)
+		return ""
+	}
+	return cfg.String()
 }
 
-func (c *ConfigBuilder) BuildInitSvc() string {
-	var initSvcBuilder strings.Builder
+/*
+CloudConfig builds the document for the VM - the distro's base userdata with the hostname, fqdn
+and ssh key set, then init services, packages, the run commands of every dependency and the guest
+agent. The preset gets the last word through Apply.
 
-	initSvcBuilder.WriteString("\npackages:\n")
+Layer a user supplied file on top with Merge:
 
+	cfg, _ := builder.CloudConfig()
+	cfg.Merge(userFile)
+*/
+func (c *ConfigBuilder) CloudConfig() (*cloudinit.Config, error) {
+	cfg, err := cloudinit.Parse(c.distro.DefaultCloudInit())
+	if err != nil {
+		return nil, err
+	}
+	if c.hostname != "" {
+		cfg.SetIdentity(c.hostname, kvmconfig.Current().FQDN(c.hostname), c.username, c.sshpubkey)
+	}
+
+	if err := c.BuildInitSvc(cfg); err != nil {
+		return nil, err
+	}
+	c.BuildPackages(cfg)
+	if err := c.BuildRunCmds(cfg); err != nil {
+		return nil, err
+	}
+	if err := AddGuestAgent(cfg, c.distro); err != nil {
+		return nil, err
+	}
+
+	c.Component.Apply(cfg)
+	return cfg, nil
+}
+
+// BuildInitSvc merges the init service fragments such as power_state into the document
+func (c *ConfigBuilder) BuildInitSvc(cfg *cloudinit.Config) error {
 	for _, svc := range c.initsvc {
 		initService := c.distro.GetInitSvc(svc)
 		if initService == "" {
-			log.Printf("No Run Command Found for Dependency")
+			log.Printf("No Init Svc found for %s", svc)
 			continue
 		}
-		initSvcBuilder.WriteString("\n" + initService + "\n")
+		fragment, err := cloudinit.Parse(initService)
+		if err != nil {
+			return fmt.Errorf("init svc %s: %v", svc, err)
+		}
+		cfg.Merge(fragment)
 	}
-
-	return initSvcBuilder.String()
+	return nil
 }
 
-func (c *ConfigBuilder) BuildPackages() string {
-	var pkgBuilder strings.Builder
-
-	//	pkgBuilder.WriteString("\npackages:\n") Already do this in BuildInitSvc
-
+func (c *ConfigBuilder) BuildPackages(cfg *cloudinit.Config) {
 	for _, pkg := range c.pkgs {
 		pkgCode := c.distro.GetPackage(pkg)
 		if pkgCode == "" {
-			log.Printf("No Run Command Found for Dependency")
+			log.Printf("No Package found for %s", pkg)
 			continue
 		}
-		pkgBuilder.WriteString("  - " + pkgCode + "\n")
+		cfg.AddPackages(pkgCode)
 	}
+}
 
-	return pkgBuilder.String()
+/*
+AddGuestAgent installs qemu-guest-agent and starts it ahead of the other run commands, so the
+VM's addresses - static and IPv6 ones included - can be read through libvirt while the rest of
+the preset is still installing.
+*/
+func AddGuestAgent(cfg *cloudinit.Config, distro Distro) error {
+	if pkg := distro.GetPackage(constants.QemuGuestAgent); pkg != "" {
+		cfg.AddPackages(pkg)
+	}
+	cmds, err := cloudinit.ParseRunCmd(distro.GetRunCmd(constants.GuestAgent))
+	if err != nil {
+		return fmt.Errorf("run command for %s: %v", constants.GuestAgent, err)
+	}
+	cfg.RunCmd = append(cmds, cfg.RunCmd...)
+	return nil
 }
 
 /*
 Generate the runCmd that specifies Boot Instructions to install deps.
 Multiple Dependencies can be passed.
 */
-func (c *ConfigBuilder) BuildRunCmds() string {
-	var runCmdBuilder strings.Builder
-	runCmdBuilder.WriteString("\nruncmd:\n")
-
+func (c *ConfigBuilder) BuildRunCmds(cfg *cloudinit.Config) error {
 	for _, dependency := range c.deps {
-
 		runCmd := c.distro.GetRunCmd(dependency)
 		if runCmd == "" {
 			log.Printf("No Run Command Found for Dependency")
 			continue
 		}
-		runCmdBuilder.WriteString("\n  # Run Command for Dependency: " + string(dependency) + runCmd)
+		cmds, err := cloudinit.ParseRunCmd(runCmd)
+		if err != nil {
+			return fmt.Errorf("run command for %s: %v", dependency, err)
+		}
+		cfg.RunCmd = append(cfg.RunCmd, cmds...)
 	}
-
-	return runCmdBuilder.String()
+	return nil
 }
 
 /*
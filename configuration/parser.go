@@ -3,6 +3,8 @@ package configuration
 import (
 	"fmt"
 	"strings"
+
+	kvmconfig "kvmgo/config"
 )
 
 /* Adds the Hostname, fqdn, & SSH key to the Userdata */
@@ -32,7 +34,7 @@ func SubstituteHostnameUserData(yamlTemplate, hostname string) string {
 func SubstituteFqdnUserData(yamlTemplate, hostname string) string {
 	userData := strings.Replace(yamlTemplate,
 		"#fqdn: _FQDN_",
-		fmt.Sprintf("fqdn: %s", hostname+".kuro.com"),
+		fmt.Sprintf("fqdn: %s", kvmconfig.Current().FQDN(hostname)),
 		1)
 	return userData
 }
@@ -1,9 +1,12 @@
 package configuration
 
+import "kvmgo/cloudinit"
+
+// Preset adjusts the cloud-config a ConfigBuilder produced before it is rendered
 type Preset interface {
-	Substitutions(string) string
+	Apply(*cloudinit.Config)
 }
 
 type DefaultPreset struct{}
 
-func (d DefaultPreset) Substitutions(userdata string) string { return userdata }
+func (d DefaultPreset) Apply(*cloudinit.Config) {}
@@ -7,10 +7,10 @@ import (
 	"kvmgo/constants"
 )
 
-func CreateClickhouseUserData(username, pass, vmname, sshpub string) string {
+func CreateClickhouseUserData(distro constants.Distro, username, pass, vmname, sshpub string) string {
 	config, err := configuration.NewConfigBuilder(
 		configuration.DefaultPreset{},
-		constants.Ubuntu,
+		distro,
 		[]constants.Dependency{
 			constants.Clickhouse,
 		},
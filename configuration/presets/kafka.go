@@ -5,6 +5,8 @@ import (
 	"log"
 	"strings"
 
+	"kvmgo/cloudinit"
+	kvmconfig "kvmgo/config"
 	"kvmgo/configuration"
 	"kvmgo/constants"
 	"kvmgo/constants/kafka"
@@ -44,22 +46,19 @@ func NewKafkaConfig(domain string) Kafka {
 }
 
 func SubstitueAdvertisedListenersKafka(yamlTemplate, domain string) string {
-	fqdn := domain + ".kuro.com"
+	fqdn := kvmconfig.Current().FQDN(domain)
 	r := "$FQDN"
 	ans := strings.Replace(yamlTemplate, r, fqdn, 1)
 	return strings.Replace(ans, "##-", "  -", 1)
 }
 
-func (k Kafka) Substitutions(userdata string) string {
-	return userdata
-	// return SubstitueAdvertisedListenersKafka(userdata, k.domain)
-}
+func (k Kafka) Apply(*cloudinit.Config) {}
 
 /* Launch Kafka */
-func CreateKafkaUserData(username, pass, vmname, sshpub string) string {
+func CreateKafkaUserData(distro constants.Distro, username, pass, vmname, sshpub string) string {
 	config, err := configuration.NewConfigBuilder(
 		Kafka{domain: vmname},
-		constants.Ubuntu,
+		distro,
 		[]constants.Dependency{
 			constants.Zsh,
 			constants.JDK_SCALA,
@@ -83,7 +82,8 @@ func CreateKafkaUserData(username, pass, vmname, sshpub string) string {
 	return userdata
 }
 
-func CreateKafkaKraftCluster(username, pass, vmname, sshpub string,
+// vmAddress is advertised to clients inside the host - a static IP, or the VM's fqdn when empty
+func CreateKafkaKraftCluster(distro constants.Distro, username, pass, vmname, sshpub, vmAddress string,
 	vmPort int, hostIP string, hostPort int, externalIP string,
 	nodeId int, role kafka.KafkaRole,
 ) string {
@@ -91,7 +91,7 @@ func CreateKafkaKraftCluster(username, pass, vmname, sshpub string,
 
 	config, err := configuration.NewConfigBuilder(
 		kafkaCfg,
-		constants.Ubuntu,
+		distro,
 		[]constants.Dependency{
 			constants.Zsh,
 			constants.JDK_SCALA,
@@ -111,11 +111,19 @@ func CreateKafkaKraftCluster(username, pass, vmname, sshpub string,
 		log.Printf("Failed to create Configuration")
 	}
 
-	userdata := config.CreateCloudInitData()
+	userdata, err := config.CloudConfig()
+	if err != nil {
+		log.Printf("Failed to build Kafka userdata ERROR:%s", err)
+		return ""
+	}
+
+	if vmAddress == "" {
+		vmAddress = kvmconfig.Current().FQDN(vmname)
+	}
 
 	kraftUserdata := kafkaCfg.GenerateKraftUserdata(
 		vmname,
-		vmname+".kuro.com",
+		vmAddress,
 		vmPort,
 		hostIP,
 		hostPort,
@@ -123,7 +131,8 @@ func CreateKafkaKraftCluster(username, pass, vmname, sshpub string,
 		nodeId,
 		kafka.BrokerController)
 
-	return userdata + kraftUserdata
+	userdata.Merge(kraftUserdata)
+	return userdata.String()
 }
 
 /*
@@ -139,15 +148,17 @@ func (k Kafka) GenerateKraftUserdata(domain,
 	vmIPorDomain string, vmPort int,
 	hostIP string, hostPort int, externalIP string,
 	nodeId int, role kafka.KafkaRole,
-) string {
+) *cloudinit.Config {
 	exposeCmd := ExposeBrokerCmd(domain, vmPort, hostPort, externalIP)
 	log.Printf("Expose Command once Kafka Cluster is Running:\n%s\n", exposeCmd)
 
 	kraftStorageFormatCmd := KafkaFormatKraftStorage()
 
-	initCmds := utils.IndentArrayRunCmd(append(
-		kafka.KAFKA_RUNCMD_INITIAL_STEPS,
-		kraftStorageFormatCmd))
+	var runCmd []cloudinit.Command
+	for _, cmd := range kafka.KAFKA_RUNCMD_INITIAL_STEPS {
+		runCmd = append(runCmd, cloudinit.Shell(cmd))
+	}
+	runCmd = append(runCmd, cloudinit.Shell(kraftStorageFormatCmd))
 
 	settings := k.GenerateKafkaSettings(
 		domain,
@@ -160,35 +171,20 @@ func (k Kafka) GenerateKraftUserdata(domain,
 	)
 	fmt.Println(settings)
 
-	replaceCmd := ReplaceKafkaKraftSettings(settings)
+	runCmd = append(runCmd,
+		cloudinit.Shell(ReplaceKafkaKraftSettings(settings)),
+		cloudinit.Shell(kafka.KAFKA_KRAFT_START_CLUSTER))
 
-	runCmdReplaceIndented := DefineKafkaSettingsInRunCmd(replaceCmd)
-
-	return initCmds + "\n" +
-		runCmdReplaceIndented +
-		fmt.Sprintf("  - %s\n\n", kafka.KAFKA_KRAFT_START_CLUSTER) +
-		`final_message: "Kafka has been successfully installed and started."` + "\n"
+	return &cloudinit.Config{
+		RunCmd:       runCmd,
+		FinalMessage: "Kafka has been successfully installed and started.",
+	}
 }
 
 func ReplaceKafkaKraftSettings(clusterSettings string) string {
 	return fmt.Sprintf(kafka.KAFKA_SETTINGS_RUNCMD_TEMPLATE, clusterSettings)
 }
 
-func DefineKafkaSettingsInRunCmd(replaceKraftSettingsCmd string) string {
-	var runCmdSettingsBuilder strings.Builder
-	runCmdSettingsBuilder.WriteString("  - |-\n")
-
-	settingsLines := strings.Split(replaceKraftSettingsCmd, "\n")
-
-	for _, line := range settingsLines {
-		runCmdSettingsBuilder.WriteString(fmt.Sprintf("    %s\n", line))
-	}
-
-	return runCmdSettingsBuilder.String()
-
-	// sudo tee /opt/kafka/config/kraft/server.properties > /dev/null <<EOL
-}
-
 func (k Kafka) GenerateKafkaSettings(
 	domain,
 	vmIPorDomain string, vmPort int,
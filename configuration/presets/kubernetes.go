@@ -1,13 +1,39 @@
 package presets
 
 import (
+	"fmt"
 	"log"
+	"strings"
 
+	"kvmgo/cloudinit"
 	"kvmgo/configuration"
 	"kvmgo/constants"
 )
 
-func CreateKubeControlPlaneUserData(username, pass, vmname, sshpub string, cilium bool) string {
+/*
+KubeControlPlane pins the API server to a static address - kubeadm otherwise advertises whatever
+the default route's interface got from DHCP, and join commands break once the lease changes.
+Leave Endpoint empty to keep kubeadm's default.
+*/
+type KubeControlPlane struct {
+	Endpoint string
+}
+
+// Apply appends the advertise address and control plane endpoint to every kubeadm init
+func (k KubeControlPlane) Apply(cfg *cloudinit.Config) {
+	if k.Endpoint == "" {
+		return
+	}
+	flags := fmt.Sprintf("kubeadm init --apiserver-advertise-address=%s --control-plane-endpoint=%s:6443", k.Endpoint, k.Endpoint)
+	for i, cmd := range cfg.RunCmd {
+		if strings.HasPrefix(cmd.Shell, "kubeadm init") {
+			cfg.RunCmd[i].Shell = strings.Replace(cmd.Shell, "kubeadm init", flags, 1)
+		}
+	}
+}
+
+// endpoint is the control plane's static IPv4 - empty when it uses DHCP
+func CreateKubeControlPlaneUserData(distro constants.Distro, username, pass, vmname, sshpub, endpoint string, cilium bool) string {
 	var clusterNetworking constants.Dependency
 	log.Printf("Kubeadm Reference https://kubernetes.io/docs/setup/production-environment/tools/kubeadm/install-kubeadm/")
 
@@ -18,8 +44,8 @@ func CreateKubeControlPlaneUserData(username, pass, vmname, sshpub string, ciliu
 	}
 
 	config, err := configuration.NewConfigBuilder(
-		configuration.DefaultPreset{},
-		constants.Ubuntu,
+		KubeControlPlane{Endpoint: endpoint},
+		distro,
 		[]constants.Dependency{
 			constants.Zsh,
 			clusterNetworking,
@@ -42,13 +68,13 @@ func CreateKubeControlPlaneUserData(username, pass, vmname, sshpub string, ciliu
 	return userdata
 }
 
-func CreateKubeWorkerUserData(username, pass, vmname, sshpub string) string {
+func CreateKubeWorkerUserData(distro constants.Distro, username, pass, vmname, sshpub string) string {
 	log.Printf("Kubeadm Reference https://kubernetes.io/docs/setup/production-environment/tools/kubeadm/install-kubeadm/")
 
 	config, err := configuration.NewConfigBuilder(
 		configuration.DefaultPreset{},
 
-		constants.Ubuntu,
+		distro,
 		[]constants.Dependency{
 			constants.Zsh,
 			constants.KubeWorker,
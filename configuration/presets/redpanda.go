@@ -3,31 +3,28 @@ package presets
 import (
 	"fmt"
 	"log"
-	"strings"
 
+	"kvmgo/cloudinit"
 	"kvmgo/configuration"
 	"kvmgo/constants"
 	"kvmgo/constants/redpanda"
-	"kvmgo/utils"
 )
 
 type Redpanda struct {
 	domain string
 }
 
-func (k Redpanda) Substitutions(userdata string) string {
-	return userdata
-	// return SubstitueAdvertisedListenersKafka(userdata, k.domain)
-}
+func (k Redpanda) Apply(*cloudinit.Config) {}
 
 /* Test using Preset now - this should generate full metadata */
 func CreateRedpandaUserdata(
+	distro constants.Distro,
 	username, pass, vmname, sshpub,
 	vmIP, vmPort, hostIP, hostPort string,
 ) string {
 	config, err := configuration.NewConfigBuilder(
 		Redpanda{domain: vmname},
-		constants.Ubuntu,
+		distro,
 		[]constants.Dependency{
 			constants.Zsh,
 		},
@@ -46,37 +43,33 @@ func CreateRedpandaUserdata(
 		log.Printf("Failed to create Configuration")
 	}
 
-	userdata := config.CreateCloudInitData()
+	userdata, err := config.CloudConfig()
+	if err != nil {
+		log.Printf("Failed to build Redpanda userdata ERROR:%s", err)
+		return ""
+	}
 
-	return userdata + GenerateRedpandaUserdata(vmIP, vmPort, hostIP, hostPort)
+	userdata.Merge(GenerateRedpandaUserdata(vmIP, vmPort, hostIP, hostPort))
+	return userdata.String()
 }
 
-func GenerateRedpandaUserdata(vmIP, vmPort, hostIP, hostPort string) string {
-	initCmds := utils.IndentArrayRunCmd(redpanda.REDPANDA_RUNCMD_INITIAL_STEPS)
+// GenerateRedpandaUserdata is the fragment CreateRedpandaUserdata merges over the base userdata
+func GenerateRedpandaUserdata(vmIP, vmPort, hostIP, hostPort string) *cloudinit.Config {
+	var runCmd []cloudinit.Command
+	for _, cmd := range redpanda.REDPANDA_RUNCMD_INITIAL_STEPS {
+		runCmd = append(runCmd, cloudinit.Shell(cmd))
+	}
 
 	config := GenerateRedpandaConfig(vmIP, vmPort, hostIP, hostPort)
 
-	substitued := GetInitSettingsReplacementString(config)
-
-	runCmdReplaceIndented := IndentRpSettingsReplaceCmds(substitued)
+	runCmd = append(runCmd,
+		cloudinit.Shell(GetInitSettingsReplacementString(config)),
+		cloudinit.Shell(redpanda.REDPANDA_START_CMD))
 
-	return initCmds + "\n" +
-		runCmdReplaceIndented +
-		fmt.Sprintf("  - %s\n\n", redpanda.REDPANDA_START_CMD) +
-		`final_message: "Redpanda has been successfully installed and started."` + "\n"
-}
-
-func IndentRpSettingsReplaceCmds(replaceRpSettingsCmd string) string {
-	var runCmdSettingsBuilder strings.Builder
-	runCmdSettingsBuilder.WriteString("  - |-\n")
-
-	settingsLines := strings.Split(replaceRpSettingsCmd, "\n")
-
-	for _, line := range settingsLines {
-		runCmdSettingsBuilder.WriteString(fmt.Sprintf("    %s\n", line))
+	return &cloudinit.Config{
+		RunCmd:       runCmd,
+		FinalMessage: "Redpanda has been successfully installed and started.",
 	}
-
-	return runCmdSettingsBuilder.String()
 }
 
 func RedpandaAdvertisedExternalKafkaAPI(hostIP, hostPort string) string {
@@ -115,7 +108,7 @@ Create Redpanda Config to Launch and Expose
 */
 func GenerateRedpandaConfig(vmIP, vmPort, hostIP, hostPort string) string {
 	config := `
-redpanda:	
+redpanda:
     data_directory: /var/lib/redpanda/data
     seed_servers: []
     rpc_server:
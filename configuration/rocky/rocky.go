@@ -0,0 +1,36 @@
+package rocky
+
+import (
+	"kvmgo/configuration/fedora"
+	"kvmgo/constants"
+)
+
+// RockyConfig shares Fedora's dnf runcmds - packages missing from the Rocky repos map to empty
+type RockyConfig struct {
+	fedora.FedoraConfig
+}
+
+func (r *RockyConfig) GetImageUrl() string {
+	return "https://dl.rockylinux.org/pub/rocky/9/images/x86_64/Rocky-9-GenericCloud-Base.latest.x86_64.qcow2"
+}
+
+func (r *RockyConfig) GetVersion() string {
+	return "9_GenericCloud_x86_64"
+}
+
+func (r *RockyConfig) GetOSVariant() string {
+	return "rocky9"
+}
+
+func (r *RockyConfig) GetPackage(dep constants.CloudInitPkg) string {
+	switch dep {
+	case constants.DefaultJre:
+		return "java-17-openjdk-headless"
+	case constants.BuildTools:
+		return "@development"
+	case constants.ZSH, constants.Git, constants.Curl, constants.Wget, constants.Tar, constants.NetTools, constants.OpenJDK11, constants.QemuGuestAgent:
+		return r.FedoraConfig.GetPackage(dep)
+	default: // containerd and kubeadm come from the Docker and pkgs.k8s.io repos the kube runcmds add
+		return ""
+	}
+}
@@ -26,6 +26,10 @@ func (u *UbuntuConfig) GetVersion() string {
 	return "22.04_Jammy_amd64"
 }
 
+func (u *UbuntuConfig) GetOSVariant() string {
+	return "ubuntu22.04"
+}
+
 func (u *UbuntuConfig) GetPackage(dep constants.CloudInitPkg) string {
 	return string(dep)
 }
@@ -34,6 +38,8 @@ func (u *UbuntuConfig) GetRunCmd(dep constants.Dependency) string {
 	switch dep {
 	case constants.Zsh:
 		return shell.ZSH_UBUNTU_RUNCMD
+	case constants.GuestAgent:
+		return shell.GUEST_AGENT_RUNCMD
 	case constants.JDK_SCALA:
 		return jvm.JDK_SCALA_RUNCMD
 	case constants.Kafka:
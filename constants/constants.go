@@ -1,12 +1,64 @@
 package constants
 
+import (
+	"fmt"
+	"strings"
+)
+
 type Distro int
 
 const (
 	Ubuntu Distro = iota
 	Debian
+	Fedora
+	Rocky
+	Alpine
+	FedoraCoreOS
+	Flatcar
 )
 
+// DistroNames are the values accepted by --distro
+var DistroNames = []string{"ubuntu", "debian", "fedora", "rocky", "alpine", "fedora-coreos", "flatcar"}
+
+func (d Distro) String() string {
+	if int(d) < 0 || int(d) >= len(DistroNames) {
+		return fmt.Sprintf("distro(%d)", int(d))
+	}
+	return DistroNames[d]
+}
+
+// UsesIgnition is true for the immutable CoreOS images - they are provisioned with an Ignition
+// config passed through fw_cfg instead of a cloud-init seed
+func (d Distro) UsesIgnition() bool {
+	return d == FedoraCoreOS || d == Flatcar
+}
+
+// ParseDistro maps a --distro value such as fedora to its Distro
+func ParseDistro(name string) (Distro, error) {
+	for i, n := range DistroNames {
+		if strings.EqualFold(name, n) {
+			return Distro(i), nil
+		}
+	}
+	return Ubuntu, fmt.Errorf("unknown distro %q: must be one of %s", name, strings.Join(DistroNames, ", "))
+}
+
+// MarshalText keeps the distro readable in vm.yaml and the daemon API
+func (d Distro) MarshalText() ([]byte, error) { return []byte(d.String()), nil }
+
+func (d *Distro) UnmarshalText(text []byte) error {
+	if len(text) == 0 {
+		*d = Ubuntu
+		return nil
+	}
+	parsed, err := ParseDistro(string(text))
+	if err != nil {
+		return err
+	}
+	*d = parsed
+	return nil
+}
+
 type Dependency string
 
 const (
@@ -25,4 +77,5 @@ const (
 	Helm                    Dependency = "Helm"
 	JDK_SCALA               Dependency = "Jdk_Scala"
 	Clickhouse              Dependency = "Clickhouse"
+	GuestAgent              Dependency = "GuestAgent"
 )
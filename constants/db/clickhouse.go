@@ -29,3 +29,10 @@ const CLICKHOUSE_RUNCMD = `
   - sudo apt-get install -y clickhouse-server clickhouse-client
   - sudo systemctl restart clickhouse-server
 `
+
+// CLICKHOUSE_RPM_RUNCMD installs clickhouse from its rpm repo for Fedora and Rocky
+const CLICKHOUSE_RPM_RUNCMD = `
+  - curl -fsSL https://packages.clickhouse.com/rpm/clickhouse.repo -o /etc/yum.repos.d/clickhouse.repo
+  - dnf install -y clickhouse-server clickhouse-client
+  - systemctl enable --now clickhouse-server
+`
@@ -27,3 +27,27 @@ const JDK_SCALA_RUNCMD = `
   
 
 `
+
+// JDK_SCALA_RPM_RUNCMD installs sbt from its rpm repo for Fedora and Rocky
+const JDK_SCALA_RPM_RUNCMD = `
+
+  - HOME_DIR="/home/ubuntu"
+  - ENV_SHELL="$HOME_DIR/.zshrc"
+  - JAVA_HOME_DIR=$(dirname $(dirname $(readlink -f /usr/bin/java)))
+  - echo "export JAVA_HOME=$JAVA_HOME_DIR" >> $ENV_SHELL
+
+  # Setup Scala
+  - |
+    echo -e "Setting up Scala 2.13"
+    curl -fsSL https://downloads.lightbend.com/scala/2.13.8/scala-2.13.8.tgz -o /tmp/scala-2.13.8.tgz
+    tar -xvzf /tmp/scala-2.13.8.tgz -C /tmp
+    mv /tmp/scala-2.13.8 /usr/local/scala
+    echo 'export PATH=$PATH:/usr/local/scala/bin' >> $ENV_SHELL
+
+  # Setup sbt
+  - |
+    echo -e "Installing and Setting up sbt"
+    curl -fsSL https://www.scala-sbt.org/sbt-rpm.repo -o /etc/yum.repos.d/sbt-rpm.repo
+    dnf install -y sbt
+
+`
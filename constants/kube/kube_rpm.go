@@ -0,0 +1,91 @@
+package kube
+
+/*
+Fedora and Rocky variants of the kubeadm runcmds - same steps as the Ubuntu ones with the
+pkgs.k8s.io rpm repo, SELinux set to permissive as kubeadm requires, and containerd from the
+Docker repo when the distro does not package it (Rocky).
+*/
+const kubeNodeRPMSetup = `
+  # Disable Swap
+  - swapoff -a
+  - sed -i '/ swap / s/^/#/' /etc/fstab
+
+  # kubeadm does not support enforcing SELinux
+  - setenforce 0
+  - sed -i 's/^SELINUX=enforcing$/SELINUX=permissive/' /etc/selinux/config
+
+  # Install and Configure containerd
+  - rpm -q containerd || (curl -fsSL https://download.docker.com/linux/centos/docker-ce.repo -o /etc/yum.repos.d/docker-ce.repo && dnf install -y containerd.io)
+  - mkdir -p /etc/containerd
+  - containerd config default | tee /etc/containerd/config.toml
+  - sed -i 's/SystemdCgroup = false/SystemdCgroup = true/' /etc/containerd/config.toml
+  - systemctl enable --now containerd
+  - systemctl restart containerd
+
+  # Load Modules
+  - modprobe overlay
+  - modprobe br_netfilter
+
+  # Set Sysctl
+  - |
+    echo "net.bridge.bridge-nf-call-iptables  = 1
+    net.ipv4.ip_forward                 = 1
+    net.bridge.bridge-nf-call-ip6tables = 1" | tee /etc/sysctl.d/99-kubernetes-cri.conf
+  - sysctl --system
+
+  # Add Kubernetes Repo
+  - |
+    cat <<REPO | tee /etc/yum.repos.d/kubernetes.repo
+    [kubernetes]
+    name=Kubernetes
+    baseurl=https://pkgs.k8s.io/core:/stable:/v1.29/rpm/
+    enabled=1
+    gpgcheck=1
+    gpgkey=https://pkgs.k8s.io/core:/stable:/v1.29/rpm/repodata/repomd.xml.key
+    exclude=kubelet kubeadm kubectl cri-tools kubernetes-cni
+    REPO
+
+  # Install Kubernetes Components
+  - dnf install -y kubelet kubeadm kubectl --disableexcludes=kubernetes
+  - systemctl enable --now kubelet
+`
+
+const kubeConfigUbuntuUser = `
+  # Setup Kubeconfig
+  - mkdir -p /home/ubuntu/.kube
+  - cp /etc/kubernetes/admin.conf /home/ubuntu/.kube/config
+  - chown $(id -u ubuntu):$(id -g ubuntu) /home/ubuntu/.kube/config
+  - export KUBECONFIG=/home/ubuntu/.kube/config
+
+  # Install Helm
+  - curl https://raw.githubusercontent.com/helm/helm/main/scripts/get-helm-3 | bash
+`
+
+const KUBE_WORKER_RPM_RUNCMD = kubeNodeRPMSetup
+
+const KUBE_CONTROL_CALICO_RPM_RUNCMD = kubeNodeRPMSetup + `
+  # Initialize Kubernetes
+  - kubeadm init | tee /home/ubuntu/kubeadm-init.log
+` + kubeConfigUbuntuUser + `
+  # Setup pod networking (Calico)
+  - kubectl --kubeconfig=/home/ubuntu/.kube/config apply -f https://docs.projectcalico.org/manifests/calico.yaml
+
+`
+
+const KUBE_CONTROL_CILIUM_RPM_RUNCMD = kubeNodeRPMSetup + `
+  # Initialize Kubernetes (For Cilium we need to skip kube-proxy)
+  - kubeadm init --skip-phases=addon/kube-proxy | tee /home/ubuntu/kubeadm-init.log
+` + kubeConfigUbuntuUser + `
+  - |
+    until kubectl get nodes; do
+      echo "Waiting for Kubernetes API Server to become ready..."
+      sleep 5
+    done
+
+  # Allows Scheduling of Pods onto Control Plane
+  - kubectl taint nodes --all node-role.kubernetes.io/control-plane-
+` + CILIUM_LINUX_RUNCMD + `
+  - cilium install --set kubeProxyReplacement=strict
+  - cilium status --wait
+
+`
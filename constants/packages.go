@@ -30,4 +30,5 @@ const (
 	Wget           CloudInitPkg = "wget"
 	DefaultJre     CloudInitPkg = "default-jre"
 	Tar            CloudInitPkg = "tar"
+	QemuGuestAgent CloudInitPkg = "qemu-guest-agent"
 )
@@ -1,8 +0,0 @@
-package constants
-
-const (
-	LogfileDir   = "/home/kuro/Documents/Code/Go/kvmgo/data/network/logs/"
-	CmdsFilePath = "/home/kuro/Documents/Code/Go/kvmgo/data/network/logs/cmds"
-	SshPriv      = "/home/kuro/Documents/Code/Go/kvmgo/data/keys/id_rsa"
-	SshPub       = "/home/kuro/Documents/Code/Go/kvmgo/data/keys/id_rsa.pub"
-)
@@ -0,0 +1,12 @@
+package shell
+
+// GUEST_AGENT_RUNCMD starts qemu-guest-agent once cloud-init installed it - on later boots the virtio port's udev rule starts it
+const GUEST_AGENT_RUNCMD = `
+  - systemctl start qemu-guest-agent
+`
+
+// GUEST_AGENT_OPENRC_RUNCMD is GUEST_AGENT_RUNCMD for Alpine, which has to add the service to the default runlevel
+const GUEST_AGENT_OPENRC_RUNCMD = `
+  - rc-update add qemu-guest-agent default
+  - rc-service qemu-guest-agent start
+`
@@ -20,11 +20,7 @@ const CloudInitUbuntu = `#cloud-config
 
 #hostname: _HOSTNAME_
 #fqdn: _FQDN_
-passwd: password  
-lock_passwd: false
-sudo: ['ALL=(ALL) NOPASSWD:ALL']
-# sudo: ALL=(ALL) NOPASSWD:ALL
-package-update: true
+package_update: true
 package_upgrade: true
 password: password
 ssh_pwauth: true
@@ -36,9 +32,7 @@ const DefaultUserdata = `#cloud-config
 
 #hostname: _HOSTNAME_
 #fqdn: _FQDN_
-lock_passwd: false
-sudo: ['ALL=(ALL) NOPASSWD:ALL']
-package-update: true
+package_update: true
 package_upgrade: true
 password: password
 ssh_pwauth: true
@@ -52,9 +46,7 @@ const DefaultUserDataShellZsh = `#cloud-config
 
 #hostname: _HOSTNAME_
 #fqdn: _FQDN_
-lock_passwd: false
-sudo: ['ALL=(ALL) NOPASSWD:ALL']
-package-update: true
+package_update: true
 package_upgrade: true
 password: password
 ssh_pwauth: true
@@ -83,3 +75,51 @@ power_state:
   message: Rebooting after cloud-init configuration
   timeout: 15 
   condition: True`
+
+/*
+DefaultUserdataUbuntuUser is the base for Debian, Fedora and Rocky images. Their cloud images log in
+as debian, fedora or rocky - kvmetal's ssh, join and the preset runcmds use ubuntu:password and
+/home/ubuntu, so that user is created next to the image's default one.
+*/
+const DefaultUserdataUbuntuUser = `#cloud-config
+
+#hostname: _HOSTNAME_
+#fqdn: _FQDN_
+users:
+  - default
+  - name: ubuntu
+    sudo: ['ALL=(ALL) NOPASSWD:ALL']
+    shell: /bin/bash
+    lock_passwd: false
+    plain_text_passwd: password
+    #ssh_authorized_keys:
+    #  - ssh-rsa $SSH_PUB
+package_update: true
+package_upgrade: true
+ssh_pwauth: true
+chpasswd: { expire: False }
+
+`
+
+// DefaultUserdataAlpine installs sudo and bash first - the Alpine cloud image ships with neither
+const DefaultUserdataAlpine = `#cloud-config
+
+#hostname: _HOSTNAME_
+#fqdn: _FQDN_
+bootcmd:
+  - apk add --no-cache sudo bash
+users:
+  - default
+  - name: ubuntu
+    sudo: ['ALL=(ALL) NOPASSWD:ALL']
+    shell: /bin/bash
+    lock_passwd: false
+    plain_text_passwd: password
+    #ssh_authorized_keys:
+    #  - ssh-rsa $SSH_PUB
+package_update: true
+package_upgrade: true
+ssh_pwauth: true
+chpasswd: { expire: False }
+
+`
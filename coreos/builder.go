@@ -0,0 +1,164 @@
+package coreos
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"kvmgo/configuration/fedora"
+	"kvmgo/constants"
+)
+
+// ConfigBuilder mirrors configuration.ConfigBuilder for the Ignition distros
+type ConfigBuilder struct {
+	distro    constants.Distro
+	deps      []constants.Dependency
+	pkgs      []constants.CloudInitPkg
+	username  string
+	password  string
+	hostname  string
+	sshpubkey string
+}
+
+/*
+Build the Ignition config for a Fedora CoreOS or Flatcar VM from a Dependency and Package List
+
+Dependencies without an Ignition definition are logged and skipped - only the Kubernetes
+control plane and worker nodes have one. Packages are layered with rpm-ostree on Fedora CoreOS and
+skipped on Flatcar, which has no package manager.
+*/
+func NewConfigBuilder(
+	distro constants.Distro,
+	deps []constants.Dependency,
+	pkgs []constants.CloudInitPkg,
+	username,
+	password,
+	hostname, sshkey string,
+) (*ConfigBuilder, error) {
+	if !distro.UsesIgnition() {
+		return nil, fmt.Errorf("%s is provisioned with cloud-init - use configuration.NewConfigBuilder", distro)
+	}
+
+	return &ConfigBuilder{
+		distro:    distro,
+		deps:      deps,
+		pkgs:      pkgs,
+		username:  username,
+		password:  password,
+		hostname:  hostname,
+		sshpubkey: sshkey,
+	}, nil
+}
+
+// Config assembles users, hostname, packages and the dependencies' files and units
+func (c *ConfigBuilder) Config() (*Config, error) {
+	cfg := &Config{Ignition: Ignition{Version: IgnitionVersion}}
+
+	var keys []string
+	if key := strings.TrimSpace(c.sshpubkey); key != "" {
+		keys = []string{key}
+	}
+
+	// kvmetal's ssh and the preset scripts log in as the given user - core keeps the key as well
+	user := User{Name: c.username, SSHAuthorizedKeys: keys, Groups: []string{"sudo"}}
+	if c.password != "" {
+		hash, err := HashPassword(c.password)
+		if err != nil {
+			return nil, err
+		}
+		user.PasswordHash = hash
+	}
+	cfg.Passwd.Users = append(cfg.Passwd.Users, user)
+	if c.username != "core" && keys != nil {
+		cfg.Passwd.Users = append(cfg.Passwd.Users, User{Name: "core", SSHAuthorizedKeys: keys})
+	}
+
+	if c.hostname != "" {
+		cfg.Storage.Files = append(cfg.Storage.Files,
+			File{Path: "/etc/hostname", Mode: 0o644, Overwrite: true, Contents: c.hostname + "\n"})
+	}
+
+	c.buildPackages(cfg)
+
+	for _, dep := range c.deps {
+		switch dep {
+		case constants.KubernetesControlCalico:
+			c.kubeControlPlane(cfg, false)
+		case constants.KubernetesControlCilium:
+			c.kubeControlPlane(cfg, true)
+		case constants.KubeWorker:
+			if !hasUnit(cfg, "kubelet.service") {
+				c.kubeNode(cfg)
+			}
+		default:
+			log.Printf("No Ignition config found for Dependency %s on %s", dep, c.distro)
+		}
+	}
+
+	return cfg, nil
+}
+
+// buildPackages layers the packages with rpm-ostree on first boot - Flatcar cannot install any
+func (c *ConfigBuilder) buildPackages(cfg *Config) {
+	if len(c.pkgs) == 0 {
+		return
+	}
+	if c.distro != constants.FedoraCoreOS {
+		log.Printf("Skipping packages %v - %s has no package manager", c.pkgs, c.distro)
+		return
+	}
+
+	var names []string
+	for _, pkg := range c.pkgs {
+		if name := (&fedora.FedoraConfig{}).GetPackage(pkg); name != "" {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return
+	}
+
+	cfg.Systemd.Units = append(cfg.Systemd.Units, Unit{
+		Name:    "rpm-ostree-install-packages.service",
+		Enabled: enabled(),
+		Contents: fmt.Sprintf(`[Unit]
+Description=Layer packages with rpm-ostree
+Wants=network-online.target
+After=network-online.target
+Before=zincati.service
+ConditionPathExists=!/var/lib/rpm-ostree-install-packages.stamp
+
+[Service]
+Type=oneshot
+RemainAfterExit=yes
+ExecStart=/usr/bin/rpm-ostree install --idempotent --apply-live --allow-inactive %s
+ExecStart=/bin/touch /var/lib/rpm-ostree-install-packages.stamp
+
+[Install]
+WantedBy=multi-user.target
+`, strings.Join(names, " ")),
+	})
+}
+
+// CreateIgnitionData renders the config.ign passed to the VM through fw_cfg
+func (c *ConfigBuilder) CreateIgnitionData() (string, error) {
+	cfg, err := c.Config()
+	if err != nil {
+		return "", err
+	}
+	return cfg.JSON()
+}
+
+// CreateButaneData renders the same config as Butane yaml
+func (c *ConfigBuilder) CreateButaneData() (string, error) {
+	cfg, err := c.Config()
+	if err != nil {
+		return "", err
+	}
+	return cfg.Butane(c.distro)
+}
+
+func enabled() *bool {
+	enabled := true
+	return &enabled
+}
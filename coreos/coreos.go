@@ -0,0 +1,47 @@
+/*
+Package coreos provisions Fedora CoreOS and Flatcar guests through Ignition.
+
+The immutable images ignore cloud-init - Ignition runs once in the initramfs on first boot and
+reads its config from the opt/com.coreos/config fw_cfg entry. ConfigBuilder takes the same
+inputs as configuration.ConfigBuilder and renders users, ssh keys, files and systemd units.
+
+Usage:
+
+	builder, _ := coreos.NewConfigBuilder(constants.FedoraCoreOS,
+		[]constants.Dependency{constants.KubeWorker}, nil,
+		"ubuntu", "password", "worker", sshpub)
+
+	ign, _ := builder.CreateIgnitionData() // data/artifacts/<vm>/userdata/config.ign
+	bu, _ := builder.CreateButaneData()    // same config for humans to read and edit
+*/
+package coreos
+
+// FedoraCoreOSConfig is the stable stream qemu image - xz compressed, decompressed on pull
+type FedoraCoreOSConfig struct{}
+
+func (f *FedoraCoreOSConfig) GetImageUrl() string {
+	return "https://builds.coreos.fedoraproject.org/prod/streams/stable/builds/40.20240906.3.0/x86_64/fedora-coreos-40.20240906.3.0-qemu.x86_64.qcow2.xz"
+}
+
+func (f *FedoraCoreOSConfig) GetVersion() string {
+	return "40.20240906.3.0_stable_x86_64"
+}
+
+func (f *FedoraCoreOSConfig) GetOSVariant() string {
+	return "fedora-coreos-stable"
+}
+
+// FlatcarConfig is the stable channel qemu image - a qcow2 despite the .img name
+type FlatcarConfig struct{}
+
+func (f *FlatcarConfig) GetImageUrl() string {
+	return "https://stable.release.flatcar-linux.net/amd64-usr/3975.2.1/flatcar_production_qemu_image.img"
+}
+
+func (f *FlatcarConfig) GetVersion() string {
+	return "3975.2.1_stable_amd64"
+}
+
+func (f *FlatcarConfig) GetOSVariant() string {
+	return "linux2022"
+}
@@ -0,0 +1,120 @@
+package coreos
+
+import (
+	"crypto/rand"
+	"crypto/sha512"
+	"fmt"
+	"strings"
+)
+
+const cryptAlphabet = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// HashPassword returns the $6$ (SHA-512 crypt) hash Ignition's passwordHash expects - Ignition
+// never takes a plain text password
+func HashPassword(password string) (string, error) {
+	raw := make([]byte, 16)
+	if _, err := rand.Read(raw); err != nil {
+		return "", fmt.Errorf("failed to generate salt: %v", err)
+	}
+
+	salt := make([]byte, len(raw))
+	for i, b := range raw {
+		salt[i] = cryptAlphabet[int(b)%len(cryptAlphabet)]
+	}
+	return SHA512Crypt(password, string(salt)), nil
+}
+
+/*
+SHA512Crypt implements the glibc sha512-crypt scheme with the default 5000 rounds - the same
+hash `openssl passwd -6 -salt <salt>` and mkpasswd produce.
+
+See: https://www.akkadia.org/drepper/SHA-crypt.txt
+*/
+func SHA512Crypt(password, salt string) string {
+	const rounds = 5000
+
+	if len(salt) > 16 {
+		salt = salt[:16]
+	}
+	p, s := []byte(password), []byte(salt)
+
+	alt := sha512.New()
+	alt.Write(p)
+	alt.Write(s)
+	alt.Write(p)
+	altSum := alt.Sum(nil)
+
+	a := sha512.New()
+	a.Write(p)
+	a.Write(s)
+	a.Write(repeatTo(altSum, len(p)))
+	for i := len(p); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			a.Write(altSum)
+		} else {
+			a.Write(p)
+		}
+	}
+	sum := a.Sum(nil)
+
+	dp := sha512.New()
+	for range p {
+		dp.Write(p)
+	}
+	pSeq := repeatTo(dp.Sum(nil), len(p))
+
+	ds := sha512.New()
+	for i := 0; i < 16+int(sum[0]); i++ {
+		ds.Write(s)
+	}
+	sSeq := repeatTo(ds.Sum(nil), len(s))
+
+	for i := 0; i < rounds; i++ {
+		c := sha512.New()
+		if i&1 != 0 {
+			c.Write(pSeq)
+		} else {
+			c.Write(sum)
+		}
+		if i%3 != 0 {
+			c.Write(sSeq)
+		}
+		if i%7 != 0 {
+			c.Write(pSeq)
+		}
+		if i&1 != 0 {
+			c.Write(sum)
+		} else {
+			c.Write(pSeq)
+		}
+		sum = c.Sum(nil)
+	}
+
+	var out strings.Builder
+	out.WriteString("$6$" + salt + "$")
+	for i := 0; i < 21; i++ {
+		// bytes are taken 21 apart - (0,21,42) (22,43,1) (44,2,23) ...
+		x := i * 22 % 63
+		encode24(&out, sum[x], sum[(x+21)%63], sum[(x+42)%63], 4)
+	}
+	encode24(&out, 0, 0, sum[63], 2)
+
+	return out.String()
+}
+
+// repeatTo repeats digest up to n bytes
+func repeatTo(digest []byte, n int) []byte {
+	out := make([]byte, 0, n)
+	for len(out)+len(digest) <= n {
+		out = append(out, digest...)
+	}
+	return append(out, digest[:n-len(out)]...)
+}
+
+func encode24(out *strings.Builder, b2, b1, b0 byte, n int) {
+	w := uint(b2)<<16 | uint(b1)<<8 | uint(b0)
+	for ; n > 0; n-- {
+		out.WriteByte(cryptAlphabet[w&0x3f])
+		w >>= 6
+	}
+}
@@ -0,0 +1,219 @@
+package coreos
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"kvmgo/constants"
+
+	"gopkg.in/yaml.v2"
+)
+
+// IgnitionVersion is the spec the configs are written against - understood by current
+// Fedora CoreOS and Flatcar releases alike
+const IgnitionVersion = "3.3.0"
+
+/*
+Config is the subset of the Ignition v3 spec kvmetal generates - users, files and systemd units.
+
+	{
+	  "ignition": {"version": "3.3.0"},
+	  "passwd": {"users": [{"name": "ubuntu", "sshAuthorizedKeys": ["ssh-ed25519 ..."]}]},
+	  "storage": {"files": [{"path": "/etc/hostname", "mode": 420, "contents": {"source": "data:;base64,..."}}]},
+	  "systemd": {"units": [{"name": "kubelet.service", "enabled": true, "contents": "[Unit]..."}]}
+	}
+*/
+type Config struct {
+	Ignition Ignition `json:"ignition"`
+	Passwd   Passwd   `json:"passwd"`
+	Storage  Storage  `json:"storage"`
+	Systemd  Systemd  `json:"systemd"`
+}
+
+type Ignition struct {
+	Version string `json:"version"`
+}
+
+type Passwd struct {
+	Users []User `json:"users,omitempty"`
+}
+
+type User struct {
+	Name              string   `json:"name"`
+	PasswordHash      string   `json:"passwordHash,omitempty"`
+	SSHAuthorizedKeys []string `json:"sshAuthorizedKeys,omitempty"`
+	Groups            []string `json:"groups,omitempty"`
+}
+
+type Storage struct {
+	Files []File `json:"files,omitempty"`
+}
+
+// File is written before the switch to the real root - Contents is the plain file content
+type File struct {
+	Path      string
+	Mode      int
+	Overwrite bool
+	Contents  string
+}
+
+type Systemd struct {
+	Units []Unit `json:"units,omitempty"`
+}
+
+type Unit struct {
+	Name     string   `json:"name"`
+	Enabled  *bool    `json:"enabled,omitempty"`
+	Contents string   `json:"contents,omitempty"`
+	Dropins  []Dropin `json:"dropins,omitempty"`
+}
+
+type Dropin struct {
+	Name     string `json:"name"`
+	Contents string `json:"contents,omitempty"`
+}
+
+// ignitionFile is File as the spec encodes it - contents are a data url
+type ignitionFile struct {
+	Path      string `json:"path"`
+	Mode      int    `json:"mode,omitempty"`
+	Overwrite bool   `json:"overwrite,omitempty"`
+	Contents  struct {
+		Source string `json:"source"`
+	} `json:"contents"`
+}
+
+func (f File) MarshalJSON() ([]byte, error) {
+	out := ignitionFile{Path: f.Path, Mode: f.Mode, Overwrite: f.Overwrite}
+	out.Contents.Source = DataURL(f.Contents)
+	return json.Marshal(out)
+}
+
+func (f *File) UnmarshalJSON(data []byte) error {
+	var in ignitionFile
+	if err := json.Unmarshal(data, &in); err != nil {
+		return err
+	}
+	contents, err := decodeDataURL(in.Contents.Source)
+	if err != nil {
+		return fmt.Errorf("file %s: %v", in.Path, err)
+	}
+	*f = File{Path: in.Path, Mode: in.Mode, Overwrite: in.Overwrite, Contents: contents}
+	return nil
+}
+
+// DataURL encodes file contents the way Ignition expects them inline
+func DataURL(contents string) string {
+	return "data:;base64," + base64.StdEncoding.EncodeToString([]byte(contents))
+}
+
+func decodeDataURL(source string) (string, error) {
+	encoded, ok := strings.CutPrefix(source, "data:;base64,")
+	if !ok {
+		return "", fmt.Errorf("unsupported contents source %q - only base64 data urls are read back", source)
+	}
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", fmt.Errorf("failed to decode contents: %v", err)
+	}
+	return string(data), nil
+}
+
+// JSON renders the config passed to the guest through fw_cfg
+func (c *Config) JSON() (string, error) {
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal ignition config: %v", err)
+	}
+	return string(data), nil
+}
+
+// Butane variants for the same Ignition spec version
+var butaneVariants = map[constants.Distro]struct{ variant, version string }{
+	constants.FedoraCoreOS: {"fcos", "1.4.0"},
+	constants.Flatcar:      {"flatcar", "1.0.0"},
+}
+
+type butaneConfig struct {
+	Variant string        `yaml:"variant"`
+	Version string        `yaml:"version"`
+	Passwd  butanePasswd  `yaml:"passwd,omitempty"`
+	Storage butaneStorage `yaml:"storage,omitempty"`
+	Systemd butaneSystemd `yaml:"systemd,omitempty"`
+}
+
+type butanePasswd struct {
+	Users []butaneUser `yaml:"users,omitempty"`
+}
+
+type butaneUser struct {
+	Name              string   `yaml:"name"`
+	PasswordHash      string   `yaml:"password_hash,omitempty"`
+	SSHAuthorizedKeys []string `yaml:"ssh_authorized_keys,omitempty"`
+	Groups            []string `yaml:"groups,omitempty"`
+}
+
+type butaneStorage struct {
+	Files []butaneFile `yaml:"files,omitempty"`
+}
+
+type butaneFile struct {
+	Path      string `yaml:"path"`
+	Mode      int    `yaml:"mode,omitempty"`
+	Overwrite bool   `yaml:"overwrite,omitempty"`
+	Contents  struct {
+		Inline string `yaml:"inline"`
+	} `yaml:"contents"`
+}
+
+type butaneSystemd struct {
+	Units []butaneUnit `yaml:"units,omitempty"`
+}
+
+type butaneUnit struct {
+	Name     string         `yaml:"name"`
+	Enabled  *bool          `yaml:"enabled,omitempty"`
+	Contents string         `yaml:"contents,omitempty"`
+	Dropins  []butaneDropin `yaml:"dropins,omitempty"`
+}
+
+type butaneDropin struct {
+	Name     string `yaml:"name"`
+	Contents string `yaml:"contents,omitempty"`
+}
+
+/*
+Butane renders the config as Butane yaml for the distro's variant - `butane --strict` turns it back into
+the Ignition JSON. Modes are written in decimal (420 is 0644).
+*/
+func (c *Config) Butane(distro constants.Distro) (string, error) {
+	v, ok := butaneVariants[distro]
+	if !ok {
+		return "", fmt.Errorf("no butane variant for %s", distro)
+	}
+
+	out := butaneConfig{Variant: v.variant, Version: v.version}
+	for _, u := range c.Passwd.Users {
+		out.Passwd.Users = append(out.Passwd.Users, butaneUser(u))
+	}
+	for _, f := range c.Storage.Files {
+		file := butaneFile{Path: f.Path, Mode: f.Mode, Overwrite: f.Overwrite}
+		file.Contents.Inline = f.Contents
+		out.Storage.Files = append(out.Storage.Files, file)
+	}
+	for _, u := range c.Systemd.Units {
+		unit := butaneUnit{Name: u.Name, Enabled: u.Enabled, Contents: u.Contents}
+		for _, d := range u.Dropins {
+			unit.Dropins = append(unit.Dropins, butaneDropin(d))
+		}
+		out.Systemd.Units = append(out.Systemd.Units, unit)
+	}
+
+	data, err := yaml.Marshal(out)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal butane config: %v", err)
+	}
+	return string(data), nil
+}
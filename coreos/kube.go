@@ -0,0 +1,229 @@
+package coreos
+
+import (
+	"fmt"
+	"strings"
+
+	"kvmgo/constants"
+)
+
+/*
+Kubernetes on the immutable images - /usr is read only, so kubeadm, kubelet and kubectl are
+downloaded into /opt/bin by a oneshot unit on first boot instead of installed from a package repo.
+containerd ships with both images and is pointed at a config with the systemd cgroup driver.
+
+Flex volume plugins default to a path under /usr - kubelet and the controller manager are moved
+to /opt/libexec the same way the Flatcar and Fedora CoreOS docs do it.
+*/
+const flexVolumeDir = "/opt/libexec/kubernetes/kubelet-plugins/volume/exec/"
+
+const kubeModules = `overlay
+br_netfilter
+`
+
+const kubeSysctl = `net.bridge.bridge-nf-call-iptables  = 1
+net.ipv4.ip_forward                 = 1
+net.bridge.bridge-nf-call-ip6tables = 1
+`
+
+const optBinProfile = `export PATH="$PATH:/opt/bin"
+`
+
+const containerdConfig = `version = 2
+
+[plugins."io.containerd.grpc.v1.cri".containerd.runtimes.runc.options]
+  SystemdCgroup = true
+
+[plugins."io.containerd.grpc.v1.cri".cni]
+  bin_dir = "/opt/cni/bin"
+  conf_dir = "/etc/cni/net.d"
+`
+
+// Flatcar reads its bundled containerd config unless told otherwise
+const flatcarContainerdDropin = `[Service]
+Environment=CONTAINERD_CONFIG=/etc/containerd/config.toml
+`
+
+const installKubernetesScript = `#!/bin/bash
+set -euo pipefail
+
+KUBE_VERSION=$(curl -fsSL https://dl.k8s.io/release/stable-1.29.txt)
+CNI_VERSION=v1.4.1
+CRICTL_VERSION=v1.29.0
+ARCH=amd64
+
+# conntrack, socat and ethtool are kubeadm preflight requirements Fedora CoreOS does not ship
+if ! command -v conntrack && command -v rpm-ostree; then
+  rpm-ostree install --idempotent --apply-live --allow-inactive conntrack-tools socat ethtool
+fi
+
+mkdir -p /opt/bin /opt/cni/bin
+curl -fsSL "https://github.com/containernetworking/plugins/releases/download/${CNI_VERSION}/cni-plugins-linux-${ARCH}-${CNI_VERSION}.tgz" | tar -C /opt/cni/bin -xz
+curl -fsSL "https://github.com/kubernetes-sigs/cri-tools/releases/download/${CRICTL_VERSION}/crictl-${CRICTL_VERSION}-linux-${ARCH}.tar.gz" | tar -C /opt/bin -xz
+
+cd /opt/bin
+curl -fsSL --remote-name-all "https://dl.k8s.io/release/${KUBE_VERSION}/bin/linux/${ARCH}/{kubeadm,kubelet,kubectl}"
+chmod +x kubeadm kubelet kubectl
+`
+
+const installKubernetesUnit = `[Unit]
+Description=Install kubeadm, kubelet and kubectl into /opt/bin
+Wants=network-online.target
+After=network-online.target
+ConditionPathExists=!/opt/bin/kubeadm
+
+[Service]
+Type=oneshot
+RemainAfterExit=yes
+ExecStart=/opt/kvmetal/install-kubernetes.sh
+
+[Install]
+WantedBy=multi-user.target
+`
+
+const kubeletUnit = `[Unit]
+Description=kubelet: The Kubernetes Node Agent
+Documentation=https://kubernetes.io/docs/
+Wants=network-online.target containerd.service
+After=network-online.target containerd.service install-kubernetes.service
+Requires=install-kubernetes.service
+
+[Service]
+ExecStart=/opt/bin/kubelet
+Restart=always
+StartLimitInterval=0
+RestartSec=10
+
+[Install]
+WantedBy=multi-user.target
+`
+
+// the drop-in kubeadm's deb and rpm packages install - with the binary in /opt/bin
+const kubeletKubeadmDropin = `[Service]
+Environment="KUBELET_KUBECONFIG_ARGS=--bootstrap-kubeconfig=/etc/kubernetes/bootstrap-kubelet.conf --kubeconfig=/etc/kubernetes/kubelet.conf"
+Environment="KUBELET_CONFIG_ARGS=--config=/var/lib/kubelet/config.yaml"
+EnvironmentFile=-/var/lib/kubelet/kubeadm-flags.env
+EnvironmentFile=-/etc/sysconfig/kubelet
+ExecStart=
+ExecStart=/opt/bin/kubelet $KUBELET_KUBECONFIG_ARGS $KUBELET_CONFIG_ARGS $KUBELET_KUBEADM_ARGS $KUBELET_EXTRA_ARGS
+`
+
+// kubeadm join on workers picks the flex volume dir up from the kubelet config the control plane hands out
+const kubeadmConfig = `apiVersion: kubeadm.k8s.io/v1beta3
+kind: ClusterConfiguration
+networking:
+  podSubnet: 192.168.0.0/16
+controllerManager:
+  extraArgs:
+    flex-volume-plugin-dir: ` + flexVolumeDir + `
+---
+apiVersion: kubelet.config.k8s.io/v1beta1
+kind: KubeletConfiguration
+cgroupDriver: systemd
+volumePluginDir: ` + flexVolumeDir + `
+`
+
+const kubeadmInitUnit = `[Unit]
+Description=Initialize the Kubernetes control plane with kubeadm
+Wants=network-online.target
+After=network-online.target containerd.service install-kubernetes.service
+Requires=install-kubernetes.service
+ConditionPathExists=!/etc/kubernetes/admin.conf
+
+[Service]
+Type=oneshot
+RemainAfterExit=yes
+Environment=PATH=/opt/bin:/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin
+ExecStart=/opt/kvmetal/kubeadm-init.sh
+
+[Install]
+WantedBy=multi-user.target
+`
+
+// calico's manifest mounts the flex volume driver from /usr - rewritten to the /opt path
+const calicoApply = `curl -fsSL https://docs.projectcalico.org/manifests/calico.yaml |
+  sed 's#/usr/libexec/kubernetes/kubelet-plugins/volume/exec#/opt/libexec/kubernetes/kubelet-plugins/volume/exec#' |
+  kubectl apply -f -
+`
+
+const ciliumInstall = `CILIUM_CLI_VERSION=$(curl -fsSL https://raw.githubusercontent.com/cilium/cilium-cli/main/stable.txt)
+curl -fsSL "https://github.com/cilium/cilium-cli/releases/download/${CILIUM_CLI_VERSION}/cilium-linux-amd64.tar.gz" | tar -C /opt/bin -xz
+
+# Allows Scheduling of Pods onto Control Plane
+kubectl taint nodes --all node-role.kubernetes.io/control-plane-
+cilium install --set kubeProxyReplacement=strict
+cilium status --wait
+`
+
+// kubeadmInitScript initializes the control plane and hands admin.conf to the login user
+func kubeadmInitScript(username string, cilium bool) string {
+	initArgs, cni := "", calicoApply
+	if cilium { // cilium replaces kube-proxy
+		initArgs, cni = " --skip-phases=addon/kube-proxy", ciliumInstall
+	}
+
+	return fmt.Sprintf(`#!/bin/bash
+set -euo pipefail
+
+kubeadm init --config /etc/kubernetes/kubeadm.yaml%s | tee /home/%[2]s/kubeadm-init.log
+
+mkdir -p /home/%[2]s/.kube
+cp /etc/kubernetes/admin.conf /home/%[2]s/.kube/config
+chown -R %[2]s: /home/%[2]s/.kube
+export KUBECONFIG=/etc/kubernetes/admin.conf
+
+until kubectl get nodes; do
+  echo "Waiting for Kubernetes API Server to become ready..."
+  sleep 5
+done
+
+%s`, initArgs, username, cni)
+}
+
+// kubeNode is what both control plane and worker nodes need - kubeadm join is left to kvmetal
+func (c *ConfigBuilder) kubeNode(cfg *Config) {
+	cfg.Storage.Files = append(cfg.Storage.Files,
+		File{Path: "/etc/modules-load.d/k8s.conf", Mode: 0o644, Contents: kubeModules},
+		File{Path: "/etc/sysctl.d/k8s.conf", Mode: 0o644, Contents: kubeSysctl},
+		File{Path: "/etc/profile.d/opt-bin.sh", Mode: 0o644, Contents: optBinProfile},
+		File{Path: "/etc/containerd/config.toml", Mode: 0o644, Overwrite: true, Contents: containerdConfig},
+		File{Path: "/opt/kvmetal/install-kubernetes.sh", Mode: 0o755, Contents: installKubernetesScript},
+	)
+
+	containerd := Unit{Name: "containerd.service", Enabled: enabled()}
+	if c.distro == constants.Flatcar {
+		containerd.Dropins = []Dropin{{Name: "10-use-custom-config.conf", Contents: flatcarContainerdDropin}}
+	}
+
+	cfg.Systemd.Units = append(cfg.Systemd.Units,
+		containerd,
+		Unit{Name: "install-kubernetes.service", Enabled: enabled(), Contents: installKubernetesUnit},
+		Unit{
+			Name:     "kubelet.service",
+			Enabled:  enabled(),
+			Contents: kubeletUnit,
+			Dropins:  []Dropin{{Name: "10-kubeadm.conf", Contents: kubeletKubeadmDropin}},
+		},
+	)
+}
+
+func (c *ConfigBuilder) kubeControlPlane(cfg *Config, cilium bool) {
+	c.kubeNode(cfg)
+
+	cfg.Storage.Files = append(cfg.Storage.Files,
+		File{Path: "/etc/kubernetes/kubeadm.yaml", Mode: 0o644, Contents: kubeadmConfig},
+		File{Path: "/opt/kvmetal/kubeadm-init.sh", Mode: 0o755, Contents: kubeadmInitScript(c.username, cilium)},
+	)
+	cfg.Systemd.Units = append(cfg.Systemd.Units,
+		Unit{Name: "kubeadm-init.service", Enabled: enabled(), Contents: kubeadmInitUnit})
+}
+
+// hasUnit reports whether a unit was already added by another dependency
+func hasUnit(cfg *Config, name string) bool {
+	for _, u := range cfg.Systemd.Units {
+		if strings.EqualFold(u.Name, name) {
+			return true
+		}
+	}
+	return false
+}
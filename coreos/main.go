@@ -1,5 +0,0 @@
-package coreos
-
-func main() {
-	// url := "https://fedoraproject.org/fedora.gpg"
-}
@@ -0,0 +1,176 @@
+package daemon
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+
+	"kvmgo/jobs"
+	"kvmgo/network"
+	"kvmgo/types/nic"
+	kvm "kvmgo/vm"
+)
+
+/*
+kvmetald - HTTP+JSON API over a unix socket for VM lifecycle, port exposure, snapshots and clusters.
+
+The daemon owns one libvirt connection and runs every operation in process - dashboards and CI
+jobs request environments with curl, the kvmetal CLI talks to it through Client whenever the
+socket answers.
+
+	GET    /v1/health
+	GET    /v1/vms
+	POST   /v1/vms[?async=true]                      CreateVMRequest - async answers 202 with the launch Job
+	GET    /v1/vms/{name}
+	DELETE /v1/vms/{name}[?dry_run=true]
+	GET    /v1/vms/{name}/ip
+	POST   /v1/vms/{name}/expose                     ExposeRequest
+	DELETE /v1/vms/{name}/expose[?hostport=9094&protocol=tcp]
+	GET    /v1/vms/{name}/snapshots
+	POST   /v1/vms/{name}/snapshots                  SnapshotRequest
+	POST   /v1/vms/{name}/snapshots/{snapshot}/revert
+	DELETE /v1/vms/{name}/snapshots/{snapshot}
+	POST   /v1/clusters                              ClusterRequest
+	POST   /v1/clusters/join                         JoinRequest
+	GET    /v1/clusters/status[?nodes=control,worker]
+	GET    /v1/jobs
+	GET    /v1/jobs/{id}
+	DELETE /v1/jobs/{id}                             cancels the job
+	GET    /v1/jobs/{id}/events                      newline delimited jobs.Event, replayed then followed
+
+Errors are returned as {"error": "..."} with 400 for invalid requests, 404 when the VM or
+snapshot does not exist and 409 while another operation holds the VM.
+
+Usage:
+
+	curl --unix-socket $XDG_RUNTIME_DIR/kvmetal/kvmetald.sock http://kvmetald/v1/vms
+	curl --unix-socket ... -X POST -d '{"name":"ci-1","preset":"kafka","cpu":4,"memory":8192}' http://kvmetald/v1/vms
+	curl --unix-socket ... -N http://kvmetald/v1/jobs/4f1c2a9e7b3d/events
+*/
+type Backend interface {
+	ListVMs(ctx context.Context) ([]kvm.VMStatus, error)
+	GetVM(ctx context.Context, name string) (*kvm.VMStatus, error)
+	CreateVM(ctx context.Context, req CreateVMRequest) (*CreateVMResponse, error)
+	DeleteVM(ctx context.Context, name string, dryRun bool) (*kvm.Plan, error)
+	VMAddress(ctx context.Context, name string) (*VMAddress, error)
+
+	Expose(ctx context.Context, req ExposeRequest) error
+	Unexpose(ctx context.Context, name string, hostPort int, protocol string) error
+
+	ListSnapshots(ctx context.Context, vm string) ([]kvm.SnapshotInfo, error)
+	CreateSnapshot(ctx context.Context, vm string, req SnapshotRequest) error
+	RevertSnapshot(ctx context.Context, vm, snapshot string) error
+	DeleteSnapshot(ctx context.Context, vm, snapshot string) error
+
+	CreateCluster(ctx context.Context, req ClusterRequest) ([]*kvm.Plan, error)
+	JoinCluster(ctx context.Context, nodes []string) error
+	ClusterStatus(ctx context.Context, nodes []string) ([]kvm.VMStatus, error)
+
+	// SubmitVM starts a launch in the background - follow it with WatchJob
+	SubmitVM(ctx context.Context, req CreateVMRequest) (*jobs.Job, error)
+	ListJobs(ctx context.Context) ([]jobs.Job, error)
+	GetJob(ctx context.Context, id string) (*jobs.Job, error)
+	CancelJob(ctx context.Context, id string) error
+	// WatchJob calls fn with the job's events, past ones first, until it finishes
+	WatchJob(ctx context.Context, id string, fn func(jobs.Event) error) error
+}
+
+var (
+	// ErrNotFound - the VM, snapshot or image does not exist (404)
+	ErrNotFound = errors.New("not found")
+	// ErrInvalid - the request is malformed (400)
+	ErrInvalid = errors.New("invalid request")
+)
+
+// Error is a failed API call as seen by Client - errors.Is matches ErrNotFound and ErrInvalid by status
+type Error struct {
+	Status  int
+	Message string
+}
+
+func (e *Error) Error() string { return e.Message }
+
+func (e *Error) Is(target error) bool {
+	switch target {
+	case ErrNotFound:
+		return e.Status == http.StatusNotFound
+	case ErrInvalid:
+		return e.Status == http.StatusBadRequest
+	}
+	return false
+}
+
+/*
+CreateVMRequest launches a VM. Files travel as their contents - the daemon runs as root and never
+opens a path a client names.
+*/
+type CreateVMRequest struct {
+	Name       string `json:"name"` // ValidVMName
+	Preset     string `json:"preset,omitempty"`
+	Distro     string `json:"distro,omitempty"` // ubuntu when empty
+	CPU        int    `json:"cpu,omitempty"`
+	Memory     int    `json:"memory,omitempty"`
+	Userdata   string `json:"userdata,omitempty"` // cloud-config merged over the preset's
+	BootScript string `json:"boot_script,omitempty"`
+	DryRun     bool   `json:"dry_run,omitempty"`
+	// Interfaces replace the single DHCP NIC on network=default
+	Interfaces []nic.Interface `json:"interfaces,omitempty"`
+	// KeepOnFailure leaves a failed launch's disks, artifacts and domain in place instead of rolling back
+	KeepOnFailure bool `json:"keep_on_failure,omitempty"`
+}
+
+var vmName = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*$`)
+
+// ValidVMName rejects names that are not safe in image, artifact and /mnt paths
+func ValidVMName(name string) error {
+	if !vmName.MatchString(name) {
+		return fmt.Errorf("%w: invalid VM name %q - use lowercase letters, digits and dashes", ErrInvalid, name)
+	}
+	return nil
+}
+
+// CreateVMResponse holds the plan for a dry run, otherwise the launched VM
+type CreateVMResponse struct {
+	Plan *kvm.Plan     `json:"plan,omitempty"`
+	VM   *kvm.VMStatus `json:"vm,omitempty"`
+}
+
+// VMAddress is the result of vm ip and --getip - IP is the address to connect to, Addresses all of them
+type VMAddress struct {
+	VM     string `json:"vm"`
+	IP     string `json:"ip"`
+	HostIP string `json:"host_ip"`
+
+	Addresses []network.InterfaceAddress `json:"addresses,omitempty"`
+}
+
+// ExposeRequest is a port forward requested with --expose-vm, net expose or POST /v1/vms/{name}/expose.
+// Maps holds --map specs such as 8000-8010:9000-9010/tcp, forwarded along with Port and HostPort.
+type ExposeRequest struct {
+	VM         string   `json:"vm"`
+	Port       int      `json:"port,omitempty"`
+	HostPort   int      `json:"hostport,omitempty"`
+	Maps       []string `json:"maps,omitempty"`
+	ExternalIP string   `json:"external_ip,omitempty"`
+	Protocol   string   `json:"protocol,omitempty"`
+}
+
+// SnapshotRequest names a new snapshot
+type SnapshotRequest struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+}
+
+// ClusterRequest launches a control plane and workers and joins them - DryRun returns the plans
+type ClusterRequest struct {
+	Control string   `json:"control"`
+	Workers []string `json:"workers"`
+	DryRun  bool     `json:"dry_run,omitempty"`
+}
+
+// JoinRequest joins running workers to nodes[0]
+type JoinRequest struct {
+	Nodes []string `json:"nodes"`
+}
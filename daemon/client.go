@@ -0,0 +1,262 @@
+package daemon
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"kvmgo/jobs"
+	kvm "kvmgo/vm"
+)
+
+// Client calls kvmetald over its unix socket - it implements Backend so the CLI can use either
+type Client struct {
+	Socket string
+	http   *http.Client
+}
+
+/*
+NewClient returns a client for the daemon at socket - no connection is made until the first call.
+
+Usage:
+
+	c := daemon.NewClient(config.Current().Socket)
+	if c.Available(ctx) {
+		vms, err := c.ListVMs(ctx)
+	}
+*/
+func NewClient(socket string) *Client {
+	dialer := &net.Dialer{Timeout: 2 * time.Second}
+	return &Client{
+		Socket: socket,
+		http: &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					return dialer.DialContext(ctx, "unix", socket)
+				},
+			},
+		},
+	}
+}
+
+// Available reports whether a daemon answers on the socket
+func (c *Client) Available(ctx context.Context) bool {
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	return c.do(ctx, http.MethodGet, "/v1/health", nil, nil) == nil
+}
+
+func (c *Client) do(ctx context.Context, method, path string, body, out any) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return fmt.Errorf("failed to marshal request: %v", err)
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	// the host is ignored - every request goes to the socket
+	req, err := http.NewRequestWithContext(ctx, method, "http://kvmetald"+path, reader)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to reach kvmetald at %s: %v", c.Socket, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		return responseError(resp)
+	}
+
+	if out == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("failed to decode kvmetald response: %v", err)
+	}
+	return nil
+}
+
+// responseError turns an error response into *Error
+func responseError(resp *http.Response) error {
+	var apiErr struct {
+		Error string `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&apiErr); err != nil || apiErr.Error == "" {
+		apiErr.Error = resp.Status
+	}
+	return &Error{Status: resp.StatusCode, Message: apiErr.Error}
+}
+
+func vmPath(name string, parts ...string) string {
+	segments := append([]string{"/v1/vms", url.PathEscape(name)}, parts...)
+	return strings.Join(segments, "/")
+}
+
+func (c *Client) ListVMs(ctx context.Context) ([]kvm.VMStatus, error) {
+	var vms []kvm.VMStatus
+	return vms, c.do(ctx, http.MethodGet, "/v1/vms", nil, &vms)
+}
+
+func (c *Client) GetVM(ctx context.Context, name string) (*kvm.VMStatus, error) {
+	var vm kvm.VMStatus
+	if err := c.do(ctx, http.MethodGet, vmPath(name), nil, &vm); err != nil {
+		return nil, err
+	}
+	return &vm, nil
+}
+
+func (c *Client) CreateVM(ctx context.Context, req CreateVMRequest) (*CreateVMResponse, error) {
+	var resp CreateVMResponse
+	if err := c.do(ctx, http.MethodPost, "/v1/vms", req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+func (c *Client) DeleteVM(ctx context.Context, name string, dryRun bool) (*kvm.Plan, error) {
+	path := vmPath(name)
+	if dryRun {
+		path += "?dry_run=true"
+	}
+
+	var plan *kvm.Plan
+	if err := c.do(ctx, http.MethodDelete, path, nil, &plan); err != nil {
+		return nil, err
+	}
+	return plan, nil
+}
+
+func (c *Client) VMAddress(ctx context.Context, name string) (*VMAddress, error) {
+	var addr VMAddress
+	if err := c.do(ctx, http.MethodGet, vmPath(name, "ip"), nil, &addr); err != nil {
+		return nil, err
+	}
+	return &addr, nil
+}
+
+func (c *Client) Expose(ctx context.Context, req ExposeRequest) error {
+	return c.do(ctx, http.MethodPost, vmPath(req.VM, "expose"), req, nil)
+}
+
+func (c *Client) Unexpose(ctx context.Context, name string, hostPort int, protocol string) error {
+	query := url.Values{"protocol": {protocol}}
+	if hostPort != 0 {
+		query.Set("hostport", strconv.Itoa(hostPort))
+	}
+	return c.do(ctx, http.MethodDelete, vmPath(name, "expose")+"?"+query.Encode(), nil, nil)
+}
+
+func (c *Client) ListSnapshots(ctx context.Context, vm string) ([]kvm.SnapshotInfo, error) {
+	var snaps []kvm.SnapshotInfo
+	return snaps, c.do(ctx, http.MethodGet, vmPath(vm, "snapshots"), nil, &snaps)
+}
+
+func (c *Client) CreateSnapshot(ctx context.Context, vm string, req SnapshotRequest) error {
+	return c.do(ctx, http.MethodPost, vmPath(vm, "snapshots"), req, nil)
+}
+
+func (c *Client) RevertSnapshot(ctx context.Context, vm, snapshot string) error {
+	return c.do(ctx, http.MethodPost, vmPath(vm, "snapshots", url.PathEscape(snapshot), "revert"), nil, nil)
+}
+
+func (c *Client) DeleteSnapshot(ctx context.Context, vm, snapshot string) error {
+	return c.do(ctx, http.MethodDelete, vmPath(vm, "snapshots", url.PathEscape(snapshot)), nil, nil)
+}
+
+func (c *Client) CreateCluster(ctx context.Context, req ClusterRequest) ([]*kvm.Plan, error) {
+	var plans []*kvm.Plan
+	return plans, c.do(ctx, http.MethodPost, "/v1/clusters", req, &plans)
+}
+
+func (c *Client) JoinCluster(ctx context.Context, nodes []string) error {
+	return c.do(ctx, http.MethodPost, "/v1/clusters/join", JoinRequest{Nodes: nodes}, nil)
+}
+
+func (c *Client) ClusterStatus(ctx context.Context, nodes []string) ([]kvm.VMStatus, error) {
+	path := "/v1/clusters/status"
+	if len(nodes) > 0 {
+		path += "?" + url.Values{"nodes": {strings.Join(nodes, ",")}}.Encode()
+	}
+
+	var status []kvm.VMStatus
+	return status, c.do(ctx, http.MethodGet, path, nil, &status)
+}
+
+func (c *Client) SubmitVM(ctx context.Context, req CreateVMRequest) (*jobs.Job, error) {
+	var job jobs.Job
+	if err := c.do(ctx, http.MethodPost, "/v1/vms?async=true", req, &job); err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+func (c *Client) ListJobs(ctx context.Context) ([]jobs.Job, error) {
+	var list []jobs.Job
+	return list, c.do(ctx, http.MethodGet, "/v1/jobs", nil, &list)
+}
+
+func (c *Client) GetJob(ctx context.Context, id string) (*jobs.Job, error) {
+	var job jobs.Job
+	if err := c.do(ctx, http.MethodGet, "/v1/jobs/"+url.PathEscape(id), nil, &job); err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+func (c *Client) CancelJob(ctx context.Context, id string) error {
+	return c.do(ctx, http.MethodDelete, "/v1/jobs/"+url.PathEscape(id), nil, nil)
+}
+
+// WatchJob reads the event stream - it ends with the job's final event or when ctx is cancelled
+func (c *Client) WatchJob(ctx context.Context, id string, fn func(jobs.Event) error) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://kvmetald/v1/jobs/"+url.PathEscape(id)+"/events", nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to reach kvmetald at %s: %v", c.Socket, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		return responseError(resp)
+	}
+
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var ev jobs.Event
+		if err := dec.Decode(&ev); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if err == io.EOF {
+				return fmt.Errorf("event stream for job %s ended before the job finished", id)
+			}
+			return fmt.Errorf("failed to decode job event: %v", err)
+		}
+		if err := fn(ev); err != nil {
+			return err
+		}
+		if ev.Final() {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,434 @@
+package daemon
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"kvmgo/jobs"
+)
+
+// Server serves a Backend on a unix socket
+type Server struct {
+	Socket  string
+	backend Backend
+
+	mu    sync.Mutex
+	busy  map[string]bool // VMs with a mutating operation in flight
+	start time.Time
+	ctx   context.Context // outlives requests - async launches are released under it
+}
+
+/*
+NewServer wraps backend - ListenAndServe binds the socket.
+
+Usage:
+
+	srv := daemon.NewServer(cli.LocalBackend(ctx, &wg), config.Current().Socket)
+	err := srv.ListenAndServe(ctx)
+*/
+func NewServer(backend Backend, socket string) *Server {
+	return &Server{
+		Socket:  socket,
+		backend: backend,
+		busy:    make(map[string]bool),
+		ctx:     context.Background(),
+	}
+}
+
+// Handler routes the API - exposed so it can be served on a test listener
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("GET /v1/health", s.health)
+
+	mux.HandleFunc("GET /v1/vms", s.listVMs)
+	mux.HandleFunc("POST /v1/vms", s.createVM)
+	mux.HandleFunc("GET /v1/vms/{name}", s.getVM)
+	mux.HandleFunc("DELETE /v1/vms/{name}", s.deleteVM)
+	mux.HandleFunc("GET /v1/vms/{name}/ip", s.vmAddress)
+
+	mux.HandleFunc("POST /v1/vms/{name}/expose", s.expose)
+	mux.HandleFunc("DELETE /v1/vms/{name}/expose", s.unexpose)
+
+	mux.HandleFunc("GET /v1/vms/{name}/snapshots", s.listSnapshots)
+	mux.HandleFunc("POST /v1/vms/{name}/snapshots", s.createSnapshot)
+	mux.HandleFunc("POST /v1/vms/{name}/snapshots/{snapshot}/revert", s.revertSnapshot)
+	mux.HandleFunc("DELETE /v1/vms/{name}/snapshots/{snapshot}", s.deleteSnapshot)
+
+	mux.HandleFunc("POST /v1/clusters", s.createCluster)
+	mux.HandleFunc("POST /v1/clusters/join", s.joinCluster)
+	mux.HandleFunc("GET /v1/clusters/status", s.clusterStatus)
+
+	mux.HandleFunc("GET /v1/jobs", s.listJobs)
+	mux.HandleFunc("GET /v1/jobs/{id}", s.getJob)
+	mux.HandleFunc("DELETE /v1/jobs/{id}", s.cancelJob)
+	mux.HandleFunc("GET /v1/jobs/{id}/events", s.jobEvents)
+
+	return mux
+}
+
+/*
+ListenAndServe binds the socket (replacing a stale one) and serves until ctx is cancelled.
+
+The socket is created 0660 - add CI users to the daemon's group rather than running them with sudo.
+*/
+func (s *Server) ListenAndServe(ctx context.Context) error {
+	if err := os.MkdirAll(filepath.Dir(s.Socket), 0o755); err != nil {
+		return fmt.Errorf("failed to create socket dir: %v", err)
+	}
+
+	// a socket nothing answers on is left over from a previous run
+	if conn, err := net.DialTimeout("unix", s.Socket, time.Second); err == nil {
+		conn.Close()
+		return fmt.Errorf("kvmetald is already listening on %s", s.Socket)
+	}
+	if err := os.Remove(s.Socket); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove stale socket %s: %v", s.Socket, err)
+	}
+
+	listener, err := net.Listen("unix", s.Socket)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %v", s.Socket, err)
+	}
+	if err := os.Chmod(s.Socket, 0o660); err != nil {
+		listener.Close()
+		return fmt.Errorf("failed to set socket permissions: %v", err)
+	}
+
+	s.start, s.ctx = time.Now(), ctx
+	srv := &http.Server{
+		Handler:           s.Handler(),
+		ReadHeaderTimeout: 10 * time.Second,
+		BaseContext:       func(net.Listener) context.Context { return ctx },
+	}
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+
+	log.Printf("kvmetald listening on %s", s.Socket)
+	err = srv.Serve(listener)
+	os.Remove(s.Socket)
+
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+// acquire marks vm busy - false when another mutating request holds it
+func (s *Server) acquire(vm string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.busy[vm] {
+		return false
+	}
+	s.busy[vm] = true
+	return true
+}
+
+func (s *Server) release(vm string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.busy, vm)
+}
+
+// exclusive runs fn for the VMs named by the request, rejecting it with 409 if any are busy
+func (s *Server) exclusive(w http.ResponseWriter, vms []string, fn func()) {
+	var held []string
+	defer func() {
+		for _, vm := range held {
+			s.release(vm)
+		}
+	}()
+
+	for _, vm := range vms {
+		if !s.acquire(vm) {
+			writeJSON(w, http.StatusConflict, map[string]string{"error": fmt.Sprintf("an operation on %s is already in progress", vm)})
+			return
+		}
+		held = append(held, vm)
+	}
+	fn()
+}
+
+func (s *Server) health(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok", "uptime": time.Since(s.start).Round(time.Second).String()})
+}
+
+func (s *Server) listVMs(w http.ResponseWriter, r *http.Request) {
+	vms, err := s.backend.ListVMs(r.Context())
+	respond(w, http.StatusOK, vms, err)
+}
+
+func (s *Server) getVM(w http.ResponseWriter, r *http.Request) {
+	vm, err := s.backend.GetVM(r.Context(), r.PathValue("name"))
+	respond(w, http.StatusOK, vm, err)
+}
+
+func (s *Server) createVM(w http.ResponseWriter, r *http.Request) {
+	var req CreateVMRequest
+	if !decode(w, r, &req) {
+		return
+	}
+	if err := ValidVMName(req.Name); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	if r.URL.Query().Get("async") == "true" {
+		s.submitVM(w, r, req)
+		return
+	}
+
+	s.exclusive(w, []string{req.Name}, func() {
+		resp, err := s.backend.CreateVM(r.Context(), req)
+		status := http.StatusCreated
+		if req.DryRun {
+			status = http.StatusOK
+		}
+		respond(w, status, resp, err)
+	})
+}
+
+// submitVM starts the launch as a job - the VM stays busy until the job finishes, not until the response
+func (s *Server) submitVM(w http.ResponseWriter, r *http.Request, req CreateVMRequest) {
+	if !s.acquire(req.Name) {
+		writeJSON(w, http.StatusConflict, map[string]string{"error": fmt.Sprintf("an operation on %s is already in progress", req.Name)})
+		return
+	}
+
+	job, err := s.backend.SubmitVM(r.Context(), req)
+	if err != nil {
+		s.release(req.Name)
+		writeError(w, err)
+		return
+	}
+
+	go func() {
+		defer s.release(req.Name)
+		if err := s.backend.WatchJob(s.ctx, job.ID, func(jobs.Event) error { return nil }); err != nil {
+			log.Printf("Stopped following job %s for %s ERROR:%s", job.ID, req.Name, err)
+		}
+	}()
+
+	w.Header().Set("Location", "/v1/jobs/"+job.ID)
+	writeJSON(w, http.StatusAccepted, job)
+}
+
+func (s *Server) deleteVM(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	dryRun := r.URL.Query().Get("dry_run") == "true"
+
+	s.exclusive(w, []string{name}, func() {
+		plan, err := s.backend.DeleteVM(r.Context(), name, dryRun)
+		respond(w, http.StatusOK, plan, err)
+	})
+}
+
+func (s *Server) vmAddress(w http.ResponseWriter, r *http.Request) {
+	addr, err := s.backend.VMAddress(r.Context(), r.PathValue("name"))
+	respond(w, http.StatusOK, addr, err)
+}
+
+func (s *Server) expose(w http.ResponseWriter, r *http.Request) {
+	var req ExposeRequest
+	if !decode(w, r, &req) {
+		return
+	}
+	req.VM = r.PathValue("name")
+
+	s.exclusive(w, []string{req.VM}, func() {
+		respond(w, http.StatusOK, req, s.backend.Expose(r.Context(), req))
+	})
+}
+
+func (s *Server) unexpose(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	query := r.URL.Query()
+
+	hostPort := 0
+	if hp := query.Get("hostport"); hp != "" {
+		var err error
+		if hostPort, err = strconv.Atoi(hp); err != nil {
+			writeError(w, fmt.Errorf("%w: hostport %q is not a number", ErrInvalid, hp))
+			return
+		}
+	}
+	protocol := query.Get("protocol")
+	if protocol == "" {
+		protocol = "tcp"
+	}
+
+	s.exclusive(w, []string{name}, func() {
+		respond(w, http.StatusOK, map[string]string{"vm": name}, s.backend.Unexpose(r.Context(), name, hostPort, protocol))
+	})
+}
+
+func (s *Server) listSnapshots(w http.ResponseWriter, r *http.Request) {
+	snaps, err := s.backend.ListSnapshots(r.Context(), r.PathValue("name"))
+	respond(w, http.StatusOK, snaps, err)
+}
+
+func (s *Server) createSnapshot(w http.ResponseWriter, r *http.Request) {
+	var req SnapshotRequest
+	if !decode(w, r, &req) {
+		return
+	}
+	if req.Name == "" {
+		writeError(w, fmt.Errorf("%w: snapshot name is required", ErrInvalid))
+		return
+	}
+
+	name := r.PathValue("name")
+	s.exclusive(w, []string{name}, func() {
+		respond(w, http.StatusCreated, req, s.backend.CreateSnapshot(r.Context(), name, req))
+	})
+}
+
+func (s *Server) revertSnapshot(w http.ResponseWriter, r *http.Request) {
+	name, snapshot := r.PathValue("name"), r.PathValue("snapshot")
+	s.exclusive(w, []string{name}, func() {
+		respond(w, http.StatusOK, map[string]string{"vm": name, "snapshot": snapshot}, s.backend.RevertSnapshot(r.Context(), name, snapshot))
+	})
+}
+
+func (s *Server) deleteSnapshot(w http.ResponseWriter, r *http.Request) {
+	name, snapshot := r.PathValue("name"), r.PathValue("snapshot")
+	s.exclusive(w, []string{name}, func() {
+		respond(w, http.StatusOK, map[string]string{"vm": name, "snapshot": snapshot}, s.backend.DeleteSnapshot(r.Context(), name, snapshot))
+	})
+}
+
+func (s *Server) createCluster(w http.ResponseWriter, r *http.Request) {
+	var req ClusterRequest
+	if !decode(w, r, &req) {
+		return
+	}
+	if req.Control == "" || len(req.Workers) == 0 {
+		writeError(w, fmt.Errorf("%w: control and at least one worker are required", ErrInvalid))
+		return
+	}
+
+	s.exclusive(w, append([]string{req.Control}, req.Workers...), func() {
+		plans, err := s.backend.CreateCluster(r.Context(), req)
+		respond(w, http.StatusOK, plans, err)
+	})
+}
+
+func (s *Server) joinCluster(w http.ResponseWriter, r *http.Request) {
+	var req JoinRequest
+	if !decode(w, r, &req) {
+		return
+	}
+	if len(req.Nodes) < 2 {
+		writeError(w, fmt.Errorf("%w: a control node and at least one worker are required", ErrInvalid))
+		return
+	}
+
+	s.exclusive(w, req.Nodes, func() {
+		respond(w, http.StatusOK, req, s.backend.JoinCluster(r.Context(), req.Nodes))
+	})
+}
+
+func (s *Server) clusterStatus(w http.ResponseWriter, r *http.Request) {
+	var nodes []string
+	if list := r.URL.Query().Get("nodes"); list != "" {
+		nodes = strings.Split(list, ",")
+	}
+	status, err := s.backend.ClusterStatus(r.Context(), nodes)
+	respond(w, http.StatusOK, status, err)
+}
+
+func (s *Server) listJobs(w http.ResponseWriter, r *http.Request) {
+	list, err := s.backend.ListJobs(r.Context())
+	respond(w, http.StatusOK, list, err)
+}
+
+func (s *Server) getJob(w http.ResponseWriter, r *http.Request) {
+	job, err := s.backend.GetJob(r.Context(), r.PathValue("id"))
+	respond(w, http.StatusOK, job, err)
+}
+
+func (s *Server) cancelJob(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	respond(w, http.StatusOK, map[string]string{"id": id}, s.backend.CancelJob(r.Context(), id))
+}
+
+// jobEvents streams the job's events as newline delimited JSON until it finishes or the client leaves
+func (s *Server) jobEvents(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if _, err := s.backend.GetJob(r.Context(), id); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	enc := json.NewEncoder(w)
+
+	err := s.backend.WatchJob(r.Context(), id, func(ev jobs.Event) error {
+		if err := enc.Encode(ev); err != nil {
+			return err
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		return nil
+	})
+	if err != nil && r.Context().Err() == nil {
+		log.Printf("Event stream for job %s ended ERROR:%s", id, err)
+	}
+}
+
+func decode(w http.ResponseWriter, r *http.Request, v any) bool {
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		writeError(w, fmt.Errorf("%w: %v", ErrInvalid, err))
+		return false
+	}
+	return true
+}
+
+func respond(w http.ResponseWriter, status int, v any, err error) {
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, status, v)
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, ErrNotFound):
+		status = http.StatusNotFound
+	case errors.Is(err, ErrInvalid):
+		status = http.StatusBadRequest
+	}
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Failed to write response ERROR:%s", err)
+	}
+}
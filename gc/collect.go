@@ -0,0 +1,264 @@
+package gc
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+	"time"
+
+	kvmconfig "kvmgo/config"
+	"kvmgo/lib"
+	"kvmgo/network/qemu_hooks"
+	"kvmgo/state"
+	"kvmgo/utils"
+	kvm "kvmgo/vm"
+
+	"libvirt.org/go/libvirt"
+)
+
+// chain prefixes created by qemu_hooks.NewChain and the table each lives in
+var chainTables = map[qemu_hooks.ChainHook]string{
+	qemu_hooks.DNAT: "nat",
+	qemu_hooks.SNAT: "nat",
+	qemu_hooks.FWD:  "filter",
+}
+
+/*
+Collect reads the host into an Inventory - libvirt must answer, without the defined domains
+every VM would look orphaned. Sources that cannot be read (iptables without sudo, a host without
+nft, an inactive pool) are logged and left out.
+*/
+func Collect(minAge time.Duration) (Inventory, error) {
+	cfg := kvmconfig.Current()
+	inv := Inventory{
+		ImagesDir:      cfg.ImagesDir,
+		ArtifactsDir:   cfg.ArtifactsDir,
+		MountRoot:      "/mnt",
+		ForwardingFile: cfg.ForwardingConfigFile(),
+		Mounted:        kvm.IsMounted,
+		MinAge:         minAge,
+		Now:            time.Now(),
+	}
+
+	client, err := lib.ConnectLibvirt()
+	if err != nil {
+		return inv, fmt.Errorf("failed to connect to libvirt - orphans cannot be told apart from VMs without it: %v", err)
+	}
+	defer client.Close()
+
+	if inv.Domains, err = client.DomainDisks(); err != nil {
+		return inv, err
+	}
+
+	inv.Volumes = poolVolumes(client.Conn())
+
+	fwd, err := qemu_hooks.ReadConfigsFromFile()
+	if err != nil {
+		return inv, fmt.Errorf("failed to read %s: %v", inv.ForwardingFile, err)
+	}
+	inv.Forwarding = fwd.Configs
+
+	if inv.Records, err = state.Default().List(); err != nil {
+		return inv, fmt.Errorf("failed to read state: %v", err)
+	}
+
+	for _, table := range []string{"nat", "filter"} {
+		out, err := exec.Command("sudo", "iptables", "-t", table, "-S").Output()
+		if err != nil {
+			log.Printf("Skipping iptables %s chains - could not list them ERROR:%s", table, err)
+			continue
+		}
+		inv.Chains = append(inv.Chains, ParseChains(table, string(out))...)
+	}
+
+	// tables of the nftables backend - left behind when a host switched back to iptables too
+	if out, err := exec.Command("sudo", "nft", "list", "tables").Output(); err != nil {
+		log.Printf("Skipping nftables tables - could not list them ERROR:%s", err)
+	} else {
+		inv.NFTTables = ParseNFTTables(string(out))
+	}
+
+	return inv, nil
+}
+
+// poolVolumes lists the volumes of every storage pool through lib.Pool
+func poolVolumes(conn *libvirt.Connect) []PoolVolume {
+	pools, err := conn.ListAllStoragePools(0)
+	if err != nil {
+		log.Printf("Skipping storage pools - could not list them ERROR:%s", err)
+		return nil
+	}
+
+	var volumes []PoolVolume
+	for _, p := range pools {
+		name, err := p.GetName()
+		p.Free()
+		if err != nil {
+			continue
+		}
+
+		pool, err := lib.GetPool(conn, name)
+		if err != nil {
+			log.Printf("Skipping pool %s ERROR:%s", name, err)
+			continue
+		}
+		paths, err := pool.GetVolumes(true)
+		if err != nil {
+			log.Printf("Skipping pool %s ERROR:%s", name, err)
+			continue
+		}
+		images, _ := pool.GetImages()
+
+		for _, path := range paths {
+			v := PoolVolume{Pool: name, Path: path}
+			if vol, ok := images[path]; ok {
+				v.Backing, _ = vol.BackingStore()
+				if alloc, err := vol.Allocation(); err == nil {
+					v.Size = int64(alloc)
+				}
+			}
+			if info, err := os.Stat(path); err == nil {
+				v.ModTime = info.ModTime()
+			}
+			volumes = append(volumes, v)
+		}
+	}
+	return volumes
+}
+
+/*
+ParseChains picks the per VM forwarding chains out of iptables -S output
+
+	-N DNAT-kafka -> {nat DNAT-kafka kafka}
+*/
+func ParseChains(table, output string) []IptablesChain {
+	var chains []IptablesChain
+	for _, line := range strings.Split(output, "\n") {
+		name, ok := strings.CutPrefix(strings.TrimSpace(line), "-N ")
+		if !ok {
+			continue
+		}
+		for hook, hookTable := range chainTables {
+			vm, ok := strings.CutPrefix(name, string(hook)+"-")
+			if ok && vm != "" && hookTable == table {
+				chains = append(chains, IptablesChain{Table: table, Name: name, VM: vm})
+			}
+		}
+	}
+	return chains
+}
+
+/*
+ParseNFTTables picks the per VM tables out of nft list tables output
+
+	table ip kvmetal-kafka -> {ip kvmetal-kafka kafka}
+*/
+func ParseNFTTables(output string) []NFTTable {
+	var tables []NFTTable
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 3 || fields[0] != "table" {
+			continue
+		}
+		vm, ok := strings.CutPrefix(fields[2], qemu_hooks.NFTTable(""))
+		if ok && vm != "" {
+			tables = append(tables, NFTTable{Family: fields[1], Name: fields[2], VM: vm})
+		}
+	}
+	return tables
+}
+
+// Remove deletes one orphan - Find's order unmounts and unhooks before deleting files
+func Remove(o Orphan) error {
+	switch o.Kind {
+	case Mount:
+		if kvm.IsMounted(o.VM) {
+			if err := kvm.UnmountVM(o.VM); err != nil {
+				return fmt.Errorf("failed to unmount %s: %v", o.Path, err)
+			}
+		}
+		return utils.ClearMountPath(o.VM)
+
+	case Chain:
+		return removeChain(o)
+
+	case Table:
+		// the table holds its own base chains - deleting it removes every rule with it
+		args := []string{"sudo", "nft", "delete", "table", o.Table, o.Path}
+		if out, err := exec.Command(args[0], args[1:]...).CombinedOutput(); err != nil {
+			return fmt.Errorf("failed to run %s: %v %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+		}
+		return nil
+
+	case Forwarding:
+		return qemu_hooks.ClearVMForwardingConfig(o.VM)
+
+	case Volume:
+		client, err := lib.ConnectLibvirt()
+		if err != nil {
+			return fmt.Errorf("failed to connect to libvirt: %v", err)
+		}
+		defer client.Close()
+
+		pool, err := lib.GetPool(client.Conn(), o.Pool)
+		if err != nil {
+			return err
+		}
+		if err := pool.UpdateVolumes(); err != nil {
+			return err
+		}
+		return pool.DeleteVolume(o.Path)
+
+	case VMImage:
+		if err := os.Remove(o.Path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove %s: %v", o.Path, err)
+		}
+		return nil
+
+	case Artifacts:
+		if err := os.RemoveAll(o.Path); err != nil {
+			return fmt.Errorf("failed to remove %s: %v", o.Path, err)
+		}
+		return nil
+
+	case Record:
+		return state.Default().Delete(o.VM)
+	}
+	return fmt.Errorf("unknown orphan kind %q", o.Kind)
+}
+
+// removeChain drops the rules jumping to the chain, then flushes and deletes it
+func removeChain(o Orphan) error {
+	out, err := exec.Command("sudo", "iptables", "-t", o.Table, "-S").Output()
+	if err != nil {
+		return fmt.Errorf("failed to list iptables %s rules: %v", o.Table, err)
+	}
+
+	var cmds [][]string
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || fields[0] != "-A" {
+			continue
+		}
+		if j := slices.Index(fields, "-j"); j >= 0 && j+1 < len(fields) && fields[j+1] == o.Path {
+			fields[0] = "-D"
+			cmds = append(cmds, append([]string{"sudo", "iptables", "-t", o.Table}, fields...))
+		}
+	}
+
+	hook, vm, _ := strings.Cut(o.Path, "-")
+	chain := qemu_hooks.NewChain(vm, qemu_hooks.ChainHook(hook))
+	for _, line := range strings.Split(chain.DeleteChain(o.Table), "\n") {
+		cmds = append(cmds, strings.Fields(line))
+	}
+
+	for _, args := range cmds {
+		if out, err := exec.Command(args[0], args[1:]...).CombinedOutput(); err != nil {
+			return fmt.Errorf("failed to run %s: %v %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,321 @@
+package gc
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"kvmgo/network"
+	"kvmgo/state"
+)
+
+/*
+Finds what crashed or interrupted launches leave behind - VM images, artifact dirs, pool volumes,
+/mnt mounts, forwarding entries, iptables chains, nftables tables and state records that belong
+to no defined libvirt domain.
+
+Collect reads the host into an Inventory, Find cross-references it against the defined domains
+and Remove deletes one orphan. Find is pure so the rules can be tested without libvirt.
+
+Only kvmetal's own naming is considered: <vm>-vm-disk.qcow2 and other <vm>-*disk.qcow2 volumes,
+<artifacts_dir>/<vm>, /mnt/<vm> of VMs with other orphans, the DNAT-/SNAT-/FWD-<vm> chains and the
+kvmetal-<vm> tables of the nftables backend.
+Base images are a shared cache and are left to image rm. Files modified within MinAge are skipped
+so a launch that has not defined its domain yet is not collected.
+
+Usage:
+
+	inv, err := gc.Collect(gc.DefaultMinAge)
+	orphans := gc.Find(inv)
+	for _, o := range orphans {
+		err := gc.Remove(o)
+	}
+*/
+type Kind string
+
+const (
+	Mount      Kind = "mount"
+	Chain      Kind = "iptables-chain"
+	Table      Kind = "nft-table"
+	Forwarding Kind = "forwarding"
+	Volume     Kind = "volume"
+	VMImage    Kind = "vm-image"
+	Artifacts  Kind = "artifacts"
+	Record     Kind = "state"
+)
+
+// removal order - unmount before deleting the image, drop jumps before the chains they target
+var kindOrder = map[Kind]int{Mount: 0, Chain: 1, Table: 2, Forwarding: 3, Volume: 4, VMImage: 5, Artifacts: 6, Record: 7}
+
+// DefaultMinAge protects artifacts of launches still in progress
+const DefaultMinAge = time.Hour
+
+// Orphan is one leftover resource
+type Orphan struct {
+	Kind   Kind   `json:"kind"`
+	VM     string `json:"vm"`
+	Path   string `json:"path"` // file, dir, volume path, chain or table name, or forwarding config file
+	Size   int64  `json:"size_bytes"`
+	Pool   string `json:"pool,omitempty"`  // volumes
+	Table  string `json:"table,omitempty"` // iptables table of chains, address family of nft tables
+	Detail string `json:"detail,omitempty"`
+}
+
+// PoolVolume is a volume of a libvirt storage pool
+type PoolVolume struct {
+	Pool    string
+	Path    string
+	Backing string // path of the image it is layered on
+	Size    int64
+	ModTime time.Time
+}
+
+// IptablesChain is a chain created by qemu_hooks.NewChain
+type IptablesChain struct {
+	Table string
+	Name  string
+	VM    string
+}
+
+// NFTTable is a table created by qemu_hooks.NFTables - kvmetal-<vm>
+type NFTTable struct {
+	Family string
+	Name   string
+	VM     string
+}
+
+// Inventory is everything Find looks at - built by Collect
+type Inventory struct {
+	// Domains maps each defined domain to its disk files, backing chains included
+	Domains map[string][]string
+
+	ImagesDir    string
+	ArtifactsDir string
+	MountRoot    string // /mnt
+
+	Volumes        []PoolVolume
+	Forwarding     []network.ForwardingConfig
+	ForwardingFile string
+	Chains         []IptablesChain
+	NFTTables      []NFTTable
+	Records        []*state.VMRecord
+
+	// Mounted reports whether MountRoot/<vm> is mounted - vm.IsMounted on a host
+	Mounted func(vm string) bool
+
+	MinAge time.Duration
+	Now    time.Time
+}
+
+// Find returns the orphans in removal order
+func Find(inv Inventory) []Orphan {
+	if inv.Now.IsZero() {
+		inv.Now = time.Now()
+	}
+
+	defined := func(vm string) bool {
+		_, ok := inv.Domains[vm]
+		return ok
+	}
+	inUse := make(map[string]bool)
+	for _, files := range inv.Domains {
+		for _, f := range files {
+			inUse[f] = true
+		}
+	}
+	recent := func(mod time.Time) bool { return inv.Now.Sub(mod) < inv.MinAge }
+
+	var orphans []Orphan
+	reported := make(map[string]bool) // paths, so a pool over images_dir does not report twice
+	seen := make(map[string]bool)     // VMs with an orphan - /mnt candidates, a launch in progress is not one
+
+	add := func(o Orphan) {
+		reported[o.Path] = true
+		seen[o.VM] = true
+		orphans = append(orphans, o)
+	}
+
+	// <images_dir>/<vm>-vm-disk.qcow2
+	if entries, err := os.ReadDir(inv.ImagesDir); err == nil {
+		for _, entry := range entries {
+			vm, ok := strings.CutSuffix(entry.Name(), "-vm-disk.qcow2")
+			if !ok || entry.IsDir() {
+				continue
+			}
+			path := filepath.Join(inv.ImagesDir, entry.Name())
+			info, err := entry.Info()
+			if err != nil || defined(vm) || inUse[path] || recent(info.ModTime()) {
+				continue
+			}
+			add(Orphan{Kind: VMImage, VM: vm, Path: path, Size: info.Size()})
+		}
+	}
+
+	// <artifacts_dir>/<vm>/
+	if entries, err := os.ReadDir(inv.ArtifactsDir); err == nil {
+		for _, entry := range entries {
+			if !entry.IsDir() {
+				continue
+			}
+			vm := entry.Name()
+			path := filepath.Join(inv.ArtifactsDir, vm)
+			size, newest := treeSize(path)
+			if defined(vm) || recent(newest) {
+				continue
+			}
+			add(Orphan{Kind: Artifacts, VM: vm, Path: path, Size: size})
+		}
+	}
+
+	// volumes nothing boots from or layers on
+	backing := make(map[string]bool)
+	for _, v := range inv.Volumes {
+		if v.Backing != "" {
+			backing[v.Backing] = true
+		}
+	}
+	for _, v := range inv.Volumes {
+		name := filepath.Base(v.Path)
+		vm := volumeOwner(name)
+		if vm == "" || reported[v.Path] || inUse[v.Path] || backing[v.Path] || recent(v.ModTime) {
+			continue
+		}
+		// VM names contain dashes - kafka-kraft-openebs-disk.qcow2 must not be credited to kafka
+		owned := false
+		for d := range inv.Domains {
+			owned = owned || strings.HasPrefix(name, d+"-")
+		}
+		if owned {
+			continue
+		}
+		add(Orphan{Kind: Volume, VM: vm, Path: v.Path, Size: v.Size, Pool: v.Pool})
+	}
+
+	for _, cfg := range inv.Forwarding {
+		if defined(cfg.VMName) {
+			continue
+		}
+		add(Orphan{Kind: Forwarding, VM: cfg.VMName, Path: inv.ForwardingFile, Detail: forwardingDetail(cfg)})
+	}
+
+	for _, c := range inv.Chains {
+		if defined(c.VM) {
+			continue
+		}
+		add(Orphan{Kind: Chain, VM: c.VM, Path: c.Name, Table: c.Table})
+	}
+
+	for _, nt := range inv.NFTTables {
+		if defined(nt.VM) {
+			continue
+		}
+		add(Orphan{Kind: Table, VM: nt.VM, Path: nt.Name, Table: nt.Family})
+	}
+
+	for _, rec := range inv.Records {
+		if defined(rec.Name) {
+			continue
+		}
+		add(Orphan{Kind: Record, VM: rec.Name, Path: rec.Name, Detail: "domain missing"})
+	}
+
+	// /mnt/<vm> - only for VMs with other orphans, /mnt holds more than setup mounts and setup-vm
+	// mounts before create-vm defines the domain
+	if inv.MountRoot != "" {
+		for vm := range seen {
+			if vm == "" || defined(vm) {
+				continue
+			}
+			path := filepath.Join(inv.MountRoot, vm)
+			info, err := os.Stat(path)
+			if err != nil || !info.IsDir() {
+				continue
+			}
+			o := Orphan{Kind: Mount, VM: vm, Path: path}
+			if inv.Mounted != nil && inv.Mounted(vm) {
+				o.Detail = "mounted"
+			}
+			orphans = append(orphans, o)
+		}
+	}
+
+	sort.SliceStable(orphans, func(i, j int) bool {
+		a, b := orphans[i], orphans[j]
+		if a.Kind != b.Kind {
+			return kindOrder[a.Kind] < kindOrder[b.Kind]
+		}
+		if a.VM != b.VM {
+			return a.VM < b.VM
+		}
+		return a.Path < b.Path
+	})
+	return orphans
+}
+
+// TotalSize is the space removing the orphans frees
+func TotalSize(orphans []Orphan) int64 {
+	var total int64
+	for _, o := range orphans {
+		total += o.Size
+	}
+	return total
+}
+
+/*
+volumeOwner guesses the VM a volume was created for, empty when it does not follow kvmetal naming
+
+	kafka-vm-disk.qcow2            -> kafka
+	kafka-kraft-openebs-disk.qcow2 -> kafka-kraft
+*/
+func volumeOwner(name string) string {
+	if vm, ok := strings.CutSuffix(name, "-vm-disk.qcow2"); ok {
+		return vm
+	}
+	base, ok := strings.CutSuffix(name, "-disk.qcow2")
+	if !ok {
+		return ""
+	}
+	i := strings.LastIndex(base, "-")
+	if i <= 0 {
+		return ""
+	}
+	return base[:i]
+}
+
+// treeSize sums the files under dir and returns the newest modification time in it
+func treeSize(dir string) (int64, time.Time) {
+	var size int64
+	var newest time.Time
+	filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		if info.ModTime().After(newest) {
+			newest = info.ModTime()
+		}
+		if !d.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, newest
+}
+
+func forwardingDetail(cfg network.ForwardingConfig) string {
+	var ports []string
+	for _, m := range cfg.PortMap {
+		ports = append(ports, fmt.Sprintf("%d->%d/%s", m.HostPort, m.VMPort, m.Protocol))
+	}
+	for _, r := range cfg.PortRange {
+		ports = append(ports, fmt.Sprintf("%d-%d/%s", r.HostStartPortNum, r.HostEndPortNum, r.Protocol))
+	}
+	return strings.Join(ports, ", ")
+}
@@ -0,0 +1,496 @@
+package jobs
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+/*
+Runs multi stage operations - VM launches - in the background and reports every stage
+transition as an Event.
+
+Each job runs its stages in order. The job's context is checked before every stage and passed
+to it, so Cancel (or cancelling the context given to Submit) stops a launch between stages or
+inside a stage that honours ctx. A failed or cancelled stage marks the rest as skipped.
+
+A stage may register Undo. When a stage fails or the job is cancelled, the failing stage and every
+stage before it are undone in reverse order, so the job leaves nothing behind - stages without
+Undo (or with it left nil on purpose, to keep artifacts for debugging) are left as they are.
+
+Events are kept with the job so a watcher that attaches late - a CLI reconnecting to the daemon -
+replays the history before following live events.
+
+Usage:
+
+	engine := jobs.NewEngine()
+
+	job := engine.Submit(ctx, "launch", "kafka", vmConfig.LaunchStages())
+
+	err := engine.Watch(ctx, job.ID, func(ev jobs.Event) error {
+		fmt.Println(ev.Type, ev.Stage)
+		return nil
+	})
+
+	final, _ := engine.Get(job.ID)
+	fmt.Println(final.Status, final.Error)
+*/
+type Engine struct {
+	mu       sync.Mutex
+	runs     map[string]*run
+	handlers []func(Event)
+	retain   int
+}
+
+/*
+Stage is one step of a job.
+
+Undo is optional and must only remove what Run created - it is also called for the stage that
+failed, after a partial Run, so it has to tolerate missing artifacts.
+*/
+type Stage struct {
+	Name string
+	Run  func(ctx context.Context) error
+	Undo func(ctx context.Context) error
+}
+
+type Status string
+
+const (
+	Pending   Status = "pending"
+	Running   Status = "running"
+	Succeeded Status = "succeeded"
+	Failed    Status = "failed"
+	Cancelled Status = "cancelled"
+	Skipped   Status = "skipped"
+
+	// a stage that succeeded and was undone after a later failure - the failing stage keeps its status
+	RolledBack Status = "rolled_back"
+)
+
+// Done reports whether the status is final
+func (s Status) Done() bool {
+	return s == Succeeded || s == Failed || s == Cancelled || s == Skipped || s == RolledBack
+}
+
+// StageState is the progress of one stage
+type StageState struct {
+	Name       string     `json:"name"`
+	Status     Status     `json:"status"`
+	StartedAt  *time.Time `json:"started_at,omitempty"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+	DurationMS int64      `json:"duration_ms,omitempty"`
+	Error      string     `json:"error,omitempty"`
+	// set when Undo failed - whatever the stage created is still on the host
+	RollbackError string `json:"rollback_error,omitempty"`
+}
+
+// Job is a snapshot of a submitted job
+type Job struct {
+	ID         string       `json:"id"`
+	Kind       string       `json:"kind"`   // launch
+	Target     string       `json:"target"` // VM name
+	Status     Status       `json:"status"`
+	Stages     []StageState `json:"stages"`
+	Error      string       `json:"error,omitempty"`
+	CreatedAt  time.Time    `json:"created_at"`
+	FinishedAt *time.Time   `json:"finished_at,omitempty"`
+}
+
+// FailedStage returns the stage the job failed or was cancelled in, nil otherwise
+func (j Job) FailedStage() *StageState {
+	for i := range j.Stages {
+		if j.Stages[i].Status == Failed || j.Stages[i].Status == Cancelled {
+			return &j.Stages[i]
+		}
+	}
+	return nil
+}
+
+// Err is the job's error, nil unless it failed or was cancelled
+func (j Job) Err() error {
+	switch j.Status {
+	case Failed:
+		return errors.New(j.Error)
+	case Cancelled:
+		return fmt.Errorf("job %s cancelled: %w", j.ID, context.Canceled)
+	}
+	return nil
+}
+
+type EventType string
+
+const (
+	JobStarted     EventType = "job_started"
+	StageStarted   EventType = "stage_started"
+	StageSucceeded EventType = "stage_succeeded"
+	StageFailed    EventType = "stage_failed"
+	StageCancelled EventType = "stage_cancelled"
+	JobSucceeded   EventType = "job_succeeded"
+	JobFailed      EventType = "job_failed"
+	JobCancelled   EventType = "job_cancelled"
+
+	// rollback events follow the failed stage in reverse stage order, before the job's final event
+	StageRolledBack     EventType = "stage_rolled_back"
+	StageRollbackFailed EventType = "stage_rollback_failed"
+)
+
+// Event is a stage or job transition - streamed as one JSON object per line by the daemon
+type Event struct {
+	Seq        int       `json:"seq"` // 1 based position in the job's history
+	JobID      string    `json:"job_id"`
+	Target     string    `json:"target"`
+	Type       EventType `json:"type"`
+	Stage      string    `json:"stage,omitempty"`
+	Index      int       `json:"index"` // stage position, 0 based
+	Total      int       `json:"total"` // number of stages
+	Time       time.Time `json:"time"`
+	DurationMS int64     `json:"duration_ms,omitempty"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// Final reports whether this is the last event of the job
+func (e Event) Final() bool {
+	return e.Type == JobSucceeded || e.Type == JobFailed || e.Type == JobCancelled
+}
+
+var ErrUnknownJob = errors.New("unknown job")
+
+type run struct {
+	job    Job
+	stages []Stage
+	events []Event
+	notify chan struct{} // closed and replaced on every event
+	done   chan struct{}
+	cancel context.CancelFunc
+}
+
+// NewEngine returns an engine that keeps the 100 most recent finished jobs
+func NewEngine() *Engine {
+	return &Engine{runs: make(map[string]*run), retain: 100}
+}
+
+// OnEvent registers fn for every event of every job - called synchronously, keep it fast
+func (e *Engine) OnEvent(fn func(Event)) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.handlers = append(e.handlers, fn)
+}
+
+/*
+Submit starts the stages in the background and returns the pending job.
+
+The job runs under ctx - pass a context that outlives the caller (the daemon's, not a request's)
+when the job should keep running after Submit returns.
+*/
+func (e *Engine) Submit(ctx context.Context, kind, target string, stages []Stage) Job {
+	ctx, cancel := context.WithCancel(ctx)
+
+	r := &run{
+		job: Job{
+			ID:        newID(),
+			Kind:      kind,
+			Target:    target,
+			Status:    Pending,
+			Stages:    make([]StageState, len(stages)),
+			CreatedAt: time.Now(),
+		},
+		stages: stages,
+		notify: make(chan struct{}),
+		done:   make(chan struct{}),
+		cancel: cancel,
+	}
+	for i, stage := range stages {
+		r.job.Stages[i] = StageState{Name: stage.Name, Status: Pending}
+	}
+
+	e.mu.Lock()
+	e.runs[r.job.ID] = r
+	e.prune()
+	snapshot := r.snapshot()
+	e.mu.Unlock()
+
+	go e.execute(ctx, r)
+
+	return snapshot
+}
+
+// Run submits the stages and waits for them - the returned error is the job's
+func (e *Engine) Run(ctx context.Context, kind, target string, stages []Stage) (Job, error) {
+	job := e.Submit(ctx, kind, target, stages)
+	job, err := e.Wait(context.Background(), job.ID)
+	if err != nil {
+		return job, err
+	}
+	return job, job.Err()
+}
+
+func (e *Engine) execute(ctx context.Context, r *run) {
+	defer r.cancel()
+
+	total := len(r.stages)
+	e.update(r, func(job *Job) Event {
+		job.Status = Running
+		return Event{Type: JobStarted, Total: total}
+	})
+
+	var failure error
+	last := -1 // the last stage that ran
+	for i, stage := range r.stages {
+		if failure == nil {
+			failure = ctx.Err()
+		}
+		if failure != nil {
+			e.update(r, func(job *Job) Event {
+				job.Stages[i].Status = Skipped
+				return Event{}
+			})
+			continue
+		}
+
+		start := time.Now()
+		e.update(r, func(job *Job) Event {
+			job.Stages[i].Status = Running
+			job.Stages[i].StartedAt = &start
+			return Event{Type: StageStarted, Stage: stage.Name, Index: i, Total: total}
+		})
+
+		// a stage that completes despite a cancel keeps its result - the next stage is skipped
+		err := stage.Run(ctx)
+
+		end := time.Now()
+		e.update(r, func(job *Job) Event {
+			st := &job.Stages[i]
+			st.FinishedAt = &end
+			st.DurationMS = end.Sub(start).Milliseconds()
+
+			ev := Event{Type: StageSucceeded, Stage: stage.Name, Index: i, Total: total, DurationMS: st.DurationMS}
+			switch {
+			case err == nil:
+				st.Status = Succeeded
+			case errors.Is(err, context.Canceled):
+				st.Status, st.Error = Cancelled, err.Error()
+				ev.Type, ev.Error = StageCancelled, err.Error()
+			default:
+				st.Status, st.Error = Failed, err.Error()
+				ev.Type, ev.Error = StageFailed, err.Error()
+			}
+			return ev
+		})
+
+		last = i
+		if err != nil {
+			failure = err
+		}
+	}
+
+	if failure != nil {
+		e.rollback(context.WithoutCancel(ctx), r, last)
+	}
+
+	finished := time.Now()
+	e.update(r, func(job *Job) Event {
+		job.FinishedAt = &finished
+		ev := Event{Type: JobSucceeded, Total: total, DurationMS: finished.Sub(job.CreatedAt).Milliseconds()}
+		switch {
+		case failure == nil:
+			job.Status = Succeeded
+		case errors.Is(failure, context.Canceled):
+			job.Status, job.Error = Cancelled, failure.Error()
+			ev.Type, ev.Error = JobCancelled, failure.Error()
+		default:
+			job.Status, job.Error = Failed, failure.Error()
+			ev.Type, ev.Error = JobFailed, failure.Error()
+		}
+		return ev
+	})
+
+	close(r.done)
+}
+
+/*
+rollback undoes stages last..0 - the failed stage first. It runs without the job's cancellation,
+a cancelled launch still has to remove what it created.
+*/
+func (e *Engine) rollback(ctx context.Context, r *run, last int) {
+	total := len(r.stages)
+	for i := last; i >= 0; i-- {
+		stage := r.stages[i]
+		if stage.Undo == nil {
+			continue
+		}
+
+		start := time.Now()
+		err := stage.Undo(ctx)
+		duration := time.Since(start).Milliseconds()
+
+		e.update(r, func(job *Job) Event {
+			st := &job.Stages[i]
+			ev := Event{Type: StageRolledBack, Stage: stage.Name, Index: i, Total: total, DurationMS: duration}
+			switch {
+			case err != nil:
+				st.RollbackError = err.Error()
+				ev.Type, ev.Error = StageRollbackFailed, err.Error()
+			case st.Status == Succeeded:
+				st.Status = RolledBack
+			}
+			return ev
+		})
+	}
+}
+
+// update applies fn to the job under the lock and publishes the event it returns (none if Type is empty)
+func (e *Engine) update(r *run, fn func(job *Job) Event) {
+	e.mu.Lock()
+	ev := fn(&r.job)
+	if ev.Type == "" {
+		e.mu.Unlock()
+		return
+	}
+
+	ev.Seq = len(r.events) + 1
+	ev.JobID, ev.Target = r.job.ID, r.job.Target
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+	r.events = append(r.events, ev)
+
+	close(r.notify)
+	r.notify = make(chan struct{})
+
+	handlers := slices.Clone(e.handlers)
+	e.mu.Unlock()
+
+	for _, fn := range handlers {
+		fn(ev)
+	}
+}
+
+// Get returns a snapshot of the job
+func (e *Engine) Get(id string) (Job, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	r, ok := e.runs[id]
+	if !ok {
+		return Job{}, fmt.Errorf("%w: %s", ErrUnknownJob, id)
+	}
+	return r.snapshot(), nil
+}
+
+// List returns every retained job, newest first
+func (e *Engine) List() []Job {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	list := make([]Job, 0, len(e.runs))
+	for _, r := range e.runs {
+		list = append(list, r.snapshot())
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.After(list[j].CreatedAt) })
+	return list
+}
+
+// Cancel stops the job - the running stage sees its context cancelled and the rest are skipped
+func (e *Engine) Cancel(id string) error {
+	e.mu.Lock()
+	r, ok := e.runs[id]
+	e.mu.Unlock()
+
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrUnknownJob, id)
+	}
+	r.cancel()
+	return nil
+}
+
+// Wait blocks until the job finishes or ctx is done
+func (e *Engine) Wait(ctx context.Context, id string) (Job, error) {
+	e.mu.Lock()
+	r, ok := e.runs[id]
+	e.mu.Unlock()
+
+	if !ok {
+		return Job{}, fmt.Errorf("%w: %s", ErrUnknownJob, id)
+	}
+
+	select {
+	case <-r.done:
+	case <-ctx.Done():
+		return Job{}, ctx.Err()
+	}
+	return e.Get(id)
+}
+
+/*
+Watch calls fn with every event of the job - past events first - until the final event has been
+delivered, fn returns an error or ctx is done.
+*/
+func (e *Engine) Watch(ctx context.Context, id string, fn func(Event) error) error {
+	next := 0
+	for {
+		e.mu.Lock()
+		r, ok := e.runs[id]
+		if !ok {
+			e.mu.Unlock()
+			return fmt.Errorf("%w: %s", ErrUnknownJob, id)
+		}
+		pending := append([]Event(nil), r.events[next:]...)
+		notify := r.notify
+		e.mu.Unlock()
+
+		for _, ev := range pending {
+			if err := fn(ev); err != nil {
+				return err
+			}
+			next++
+			if ev.Final() {
+				return nil
+			}
+		}
+
+		select {
+		case <-notify:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (r *run) snapshot() Job {
+	job := r.job
+	job.Stages = append([]StageState(nil), r.job.Stages...)
+	return job
+}
+
+// prune drops the oldest finished jobs beyond retain - callers hold e.mu
+func (e *Engine) prune() {
+	var finished []*run
+	for _, r := range e.runs {
+		if r.job.Status.Done() {
+			finished = append(finished, r)
+		}
+	}
+	if len(finished) <= e.retain {
+		return
+	}
+
+	sort.Slice(finished, func(i, j int) bool { return finished[i].job.CreatedAt.Before(finished[j].job.CreatedAt) })
+	for _, r := range finished[:len(finished)-e.retain] {
+		delete(e.runs, r.job.ID)
+	}
+}
+
+func newID() string {
+	b := make([]byte, 6)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
@@ -6,6 +6,8 @@ import (
 	"slices"
 	"time"
 
+	"kvmgo/lib/connection"
+
 	"libvirt.org/go/libvirt"
 	libvirtxml "libvirt.org/libvirt-go-xml"
 
@@ -17,9 +19,14 @@ type VirtClient struct {
 	domains map[string]*Domain
 }
 
-/* Connect to Libvirt and Return the Client */
+/* Connect to Libvirt using the resolved connection URI and Return the Client */
 func ConnectLibvirt() (*VirtClient, error) {
-	conn, err := libvirt.NewConnect("qemu:///system")
+	return ConnectLibvirtURI(connection.URI())
+}
+
+/* Connect to Libvirt at uri - e.g qemu:///session, qemu+ssh://host/system, test:///default */
+func ConnectLibvirtURI(uri string) (*VirtClient, error) {
+	conn, err := libvirt.NewConnect(uri)
 	if err != nil {
 		log.Printf("Error Connecting %s", err)
 		return nil, err
@@ -3,10 +3,13 @@ package lib
 import (
 	"fmt"
 	"log"
+	"strings"
 
 	ldom "kvmgo/lib/domain"
+	"kvmgo/types/nic"
 
 	"libvirt.org/go/libvirt"
+	libvirtxml "libvirt.org/libvirt-go-xml"
 )
 
 // Configuring the Virtual Machine
@@ -24,8 +27,12 @@ type VMConfig struct {
 	CPUCores     int
 	DiskPath     string
 	UserDataPath string
+	Disks        []string // additional qcow2 disks attached after the primary disk
 	Network      string
+	Interfaces   []nic.Interface // one <interface> each - a single NIC on Network when empty
 	OSVariant    string
+	DomainType   string // kvm unless overridden - test:///default requires "test"
+	IgnitionPath string // Ignition config for CoreOS guests - replaces the cloud-init seed
 }
 
 func NewVMConfig(name string) *VMConfig {
@@ -63,94 +70,213 @@ func (c *VMConfig) SetNetwork(network string) *VMConfig {
 	return c
 }
 
+// Attach one NIC per interface instead of the single NIC on Network
+func (c *VMConfig) SetInterfaces(ifaces []nic.Interface) *VMConfig {
+	c.Interfaces = ifaces
+	return c
+}
+
 func (c *VMConfig) SetOSVariant(osVariant string) *VMConfig {
 	c.OSVariant = osVariant
 	return c
 }
 
-/*	cmdArgs := []string{
-	"--name", vm.VMName,
-	"--virt-type", "kvm",
-	"--memory", fmt.Sprint(vm.Memory),
-	"--vcpus", fmt.Sprint(vm.CPUCores),
-	"--disk", "path=" + generatedVmImg + ",device=disk",
-	"--disk", "path=" + vm_userdata_img + ",format=raw",
-	"--graphics", "none",
-	"--boot", "hd,menu=on",
-	"--network", "network=default",
-	"--os-variant", "ubuntu18.04",
-	"--noautoconsole",
-} */
-
-func xmlName(name string) string {
-	return fmt.Sprintf("<name>%s</name>", name)
-}
-
-func xmlCpuMem(vcpu, mem int) string {
-	return fmt.Sprintf(`<memory unit='MiB'>%d</memory>
-  <vcpu placement='static'>%d</vcpu>`, mem, vcpu)
-}
-
-func xmlPrimaryDisk(path string) string {
-	return fmt.Sprintf(`<disk type='file' device='disk'>
-      <driver name='qemu' type='qcow2'/>
-      <source file='%s'/>
-      <target dev='vda' bus='virtio'/>
-    </disk>`, path)
-}
-
-func xmlCloudInitDisk(path string) string {
-	return fmt.Sprintf(`<disk type='file' device='cdrom'>
-      <driver name='qemu' type='raw'/>
-      <source file='%s'/>
-      <target dev='hda' bus='ide'/>
-      <readonly/>
-    </disk>`, path)
-}
-
-func xmlNetwork(iface string) string {
-	return fmt.Sprintf(`<interface type='network'>
-      <source network='%s'/>
-      <model type='virtio'/>
-    </interface>`, iface)
-}
-
-func (c *VMConfig) GenerateDomainXML() string {
-	return fmt.Sprintf(`
-<domain type='kvm'>
-  <name>%s</name>
-  <memory unit='MiB'>%d</memory>
-  <vcpu placement='static'>%d</vcpu>
-  <os>
-    <type arch='x86_64' machine='pc-i440fx-2.9'>hvm</type>
-    <boot dev='hd'/>
-  </os>
-  <features>
-    <acpi/>
-    <apic/>
-  </features>
-  <devices>
-    <disk type='file' device='disk'>
-      <driver name='qemu' type='qcow2'/>
-      <source file='%s'/>
-      <target dev='vda' bus='virtio'/>
-    </disk>
-    <disk type='file' device='cdrom'>
-      <driver name='qemu' type='raw'/>
-      <source file='%s'/>
-      <target dev='hda' bus='ide'/>
-      <readonly/>
-    </disk>
-    <interface type='network'>
-      <source network='%s'/>
-      <model type='virtio'/>
-    </interface>
-    <graphics type='vnc' port='-1'/>
-    <console type='pty'>
-      <target type='serial' port='0'/>
-    </console>
-  </devices>
-</domain>`, c.Name, c.Memory, c.CPUCores, c.DiskPath, c.UserDataPath, c.Network)
+// Attach an additional qcow2 disk
+func (c *VMConfig) AddDisk(diskPath string) *VMConfig {
+	c.Disks = append(c.Disks, diskPath)
+	return c
+}
+
+func (c *VMConfig) SetDomainType(domainType string) *VMConfig {
+	c.DomainType = domainType
+	return c
+}
+
+// Pass an Ignition config to the guest through the opt/com.coreos/config fw_cfg entry
+func (c *VMConfig) SetIgnitionPath(ignitionPath string) *VMConfig {
+	c.IgnitionPath = ignitionPath
+	return c
+}
+
+// DomainDefinition builds the libvirt domain for the VM - the native equivalent of
+//
+//	virt-install --name vm --virt-type kvm --memory 2048 --vcpus 2 \
+//	  --disk path=vm-vm-disk.qcow2,device=disk --disk path=user-data.img,format=raw \
+//	  --graphics none --boot hd,menu=on --network network=default \
+//	  --os-variant ubuntu22.04 --noautoconsole
+//
+// The primary qcow2 is vda, additional disks follow as vdb, vdc.. vdz, vdaa.. and the cloud-init
+// seed is attached as a readonly cdrom. Console access is through a pty serial port, and
+// qemu-guest-agent is reached through the org.qemu.guest_agent.0 virtio channel.
+// Interfaces become one virtio NIC each, in order, with their MAC when set.
+//
+// CoreOS guests read Ignition from fw_cfg instead - with IgnitionPath set the domain gets
+//
+//	<sysinfo type='fwcfg'><entry name='opt/com.coreos/config' file='config.ign'/></sysinfo>
+func (c *VMConfig) DomainDefinition() *libvirtxml.Domain {
+	domainType := c.DomainType
+	if domainType == "" {
+		domainType = "kvm"
+	}
+
+	serialPort := uint(0)
+
+	domain := &libvirtxml.Domain{
+		Type:   domainType,
+		Name:   c.Name,
+		Memory: &libvirtxml.DomainMemory{Value: uint(c.Memory), Unit: "MiB"},
+		VCPU:   &libvirtxml.DomainVCPU{Placement: "static", Value: uint(c.CPUCores)},
+		OS: &libvirtxml.DomainOS{
+			Type:        &libvirtxml.DomainOSType{Arch: "x86_64", Type: "hvm"},
+			BootDevices: []libvirtxml.DomainBootDevice{{Dev: "hd"}},
+			BootMenu:    &libvirtxml.DomainBootMenu{Enable: "yes"},
+		},
+		Features: &libvirtxml.DomainFeatureList{
+			ACPI: &libvirtxml.DomainFeature{},
+			APIC: &libvirtxml.DomainFeatureAPIC{},
+		},
+		OnPoweroff: "destroy",
+		OnReboot:   "restart",
+		OnCrash:    "destroy",
+		Devices: &libvirtxml.DomainDeviceList{
+			Disks:      c.domainDisks(),
+			Interfaces: c.domainInterfaces(),
+			Serials: []libvirtxml.DomainSerial{{
+				Source: &libvirtxml.DomainChardevSource{Pty: &libvirtxml.DomainChardevSourcePty{}},
+				Target: &libvirtxml.DomainSerialTarget{Port: &serialPort},
+			}},
+			Consoles: []libvirtxml.DomainConsole{{
+				Source: &libvirtxml.DomainChardevSource{Pty: &libvirtxml.DomainChardevSourcePty{}},
+				Target: &libvirtxml.DomainConsoleTarget{Type: "serial", Port: &serialPort},
+			}},
+			Channels: []libvirtxml.DomainChannel{{
+				Source: &libvirtxml.DomainChardevSource{UNIX: &libvirtxml.DomainChardevSourceUNIX{Mode: "bind"}},
+				Target: &libvirtxml.DomainChannelTarget{VirtIO: &libvirtxml.DomainChannelTargetVirtIO{Name: GuestAgentChannel}},
+			}},
+		},
+	}
+
+	// same as virt-install --virt-type kvm picking the host cpu
+	if domainType == "kvm" {
+		domain.CPU = &libvirtxml.DomainCPU{Mode: "host-passthrough"}
+	}
+
+	if c.IgnitionPath != "" {
+		domain.SysInfo = []libvirtxml.DomainSysInfo{{
+			FWCfg: &libvirtxml.DomainSysInfoFWCfg{
+				Entry: []libvirtxml.DomainSysInfoEntry{{Name: IgnitionFWCfgName, File: c.IgnitionPath}},
+			},
+		}}
+	}
+
+	if id := OSInfoID(c.OSVariant); id != "" {
+		domain.Metadata = &libvirtxml.DomainMetadata{
+			XML: fmt.Sprintf(`<libosinfo:libosinfo xmlns:libosinfo="http://libosinfo.org/xmlns/libvirt/domain/1.0"><libosinfo:os id="%s"/></libosinfo:libosinfo>`, id),
+		}
+	}
+
+	return domain
+}
+
+// domainInterfaces is a virtio NIC per interface, keeping the MACs the seed's network-config matches on
+func (c *VMConfig) domainInterfaces() []libvirtxml.DomainInterface {
+	ifaces := c.Interfaces
+	if len(ifaces) == 0 {
+		ifaces = []nic.Interface{{Network: c.Network}}
+	}
+
+	var interfaces []libvirtxml.DomainInterface
+	for _, iface := range ifaces {
+		domIface := libvirtxml.DomainInterface{
+			Source: &libvirtxml.DomainInterfaceSource{
+				Network: &libvirtxml.DomainInterfaceSourceNetwork{Network: iface.NetworkName()},
+			},
+			Model: &libvirtxml.DomainInterfaceModel{Type: "virtio"},
+		}
+		if iface.MAC != "" {
+			domIface.MAC = &libvirtxml.DomainInterfaceMAC{Address: iface.MAC}
+		}
+		interfaces = append(interfaces, domIface)
+	}
+	return interfaces
+}
+
+func (c *VMConfig) domainDisks() []libvirtxml.DomainDisk {
+	disks := []libvirtxml.DomainDisk{
+		fileDisk("disk", "qcow2", c.DiskPath, "vda", "virtio"),
+	}
+
+	for i, path := range c.Disks {
+		disks = append(disks, fileDisk("disk", "qcow2", path, diskTarget("vd", i+1), "virtio"))
+	}
+
+	if c.UserDataPath != "" {
+		seed := fileDisk("cdrom", "raw", c.UserDataPath, "sda", "sata")
+		seed.ReadOnly = &libvirtxml.DomainDiskReadOnly{}
+		disks = append(disks, seed)
+	}
+
+	return disks
+}
+
+// diskTarget names the index-th disk as the kernel does - vda..vdz, then vdaa, vdab..
+func diskTarget(prefix string, index int) string {
+	name := ""
+	for n := index; n >= 0; n = n/26 - 1 {
+		name = string(rune('a'+n%26)) + name
+	}
+	return prefix + name
+}
+
+func fileDisk(device, format, path, dev, bus string) libvirtxml.DomainDisk {
+	return libvirtxml.DomainDisk{
+		Device: device,
+		Driver: &libvirtxml.DomainDiskDriver{Name: "qemu", Type: format},
+		Source: &libvirtxml.DomainDiskSource{File: &libvirtxml.DomainDiskSourceFile{File: path}},
+		Target: &libvirtxml.DomainDiskTarget{Dev: dev, Bus: bus},
+	}
+}
+
+// IgnitionFWCfgName is the fw_cfg key Ignition reads its config from on qemu
+const IgnitionFWCfgName = "opt/com.coreos/config"
+
+// GuestAgentChannel is the virtio port qemu-guest-agent listens on inside the guest
+const GuestAgentChannel = "org.qemu.guest_agent.0"
+
+// osinfo prefixes for the short ids accepted by virt-install --os-variant
+var osInfoPrefixes = []struct{ short, id string }{
+	{"ubuntu", "http://ubuntu.com/ubuntu/"},
+	{"debian", "http://debian.org/debian/"},
+	{"fedora-coreos-", "http://fedoraproject.org/coreos/"},
+	{"fedora", "http://fedoraproject.org/fedora/"},
+	{"rocky", "http://rockylinux.org/rocky/"},
+	{"alpinelinux", "http://alpinelinux.org/alpinelinux/"},
+	{"linux", "http://libosinfo.org/linux/"}, // generic linux2022 - Flatcar has no entry of its own
+}
+
+// OSInfoID maps an --os-variant short id such as ubuntu22.04 to its libosinfo id.
+// Full ids (http://...) are returned as is.
+func OSInfoID(variant string) string {
+	if variant == "" || strings.HasPrefix(variant, "http") {
+		return variant
+	}
+
+	for _, p := range osInfoPrefixes {
+		if strings.HasPrefix(variant, p.short) {
+			return p.id + strings.TrimPrefix(variant, p.short)
+		}
+	}
+
+	return ""
+}
+
+// GenerateDomainXML renders the domain definition
+func (c *VMConfig) GenerateDomainXML() (string, error) {
+	domainXML, err := c.DomainDefinition().Marshal()
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal domain xml for %s: %v", c.Name, err)
+	}
+	return domainXML, nil
 }
 
 // Create the VM with the config
@@ -159,7 +285,10 @@ func (vm *VMConfig) CreateAndStartVM(client *libvirt.Connect) error {
 		return fmt.Errorf("VM already exists %s", vm.Name)
 	}
 
-	domainXML := vm.GenerateDomainXML()
+	domainXML, err := vm.GenerateDomainXML()
+	if err != nil {
+		return err
+	}
 
 	domain, err := client.DomainDefineXML(domainXML)
 	if err != nil {
@@ -0,0 +1,140 @@
+package connection
+
+import (
+	"os"
+	"os/exec"
+	"sync"
+
+	"kvmgo/config"
+
+	"libvirt.org/go/libvirt"
+)
+
+/*
+Resolves the libvirt connection URI used for every domain, pool and network operation.
+
+Precedence:
+
+	1. SetURI - from --connect or the uri: key of a manifest
+	2. KVMETAL_LIBVIRT_URI
+	3. LIBVIRT_DEFAULT_URI (same variable virsh honours)
+	4. uri: in the kvmetal config file
+	5. qemu:///system
+
+Examples:
+
+	qemu:///system
+	qemu:///session
+	qemu+ssh://user@host/system
+	test:///default
+*/
+
+const (
+	DefaultURI = "qemu:///system"
+	EnvURI     = "KVMETAL_LIBVIRT_URI"
+)
+
+var (
+	mu     sync.RWMutex
+	uri    string
+	shared *libvirt.Connect
+)
+
+// SetURI overrides the connection URI for the process - empty resets to env/default resolution
+func SetURI(connectURI string) {
+	mu.Lock()
+	defer mu.Unlock()
+	uri = connectURI
+}
+
+// URI returns the resolved connection URI
+func URI() string {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	if uri != "" {
+		return uri
+	}
+	if env := os.Getenv(EnvURI); env != "" {
+		return env
+	}
+	if env := os.Getenv("LIBVIRT_DEFAULT_URI"); env != "" {
+		return env
+	}
+	if configured := config.Current().URI; configured != "" {
+		return configured
+	}
+	return DefaultURI
+}
+
+/*
+Connect opens a libvirt connection to the resolved URI.
+
+Once a connection has been shared every caller gets it with an extra reference instead - the
+caller's Close only drops that reference. A dead shared connection is not handed out.
+*/
+func Connect() (*libvirt.Connect, error) {
+	mu.RLock()
+	conn := shared
+	mu.RUnlock()
+
+	if conn != nil {
+		if alive, err := conn.IsAlive(); err == nil && alive && conn.Ref() == nil {
+			return conn, nil
+		}
+	}
+	return libvirt.NewConnect(URI())
+}
+
+/*
+Share opens one connection to the resolved URI and makes Connect reuse it - kvmetald calls
+this at startup so all requests go through a single connection. Unshare releases it.
+
+Usage:
+
+	if err := connection.Share(); err != nil { ... }
+	defer connection.Unshare()
+*/
+func Share() error {
+	conn, err := libvirt.NewConnect(URI())
+	if err != nil {
+		return err
+	}
+
+	mu.Lock()
+	prev := shared
+	shared = conn
+	mu.Unlock()
+
+	if prev != nil {
+		prev.Close()
+	}
+	return nil
+}
+
+// Unshare drops the shared connection - callers still holding it keep their reference
+func Unshare() {
+	mu.Lock()
+	conn := shared
+	shared = nil
+	mu.Unlock()
+
+	if conn != nil {
+		conn.Close()
+	}
+}
+
+// Virsh builds a virsh command against the resolved URI : virsh -c <uri> <args>
+func Virsh(args ...string) *exec.Cmd {
+	return exec.Command("virsh", VirshArgs(args...)...)
+}
+
+// VirshArgs prefixes args with the connection flag
+func VirshArgs(args ...string) []string {
+	return append([]string{"-c", URI()}, args...)
+}
+
+// VirshCmd returns a virsh invocation for shell pipelines : "virsh -c <uri> " + cmd
+func VirshCmd(cmd string) string {
+	return "virsh -c " + URI() + " " + cmd
+}
@@ -13,8 +13,9 @@ func GetIPLibvirtRetry(domain string) (string, error) {
 		return GetIPLibvirt(domain) // Your function that gets the IP
 	}
 
+	// the domain may not be defined yet, and a booting one has no address in any source
 	condition := func(err error) bool {
-		return err != nil && (strings.Contains(err.Error(), "Domain not found:") || strings.Contains(err.Error(), "no IPv4 address found for domain"))
+		return err != nil && (strings.Contains(err.Error(), "Domain not found:") || strings.Contains(err.Error(), "no address found"))
 	}
 
 	// Attempt to retry up to 5 times with a 2-second fixed delay between retries
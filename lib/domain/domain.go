@@ -226,20 +226,14 @@ func (d *Domain) GetInfo() error {
 /* Pulls all IP Addresses associated with the Domain */
 
 func (d *Domain) PullIP() (string, error) {
-	ifaces, err := d.domain.ListAllInterfaceAddresses(libvirt.DOMAIN_INTERFACE_ADDRESSES_SRC_LEASE)
+	resolver := network.NewIPResolver()
+	addrs, err := resolver.Lookup(d.domain)
 	if err != nil {
-		return "", fmt.Errorf("failed to list interface addresses: %v", err)
-	}
-
-	for _, iface := range ifaces {
-		for _, addr := range iface.Addrs {
-			if addrType := addr.Type; addrType == libvirt.IP_ADDR_TYPE_IPV4 {
-				return addr.Addr, nil
-			}
-		}
+		return "", err
 	}
 
-	return "", fmt.Errorf("no IPv4 address found for domain")
+	primary, _ := resolver.Primary(addrs)
+	return primary.IP, nil
 }
 
 // Use this everywhere for SSH Clients
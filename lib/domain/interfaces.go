@@ -2,8 +2,9 @@ package domain
 
 import (
 	"fmt"
+	"strings"
 
-	"libvirt.org/go/libvirt"
+	"kvmgo/network"
 )
 
 type IPResult struct {
@@ -16,34 +17,23 @@ type DomainIPs struct {
 	Results    []IPResult `json:"results"`
 }
 
+// GetAllIPs asks every source separately - the agent one needs qemu-guest-agent running on the VM
 func (d *Domain) GetAllIPs() (*DomainIPs, error) {
-	sources := []struct {
-		Name   string
-		Source libvirt.DomainInterfaceAddressesSource
-	}{
-		{"LEASE", libvirt.DOMAIN_INTERFACE_ADDRESSES_SRC_LEASE},
-		{"ARP", libvirt.DOMAIN_INTERFACE_ADDRESSES_SRC_ARP},
-		// Requires qemu-guest-agent to be running on VM
-		// {"AGENT", libvirt.DOMAIN_INTERFACE_ADDRESSES_SRC_AGENT},
-	}
-
 	results := []IPResult{}
 
-	for _, src := range sources {
+	for _, source := range []string{network.IPSourceLease, network.IPSourceARP, network.IPSourceAgent} {
 		var ips []string
-		ifaces, err := d.domain.ListAllInterfaceAddresses(src.Source)
+		addrs, err := network.NewIPResolver().SetSources(source).Lookup(d.domain)
 		if err != nil {
-			fmt.Printf("Error listing addresses for source %s: %v\n", src.Name, err)
+			fmt.Printf("Error listing addresses for source %s: %v\n", source, err)
 			continue
 		}
 
-		for _, iface := range ifaces {
-			for _, addr := range iface.Addrs {
-				ips = append(ips, addr.Addr)
-			}
+		for _, addr := range addrs {
+			ips = append(ips, addr.IP)
 		}
 
-		results = append(results, IPResult{Source: src.Name, IPs: ips})
+		results = append(results, IPResult{Source: strings.ToUpper(source), IPs: ips})
 	}
 
 	domainIPs := &DomainIPs{DomainName: d.Name, Results: results}
@@ -6,6 +6,7 @@ import (
 	"slices"
 	"time"
 
+	"kvmgo/lib/connection"
 	dom "kvmgo/lib/domain"
 
 	"libvirt.org/go/libvirt"
@@ -17,9 +18,20 @@ type VirtClient struct {
 	domains map[string]*dom.Domain
 }
 
-/* Connect to Libvirt and Return the Client */
+/* Connect to Libvirt using the resolved connection URI and Return the Client - reuses the shared connection when there is one */
 func ConnectLibvirt() (*VirtClient, error) {
-	conn, err := libvirt.NewConnect("qemu:///system")
+	conn, err := connection.Connect()
+	if err != nil {
+		log.Printf("Error Connecting %s", err)
+		return nil, err
+	}
+
+	return &VirtClient{conn: conn, domains: make(map[string]*dom.Domain)}, nil
+}
+
+/* Connect to Libvirt at uri - e.g qemu:///session, qemu+ssh://host/system, test:///default */
+func ConnectLibvirtURI(uri string) (*VirtClient, error) {
+	conn, err := libvirt.NewConnect(uri)
 	if err != nil {
 		log.Printf("Error Connecting %s", err)
 		return nil, err
@@ -236,6 +248,99 @@ func (v *VirtClient) ParseXML(domain string) (*libvirtxml.Domain, error) {
 	return domcfg, nil
 }
 
+// DomainStates returns every defined domain and its state as virsh list --all reports it
+func (v *VirtClient) DomainStates() (map[string]string, error) {
+	doms, err := v.conn.ListAllDomains(0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list domains: %v", err)
+	}
+
+	states := make(map[string]string, len(doms))
+	for _, d := range doms {
+		name, err := d.GetName()
+		if err != nil {
+			_ = d.Free()
+			continue
+		}
+
+		state, _, err := d.GetState()
+		if err != nil {
+			states[name] = "unknown"
+		} else {
+			states[name] = domainStateString(state)
+		}
+		_ = d.Free()
+	}
+
+	return states, nil
+}
+
+// DomainDisks maps every defined domain to the files its disks use, backing chains included
+func (v *VirtClient) DomainDisks() (map[string][]string, error) {
+	doms, err := v.conn.ListAllDomains(0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list domains: %v", err)
+	}
+
+	disks := make(map[string][]string, len(doms))
+	for _, d := range doms {
+		name, err := d.GetName()
+		if err != nil {
+			_ = d.Free()
+			continue
+		}
+
+		xmlDesc, err := d.GetXMLDesc(0)
+		_ = d.Free()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get XML for %s: %v", name, err)
+		}
+
+		domcfg := &libvirtxml.Domain{}
+		if err := domcfg.Unmarshal(xmlDesc); err != nil {
+			return nil, fmt.Errorf("failed to parse XML for %s: %v", name, err)
+		}
+
+		files := []string{}
+		if domcfg.Devices != nil {
+			for _, disk := range domcfg.Devices.Disks {
+				if disk.Source != nil && disk.Source.File != nil {
+					files = append(files, disk.Source.File.File)
+				}
+				for bs := disk.BackingStore; bs != nil; bs = bs.BackingStore {
+					if bs.Source != nil && bs.Source.File != nil {
+						files = append(files, bs.Source.File.File)
+					}
+				}
+			}
+		}
+		disks[name] = files
+	}
+
+	return disks, nil
+}
+
+func domainStateString(state libvirt.DomainState) string {
+	switch state {
+	case libvirt.DOMAIN_RUNNING:
+		return "running"
+	case libvirt.DOMAIN_BLOCKED:
+		return "idle"
+	case libvirt.DOMAIN_PAUSED:
+		return "paused"
+	case libvirt.DOMAIN_SHUTDOWN:
+		return "in shutdown"
+	case libvirt.DOMAIN_SHUTOFF:
+		return "shut off"
+	case libvirt.DOMAIN_CRASHED:
+		return "crashed"
+	case libvirt.DOMAIN_PMSUSPENDED:
+		return "pmsuspended"
+	default:
+		return "no state"
+	}
+}
+
 /////////////////// VM Image Generation for KVM Images from Base Images
 
 func (v *VirtClient) GetOrCreatePool(poolName, poolPath string) (*libvirt.StoragePool, error) {
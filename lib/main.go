@@ -4,16 +4,15 @@ import (
 	"fmt"
 	"log"
 
+	"kvmgo/lib/connection"
 	"kvmgo/utils"
-
-	"libvirt.org/go/libvirt"
 )
 
 // So this code will generate the Qemu Image? But if I am currently downloading the image file in a Directory
 // where will it generate it ? where will the output be? And if I create multiple images - where will it be ?
 
 func main() {
-	conn, err := libvirt.NewConnect("qemu:///system")
+	conn, err := connection.Connect()
 	if err != nil {
 		log.Printf("Error Connecting %s", err)
 	}
@@ -0,0 +1,423 @@
+package lib
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+
+	"libvirt.org/go/libvirt"
+	libvirtxml "libvirt.org/libvirt-go-xml"
+)
+
+// Network modes - how traffic leaves the network's bridge
+const (
+	NetworkNAT      = "nat"      // masqueraded out of the host, like default
+	NetworkIsolated = "isolated" // guests only reach each other and the host
+	NetworkRouted   = "route"    // routed without NAT - the LAN needs a route back to the CIDR
+	NetworkOpen     = "open"     // no firewall rules added by libvirt at all
+)
+
+var NetworkModes = []string{NetworkNAT, NetworkIsolated, NetworkRouted, NetworkOpen}
+
+// DHCPHost is a fixed address handed out by the network's dnsmasq to a MAC
+type DHCPHost struct {
+	MAC  string `json:"mac" yaml:"mac"`
+	Name string `json:"name,omitempty" yaml:"name,omitempty"`
+	IP   string `json:"ip" yaml:"ip"`
+}
+
+// Configuring a libvirt network - an isolated network per cluster keeps their addresses apart
+//
+//	lib.NewNetworkConfig("cluster1").
+//		SetMode(lib.NetworkIsolated).
+//		SetCIDR("10.20.0.0/24").
+//		SetDomain("cluster1.local").
+//		AddHost("52:54:00:12:34:56", "control", "10.20.0.10")
+type NetworkConfig struct {
+	Name       string
+	Mode       string // nat unless set
+	Bridge     string // virbrN picked by libvirt when empty
+	CIDR       string // 10.20.0.0/24 - the host takes the first address unless one is given, 10.20.0.254/24
+	DHCPStart  string // upper half of the CIDR when both are empty
+	DHCPEnd    string
+	NoDHCP     bool
+	Hosts      []DHCPHost
+	Domain     string // DNS domain dnsmasq answers for locally
+	ForwardDev string // host interface routed and NAT traffic leaves through
+}
+
+func NewNetworkConfig(name string) *NetworkConfig {
+	return &NetworkConfig{Name: name, Mode: NetworkNAT}
+}
+
+func (c *NetworkConfig) SetMode(mode string) *NetworkConfig {
+	c.Mode = mode
+	return c
+}
+
+func (c *NetworkConfig) SetBridge(bridge string) *NetworkConfig {
+	c.Bridge = bridge
+	return c
+}
+
+func (c *NetworkConfig) SetCIDR(cidr string) *NetworkConfig {
+	c.CIDR = cidr
+	return c
+}
+
+// Hand out addresses from start to end - both inside the CIDR
+func (c *NetworkConfig) SetDHCPRange(start, end string) *NetworkConfig {
+	c.DHCPStart, c.DHCPEnd = start, end
+	return c
+}
+
+// Turn off DHCP - guests need static addresses, e.g. vm create --nic ip=
+func (c *NetworkConfig) DisableDHCP() *NetworkConfig {
+	c.NoDHCP = true
+	return c
+}
+
+// Reserve ip for the guest with mac
+func (c *NetworkConfig) AddHost(mac, name, ip string) *NetworkConfig {
+	c.Hosts = append(c.Hosts, DHCPHost{MAC: mac, Name: name, IP: ip})
+	return c
+}
+
+func (c *NetworkConfig) SetDomain(domain string) *NetworkConfig {
+	c.Domain = domain
+	return c
+}
+
+func (c *NetworkConfig) SetForwardDev(dev string) *NetworkConfig {
+	c.ForwardDev = dev
+	return c
+}
+
+// gateway is the host's address on the network and the subnet it sits in
+func (c *NetworkConfig) gateway() (net.IP, *net.IPNet, error) {
+	ip, subnet, err := net.ParseCIDR(c.CIDR)
+	if err != nil {
+		return nil, nil, fmt.Errorf("cidr %q must be like 10.20.0.0/24", c.CIDR)
+	}
+	if ip.To4() == nil {
+		return nil, nil, fmt.Errorf("cidr %s: only IPv4 networks are supported", c.CIDR)
+	}
+	ones, bits := subnet.Mask.Size()
+	if bits-ones < 2 {
+		return nil, nil, fmt.Errorf("cidr %s leaves no addresses for guests", c.CIDR)
+	}
+	if ip.Equal(subnet.IP) {
+		ip = offsetIP(subnet.IP, 1)
+	}
+	return ip.To4(), subnet, nil
+}
+
+// dhcpRange is the configured range, or the upper half of the subnet so the lower half stays free for static addresses
+func (c *NetworkConfig) dhcpRange(subnet *net.IPNet) (net.IP, net.IP) {
+	if c.DHCPStart != "" || c.DHCPEnd != "" {
+		return net.ParseIP(c.DHCPStart).To4(), net.ParseIP(c.DHCPEnd).To4()
+	}
+	ones, bits := subnet.Mask.Size()
+	size := uint32(1) << (bits - ones)
+	return offsetIP(subnet.IP, size/2), offsetIP(subnet.IP, size-2)
+}
+
+// Validate checks the mode, that the CIDR is usable and the DHCP range and reservations sit inside it
+func (c *NetworkConfig) Validate() error {
+	if c.Name == "" {
+		return fmt.Errorf("network name is required")
+	}
+	if !validMode(c.Mode) {
+		return fmt.Errorf("unknown network mode %q - must be one of %s", c.Mode, strings.Join(NetworkModes, ", "))
+	}
+	if c.ForwardDev != "" && (c.Mode == NetworkIsolated || c.Mode == NetworkOpen) {
+		return fmt.Errorf("a forward device only applies to nat and route networks")
+	}
+
+	gw, subnet, err := c.gateway()
+	if err != nil {
+		return err
+	}
+	if !subnet.Contains(gw) || gw.Equal(broadcast(subnet)) {
+		return fmt.Errorf("host address %s is not usable in %s", gw, subnet)
+	}
+
+	if c.NoDHCP {
+		if c.DHCPStart != "" || len(c.Hosts) > 0 {
+			return fmt.Errorf("dhcp ranges and host reservations need dhcp enabled")
+		}
+		return nil
+	}
+
+	start, end := c.dhcpRange(subnet)
+	if start == nil || end == nil || !subnet.Contains(start) || !subnet.Contains(end) {
+		return fmt.Errorf("dhcp range %s-%s must be inside %s", c.DHCPStart, c.DHCPEnd, subnet)
+	}
+	if ipToInt(start) > ipToInt(end) {
+		return fmt.Errorf("dhcp range %s-%s ends before it starts", start, end)
+	}
+	if ipToInt(start) <= ipToInt(gw) && ipToInt(gw) <= ipToInt(end) {
+		return fmt.Errorf("dhcp range %s-%s includes the host address %s", start, end, gw)
+	}
+
+	macs, ips := map[string]bool{}, map[string]bool{}
+	for _, host := range c.Hosts {
+		if _, err := net.ParseMAC(host.MAC); err != nil {
+			return fmt.Errorf("host %s: invalid mac %q", host.Name, host.MAC)
+		}
+		ip := net.ParseIP(host.IP)
+		if ip == nil || !subnet.Contains(ip) || ip.Equal(gw) {
+			return fmt.Errorf("host %s: %s is not a free address in %s", host.MAC, host.IP, subnet)
+		}
+		mac := strings.ToLower(host.MAC)
+		if macs[mac] || ips[ip.String()] {
+			return fmt.Errorf("host %s %s: mac or ip is already reserved", host.MAC, host.IP)
+		}
+		macs[mac], ips[ip.String()] = true, true
+	}
+	return nil
+}
+
+/*
+NetworkDefinition builds the libvirt network - the native equivalent of virsh net-define with
+
+	<network>
+	  <name>cluster1</name>
+	  <forward mode='nat'/>
+	  <domain name='cluster1.local' localOnly='yes'/>
+	  <ip address='10.20.0.1' prefix='24'>
+	    <dhcp>
+	      <range start='10.20.0.128' end='10.20.0.254'/>
+	      <host mac='52:54:00:12:34:56' name='control' ip='10.20.0.10'/>
+	    </dhcp>
+	  </ip>
+	</network>
+
+Isolated networks get no <forward> element, which is how libvirt tells them apart.
+*/
+func (c *NetworkConfig) NetworkDefinition() (*libvirtxml.Network, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	gw, subnet, _ := c.gateway()
+	prefix, _ := subnet.Mask.Size()
+
+	network := &libvirtxml.Network{
+		Name: c.Name,
+		IPs:  []libvirtxml.NetworkIP{{Address: gw.String(), Prefix: uint(prefix)}},
+	}
+
+	if c.Mode != NetworkIsolated {
+		network.Forward = &libvirtxml.NetworkForward{Mode: c.Mode, Dev: c.ForwardDev}
+	}
+	if c.Bridge != "" {
+		network.Bridge = &libvirtxml.NetworkBridge{Name: c.Bridge, STP: "on", Delay: "0"}
+	}
+	if c.Domain != "" {
+		network.Domain = &libvirtxml.NetworkDomain{Name: c.Domain, LocalOnly: "yes"}
+	}
+
+	if !c.NoDHCP {
+		start, end := c.dhcpRange(subnet)
+		dhcp := &libvirtxml.NetworkDHCP{
+			Ranges: []libvirtxml.NetworkDHCPRange{{Start: start.String(), End: end.String()}},
+		}
+		for _, host := range c.Hosts {
+			dhcp.Hosts = append(dhcp.Hosts, libvirtxml.NetworkDHCPHost{MAC: host.MAC, Name: host.Name, IP: host.IP})
+		}
+		network.IPs[0].DHCP = dhcp
+	}
+
+	return network, nil
+}
+
+func (c *NetworkConfig) GenerateNetworkXML() (string, error) {
+	network, err := c.NetworkDefinition()
+	if err != nil {
+		return "", err
+	}
+	return network.Marshal()
+}
+
+// CreateAndStartNetwork defines the network, starts it and marks it autostart - undefined again when starting fails
+func (c *NetworkConfig) CreateAndStartNetwork(conn *libvirt.Connect) error {
+	networkXML, err := c.GenerateNetworkXML()
+	if err != nil {
+		return err
+	}
+
+	if existing, err := conn.LookupNetworkByName(c.Name); err == nil {
+		existing.Free()
+		return fmt.Errorf("network %s already exists", c.Name)
+	}
+
+	network, err := conn.NetworkDefineXML(networkXML)
+	if err != nil {
+		return fmt.Errorf("failed to define network %s: %v", c.Name, err)
+	}
+	defer network.Free()
+
+	if err := network.Create(); err != nil {
+		network.Undefine()
+		return fmt.Errorf("failed to start network %s: %v", c.Name, err)
+	}
+	if err := network.SetAutostart(true); err != nil {
+		log.Printf("Failed to set autostart for network %s ERROR:%s", c.Name, err)
+	}
+
+	log.Printf("Network %s created on %s", c.Name, c.CIDR)
+	return nil
+}
+
+// DeleteNetwork stops and undefines a network - guests attached to it lose their link
+func DeleteNetwork(conn *libvirt.Connect, name string) error {
+	network, err := conn.LookupNetworkByName(name)
+	if err != nil {
+		if lerr, ok := err.(libvirt.Error); ok && lerr.Code == libvirt.ERR_NO_NETWORK {
+			return fmt.Errorf("network %s does not exist", name)
+		}
+		return fmt.Errorf("failed to lookup network %s: %v", name, err)
+	}
+	defer network.Free()
+
+	if active, _ := network.IsActive(); active {
+		if err := network.Destroy(); err != nil {
+			return fmt.Errorf("failed to stop network %s: %v", name, err)
+		}
+	}
+	if err := network.Undefine(); err != nil {
+		return fmt.Errorf("failed to undefine network %s: %v", name, err)
+	}
+
+	log.Printf("Network %s deleted", name)
+	return nil
+}
+
+// NetworkInfo is a libvirt network as shown by net list
+type NetworkInfo struct {
+	Name      string `json:"name" yaml:"name"`
+	Mode      string `json:"mode" yaml:"mode"`
+	Bridge    string `json:"bridge,omitempty" yaml:"bridge,omitempty"`
+	CIDR      string `json:"cidr,omitempty" yaml:"cidr,omitempty"`
+	DHCP      string `json:"dhcp,omitempty" yaml:"dhcp,omitempty"`
+	Domain    string `json:"domain,omitempty" yaml:"domain,omitempty"`
+	Hosts     int    `json:"hosts" yaml:"hosts"`
+	Active    bool   `json:"active" yaml:"active"`
+	Autostart bool   `json:"autostart" yaml:"autostart"`
+}
+
+// ListNetworks describes every defined network, active or not
+func ListNetworks(conn *libvirt.Connect) ([]NetworkInfo, error) {
+	networks, err := conn.ListAllNetworks(0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list networks: %v", err)
+	}
+
+	infos := []NetworkInfo{}
+	for _, network := range networks {
+		info, err := networkInfo(&network)
+		network.Free()
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+func networkInfo(network *libvirt.Network) (NetworkInfo, error) {
+	xmlDesc, err := network.GetXMLDesc(0)
+	if err != nil {
+		return NetworkInfo{}, fmt.Errorf("failed to get network XML description: %v", err)
+	}
+	netcfg := &libvirtxml.Network{}
+	if err := netcfg.Unmarshal(xmlDesc); err != nil {
+		return NetworkInfo{}, fmt.Errorf("failed to parse network XML: %v", err)
+	}
+
+	info := NetworkInfo{Name: netcfg.Name, Mode: NetworkIsolated}
+	info.Active, _ = network.IsActive()
+	info.Autostart, _ = network.GetAutostart()
+	if netcfg.Forward != nil {
+		info.Mode = netcfg.Forward.Mode
+	}
+	if netcfg.Bridge != nil {
+		info.Bridge = netcfg.Bridge.Name
+	}
+	if netcfg.Domain != nil {
+		info.Domain = netcfg.Domain.Name
+	}
+	for _, ip := range netcfg.IPs {
+		if ip.Family == "ipv6" || info.CIDR != "" {
+			continue
+		}
+		prefix := ip.Prefix
+		if ip.Netmask != "" {
+			ones, _ := net.IPMask(net.ParseIP(ip.Netmask).To4()).Size()
+			prefix = uint(ones)
+		}
+		info.CIDR = fmt.Sprintf("%s/%d", ip.Address, prefix)
+		if ip.DHCP != nil {
+			for _, r := range ip.DHCP.Ranges {
+				info.DHCP = r.Start + "-" + r.End
+			}
+			info.Hosts = len(ip.DHCP.Hosts)
+		}
+	}
+	return info, nil
+}
+
+/*
+NetworkUsers are the domains with an interface on the network - running or not, as deleting the
+network leaves all of them without a link.
+*/
+func NetworkUsers(conn *libvirt.Connect, name string) ([]string, error) {
+	domains, err := conn.ListAllDomains(0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list domains: %v", err)
+	}
+
+	var users []string
+	for _, domain := range domains {
+		xmlDesc, err := domain.GetXMLDesc(0)
+		domain.Free()
+		if err != nil {
+			continue
+		}
+		domcfg := &libvirtxml.Domain{}
+		if err := domcfg.Unmarshal(xmlDesc); err != nil || domcfg.Devices == nil {
+			continue
+		}
+		for _, iface := range domcfg.Devices.Interfaces {
+			if iface.Source != nil && iface.Source.Network != nil && iface.Source.Network.Network == name {
+				users = append(users, domcfg.Name)
+				break
+			}
+		}
+	}
+	return users, nil
+}
+
+func validMode(mode string) bool {
+	for _, m := range NetworkModes {
+		if mode == m {
+			return true
+		}
+	}
+	return false
+}
+
+func ipToInt(ip net.IP) uint32 { return binary.BigEndian.Uint32(ip.To4()) }
+
+func offsetIP(ip net.IP, n uint32) net.IP {
+	out := make(net.IP, 4)
+	binary.BigEndian.PutUint32(out, ipToInt(ip)+n)
+	return out
+}
+
+func broadcast(subnet *net.IPNet) net.IP {
+	ones, bits := subnet.Mask.Size()
+	return offsetIP(subnet.IP, uint32(1)<<(bits-ones)-1)
+}
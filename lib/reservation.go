@@ -0,0 +1,310 @@
+package lib
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strings"
+
+	"libvirt.org/go/libvirt"
+	libvirtxml "libvirt.org/libvirt-go-xml"
+)
+
+/*
+Reservation pins a guest NIC to an address on a libvirt network and names it in the network's
+dnsmasq - the native equivalent of
+
+	virsh net-update default add ip-dhcp-host "<host mac='52:54:00:3a:1f:9c' name='kafka' ip='192.168.122.130'/>" --live --config
+	virsh net-update default add dns-host "<host ip='192.168.122.130'><hostname>kafka.kuro.com</hostname><hostname>kafka</hostname></host>" --live --config
+
+Guests on the network resolve the names right away. The host asks virbr0's dnsmasq for the domain with
+
+	resolvectl dns virbr0 192.168.122.1
+	resolvectl domain virbr0 '~kuro.com'
+*/
+type Reservation struct {
+	Network   string   // default when empty
+	MAC       string   // the NIC the DHCP host entry is for
+	Name      string   // DHCP host name - the VM
+	IP        string   // the NIC's static address, otherwise picked from the network's DHCP range
+	Hostnames []string // names the network's DNS answers with IP - none for secondary NICs
+}
+
+func (r Reservation) network() string {
+	if r.Network == "" {
+		return "default"
+	}
+	return r.Network
+}
+
+// DHCPHostXML is the <host> added to the network's <dhcp>
+func (r Reservation) DHCPHostXML() (string, error) {
+	host := &libvirtxml.NetworkDHCPHost{MAC: strings.ToLower(r.MAC), Name: r.Name, IP: r.IP}
+	return host.Marshal()
+}
+
+// DNSHostXML is the <host> added to the network's <dns>
+func (r Reservation) DNSHostXML() (string, error) {
+	host := &libvirtxml.NetworkDNSHost{IP: r.IP}
+	for _, name := range r.Hostnames {
+		host.Hostnames = append(host.Hostnames, libvirtxml.NetworkDNSHostHostname{Hostname: name})
+	}
+	return host.Marshal()
+}
+
+/*
+Reserve adds the DHCP host and DNS entries to the network, live when it is running and to its
+persistent definition either way. Returns the reserved address.
+
+A MAC the network already knows keeps its address - reserved before or leased - so recreating a VM
+does not move it. Networks without DHCP only get the DNS entry, which needs a static IP.
+*/
+func (r Reservation) Reserve(conn *libvirt.Connect) (string, error) {
+	name := r.network()
+	network, err := conn.LookupNetworkByName(name)
+	if err != nil {
+		return "", fmt.Errorf("failed to lookup network %s: %v", name, err)
+	}
+	defer network.Free()
+
+	netcfg, err := networkDefinition(network)
+	if err != nil {
+		return "", err
+	}
+	flags := updateFlags(network)
+	mac := strings.ToLower(r.MAC)
+
+	var leases []libvirt.NetworkDHCPLease
+	if active, _ := network.IsActive(); active {
+		leases, _ = network.GetDHCPLeases()
+	}
+
+	dhcp := dhcpOf(netcfg)
+	if dhcp != nil && r.MAC != "" {
+		for _, host := range dhcp.Hosts {
+			if strings.ToLower(host.MAC) != mac {
+				continue
+			}
+			if r.IP == "" || r.IP == host.IP {
+				r.IP = host.IP
+				break
+			}
+			// the NIC's static address changed - the old entry would hand out the previous one
+			if err := updateSection(network, libvirt.NETWORK_UPDATE_COMMAND_DELETE, libvirt.NETWORK_SECTION_IP_DHCP_HOST, &host, flags); err != nil {
+				return "", err
+			}
+		}
+
+		if r.IP == "" {
+			leased := []string{}
+			for _, lease := range leases {
+				if net.ParseIP(lease.IPaddr).To4() == nil {
+					continue
+				}
+				if strings.ToLower(lease.Mac) == mac {
+					r.IP = lease.IPaddr
+				}
+				leased = append(leased, lease.IPaddr)
+			}
+			if r.IP == "" {
+				if r.IP, err = FreeDHCPAddress(netcfg, leased); err != nil {
+					return "", err
+				}
+			}
+		}
+
+		if !hasDHCPHost(dhcp, mac, r.IP) {
+			hostXML, err := r.DHCPHostXML()
+			if err != nil {
+				return "", err
+			}
+			if err := network.Update(libvirt.NETWORK_UPDATE_COMMAND_ADD_LAST, libvirt.NETWORK_SECTION_IP_DHCP_HOST, -1, hostXML, flags); err != nil {
+				return "", fmt.Errorf("failed to reserve %s for %s on %s: %v", r.IP, r.MAC, name, err)
+			}
+		}
+	}
+
+	if r.IP == "" {
+		return "", fmt.Errorf("network %s has no dhcp - %s needs a static address to be named in its dns", name, r.Name)
+	}
+	if len(r.Hostnames) == 0 {
+		return r.IP, nil
+	}
+
+	if netcfg.DNS != nil {
+		for _, host := range netcfg.DNS.Host {
+			if host.IP != r.IP && !sharesHostname(host, r.Hostnames) {
+				continue
+			}
+			if err := updateSection(network, libvirt.NETWORK_UPDATE_COMMAND_DELETE, libvirt.NETWORK_SECTION_DNS_HOST, &host, flags); err != nil {
+				return "", err
+			}
+		}
+	}
+	dnsXML, err := r.DNSHostXML()
+	if err != nil {
+		return "", err
+	}
+	if err := network.Update(libvirt.NETWORK_UPDATE_COMMAND_ADD_LAST, libvirt.NETWORK_SECTION_DNS_HOST, -1, dnsXML, flags); err != nil {
+		return "", fmt.Errorf("failed to add dns entry %s for %s on %s: %v", strings.Join(r.Hostnames, ","), r.IP, name, err)
+	}
+
+	log.Printf("Reserved %s (%s) for %s on network %s", r.IP, strings.Join(r.Hostnames, ", "), r.MAC, name)
+	return r.IP, nil
+}
+
+/*
+ReleaseHost removes what Reserve added for a VM from every network - DHCP hosts named vmName and
+DNS hosts answering for any of the names. Entries it cannot remove are reported together.
+*/
+func ReleaseHost(conn *libvirt.Connect, vmName string, hostnames ...string) error {
+	networks, err := conn.ListAllNetworks(0)
+	if err != nil {
+		return fmt.Errorf("failed to list networks: %v", err)
+	}
+
+	names := append([]string{vmName}, hostnames...)
+	var errs []string
+	for i := range networks {
+		network := &networks[i]
+		if err := releaseOn(network, vmName, names); err != nil {
+			errs = append(errs, err.Error())
+		}
+		network.Free()
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to release %s: %s", vmName, strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+func releaseOn(network *libvirt.Network, vmName string, names []string) error {
+	netcfg, err := networkDefinition(network)
+	if err != nil {
+		return err
+	}
+	flags := updateFlags(network)
+
+	if dhcp := dhcpOf(netcfg); dhcp != nil {
+		for _, host := range dhcp.Hosts {
+			if host.Name != vmName {
+				continue
+			}
+			if err := updateSection(network, libvirt.NETWORK_UPDATE_COMMAND_DELETE, libvirt.NETWORK_SECTION_IP_DHCP_HOST, &host, flags); err != nil {
+				return err
+			}
+			log.Printf("Released %s (%s) on network %s", host.IP, host.MAC, netcfg.Name)
+		}
+	}
+
+	if netcfg.DNS != nil {
+		for _, host := range netcfg.DNS.Host {
+			if !sharesHostname(host, names) {
+				continue
+			}
+			if err := updateSection(network, libvirt.NETWORK_UPDATE_COMMAND_DELETE, libvirt.NETWORK_SECTION_DNS_HOST, &host, flags); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+/*
+FreeDHCPAddress is the first address of the network's DHCP range that is neither reserved for a
+host nor in leased - reservations have to stay clear of addresses dnsmasq already handed out.
+*/
+func FreeDHCPAddress(netcfg *libvirtxml.Network, leased []string) (string, error) {
+	dhcp := dhcpOf(netcfg)
+	if dhcp == nil || len(dhcp.Ranges) == 0 {
+		return "", fmt.Errorf("network %s has no dhcp range", netcfg.Name)
+	}
+
+	used := map[string]bool{}
+	for _, host := range dhcp.Hosts {
+		used[host.IP] = true
+	}
+	for _, ip := range leased {
+		used[ip] = true
+	}
+
+	for _, r := range dhcp.Ranges {
+		start, end := net.ParseIP(r.Start).To4(), net.ParseIP(r.End).To4()
+		if start == nil || end == nil || ipToInt(end) < ipToInt(start) {
+			continue
+		}
+		for n := uint32(0); n <= ipToInt(end)-ipToInt(start); n++ {
+			ip := offsetIP(start, n).String()
+			if !used[ip] {
+				return ip, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("no free address left in the dhcp range of network %s", netcfg.Name)
+}
+
+func networkDefinition(network *libvirt.Network) (*libvirtxml.Network, error) {
+	xmlDesc, err := network.GetXMLDesc(0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get network XML description: %v", err)
+	}
+	netcfg := &libvirtxml.Network{}
+	if err := netcfg.Unmarshal(xmlDesc); err != nil {
+		return nil, fmt.Errorf("failed to parse network XML: %v", err)
+	}
+	return netcfg, nil
+}
+
+// updateFlags changes the running network too when it is active - the config alone otherwise
+func updateFlags(network *libvirt.Network) libvirt.NetworkUpdateFlags {
+	if active, _ := network.IsActive(); active {
+		return libvirt.NETWORK_UPDATE_AFFECT_LIVE | libvirt.NETWORK_UPDATE_AFFECT_CONFIG
+	}
+	return libvirt.NETWORK_UPDATE_AFFECT_CONFIG
+}
+
+type marshaler interface {
+	Marshal() (string, error)
+}
+
+func updateSection(network *libvirt.Network, cmd libvirt.NetworkUpdateCommand, section libvirt.NetworkUpdateSection, entry marshaler, flags libvirt.NetworkUpdateFlags) error {
+	entryXML, err := entry.Marshal()
+	if err != nil {
+		return err
+	}
+	if err := network.Update(cmd, section, -1, entryXML, flags); err != nil {
+		return fmt.Errorf("failed to update network entry %s: %v", entryXML, err)
+	}
+	return nil
+}
+
+// dhcpOf is the DHCP of the network's first IPv4 address - where libvirt puts hosts for parentIndex -1
+func dhcpOf(netcfg *libvirtxml.Network) *libvirtxml.NetworkDHCP {
+	for _, ip := range netcfg.IPs {
+		if ip.Family != "ipv6" && ip.DHCP != nil {
+			return ip.DHCP
+		}
+	}
+	return nil
+}
+
+func hasDHCPHost(dhcp *libvirtxml.NetworkDHCP, mac, ip string) bool {
+	for _, host := range dhcp.Hosts {
+		if strings.ToLower(host.MAC) == mac && host.IP == ip {
+			return true
+		}
+	}
+	return false
+}
+
+func sharesHostname(host libvirtxml.NetworkDNSHost, names []string) bool {
+	for _, hostname := range host.Hostnames {
+		for _, name := range names {
+			if hostname.Hostname == name {
+				return true
+			}
+		}
+	}
+	return false
+}
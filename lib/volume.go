@@ -4,6 +4,7 @@ import (
 	"fmt"
 
 	"libvirt.org/go/libvirt"
+	libvirtxml "libvirt.org/libvirt-go-xml"
 )
 
 type Volume struct {
@@ -27,6 +28,32 @@ func (v *Volume) Delete() error {
 	return v.volume.Delete(libvirt.STORAGE_VOL_DELETE_NORMAL)
 }
 
+// BackingStore returns the path of the image the volume is layered on - empty for standalone volumes
+func (v *Volume) BackingStore() (string, error) {
+	xmlDesc, err := v.volume.GetXMLDesc(0)
+	if err != nil {
+		return "", fmt.Errorf("failed to get volume XML: %v", err)
+	}
+
+	vol := &libvirtxml.StorageVolume{}
+	if err := vol.Unmarshal(xmlDesc); err != nil {
+		return "", fmt.Errorf("failed to parse volume XML: %v", err)
+	}
+	if vol.BackingStore == nil {
+		return "", nil
+	}
+	return vol.BackingStore.Path, nil
+}
+
+// Allocation is the space the volume takes on the host - less than its capacity for sparse qcow2
+func (v *Volume) Allocation() (uint64, error) {
+	info, err := v.volume.GetInfo()
+	if err != nil {
+		return 0, fmt.Errorf("failed to get volume info: %v", err)
+	}
+	return info.Allocation, nil
+}
+
 func GetVolumeByPath(client *libvirt.Connect, path string) (*Volume, error) {
 	vol, err := client.LookupStorageVolByPath(path)
 	if err != nil {
@@ -27,7 +27,11 @@ const SAMPLE_UFW_BEFORE = `#KVM_GO_START
 func ExposeVM(vmname, vmPort, hostPort string) {
 	// step 1. figure out VM's IP address and hostname
 
-	vmIP, _ := GetVMIPAddr(vmname)
+	vmIP, err := GetVMIPAddr(vmname)
+	if err != nil {
+		log.Printf("Failed to get IP of %s ERROR:%s", vmname, err)
+		return
+	}
 
 	log.Printf("VM:%s\nIP Addr: %s", vmname, vmIP)
 
@@ -55,7 +59,7 @@ func ExposeVM(vmname, vmPort, hostPort string) {
 	currentUfwRules, _ := GetCurrentUfwRules()
 	utils.LogDottedLineDelimitedText(currentUfwRules)
 
-	ufwBeforeRule := CreateUfwBeforeRule(vmIP.StringWithSubnet(), vmPort, hostPort, "Rule to expose Yarn UI")
+	ufwBeforeRule := CreateUfwBeforeRule(vmIP.String(), vmPort, hostPort, "Rule to expose Yarn UI")
 
 	/* UFW: We want to add the Rule here - for each new VM - and delete it once we're done /etc/ufw/before.rules */
 	// If we have no more Active VM's : we will delete the Rule and also Comment out Qemu Hooks
@@ -64,7 +68,7 @@ func ExposeVM(vmname, vmPort, hostPort string) {
 
 	// check if the VM is already exposed
 
-	running := isVMExposed(currentUfwRules, "", vmIP.StringWithSubnet())
+	running := isVMExposed(currentUfwRules, "", vmIP.String())
 
 	if running {
 		log.Printf("VM is already Exposed")
@@ -86,8 +90,12 @@ func isVMExposed(ufwFileContent, vmName, ip string) bool {
 			log.Printf("One of VMName or IP must be explicity passed to check if its exposed")
 			return false
 		}
-		ip, _ := GetVMIPAddr(vmName)
-		vmIP = ip.StringWithSubnet()
+		ip, err := GetVMIPAddr(vmName)
+		if err != nil {
+			log.Printf("Failed to get IP of %s ERROR:%s", vmName, err)
+			return false
+		}
+		vmIP = ip.String()
 	}
 
 	content, active, _ := CheckUfwBeforeHooksActive(ufwFileContent)
@@ -1,33 +1,18 @@
 package network
 
 import (
-	"bufio"
-	"bytes"
+	"context"
 	"fmt"
 	"log"
 	"net"
-	"os/exec"
-	"strings"
 	"time"
 
 	"kvmgo/utils"
 )
 
 /*
-go get golang.org/x/crypto/ssh
-
-WORKER_IP=$(sudo arp-scan --interface=virbr0 --localnet | grep -f <(virsh dumpxml worker | awk -F"'" '/mac address/{print $2}') | awk '{print $1}')
-
-Make sure SSH is active on Node
-systemctl status ssh
-
-sudo arp-scan --interface=virbr0 --localnet | grep -f <(virsh dumpxml worker | awk -F"'" '/mac address/{print $2}') | awk '{print $1}'
-
-sudo apt-get install openssh-server
-*/
-
-/*
-Using arp-scan to get the IP of a VM
+GetVMIPAddr is the VM's primary address with its prefix - looked up through libvirt from the
+sources in ip_sources, waiting up to ip_timeout while the VM boots. See IPResolver.
 
 Usage:
 
@@ -35,30 +20,13 @@ Usage:
 	log.Printf("IP of Control Node is %s",ip)
 */
 func GetVMIPAddr(vmName string) (*IPAddressWithSubnet, error) {
-	cmdString := fmt.Sprintf("sudo arp-scan --interface=virbr0 --localnet | grep -f <(virsh dumpxml %s | awk -F\"'\" '/mac address/{print $2}') | awk '{print $1}'", vmName)
-
-	cmd := exec.Command("bash", "-c", cmdString)
-	var out bytes.Buffer
-	cmd.Stdout = &out
-	err := cmd.Run()
+	addrs, err := ResolveVMAddresses(context.Background(), vmName)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("no IP address found for VM %s: %v", vmName, err)
 	}
 
-	scanner := bufio.NewScanner(&out)
-	if scanner.Scan() {
-		ipAddr, err := NewIPAddressWithSubnet(strings.TrimSpace(scanner.Text()))
-
-		if err == nil && ipAddr != nil {
-			return ipAddr, nil
-		}
-
-		// return strings.TrimSpace(scanner.Text()), nil
-	}
-
-	log.Printf("Error Parsing Output into an IP and Subnet for VM %s  ERROR:%s", vmName, err)
-
-	return nil, fmt.Errorf("no IP address found for VM: %s", vmName)
+	primary, _ := NewIPResolver().Primary(addrs)
+	return &IPAddressWithSubnet{IP: net.ParseIP(primary.IP), Subnet: int(primary.Prefix)}, nil
 }
 
 /*
@@ -1,4 +1,199 @@
 package network
 
-func CreatePortMappings() {
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var ErrPortCollision = errors.New("host port already forwarded")
+
+/*
+CreatePortMappings parses --map specs - host:vm/protocol, both sides a port or a range of the
+same length. The protocol defaults to tcp. Single ports become PortMappings and ranges PortRanges.
+
+	8000-8010:9000-9010/tcp   host ports 8000-8010 to VM ports 9000-9010
+	53:5353/udp               host port 53 to VM port 5353
+
+Specs that forward the same host port twice are rejected - CheckPortCollisions covers other VMs.
+
+Usage:
+
+	portMap, portRange, err := network.CreatePortMappings([]string{"8000-8010:9000-9010/tcp", "53:5353/udp"})
+*/
+func CreatePortMappings(specs []string) ([]PortMapping, []PortRange, error) {
+	var portMap []PortMapping
+	var portRange []PortRange
+	var spans []portSpan
+
+	for _, spec := range specs {
+		protocol := TCP
+		ports := spec
+		if i := strings.LastIndex(spec, "/"); i >= 0 {
+			ports, protocol = spec[:i], NetProtocol(strings.ToLower(spec[i+1:]))
+		}
+		if protocol != TCP && protocol != UDP {
+			return nil, nil, fmt.Errorf("invalid map %q: protocol must be tcp or udp", spec)
+		}
+
+		host, vm, ok := strings.Cut(ports, ":")
+		if !ok {
+			return nil, nil, fmt.Errorf("invalid map %q: must be hostport:vmport/protocol", spec)
+		}
+		hostStart, hostEnd, err := parsePortSpan(host)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid map %q: %v", spec, err)
+		}
+		vmStart, vmEnd, err := parsePortSpan(vm)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid map %q: %v", spec, err)
+		}
+		if hostEnd-hostStart != vmEnd-vmStart {
+			return nil, nil, fmt.Errorf("invalid map %q: host range has %d ports, vm range %d", spec, hostEnd-hostStart+1, vmEnd-vmStart+1)
+		}
+
+		span := portSpan{protocol, hostStart, hostEnd}
+		for _, other := range spans {
+			if span.overlaps(other) {
+				return nil, nil, fmt.Errorf("invalid map %q: host port %s is mapped twice", spec, span.overlap(other))
+			}
+		}
+		spans = append(spans, span)
+
+		if hostStart == hostEnd && !strings.Contains(host, "-") {
+			portMap = append(portMap, PortMapping{Protocol: protocol, HostPort: hostStart, VMPort: vmStart})
+			continue
+		}
+		portRange = append(portRange, PortRange{
+			Protocol:         protocol,
+			HostStartPortNum: hostStart, HostEndPortNum: hostEnd,
+			VMStartPort: vmStart, VMEndPortNum: vmEnd,
+		})
+	}
+
+	return portMap, portRange, nil
+}
+
+// parsePortSpan reads 9092 or 8000-8010
+func parsePortSpan(s string) (start, end int, err error) {
+	first, last, isRange := strings.Cut(s, "-")
+	if start, err = parsePort(first); err != nil {
+		return 0, 0, err
+	}
+	if !isRange {
+		return start, start, nil
+	}
+	if end, err = parsePort(last); err != nil {
+		return 0, 0, err
+	}
+	if end < start {
+		return 0, 0, fmt.Errorf("range %s ends before it starts", s)
+	}
+	return start, end, nil
+}
+
+func parsePort(s string) (int, error) {
+	port, err := strconv.Atoi(strings.TrimSpace(s))
+	if err != nil || port < 1 || port > 65535 {
+		return 0, fmt.Errorf("port %q must be between 1 and 65535", s)
+	}
+	return port, nil
+}
+
+/*
+CheckPortCollisions rejects host ports another VM in configs already forwards on the same
+protocol - both DNATs would match and only the first rule would ever see the traffic. The VM's own
+forwards are not collisions, setting them again replaces them.
+*/
+func CheckPortCollisions(configs ForwardingConfigs, vmName string, portMap []PortMapping, portRange []PortRange) error {
+	requested := hostPortSpans(portMap, portRange)
+	for _, cfg := range configs.Configs {
+		if cfg.VMName == vmName {
+			continue
+		}
+		for _, existing := range hostPortSpans(cfg.PortMap, cfg.PortRange) {
+			for _, span := range requested {
+				if span.overlaps(existing) {
+					return fmt.Errorf("%w: %s host port %s is forwarded to %s", ErrPortCollision, span.protocol, span.overlap(existing), cfg.VMName)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// WithoutHostPorts drops the forwards whose host ports overlap those of replaceMap and replaceRange
+func WithoutHostPorts(portMap []PortMapping, portRange []PortRange, replaceMap []PortMapping, replaceRange []PortRange) ([]PortMapping, []PortRange) {
+	replaced := hostPortSpans(replaceMap, replaceRange)
+	overlapping := func(span portSpan) bool {
+		for _, r := range replaced {
+			if span.overlaps(r) {
+				return true
+			}
+		}
+		return false
+	}
+
+	keptMap := make([]PortMapping, 0, len(portMap))
+	for _, pm := range portMap {
+		if !overlapping(portSpan{pm.Protocol, pm.HostPort, pm.HostPort}) {
+			keptMap = append(keptMap, pm)
+		}
+	}
+	keptRange := make([]PortRange, 0, len(portRange))
+	for _, pr := range portRange {
+		if !overlapping(portSpan{pr.Protocol, pr.HostStartPortNum, pr.HostEndPortNum}) {
+			keptRange = append(keptRange, pr)
+		}
+	}
+	return keptMap, keptRange
+}
+
+/*
+PrivilegedPortWarnings lists host ports below 1024 - forwarding one does not need root, but it
+takes the port from the host's own service, like a local DNS resolver on 53 or sshd on 22.
+*/
+func PrivilegedPortWarnings(portMap []PortMapping, portRange []PortRange) []string {
+	var warnings []string
+	for _, span := range hostPortSpans(portMap, portRange) {
+		if span.start < 1024 {
+			warnings = append(warnings, fmt.Sprintf("%s host port %s is privileged - a host service listening on it no longer receives that traffic",
+				span.protocol, span))
+		}
+	}
+	return warnings
+}
+
+// portSpan is the host side of a PortMapping or PortRange
+type portSpan struct {
+	protocol   NetProtocol
+	start, end int
+}
+
+func hostPortSpans(portMap []PortMapping, portRange []PortRange) []portSpan {
+	spans := make([]portSpan, 0, len(portMap)+len(portRange))
+	for _, pm := range portMap {
+		spans = append(spans, portSpan{pm.Protocol, pm.HostPort, pm.HostPort})
+	}
+	for _, pr := range portRange {
+		spans = append(spans, portSpan{pr.Protocol, pr.HostStartPortNum, pr.HostEndPortNum})
+	}
+	return spans
+}
+
+func (s portSpan) overlaps(other portSpan) bool {
+	return s.protocol == other.protocol && s.start <= other.end && other.start <= s.end
+}
+
+// overlap is the shared part of two overlapping spans
+func (s portSpan) overlap(other portSpan) string {
+	return portSpan{s.protocol, max(s.start, other.start), min(s.end, other.end)}.String()
+}
+
+func (s portSpan) String() string {
+	if s.start == s.end {
+		return strconv.Itoa(s.start)
+	}
+	return fmt.Sprintf("%d-%d", s.start, s.end)
 }
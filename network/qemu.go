@@ -8,6 +8,7 @@ import (
 	"regexp"
 	"strconv"
 
+	"kvmgo/lib/connection"
 	"kvmgo/utils"
 )
 
@@ -103,7 +104,7 @@ func CreateUfwBeforeRule(vmIpAddr, vmExposePort, hostPort, comment string) strin
 
 // PrivateIPAddrAllVMs parses libvirtd output for DHCP leases and gets the IP Subnet
 func PrivateIPAddrAllVMs(print bool) []IPAddressWithSubnet {
-	output, _ := utils.ExecCmd("virsh net-dhcp-leases default", false)
+	output, _ := utils.ExecCmd(connection.VirshCmd("net-dhcp-leases default"), false)
 
 	ipAddresses := ParseIpAddrWithSubnet(output)
 
@@ -118,7 +119,7 @@ func PrivateIPAddrAllVMs(print bool) []IPAddressWithSubnet {
 
 // VMIpAddrInfoList returns the info for all Virtual Machines managed by the host
 func VMIpAddrInfoList(print bool) []VMLeaseInfo {
-	output, _ := utils.ExecCmd("virsh net-dhcp-leases default", false)
+	output, _ := utils.ExecCmd(connection.VirshCmd("net-dhcp-leases default"), false)
 
 	// Use GetVMLeaseInfo to find and return all lease information in the output.
 	leaseInfo := GetVMLeaseInfo(output)
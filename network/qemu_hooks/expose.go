@@ -0,0 +1,198 @@
+package qemu_hooks
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"kvmgo/lib/connection"
+	"kvmgo/network"
+	"kvmgo/utils"
+
+	"libvirt.org/go/libvirt"
+)
+
+var ErrNoForward = errors.New("no such forward")
+
+// SetPortMapping adds the forwards of fwd to the VM's config, replacing its forwards on the same host ports.
+// Host ports another VM forwards are rejected with network.ErrPortCollision. A VM without a config gets fwd
+// as it is. after is the config that was written.
+func SetPortMapping(fwd network.ForwardingConfig) (before, after *network.ForwardingConfig, err error) {
+	return editVMConfig(fwd.VMName, func(configs network.ForwardingConfigs, current *network.ForwardingConfig) error {
+		// checked under the same lock as the write - two exposes cannot both claim a free port
+		if err := network.CheckPortCollisions(configs, fwd.VMName, fwd.PortMap, fwd.PortRange); err != nil {
+			return err
+		}
+		if current.HostIP == nil && current.PrivateIP == nil {
+			*current = copyConfig(fwd)
+			return nil
+		}
+		if fwd.HostIP != nil {
+			current.HostIP = fwd.HostIP
+		}
+		if fwd.PrivateIP != nil {
+			current.PrivateIP = fwd.PrivateIP
+		}
+		if fwd.ExternalIP != nil {
+			current.ExternalIP = fwd.ExternalIP
+		}
+		if fwd.Interface != "" {
+			current.Interface = fwd.Interface
+		}
+
+		current.PortMap, current.PortRange = network.WithoutHostPorts(current.PortMap, current.PortRange, fwd.PortMap, fwd.PortRange)
+		current.PortMap = append(current.PortMap, fwd.PortMap...)
+		current.PortRange = append(current.PortRange, fwd.PortRange...)
+		return nil
+	})
+}
+
+// RemovePortMapping drops the VM's forward on hostPort, or the range containing it - every forward of the
+// VM when hostPort is 0.
+// after is nil when the VM has nothing left forwarded and its config was removed.
+func RemovePortMapping(vmName string, hostPort int, protocol network.NetProtocol) (before, after *network.ForwardingConfig, err error) {
+	return editVMConfig(vmName, func(_ network.ForwardingConfigs, current *network.ForwardingConfig) error {
+		if current.HostIP == nil && current.PrivateIP == nil && len(current.PortMap) == 0 && len(current.PortRange) == 0 {
+			return fmt.Errorf("%w: no forwarding config for %s", ErrNoForward, vmName)
+		}
+		if hostPort == 0 {
+			current.PortMap, current.PortRange = nil, nil
+			return nil
+		}
+
+		// a range is removed as a whole by any of its host ports
+		keptMap, keptRange := network.WithoutHostPorts(current.PortMap, current.PortRange,
+			[]network.PortMapping{{Protocol: protocol, HostPort: hostPort}}, nil)
+		if len(keptMap) == len(current.PortMap) && len(keptRange) == len(current.PortRange) {
+			return fmt.Errorf("%w: %s has no %s forward on host port %d", ErrNoForward, vmName, protocol, hostPort)
+		}
+		current.PortMap, current.PortRange = keptMap, keptRange
+		return nil
+	})
+}
+
+/*
+editVMConfig applies edit to a copy of the VM's config and writes the result - a config left
+without forwards is removed, as ClearVMForwardingConfig does. edit also gets every VM's config and
+runs under the config file lock.
+*/
+func editVMConfig(vmName string, edit func(network.ForwardingConfigs, *network.ForwardingConfig) error) (before, after *network.ForwardingConfig, err error) {
+	var current network.ForwardingConfig
+	var remove bool
+
+	err = updateConfigs(func(configs *network.ForwardingConfigs) error {
+		index := -1
+		current = network.ForwardingConfig{VMName: vmName}
+		for i, cfg := range configs.Configs {
+			if cfg.VMName == vmName {
+				index = i
+				original := copyConfig(cfg)
+				before, current = &original, copyConfig(cfg)
+				break
+			}
+		}
+
+		if err := edit(*configs, &current); err != nil {
+			return err
+		}
+		current.VMName = vmName
+		current.LastUpdated = time.Now().Format(time.RFC3339)
+
+		remove = len(current.PortMap) == 0 && len(current.PortRange) == 0
+		switch {
+		case remove && index >= 0:
+			configs.Configs = append(configs.Configs[:index], configs.Configs[index+1:]...)
+		case remove:
+		case index >= 0:
+			configs.Configs[index] = current
+		default:
+			configs.Configs = append(configs.Configs, current)
+		}
+		configs.LastUpdated = current.LastUpdated
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	if remove {
+		return before, nil, nil
+	}
+	return before, &current, nil
+}
+
+/*
+ApplyForwardingChange replaces the rules of before with those of after when the VM is running -
+a stopped VM gets its rules from the hook when it starts. Either side may be nil. Returns whether
+the VM was running.
+
+Do not call it from the hook itself, it asks libvirt for the domain state.
+
+Usage:
+
+	before, after, err := qemu_hooks.RemovePortMapping("kafka", 9094, network.TCP)
+	if err == nil {
+		_, err = qemu_hooks.ApplyForwardingChange(before, after)
+	}
+*/
+func ApplyForwardingChange(before, after *network.ForwardingConfig) (bool, error) {
+	vmName := ""
+	switch {
+	case after != nil:
+		vmName = after.VMName
+	case before != nil:
+		vmName = before.VMName
+	default:
+		return false, nil
+	}
+
+	running, err := domainRunning(vmName)
+	if err != nil || !running {
+		return false, err
+	}
+
+	backend := ConfiguredBackend()
+	var cmds []Command
+	if before != nil {
+		cmds = append(cmds, backend.Stop(before)...)
+	}
+	if after != nil {
+		cmds = append(cmds, backend.Start(after)...)
+	}
+
+	results, err := ApplyCommands(cmds)
+	for _, result := range results {
+		if result.Err != nil {
+			log.Printf(" %s %s", utils.CROSS_RED, result.Err)
+		}
+	}
+	return true, err
+}
+
+// domainRunning is false for a VM libvirt does not know - its forwards only live in the config
+func domainRunning(vmName string) (bool, error) {
+	conn, err := connection.Connect()
+	if err != nil {
+		return false, fmt.Errorf("failed to connect to libvirt: %v", err)
+	}
+	defer conn.Close()
+
+	dom, err := conn.LookupDomainByName(vmName)
+	if err != nil {
+		var virErr libvirt.Error
+		if errors.As(err, &virErr) && virErr.Code == libvirt.ERR_NO_DOMAIN {
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to look up %s: %v", vmName, err)
+	}
+	defer dom.Free()
+
+	return dom.IsActive()
+}
+
+// copyConfig keeps before intact while the edit changes the slices
+func copyConfig(cfg network.ForwardingConfig) network.ForwardingConfig {
+	cfg.PortMap = append([]network.PortMapping(nil), cfg.PortMap...)
+	cfg.PortRange = append([]network.PortRange(nil), cfg.PortRange...)
+	return cfg
+}
@@ -0,0 +1,168 @@
+package qemu_hooks
+
+import (
+	"fmt"
+	"strings"
+
+	"kvmgo/config"
+	"kvmgo/network"
+)
+
+/*
+Command is one invocation a ForwardingBackend needs - Stdin is fed to it, nft -f - reads its ruleset there.
+
+Unless and OnlyIf make it safe to run twice, as the hook does on restarts and reconnects - the
+iptables rule a -I would insert again is first looked up with -C.
+*/
+type Command struct {
+	Args   []string
+	Stdin  string
+	Unless []string // skip when this succeeds - the rule or chain is already there
+	OnlyIf []string // skip when this fails - there is nothing to remove
+}
+
+// String is the command as it would be typed - a heredoc carries Stdin
+func (c Command) String() string {
+	cmd := strings.Join(c.Args, " ")
+	switch {
+	case len(c.Unless) > 0:
+		cmd = strings.Join(c.Unless, " ") + " || " + cmd
+	case len(c.OnlyIf) > 0:
+		cmd = strings.Join(c.OnlyIf, " ") + " && " + cmd
+	}
+	if c.Stdin == "" {
+		return cmd
+	}
+	return fmt.Sprintf("%s <<'EOF'\n%sEOF", cmd, c.Stdin)
+}
+
+/*
+ForwardingBackend turns a VM's ForwardingConfig into the host commands that expose its ports
+and take them down again. The backends only render commands - nothing here touches the host.
+
+	iptables  DNAT-<vm>, SNAT-<vm> and FWD-<vm> chains jumped to from nat and filter
+	nftables  a kvmetal-<vm> table, created and replaced in one nft -f transaction
+
+Usage:
+
+	backend, _ := qemu_hooks.NewForwardingBackend("nftables")
+	for _, cmd := range backend.Start(&fwdConfig) {
+		fmt.Println(cmd)
+	}
+*/
+type ForwardingBackend interface {
+	Name() string
+	Start(fwd *network.ForwardingConfig) []Command // forward the VM's ports
+	Stop(fwd *network.ForwardingConfig) []Command  // remove everything Start added
+}
+
+// NewForwardingBackend is the backend for the forwarding setting of the config
+func NewForwardingBackend(name string) (ForwardingBackend, error) {
+	switch name {
+	case config.ForwardingIPTables, "":
+		return IPTables{}, nil
+	case config.ForwardingNFTables:
+		return NFTables{}, nil
+	}
+	return nil, fmt.Errorf("unknown forwarding backend %q - must be %s or %s", name, config.ForwardingIPTables, config.ForwardingNFTables)
+}
+
+// ConfiguredBackend is the backend the current config selects - the config rejects unknown names when loading
+func ConfiguredBackend() ForwardingBackend {
+	backend, err := NewForwardingBackend(config.Current().Forwarding)
+	if err != nil {
+		return IPTables{}
+	}
+	return backend
+}
+
+// ForwardingCommands are the commands backend needs for a qemu hook action - reconnect rebuilds the rules
+// and release repeats the cleanup of stopped, for a domain that went away without it
+func ForwardingCommands(backend ForwardingBackend, action HookAction, fwd *network.ForwardingConfig) []Command {
+	switch action {
+	case Start:
+		return backend.Start(fwd)
+	case Stopped, Release:
+		return backend.Stop(fwd)
+	case Reconnect:
+		return append(backend.Stop(fwd), backend.Start(fwd)...)
+	}
+	return []Command{}
+}
+
+// IPTables forwards through a DNAT, SNAT and FWD chain per VM - the rules come from PopulateChains and InsertChains
+type IPTables struct{}
+
+func (IPTables) Name() string { return config.ForwardingIPTables }
+
+// Start creates the chains or flushes what an earlier start left in them, then fills them and jumps to them once
+func (IPTables) Start(fwd *network.ForwardingConfig) []Command {
+	dnat, snat, filter := NewChain(fwd.VMName, DNAT), NewChain(fwd.VMName, SNAT), NewChain(fwd.VMName, FWD)
+
+	var cmds []Command
+	for _, chain := range vmChains(dnat, snat, filter) {
+		cmds = append(cmds,
+			Command{Args: strings.Fields(chain.CreateChain(chain.table)), Unless: strings.Fields(chain.ListChain(chain.table))},
+			Command{Args: strings.Fields(chain.FlushChain(chain.table))})
+	}
+
+	cmds = append(cmds, iptablesCommands(PopulateChains(dnat, snat, filter,
+		fwd.HostIP, fwd.PrivateIP, fwd.ExternalIP,
+		fwd.PortMap, fwd.PortRange, fwd.Interface))...)
+
+	checks := InsertChains(CHECK, dnat, snat, filter, fwd.HostIP, fwd.PrivateIP)
+	for i, insert := range InsertChains(INSERT, dnat, snat, filter, fwd.HostIP, fwd.PrivateIP) {
+		cmds = append(cmds, Command{Args: strings.Fields(insert), Unless: strings.Fields(checks[i])})
+	}
+	return cmds
+}
+
+// Stop removes the jumps and chains that exist - a VM stopped twice or never started is fine
+func (IPTables) Stop(fwd *network.ForwardingConfig) []Command {
+	dnat, snat, filter := NewChain(fwd.VMName, DNAT), NewChain(fwd.VMName, SNAT), NewChain(fwd.VMName, FWD)
+
+	var cmds []Command
+	checks := InsertChains(CHECK, dnat, snat, filter, fwd.HostIP, fwd.PrivateIP)
+	for i, remove := range InsertChains(DELETE, dnat, snat, filter, fwd.HostIP, fwd.PrivateIP) {
+		cmds = append(cmds, Command{Args: strings.Fields(remove), OnlyIf: strings.Fields(checks[i])})
+	}
+
+	for _, chain := range vmChains(dnat, snat, filter) {
+		for _, cmd := range iptablesCommands([]string{chain.DeleteChain(chain.table)}) {
+			cmd.OnlyIf = strings.Fields(chain.ListChain(chain.table))
+			cmds = append(cmds, cmd)
+		}
+	}
+	return cmds
+}
+
+type tableChain struct {
+	LibvirtChain
+	table string
+}
+
+func vmChains(dnat, snat, filter LibvirtChain) []tableChain {
+	return []tableChain{{dnat, "nat"}, {snat, "nat"}, {filter, "filter"}}
+}
+
+// iptablesCommands splits the generated lines - DeleteChain returns the flush and delete together
+func iptablesCommands(lines []string) []Command {
+	var cmds []Command
+	for _, line := range lines {
+		for _, cmd := range strings.Split(line, "\n") {
+			if args := strings.Fields(cmd); len(args) > 0 {
+				cmds = append(cmds, Command{Args: args})
+			}
+		}
+	}
+	return cmds
+}
+
+// CommandStrings renders cmds for the artifacts and the hook's cmds file
+func CommandStrings(cmds []Command) []string {
+	lines := make([]string, 0, len(cmds))
+	for _, cmd := range cmds {
+		lines = append(lines, cmd.String())
+	}
+	return lines
+}
@@ -8,52 +8,40 @@ import (
 	"net"
 	"os"
 	"path/filepath"
+	"syscall"
 
+	"kvmgo/config"
+	"kvmgo/lib/connection"
 	"kvmgo/network"
 	"kvmgo/utils"
 
 	"libvirt.org/go/libvirt"
 )
 
-const (
-	configFileDir  = "/home/kuro/Documents/Code/Go/kvmgo/data/network/config/"
-	configFileName = "kvmfwding_config.json"
-)
+// configFilePath is the forwarding config shared by the CLI and the hook - see config.Config.NetworkDir
+func configFilePath() string {
+	return config.Current().ForwardingConfigFile()
+}
 
 // WriteConfigToFile updates or adds a new VM configuration.
 func WriteConfigToFile(vmConfig network.ForwardingConfig) error {
-	configs, err := ReadConfigsFromFile()
-	if err != nil {
-		log.Printf("Error during Writing Configs:%s", err)
-		// File might not exist, create a new configs if so.
-		if os.IsNotExist(err) {
-			configs = network.ForwardingConfigs{Configs: []network.ForwardingConfig{}}
-		} else {
-			return err
-		}
-	}
-
-	// Add or Update the VM configuration
-	updated := false
-	for i, config := range configs.Configs {
-		if config.VMName == vmConfig.VMName {
-			configs.Configs[i] = vmConfig
-			updated = true
-			break
+	return updateConfigs(func(configs *network.ForwardingConfigs) error {
+		// Add or Update the VM configuration
+		for i, config := range configs.Configs {
+			if config.VMName == vmConfig.VMName {
+				configs.Configs[i] = vmConfig
+				return nil
+			}
 		}
-	}
-	if !updated {
 		configs.Configs = append(configs.Configs, vmConfig)
-	}
-
-	// Write back the updated configs
-	return WriteConfigsToFile(configs)
+		return nil
+	})
 }
 
 // ReadConfigFromFile reads the forwarding configuration from a JSON file.
 func ReadVMConfigFromFile(vmName string) (*network.ForwardingConfig, error) {
 	var configs network.ForwardingConfigs
-	filePath := configFileDir + configFileName
+	filePath := configFilePath()
 
 	file, err := os.Open(filePath)
 	if err != nil {
@@ -83,28 +71,23 @@ func ReadVMConfigFromFile(vmName string) (*network.ForwardingConfig, error) {
 
 // ClearVMConfig clears the Forwarding Configuration for a specific VM.
 func ClearVMForwardingConfig(vmName string) error {
-	configs, err := ReadConfigsFromFile()
-	if err != nil {
-		return err
-	}
-
-	// Filter out the VM configuration to remove
-	newConfigs := make([]network.ForwardingConfig, 0)
-	for _, cfg := range configs.Configs {
-		if cfg.VMName != vmName {
-			newConfigs = append(newConfigs, cfg)
+	return updateConfigs(func(configs *network.ForwardingConfigs) error {
+		// Filter out the VM configuration to remove
+		newConfigs := make([]network.ForwardingConfig, 0)
+		for _, cfg := range configs.Configs {
+			if cfg.VMName != vmName {
+				newConfigs = append(newConfigs, cfg)
+			}
 		}
-	}
-
-	configs.Configs = newConfigs
-
-	return WriteConfigsToFile(configs)
+		configs.Configs = newConfigs
+		return nil
+	})
 }
 
 // ReadConfigsFromFile reads the VM forwarding configurations from a JSON file.
 func ReadConfigsFromFile() (network.ForwardingConfigs, error) {
 	var configs network.ForwardingConfigs
-	filePath := filepath.Join(configFileDir, configFileName)
+	filePath := configFilePath()
 	file, err := os.Open(filePath)
 	if err != nil {
 		if os.IsNotExist(err) {
@@ -128,45 +111,104 @@ func ReadConfigsFromFile() (network.ForwardingConfigs, error) {
 	return configs, nil
 }
 
-// WriteConfigsToFile writes the VM forwarding configurations to a JSON file.
+/*
+WriteConfigsToFile replaces the forwarding config file with configs. The file is written to a temp
+file and renamed over the old one so the hook never reads a half written document.
+
+It does not lock - edits of the file go through updateConfigs so a read, check and write of one
+invocation cannot interleave with another's.
+*/
 func WriteConfigsToFile(configs network.ForwardingConfigs) error {
-	filePath := filepath.Join(configFileDir, configFileName)
-	file, err := os.Create(filePath)
+	filePath := configFilePath()
+	if err := os.MkdirAll(filepath.Dir(filePath), 0o755); err != nil {
+		return fmt.Errorf("creating config dir: %w", err)
+	}
+
+	data, err := json.MarshalIndent(configs, "", "    ")
+	if err != nil {
+		return fmt.Errorf("encoding configs: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(filePath), ".kvmfwding-*.json")
 	if err != nil {
 		return fmt.Errorf("creating config file: %w", err)
 	}
-	defer file.Close()
+	defer os.Remove(tmp.Name())
 
-	encoder := json.NewEncoder(file)
-	encoder.SetIndent("", "    ")
-	if err := encoder.Encode(configs); err != nil {
+	// the hook runs as root and the CLI as the user - both read it
+	if err := tmp.Chmod(0o644); err != nil {
+		tmp.Close()
+		return fmt.Errorf("creating config file: %w", err)
+	}
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return fmt.Errorf("writing config to file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
 		return fmt.Errorf("writing config to file: %w", err)
 	}
 
+	if err := os.Rename(tmp.Name(), filePath); err != nil {
+		return fmt.Errorf("replacing config file: %w", err)
+	}
+
 	return nil
 }
 
-// Updates the Config so we can incrementally expose VM's
-func UpdateConfig(newConfig network.ForwardingConfig) error {
+// updateConfigs applies fn to the configs under an exclusive lock and writes the result
+func updateConfigs(fn func(*network.ForwardingConfigs) error) error {
+	unlock, err := lockConfigs()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
 	configs, err := ReadConfigsFromFile()
 	if err != nil {
 		return err
 	}
+	if err := fn(&configs); err != nil {
+		return err
+	}
 
-	found := false
-	for i, config := range configs.Configs {
-		if config.VMName == newConfig.VMName {
-			mergeConfigs(&configs.Configs[i], newConfig)
-			found = true
-			break
-		}
+	return WriteConfigsToFile(configs)
+}
+
+// lockConfigs takes an exclusive flock on <config file>.lock
+func lockConfigs() (func(), error) {
+	filePath := configFilePath()
+	if err := os.MkdirAll(filepath.Dir(filePath), 0o755); err != nil {
+		return nil, fmt.Errorf("creating config dir: %w", err)
 	}
 
-	if !found {
-		configs.Configs = append(configs.Configs, newConfig)
+	f, err := os.OpenFile(filePath+".lock", os.O_CREATE|os.O_RDWR, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("opening config lock: %w", err)
 	}
 
-	return WriteConfigsToFile(configs)
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("locking config file: %w", err)
+	}
+
+	return func() {
+		_ = syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+	}, nil
+}
+
+// Updates the Config so we can incrementally expose VM's
+func UpdateConfig(newConfig network.ForwardingConfig) error {
+	return updateConfigs(func(configs *network.ForwardingConfigs) error {
+		for i, config := range configs.Configs {
+			if config.VMName == newConfig.VMName {
+				mergeConfigs(&configs.Configs[i], newConfig)
+				return nil
+			}
+		}
+		configs.Configs = append(configs.Configs, newConfig)
+		return nil
+	})
 }
 
 // Merges new configuration fields into the original configuration without duplicating port mappings or port ranges.
@@ -214,7 +256,7 @@ func mergeConfigs(original *network.ForwardingConfig, newConfig network.Forwardi
 
 // Uses Libvirt Client to get the Domain IP, Gets Host IP, and Writes Default Forwarding Config
 func DomainAddForwardingConfigIfRunning(domain string) error {
-	conn, err := libvirt.NewConnect("qemu:///system")
+	conn, err := connection.Connect()
 	if err != nil {
 		log.Printf("Error Connecting %s", err)
 	}
@@ -277,9 +319,9 @@ func DomainAddForwardingConfigIfRunning(domain string) error {
 
 	log.Printf("Successfully Created Default Forwarding Config")
 
-	if err := utils.WriteArraytoFile(cmds, CmdsFilePath); err != nil {
-		log.Printf("Failed writing generated forwarding commands to file %s ERROR:%s,", CmdsFilePath, err)
+	if err := utils.WriteArraytoFile(cmds, CmdsFilePath()); err != nil {
+		log.Printf("Failed writing generated forwarding commands to file %s ERROR:%s,", CmdsFilePath(), err)
 	}
-	log.Printf("Successfully Generated Commands Logs file at %s", CmdsFilePath)
+	log.Printf("Successfully Generated Commands Logs file at %s", CmdsFilePath())
 	return nil
 }
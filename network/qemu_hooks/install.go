@@ -0,0 +1,435 @@
+package qemu_hooks
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime/debug"
+	"strings"
+	"syscall"
+
+	"kvmgo/config"
+)
+
+// DefaultHooksDir is where libvirt looks for hooks - only when the daemon starts
+const DefaultHooksDir = "/etc/libvirt/hooks"
+
+const (
+	hookMarker   = "# kvmetal qemu hook"
+	hookName     = "qemu"
+	previousHook = "qemu.kvmetal-prev"
+	hookBinary   = "kvmetal"
+)
+
+var ErrHookNotInstalled = errors.New("the kvmetal qemu hook is not installed")
+
+/*
+HookInstaller makes kvmetal libvirt's qemu hook without taking the place of a hook that was
+already there - that one is kept next to it and still runs first:
+
+	/etc/libvirt/hooks/qemu                shim - runs the previous hook, then kvmetal hooks run
+	/etc/libvirt/hooks/qemu.kvmetal-prev   the hook that was installed before, if any
+	/etc/libvirt/hooks/kvmetal             copy of the kvmetal binary the shim calls
+
+libvirtd runs the hook as root with a scrubbed environment, where the XDG defaults are root's. The
+shim pins the network dir and forwarding backend of the config install ran with, so the hook reads
+the forwarding config kvmetal expose writes - under sudo pass --data-dir or --config to pin yours.
+
+libvirtd only looks for hooks when it starts - see RestartLibvirt.
+
+Usage:
+
+	status, err := qemu_hooks.NewHookInstaller().Install()
+	fmt.Println(status.Version, status.UpToDate)
+*/
+type HookInstaller struct {
+	Dir        string // DefaultHooksDir
+	Binary     string // installed as the hook - the running kvmetal by default
+	NetworkDir string // pinned for the hook - where the forwarding config is, config.Current()'s by default
+	Forwarding string // pinned backend - iptables or nftables
+}
+
+func NewHookInstaller() *HookInstaller {
+	binary, _ := os.Executable()
+	cfg := config.Current()
+	return &HookInstaller{Dir: DefaultHooksDir, Binary: binary, NetworkDir: cfg.NetworkDir, Forwarding: cfg.Forwarding}
+}
+
+// Install into dir instead of /etc/libvirt/hooks
+func (h *HookInstaller) SetDir(dir string) *HookInstaller {
+	h.Dir = dir
+	return h
+}
+
+// Install this binary instead of the running one
+func (h *HookInstaller) SetBinary(path string) *HookInstaller {
+	h.Binary = path
+	return h
+}
+
+// Pin the forwarding config in dir for the hook instead of the current config's
+func (h *HookInstaller) SetNetworkDir(dir string) *HookInstaller {
+	h.NetworkDir = dir
+	return h
+}
+
+// HookStatus is what kvmetal hooks status reports
+type HookStatus struct {
+	Hook             string   `json:"hook"`
+	Installed        bool     `json:"installed"`
+	Foreign          bool     `json:"foreign,omitempty"` // a hook kvmetal did not install is in place
+	Binary           string   `json:"binary,omitempty"`
+	Version          string   `json:"version,omitempty"` // of the installed binary
+	Current          string   `json:"current"`           // of the binary install would put in place
+	UpToDate         bool     `json:"up_to_date"`
+	Previous         string   `json:"previous,omitempty"`          // the hook chained before kvmetal
+	ForwardingConfig string   `json:"forwarding_config,omitempty"` // the file the hook reads its forwards from
+	Problems         []string `json:"problems,omitempty"`
+}
+
+func (h *HookInstaller) path(name string) string {
+	return filepath.Join(h.Dir, name)
+}
+
+// Status inspects the hooks dir - a missing dir or hook is reported, not an error
+func (h *HookInstaller) Status() (*HookStatus, error) {
+	status := &HookStatus{Hook: h.path(hookName), Current: BinaryVersion()}
+
+	current, err := fileDigest(h.Binary)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", h.Binary, err)
+	}
+	status.Current += " sha256:" + current[:12]
+
+	shim, err := os.ReadFile(status.Hook)
+	if os.IsNotExist(err) {
+		return status, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", status.Hook, err)
+	}
+	if !isShim(shim) {
+		status.Foreign = true
+		return status, nil
+	}
+
+	status.Installed = true
+	status.Binary = h.path(hookBinary)
+	status.Version = shimVersion(shim)
+	if installed, err := fileDigest(status.Binary); err != nil {
+		status.Problems = append(status.Problems, fmt.Sprintf("%s is missing - the hook cannot run", status.Binary))
+	} else {
+		status.UpToDate = installed == current
+	}
+	if _, err := os.Lstat(h.path(previousHook)); err == nil {
+		status.Previous = h.path(previousHook)
+	}
+
+	status.Problems = append(status.Problems, h.forwardingConfigProblems(status, shimNetworkDir(shim))...)
+	status.Problems = append(status.Problems, h.permissionProblems(status.Hook, status.Binary, status.Previous)...)
+	return status, nil
+}
+
+/*
+forwardingConfigProblems compares the forwarding config the hook reads with the one of whoever
+asks - kvmetal expose writes to the user's, which root does not resolve to on its own.
+*/
+func (h *HookInstaller) forwardingConfigProblems(status *HookStatus, pinned string) []string {
+	expected := (&config.Config{NetworkDir: h.NetworkDir}).ForwardingConfigFile()
+	if pinned == "" {
+		return []string{fmt.Sprintf("the hook resolves its forwarding config from root's environment, not %s - reinstall to pin it", expected)}
+	}
+	status.ForwardingConfig = (&config.Config{NetworkDir: pinned}).ForwardingConfigFile()
+
+	if status.ForwardingConfig != expected {
+		return []string{fmt.Sprintf("the hook reads %s, not %s - reinstall with this config to pin it", status.ForwardingConfig, expected)}
+	}
+	// sudo without -E resolves root's XDG dirs - those are rarely where the user exposed ports
+	home, _ := os.UserHomeDir()
+	if sudoUser := os.Getenv("SUDO_USER"); sudoUser != "" && os.Geteuid() == 0 && home != "" && strings.HasPrefix(pinned, home+"/") {
+		return []string{fmt.Sprintf("the hook reads root's %s, not the one of %s - reinstall with --data-dir or --config", status.ForwardingConfig, sudoUser)}
+	}
+	return nil
+}
+
+/*
+permissionProblems checks what libvirtd runs as root - the hooks must be executable and only
+writable by the hooks dir's owner, root on a real host.
+*/
+func (h *HookInstaller) permissionProblems(paths ...string) []string {
+	dir, err := os.Stat(h.Dir)
+	if err != nil {
+		return []string{fmt.Sprintf("cannot stat %s: %v", h.Dir, err)}
+	}
+	owner := fileOwner(dir)
+
+	var problems []string
+	for _, path := range append([]string{h.Dir}, paths...) {
+		if path == "" {
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		if info.Mode().Perm()&0o022 != 0 {
+			problems = append(problems, fmt.Sprintf("%s is writable by group or others (%s)", path, info.Mode().Perm()))
+		}
+		if !info.IsDir() && info.Mode().Perm()&0o100 == 0 {
+			problems = append(problems, fmt.Sprintf("%s is not executable - libvirt skips it", path))
+		}
+		if uid := fileOwner(info); uid != owner {
+			problems = append(problems, fmt.Sprintf("%s is owned by uid %d, not %d like %s", path, uid, owner, h.Dir))
+		}
+	}
+	return problems
+}
+
+/*
+Install copies the binary and puts the shim in place of the qemu hook. A foreign hook is moved to
+qemu.kvmetal-prev first and chained; reinstalling over kvmetal's own shim only updates it.
+*/
+func (h *HookInstaller) Install() (*HookStatus, error) {
+	if err := os.MkdirAll(h.Dir, 0o755); err != nil {
+		return nil, permissionHint(fmt.Errorf("failed to create %s: %v", h.Dir, err))
+	}
+
+	digest, err := fileDigest(h.Binary)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", h.Binary, err)
+	}
+	if err := copyExecutable(h.Binary, h.path(hookBinary)); err != nil {
+		return nil, permissionHint(err)
+	}
+
+	shimPath := h.path(hookName) + ".kvmetal-new"
+	shim := fmt.Sprintf(hookShim, hookMarker, BinaryVersion(), digest[:12], h.path(previousHook), h.path(hookBinary),
+		config.EnvNetworkDir, shellQuote(h.NetworkDir), config.EnvForwarding, shellQuote(h.Forwarding))
+	if err := os.WriteFile(shimPath, []byte(shim), 0o755); err != nil {
+		return nil, permissionHint(fmt.Errorf("failed to write %s: %v", shimPath, err))
+	}
+	// a shim that does not parse would fail every domain start
+	if out, err := exec.Command("sh", "-n", shimPath).CombinedOutput(); err != nil {
+		os.Remove(shimPath)
+		return nil, fmt.Errorf("generated hook does not parse: %v %s", err, out)
+	}
+
+	hook := h.path(hookName)
+	existing, err := os.ReadFile(hook)
+	moved := false
+	if err == nil && !isShim(existing) {
+		if _, err := os.Lstat(h.path(previousHook)); err == nil {
+			os.Remove(shimPath)
+			return nil, fmt.Errorf("%s and %s both exist - move one of them away first", hook, h.path(previousHook))
+		}
+		if err := os.Rename(hook, h.path(previousHook)); err != nil {
+			os.Remove(shimPath)
+			return nil, fmt.Errorf("failed to keep the existing hook %s: %v", hook, err)
+		}
+		moved = true
+	}
+
+	if err := os.Rename(shimPath, hook); err != nil {
+		if moved {
+			os.Rename(h.path(previousHook), hook)
+		}
+		os.Remove(shimPath)
+		return nil, fmt.Errorf("failed to install %s: %v", hook, err)
+	}
+
+	return h.Status()
+}
+
+// Uninstall removes the shim and binary and puts the previous hook back where it was
+func (h *HookInstaller) Uninstall() error {
+	hook := h.path(hookName)
+	existing, err := os.ReadFile(hook)
+	if os.IsNotExist(err) {
+		return ErrHookNotInstalled
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %v", hook, err)
+	}
+	if !isShim(existing) {
+		return fmt.Errorf("%s was not installed by kvmetal - leaving it in place", hook)
+	}
+
+	if err := os.Remove(hook); err != nil {
+		return permissionHint(fmt.Errorf("failed to remove %s: %v", hook, err))
+	}
+	if _, err := os.Lstat(h.path(previousHook)); err == nil {
+		if err := os.Rename(h.path(previousHook), hook); err != nil {
+			return fmt.Errorf("failed to restore the previous hook %s: %v", h.path(previousHook), err)
+		}
+	}
+	if err := os.Remove(h.path(hookBinary)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove %s: %v", h.path(hookBinary), err)
+	}
+	return nil
+}
+
+/*
+RestartLibvirt restarts the daemon that runs qemu hooks so it finds the new one - virtqemud on
+hosts with the modular daemons, libvirtd otherwise. Running VMs keep running and get a reconnect
+event, which rebuilds their forwarding. Returns the unit, empty when none was running - libvirt
+then picks the hook up when it starts.
+*/
+func RestartLibvirt() (string, error) {
+	for _, unit := range []string{"virtqemud", "libvirtd"} {
+		if exec.Command("systemctl", "is-active", "--quiet", unit).Run() != nil {
+			continue
+		}
+		if out, err := exec.Command("systemctl", "restart", unit).CombinedOutput(); err != nil {
+			return unit, fmt.Errorf("failed to restart %s: %v %s", unit, err, strings.TrimSpace(string(out)))
+		}
+		if err := exec.Command("systemctl", "is-active", "--quiet", unit).Run(); err != nil {
+			return unit, fmt.Errorf("%s is not running after the restart - check journalctl -u %s", unit, unit)
+		}
+		return unit, nil
+	}
+	return "", nil
+}
+
+// BinaryVersion is the commit kvmetal was built from - "devel" when go did not record one
+func BinaryVersion() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "devel"
+	}
+	revision, dirty := "", false
+	for _, setting := range info.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			revision = setting.Value
+		case "vcs.modified":
+			dirty = setting.Value == "true"
+		}
+	}
+	if revision == "" {
+		return "devel"
+	}
+	if len(revision) > 12 {
+		revision = revision[:12]
+	}
+	if dirty {
+		revision += "-dirty"
+	}
+	return revision
+}
+
+// libvirt passes the domain XML on stdin - each hook gets its own copy. A failing previous hook
+// fails the event the way it did before kvmetal was installed. Only kvmetal gets the pinned config.
+const hookShim = `#!/bin/sh
+%s version=%s sha256=%s
+# Installed by kvmetal hooks install - kvmetal hooks uninstall puts the previous hook back.
+xml=$(cat)
+if [ -x %[4]s ]; then
+	printf '%%s\n' "$xml" | %[4]s "$@" || exit $?
+fi
+%[6]s=%[7]s
+%[8]s=%[9]s
+export %[6]s %[8]s
+printf '%%s\n' "$xml" | %[5]s hooks run "$@"
+`
+
+// shellQuote single quotes s for the shim
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// shimNetworkDir reads the pinned network dir back - empty for a shim from before it was pinned
+func shimNetworkDir(content []byte) string {
+	for _, line := range strings.Split(string(content), "\n") {
+		if value, ok := strings.CutPrefix(line, config.EnvNetworkDir+"="); ok {
+			value = strings.TrimSuffix(strings.TrimPrefix(value, "'"), "'")
+			return strings.ReplaceAll(value, `'\''`, "'")
+		}
+	}
+	return ""
+}
+
+func isShim(content []byte) bool {
+	return strings.Contains(string(content), "\n"+hookMarker+" ")
+}
+
+// shimVersion reads version and sha256 back from the shim's marker line
+func shimVersion(content []byte) string {
+	for _, line := range strings.Split(string(content), "\n") {
+		if !strings.HasPrefix(line, hookMarker+" ") {
+			continue
+		}
+		var version, digest string
+		for _, field := range strings.Fields(strings.TrimPrefix(line, hookMarker)) {
+			if v, ok := strings.CutPrefix(field, "version="); ok {
+				version = v
+			}
+			if d, ok := strings.CutPrefix(field, "sha256="); ok {
+				digest = d
+			}
+		}
+		return version + " sha256:" + digest
+	}
+	return ""
+}
+
+func fileDigest(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// copyExecutable writes src next to dst and renames it over - a hook running the old binary keeps it
+func copyExecutable(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %v", src, err)
+	}
+	defer in.Close()
+
+	tmp := dst + ".kvmetal-new"
+	out, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o755)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %v", tmp, err)
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(tmp)
+		return fmt.Errorf("failed to copy %s to %s: %v", src, tmp, err)
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to write %s: %v", tmp, err)
+	}
+	if err := os.Rename(tmp, dst); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to install %s: %v", dst, err)
+	}
+	return nil
+}
+
+func fileOwner(info os.FileInfo) uint32 {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return stat.Uid
+	}
+	return 0
+}
+
+func permissionHint(err error) error {
+	if errors.Is(err, os.ErrPermission) {
+		return fmt.Errorf("%v - the hooks dir belongs to root, run with sudo", err)
+	}
+	return err
+}
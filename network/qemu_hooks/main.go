@@ -2,6 +2,7 @@ package qemu_hooks
 
 import (
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"os"
@@ -9,7 +10,9 @@ import (
 	"slices"
 	"time"
 
+	"kvmgo/config"
 	"kvmgo/network"
+	"kvmgo/utils"
 )
 
 /*
@@ -43,10 +46,10 @@ func main() {
 	if err != nil {
 		logger.Printf("Error Handling Qemu Hooks Event for %s ERROR:%s", action, err)
 	}
-	if err := utils.WriteArraytoFile(cmds, CmdsFilePath); err != nil {
-		logger.Printf("Failed writing generated forwarding commands to file %s ERROR:%s,", CmdsFilePath, err)
+	if err := utils.WriteArraytoFile(cmds, CmdsFilePath()); err != nil {
+		logger.Printf("Failed writing generated forwarding commands to file %s ERROR:%s,", CmdsFilePath(), err)
 	}
-	logger.Printf("Successfully Generated Commands Logs file at %s", CmdsFilePath)
+	logger.Printf("Successfully Generated Commands Logs file at %s", CmdsFilePath())
 }
 */
 
@@ -56,33 +59,93 @@ Creates the Forwarding Rules according to the Action for the Host
   - Generates and Returns the Array containing the Commands
 */
 func HandleQemuHookEvent(action, domain string) ([]string, error) {
-	readConfig, err := ReadVMConfigFromFile(domain)
+	cmds, err := HookEventCommands(action, domain)
 	if err != nil {
 		fmt.Println("Error reading config:", err)
 		return []string{}, err
 	}
+	return CommandStrings(cmds), nil
+}
+
+/*
+HookEventCommands are the forwarding commands for a libvirt hook event - start forwards the
+domain's ports, stopped and release remove them and reconnect rebuilds them. Other events and
+domains without a forwarding config need none.
+*/
+func HookEventCommands(action, domain string) ([]Command, error) {
+	fwd, err := ReadVMConfigFromFile(domain)
+	if err != nil || fwd == nil {
+		return nil, err
+	}
 
-	table := network.CreateTableFromConfig(*readConfig)
-	fmt.Println(table)
+	switch hookAction := HookAction(action); hookAction {
+	case Start, Stopped, Reconnect, Release:
+		return ForwardingCommands(ConfiguredBackend(), hookAction, fwd), nil
+	}
+	return nil, nil
+}
+
+/*
+RunHookEvent is the hook itself - it applies the forwarding the event needs and logs each failed or
+skipped command to the hook log. Failed commands are only logged: a failing start hook would keep
+libvirt from starting the domain at all. The error is for a hook log that cannot be opened.
+*/
+func RunHookEvent(domain, action string) error {
+	logger, err := LogHookEvent(domain, action)
+	if err != nil {
+		return err
+	}
+
+	cmds, err := HookEventCommands(action, domain)
+	if err != nil {
+		logger.Printf("Error Handling Qemu Hooks Event for %s ERROR:%s", action, err)
+		return nil
+	}
+	if len(cmds) == 0 {
+		return nil
+	}
+
+	if err := utils.WriteArraytoFile(CommandStrings(cmds), CmdsFilePath()); err != nil {
+		logger.Printf("Failed writing generated forwarding commands to file %s ERROR:%s,", CmdsFilePath(), err)
+	}
+
+	results, err := ApplyCommands(cmds)
+	for _, result := range results {
+		switch {
+		case result.Err != nil:
+			logger.Printf("FAILED %s", result.Err)
+		case result.Skipped:
+			logger.Printf("Skipped %s", result.Command)
+		}
+	}
+	if err != nil {
+		logger.Printf("Forwarding for %s on %s incomplete: %s", domain, action, err)
+		return nil
+	}
+	logger.Printf("Applied forwarding for %s on %s - %d commands", domain, action, len(cmds))
+	return nil
+}
 
-	switch action {
-	case "start":
-		return HandleForwardingEvent(Start, readConfig), nil
-	case "stopped":
-		return HandleForwardingEvent(Stopped, readConfig), nil
-	case "reconnect":
-		return HandleForwardingEvent(Reconnect, readConfig), nil
+// PrintHookEvent writes the commands RunHookEvent would run for the event to w
+func PrintHookEvent(w io.Writer, domain, action string) error {
+	cmds, err := HookEventCommands(action, domain)
+	if err != nil {
+		return fmt.Errorf("Error Handling Qemu Hooks Event for %s ERROR:%s", action, err)
+	}
+	for _, cmd := range cmds {
+		fmt.Fprintln(w, cmd)
 	}
-	return []string{}, nil
+	return nil
 }
 
 // https://www.libvirt.org/hooks.html
 
 // !!!! When a VM is shutdown - make sure to call  qemu_hooks.ClearVMConfig("spark") !!!!
 
-const logfileDir = "/home/kuro/Documents/Code/Go/kvmgo/data/network/logs/"
-
-const CmdsFilePath = "/home/kuro/Documents/Code/Go/kvmgo/data/network/logs/cmds"
+// CmdsFilePath is where the last generated forwarding commands are written - under config log_dir
+func CmdsFilePath() string {
+	return config.Current().CmdsFile()
+}
 
 /* IMPORTANT: Do NOT call any Libvirt API within a Hook
 
@@ -114,13 +177,12 @@ type ChainAction string
 const (
 	INSERT ChainAction = "-I"
 	DELETE ChainAction = "-D"
+	CHECK  ChainAction = "-C" // exits 0 when the rule is already there
 )
 
 // table = "nat"/"filter", name = dnat/snat/fwd chain
 func (c *LibvirtChain) CreateChain(table string) string {
-	chain := fmt.Sprintf("sudo iptables -t %s -N %s", table, c.String())
-	fmt.Println(chain)
-	return chain
+	return fmt.Sprintf("sudo iptables -t %s -N %s", table, c.String())
 }
 
 func (c *LibvirtChain) DeleteChain(table string) string {
@@ -129,6 +191,15 @@ func (c *LibvirtChain) DeleteChain(table string) string {
 		fmt.Sprintf("sudo iptables -t %s -X %s", table, c.String())
 }
 
+// ListChain succeeds only when the chain exists
+func (c *LibvirtChain) ListChain(table string) string {
+	return fmt.Sprintf("sudo iptables -t %s -S %s", table, c.String())
+}
+
+func (c *LibvirtChain) FlushChain(table string) string {
+	return fmt.Sprintf("sudo iptables -t %s -F %s", table, c.String())
+}
+
 func (c *LibvirtChain) String() string {
 	return fmt.Sprintf("%s-%s", string(c.ChainType), c.VMName)
 }
@@ -142,42 +213,9 @@ func NewChain(vmName string, chainType ChainHook) LibvirtChain {
 	return LibvirtChain{VMName: vmName, ChainType: chainType}
 }
 
+// HandleForwardingEvent renders the commands for action with the backend the config selects
 func HandleForwardingEvent(action HookAction, forwardingConfig *network.ForwardingConfig) []string {
-	dnat_chain := NewChain(forwardingConfig.VMName, DNAT)
-	snat_chain := NewChain(forwardingConfig.VMName, SNAT)
-	fwd_chain := NewChain(forwardingConfig.VMName, FWD)
-
-	switch action {
-	case Start:
-		return StartForwarding(
-			dnat_chain, snat_chain, fwd_chain,
-			forwardingConfig.HostIP, forwardingConfig.PrivateIP, forwardingConfig.ExternalIP,
-			forwardingConfig.PortMap, forwardingConfig.PortRange, forwardingConfig.Interface,
-		)
-
-	case Stopped:
-		return StopForwarding(
-			dnat_chain, snat_chain, fwd_chain,
-			forwardingConfig.HostIP, forwardingConfig.PrivateIP,
-		)
-
-	case Reconnect:
-		stopFirst := StopForwarding(
-			dnat_chain, snat_chain, fwd_chain,
-			forwardingConfig.HostIP, forwardingConfig.PrivateIP,
-		)
-
-		return append(stopFirst,
-			StartForwarding(
-				dnat_chain, snat_chain, fwd_chain,
-				forwardingConfig.HostIP, forwardingConfig.PrivateIP, forwardingConfig.ExternalIP,
-				forwardingConfig.PortMap, forwardingConfig.PortRange, forwardingConfig.Interface,
-			)...,
-		)
-
-	default:
-		return []string{}
-	}
+	return CommandStrings(ForwardingCommands(ConfiguredBackend(), action, forwardingConfig))
 }
 
 func StartForwarding(
@@ -205,8 +243,7 @@ func StartForwarding(
 		dnatChain, snatChain, fwdChain,
 		hostIp, vmPrivateIp)
 
-	combinedCmds := []string{"\n================================\nBegin Port Forwarding Commands:\n================================\n"}
-
+	var combinedCmds []string
 	combinedCmds = append(combinedCmds, dnatCmd, snatCmd, fwdCmd)
 	combinedCmds = append(combinedCmds, populated...)
 	combinedCmds = append(combinedCmds, insertChains...)
@@ -235,8 +272,8 @@ func PopulateChains(
 			mapping.HostPort,
 			vmIPandPort)
 
-		// Only enable access from Specified Whitelisted External IP if specified - else open
-		if externalIP != nil {
+		// Only enable access from Specified Whitelisted External IP if specified - else open, as for 0.0.0.0
+		if externalIP != nil && !externalIP.IsUnspecified() {
 			dnatCmd += fmt.Sprintf(" -s %s", externalIP.String())
 		}
 
@@ -248,11 +285,12 @@ func PopulateChains(
 			mapping.VMPort,
 			hostIP.String())
 
+		// POSTROUTING sees the port after DNAT - the VM's
 		masqCmd := fmt.Sprintf("sudo iptables -t nat -A %s -p %s -s %s -d %s --dport %d -j MASQUERADE",
 			snatChain.String(),
 			mapping.Protocol,
 			vmPrivateIP.String(),
-			vmPrivateIP.String(), mapping.HostPort)
+			vmPrivateIP.String(), mapping.VMPort)
 
 		fwdCmd := fmt.Sprintf("sudo iptables -t filter -A %s -p %s -d %s --dport %d -j ACCEPT",
 			fwdChain.String(),
@@ -270,34 +308,52 @@ func PopulateChains(
 	// Handle port ranges
 	for _, rangeMapping := range rangePortMappings {
 
+		if rangeMapping.HostStartPortNum == 0 || rangeMapping.HostEndPortNum == 0 ||
+			rangeMapping.VMStartPort == 0 || rangeMapping.VMEndPortNum == 0 {
+			log.Printf("Invalid Range Port Mapping Passed. Skipping")
+			continue
+		}
+
 		portRange := fmt.Sprintf("%d:%d", rangeMapping.HostStartPortNum, rangeMapping.HostEndPortNum)
-		vmPortRange := fmt.Sprintf("%s:%d-%d", vmPrivateIP.String(), rangeMapping.VMStartPort, rangeMapping.VMEndPortNum)
+		vmRange := fmt.Sprintf("%d:%d", rangeMapping.VMStartPort, rangeMapping.VMEndPortNum)
 		protocol := string(rangeMapping.Protocol)
 
-		dnatCmd := fmt.Sprintf("sudo iptables -t nat -A %s -p %s -d %s --dport %s -j DNAT --to %s",
+		// A port range alone is not kept in order - /base maps host 8000 to vm 9000, 8001 to 9001 and so on
+		vmPortRange := vmPrivateIP.String()
+		if rangeMapping.HostStartPortNum != rangeMapping.VMStartPort {
+			vmPortRange = fmt.Sprintf("%s:%d-%d/%d", vmPrivateIP.String(),
+				rangeMapping.VMStartPort, rangeMapping.VMEndPortNum, rangeMapping.HostStartPortNum)
+		}
+
+		dnatCmd := fmt.Sprintf("sudo iptables -t nat -A %s -p %s -d %s --dport %s -j DNAT --to-destination %s",
 			dnatChain.String(), protocol,
 			hostIP.String(), portRange, vmPortRange)
 
+		if externalIP != nil && !externalIP.IsUnspecified() {
+			dnatCmd += fmt.Sprintf(" -s %s", externalIP.String())
+		}
+
 		// SNAT command for outgoing traffic to be masqueraded as from the host
 		snatCmd := fmt.Sprintf("sudo iptables -t nat -A %s -p %s -s %s --dport %s -j SNAT --to-source %s",
 			snatChain.String(),
 			rangeMapping.Protocol,
 			vmPrivateIP.String(),
-			portRange,
+			vmRange,
 			hostIP.String())
 
+		// POSTROUTING sees the port after DNAT - the VM's
 		masqCmd := fmt.Sprintf("sudo iptables -t nat -A %s -p %s -s %s -d %s --dport %s -j MASQUERADE",
 			snatChain.String(),
 			rangeMapping.Protocol,
 			vmPrivateIP.String(),
 			vmPrivateIP.String(),
-			portRange)
+			vmRange)
 
 		fwdCmd := fmt.Sprintf("sudo iptables -t filter -A %s -p %s -d %s --dport %s -j ACCEPT",
 			fwdChain.String(),
 			rangeMapping.Protocol,
 			vmPrivateIP.String(),
-			portRange)
+			vmRange)
 
 		// Conditionally add interface specification
 		if net_interface != "" {
@@ -343,10 +399,7 @@ func InsertChains(action ChainAction, dnatChain, snatChain, fwdChain LibvirtChai
 func StopForwarding(dnatChain, snatChain, fwdChain LibvirtChain,
 	hostIp, vmPrivateIp net.IP,
 ) []string {
-	stopCommands := []string{"\n===============================\nStop Port Forwarding Commands:\n===============================\n"}
-
 	return slices.Concat(
-		stopCommands,
 		InsertChains(DELETE,
 			dnatChain, snatChain, fwdChain, hostIp, vmPrivateIp),
 		[]string{
@@ -358,13 +411,17 @@ func StopForwarding(dnatChain, snatChain, fwdChain LibvirtChain,
 }
 
 func LogHookEvent(domain, action string) (*log.Logger, error) {
-	logfilePath := filepath.Join(logfileDir, "libvirtHookEvents.log")
+	logfilePath := config.Current().HookLogFile()
+	if err := os.MkdirAll(filepath.Dir(logfilePath), 0o755); err != nil {
+		log.Printf("Failed to create log dir: %v", err)
+		return nil, err
+	}
 	logFile, err := os.OpenFile(logfilePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
 	if err != nil {
 		log.Printf("Failed to open log file: %v", err)
 		return nil, err
 	}
-	defer logFile.Close()
+	// left open - the hook logs the event's command results to it and exits right after
 
 	logger := log.New(logFile, "LIBVIRT_HOOK: ", log.LstdFlags)
 
@@ -0,0 +1,179 @@
+package qemu_hooks
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+
+	"kvmgo/config"
+	"kvmgo/network"
+)
+
+/*
+NFTables forwards a VM's ports with its own table, so a VM never touches another VM's rules or
+libvirt's. The table mirrors the iptables chains - base chains match the host and VM address and
+jump to dnat, snat and fwd, which hold one rule per mapping:
+
+	table ip kvmetal-kafka {
+		chain prerouting {
+			type nat hook prerouting priority -100; policy accept;
+			ip daddr 192.168.1.10 jump dnat
+		}
+		...
+		chain dnat {
+			ip daddr 192.168.1.10 tcp dport 9092 dnat to 192.168.122.50:9092
+		}
+	}
+
+Start declares, deletes and recreates the table in a single nft -f run, so reapplying a changed
+config replaces every rule at once and a VM is never left half forwarded.
+
+Accepting in fwd does not override a drop in another table - when libvirt's own rules reject new
+connections to the network, those have to allow the forwarded ports too.
+*/
+type NFTables struct{}
+
+func (NFTables) Name() string { return config.ForwardingNFTables }
+
+func (n NFTables) Start(fwd *network.ForwardingConfig) []Command {
+	return []Command{{Args: []string{"sudo", "nft", "-f", "-"}, Stdin: n.Ruleset(fwd).Render()}}
+}
+
+func (n NFTables) Stop(fwd *network.ForwardingConfig) []Command {
+	return []Command{{Args: []string{"sudo", "nft", "-f", "-"}, Stdin: n.Ruleset(fwd).RenderDelete()}}
+}
+
+// NFTRuleset is a VM's table as data - Render turns it into nft -f input
+type NFTRuleset struct {
+	Family string // ip, or ip6 for a VM forwarded on its IPv6 address
+	Table  string
+	Chains []NFTChain
+}
+
+// NFTChain is a base chain when Hook is set, otherwise a regular chain jumped to
+type NFTChain struct {
+	Name     string
+	Type     string // nat or filter
+	Hook     string
+	Priority int
+	Rules    []string
+}
+
+// NFTTable is the name of the VM's table
+func NFTTable(vmName string) string {
+	return "kvmetal-" + vmName
+}
+
+// Ruleset builds the VM's table from its forwarding config
+func (NFTables) Ruleset(fwd *network.ForwardingConfig) *NFTRuleset {
+	family := "ip"
+	if fwd.PrivateIP.To4() == nil {
+		family = "ip6"
+	}
+	host, vm := fwd.HostIP.String(), fwd.PrivateIP.String()
+
+	var dnat, snat, accept []string
+	forward := func(protocol network.NetProtocol, hostPorts, vmPorts, to string) {
+		match := fmt.Sprintf("%s daddr %s %s dport %s", family, host, protocol, hostPorts)
+		// Only accept from the whitelisted external IP when one is set - open otherwise
+		if fwd.ExternalIP != nil && !fwd.ExternalIP.IsUnspecified() {
+			match = fmt.Sprintf("%s saddr %s %s", family, fwd.ExternalIP, match)
+		}
+		dnat = append(dnat, fmt.Sprintf("%s dnat to %s", match, to))
+
+		// postrouting sees the destination after dnat - the VM's port
+		snat = append(snat,
+			fmt.Sprintf("%s saddr %s %s dport %s snat to %s", family, vm, protocol, vmPorts, host),
+			fmt.Sprintf("%s saddr %s %s daddr %s %s dport %s masquerade", family, vm, family, vm, protocol, vmPorts))
+
+		rule := fmt.Sprintf("%s daddr %s %s dport %s", family, vm, protocol, vmPorts)
+		if fwd.Interface != "" {
+			rule += fmt.Sprintf(" oifname %q", fwd.Interface)
+		}
+		accept = append(accept, rule+" accept")
+	}
+
+	for _, mapping := range fwd.PortMap {
+		forward(mapping.Protocol, strconv.Itoa(mapping.HostPort), strconv.Itoa(mapping.VMPort),
+			net.JoinHostPort(vm, strconv.Itoa(mapping.VMPort)))
+	}
+	for _, r := range fwd.PortRange {
+		if r.HostStartPortNum == 0 || r.HostEndPortNum == 0 || r.VMStartPort == 0 || r.VMEndPortNum == 0 {
+			log.Printf("Invalid Range Port Mapping Passed. Skipping")
+			continue
+		}
+		forward(r.Protocol,
+			fmt.Sprintf("%d-%d", r.HostStartPortNum, r.HostEndPortNum),
+			fmt.Sprintf("%d-%d", r.VMStartPort, r.VMEndPortNum),
+			rangeTarget(family, vm, r))
+	}
+
+	toHost := fmt.Sprintf("%s daddr %s jump dnat", family, host)
+	return &NFTRuleset{
+		Family: family,
+		Table:  NFTTable(fwd.VMName),
+		Chains: []NFTChain{
+			{Name: "prerouting", Type: "nat", Hook: "prerouting", Priority: -100, Rules: []string{toHost}},
+			{Name: "output", Type: "nat", Hook: "output", Priority: -100, Rules: []string{toHost}},
+			{Name: "postrouting", Type: "nat", Hook: "postrouting", Priority: 100, Rules: []string{
+				fmt.Sprintf("%s saddr %s %s daddr %s jump snat", family, vm, family, vm),
+			}},
+			{Name: "forward", Type: "filter", Hook: "forward", Priority: 0, Rules: []string{
+				fmt.Sprintf("%s daddr %s jump fwd", family, vm),
+			}},
+			{Name: "dnat", Rules: dnat},
+			{Name: "snat", Rules: snat},
+			{Name: "fwd", Rules: accept},
+		},
+	}
+}
+
+/*
+rangeTarget keeps each host port on its own VM port - dnat to a port range picks any port of it.
+An unshifted range keeps the port as it is, a shifted one maps port by port:
+
+	dnat to 192.168.122.50:tcp dport map { 8000 : 9000, 8001 : 9001, ... }
+*/
+func rangeTarget(family, vm string, r network.PortRange) string {
+	if r.HostStartPortNum == r.VMStartPort {
+		return vm
+	}
+	addr := vm
+	if family == "ip6" {
+		addr = "[" + vm + "]"
+	}
+
+	pairs := make([]string, 0, r.HostEndPortNum-r.HostStartPortNum+1)
+	for port := r.HostStartPortNum; port <= r.HostEndPortNum; port++ {
+		pairs = append(pairs, fmt.Sprintf("%d : %d", port, port-r.HostStartPortNum+r.VMStartPort))
+	}
+	return fmt.Sprintf("%s:%s dport map { %s }", addr, r.Protocol, strings.Join(pairs, ", "))
+}
+
+// Render is the nft -f input that replaces the table - declaring it first lets the delete succeed on a fresh host
+func (r *NFTRuleset) Render() string {
+	var b strings.Builder
+	b.WriteString(r.RenderDelete())
+
+	fmt.Fprintf(&b, "table %s %s {\n", r.Family, r.Table)
+	for _, chain := range r.Chains {
+		fmt.Fprintf(&b, "\tchain %s {\n", chain.Name)
+		if chain.Hook != "" {
+			fmt.Fprintf(&b, "\t\ttype %s hook %s priority %d; policy accept;\n", chain.Type, chain.Hook, chain.Priority)
+		}
+		for _, rule := range chain.Rules {
+			fmt.Fprintf(&b, "\t\t%s\n", rule)
+		}
+		b.WriteString("\t}\n")
+	}
+	b.WriteString("}\n")
+
+	return b.String()
+}
+
+// RenderDelete is the nft -f input that removes the table, whether or not it exists
+func (r *NFTRuleset) RenderDelete() string {
+	return fmt.Sprintf("table %s %s\ndelete table %s %s\n", r.Family, r.Table, r.Family, r.Table)
+}
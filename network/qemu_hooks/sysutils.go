@@ -26,6 +26,76 @@ func ExecuteCommands(commands []string) error {
 	return nil
 }
 
+// CommandResult is how one command of a hook event went
+type CommandResult struct {
+	Command Command
+	Skipped bool // its Unless succeeded or its OnlyIf failed
+	Output  string
+	Err     error
+}
+
+/*
+ApplyCommands runs every command, past failures - one rule that cannot be added should not keep
+the others away. Each result is returned; the error counts the failed ones.
+*/
+func ApplyCommands(commands []Command) ([]CommandResult, error) {
+	results := make([]CommandResult, 0, len(commands))
+	failed := 0
+	for _, cmd := range commands {
+		result := cmd.Run()
+		if result.Err != nil {
+			failed++
+		}
+		results = append(results, result)
+	}
+	if failed > 0 {
+		return results, fmt.Errorf("%d of %d forwarding commands failed", failed, len(commands))
+	}
+	return results, nil
+}
+
+// Run checks Unless and OnlyIf and then runs the command - sudo is dropped when already root, as in the hook
+func (c Command) Run() CommandResult {
+	result := CommandResult{Command: c}
+	if len(c.Unless) > 0 && check(c.Unless) == nil {
+		result.Skipped = true
+		return result
+	}
+	if len(c.OnlyIf) > 0 && check(c.OnlyIf) != nil {
+		result.Skipped = true
+		return result
+	}
+
+	if len(c.Args) == 0 {
+		result.Err = fmt.Errorf("empty command")
+		return result
+	}
+	args := withoutSudo(c.Args)
+	cmd := exec.Command(args[0], args[1:]...)
+	if c.Stdin != "" {
+		cmd.Stdin = strings.NewReader(c.Stdin)
+	}
+	out, err := cmd.CombinedOutput()
+	result.Output = strings.TrimSpace(string(out))
+	if err != nil {
+		result.Err = fmt.Errorf("error executing command '%s': %v %s", strings.Join(c.Args, " "), err, result.Output)
+	}
+	return result
+}
+
+// check runs an Unless or OnlyIf - only its exit status matters
+func check(args []string) error {
+	args = withoutSudo(args)
+	return exec.Command(args[0], args[1:]...).Run()
+}
+
+func withoutSudo(args []string) []string {
+	if len(args) > 1 && args[0] == "sudo" && os.Geteuid() == 0 {
+		return args[1:]
+	}
+	return args
+}
+
 // DisableBridgeFiltering Disables Bridge Filtering for Port Forwarding to Work if it is activated
 func DisableBridgeFiltering() error {
 	log.Printf("Disabling Bridge Filtering")
@@ -0,0 +1,205 @@
+package network
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"kvmgo/config"
+	"kvmgo/lib/connection"
+
+	"libvirt.org/go/libvirt"
+)
+
+// Where IPResolver looks for a VM's addresses - ip_sources in the config
+const (
+	IPSourceLease = "lease" // dnsmasq leases on the VM's libvirt network - DHCP guests
+	IPSourceAgent = "agent" // qemu-guest-agent in the guest - every interface, static and IPv6 included
+	IPSourceARP   = "arp"   // the host's neighbour table - static or bridged guests once they sent traffic
+)
+
+var ipSources = map[string]libvirt.DomainInterfaceAddressesSource{
+	IPSourceLease: libvirt.DOMAIN_INTERFACE_ADDRESSES_SRC_LEASE,
+	IPSourceAgent: libvirt.DOMAIN_INTERFACE_ADDRESSES_SRC_AGENT,
+	IPSourceARP:   libvirt.DOMAIN_INTERFACE_ADDRESSES_SRC_ARP,
+}
+
+// InterfaceAddress is one address of a VM and the source that reported it
+type InterfaceAddress struct {
+	Interface string `json:"interface"` // vnet0 for lease and arp, the guest's name such as eth0 for agent
+	MAC       string `json:"mac,omitempty"`
+	IP        string `json:"ip"`
+	Prefix    uint   `json:"prefix"`
+	IPv6      bool   `json:"ipv6"`
+	Source    string `json:"source"`
+}
+
+func (a InterfaceAddress) CIDR() string {
+	return fmt.Sprintf("%s/%d", a.IP, a.Prefix)
+}
+
+// AddressLister is the part of *libvirt.Domain the resolver reads addresses from
+type AddressLister interface {
+	ListAllInterfaceAddresses(src libvirt.DomainInterfaceAddressesSource) ([]libvirt.DomainInterface, error)
+}
+
+/*
+IPResolver finds a VM's addresses through libvirt - no sudo or arp-scan on the bridge. The
+sources are asked in order and the first that knows any address answers with all of them.
+
+The lease source only covers DHCP guests and arp only guests that sent traffic, the agent
+covers everything once qemu-guest-agent runs - presets install it, see configuration.AddGuestAgent.
+
+Usage:
+
+	resolver := network.NewIPResolver()
+	addrs, err := resolver.Resolve(ctx, conn, "kafka")
+	primary, _ := resolver.Primary(addrs)
+*/
+type IPResolver struct {
+	Sources  []string      // lease, agent, arp when empty
+	Timeout  time.Duration // how long Resolve waits for a booting VM
+	Interval time.Duration // between lookups while waiting
+	IPv6     bool          // Primary picks IPv6 over IPv4
+}
+
+// NewIPResolver follows ip_sources, ip_timeout and ipv6 of the current config
+func NewIPResolver() *IPResolver {
+	cfg := config.Current()
+	return &IPResolver{
+		Sources:  cfg.IPSources,
+		Timeout:  cfg.IPWait(),
+		Interval: 3 * time.Second,
+		IPv6:     cfg.IPv6,
+	}
+}
+
+// Ask only these sources, in this order
+func (r *IPResolver) SetSources(sources ...string) *IPResolver {
+	r.Sources = sources
+	return r
+}
+
+// Give up on a VM without an address after d - 0 looks once
+func (r *IPResolver) SetTimeout(d time.Duration) *IPResolver {
+	r.Timeout = d
+	return r
+}
+
+func (r *IPResolver) SetIPv6(prefer bool) *IPResolver {
+	r.IPv6 = prefer
+	return r
+}
+
+func (r *IPResolver) sources() []string {
+	if len(r.Sources) == 0 {
+		return config.IPSourceNames
+	}
+	return r.Sources
+}
+
+/*
+Lookup asks each source once and returns every address of the first one that has any. Loopback
+and link-local addresses the agent reports are dropped. When no source has an address the error
+says what each of them answered.
+*/
+func (r *IPResolver) Lookup(dom AddressLister) ([]InterfaceAddress, error) {
+	var failures []string
+	for _, name := range r.sources() {
+		src, ok := ipSources[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown ip source %q - must be one of %s", name, strings.Join(config.IPSourceNames, ", "))
+		}
+
+		ifaces, err := dom.ListAllInterfaceAddresses(src)
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %v", name, err))
+			continue
+		}
+		if addrs := interfaceAddresses(ifaces, name); len(addrs) > 0 {
+			return addrs, nil
+		}
+		failures = append(failures, name+": no addresses")
+	}
+	return nil, fmt.Errorf("no address found (%s)", strings.Join(failures, "; "))
+}
+
+// Resolve looks the VM's addresses up until one source has them, the VM stops or Timeout passes
+func (r *IPResolver) Resolve(ctx context.Context, conn *libvirt.Connect, vmName string) ([]InterfaceAddress, error) {
+	dom, err := conn.LookupDomainByName(vmName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to lookup domain %s: %v", vmName, err)
+	}
+	defer dom.Free()
+
+	deadline := time.Now().Add(r.Timeout)
+	for waiting := false; ; waiting = true {
+		addrs, err := r.Lookup(dom)
+		if err == nil {
+			return addrs, nil
+		}
+		if active, _ := dom.IsActive(); !active {
+			return nil, fmt.Errorf("%s is not running - %v", vmName, err)
+		}
+		if time.Now().Add(r.Interval).After(deadline) {
+			return nil, fmt.Errorf("%s has no address after %s: %v", vmName, r.Timeout, err)
+		}
+		if !waiting {
+			log.Printf("Waiting up to %s for %s to get an address", r.Timeout, vmName)
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(r.Interval):
+		}
+	}
+}
+
+// Primary is the address to connect to - the first IPv4, or the first IPv6 when preferred or the only kind
+func (r *IPResolver) Primary(addrs []InterfaceAddress) (InterfaceAddress, bool) {
+	for _, addr := range addrs {
+		if addr.IPv6 == r.IPv6 {
+			return addr, true
+		}
+	}
+	if len(addrs) > 0 {
+		return addrs[0], true
+	}
+	return InterfaceAddress{}, false
+}
+
+func interfaceAddresses(ifaces []libvirt.DomainInterface, source string) []InterfaceAddress {
+	var addrs []InterfaceAddress
+	for _, iface := range ifaces {
+		for _, addr := range iface.Addrs {
+			ip := net.ParseIP(addr.Addr)
+			if ip == nil || ip.IsLoopback() || ip.IsLinkLocalUnicast() {
+				continue
+			}
+			addrs = append(addrs, InterfaceAddress{
+				Interface: iface.Name,
+				MAC:       iface.Hwaddr,
+				IP:        ip.String(),
+				Prefix:    addr.Prefix,
+				IPv6:      ip.To4() == nil,
+				Source:    source,
+			})
+		}
+	}
+	return addrs
+}
+
+// ResolveVMAddresses resolves every address of the VM with the configured sources and timeout
+func ResolveVMAddresses(ctx context.Context, vmName string) ([]InterfaceAddress, error) {
+	conn, err := connection.Connect()
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to libvirt: %v", err)
+	}
+	defer conn.Close()
+
+	return NewIPResolver().Resolve(ctx, conn, vmName)
+}
@@ -8,7 +8,7 @@ import (
 	"os"
 	"time"
 
-	"kvmgo/constants"
+	"kvmgo/config"
 	"kvmgo/lib"
 
 	"golang.org/x/crypto/ssh"
@@ -31,7 +31,7 @@ func RunCmd(client *ssh.Client, cmd string) (string, error) {
 }
 
 func EstablishSsh(domain string) (*ssh.Client, error) {
-	privateKeyPath := constants.SshPriv
+	privateKeyPath := config.Current().SSHPrivateKey
 	qconn, _ := lib.ConnectLibvirt()
 	dom, _ := qconn.GetDomain(domain)
 	vmIP, _ := dom.GetIP()
@@ -71,7 +71,7 @@ func EstablishSsh(domain string) (*ssh.Client, error) {
 }
 
 func EstablishSshOld(domain string) (*ssh.Session, error) {
-	privateKeyPath := constants.SshPriv
+	privateKeyPath := config.Current().SSHPrivateKey
 	qconn, _ := lib.ConnectLibvirt()
 	dom, _ := qconn.GetDomain(domain)
 	vmIP, _ := dom.GetIP()
@@ -4,9 +4,10 @@ import (
 	"bytes"
 	"encoding/xml"
 	"fmt"
-	"os/exec"
 	"strconv"
 	"strings"
+
+	"kvmgo/lib/connection"
 )
 
 /*
@@ -22,7 +23,7 @@ Get the IP Subnet that our Libvirt NAT bridge runs on
 */
 func GetLibvirtIpSubnet() (string, error) {
 	// Execute the virsh command to get the XML output for the default network
-	cmd := exec.Command("virsh", "net-dumpxml", "default")
+	cmd := connection.Virsh("net-dumpxml", "default")
 	var out bytes.Buffer
 	cmd.Stdout = &out
 	if err := cmd.Run(); err != nil {
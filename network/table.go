@@ -9,12 +9,21 @@ import (
 )
 
 // Helper function to convert PortMapping slices to a string representation.
-func portMapToString(portMap []PortMapping) string {
+func portMapToStrings(portMap []PortMapping) []string {
 	var strSlice []string
 	for _, pm := range portMap {
 		strSlice = append(strSlice, fmt.Sprintf("%s (VM->Host) %d->%d", pm.Protocol, pm.VMPort, pm.HostPort))
 	}
-	return strings.Join(strSlice, ", ")
+	return strSlice
+}
+
+// Helper function to convert PortRange slices to a string representation.
+func portRangeToStrings(portRange []PortRange) []string {
+	var strSlice []string
+	for _, pr := range portRange {
+		strSlice = append(strSlice, fmt.Sprintf("%s (VM->Host) %d-%d->%d-%d", pr.Protocol, pr.VMStartPort, pr.VMEndPortNum, pr.HostStartPortNum, pr.HostEndPortNum))
+	}
+	return strSlice
 }
 
 // CreateTableFromConfig generates a concise table from a ForwardingConfig and returns it as a string.
@@ -28,28 +37,20 @@ func CreateTableFromConfig(config ForwardingConfig) string {
 	t.AppendHeader(table.Row{"VM Name", "Port Mapping", "Host IP", "External IP", "Interface", "Time"})
 
 	// Prepare the data for the table.
-	portMapStr := portMapToString(config.PortMap)
-	//	portRangeStr := portRangeToString(config.PortRange)
+	portMapStr := strings.Join(append(portMapToStrings(config.PortMap), portRangeToStrings(config.PortRange)...), ", ")
 	hostIP := config.HostIP.String()
 	externalIP := config.ExternalIP.String()
+	updated := time.Now().Format("2006-01-02 15:04")
+	if ts, err := time.Parse(time.RFC3339, config.LastUpdated); err == nil {
+		updated = ts.Format("2006-01-02 15:04")
+	}
 
 	// Append the configuration data as a row.
 	t.AppendRow(table.Row{
-		config.VMName, portMapStr, hostIP, externalIP, config.Interface, time.Now().Format("2006-01-02 15:04"),
+		config.VMName, portMapStr, hostIP, externalIP, config.Interface, updated,
 	})
 
 	t.Render()
 
 	return stringBuilder.String()
 }
-
-/*
-// Helper function to convert PortRange slices to a string representation.
-func portRangeToString(portRange []PortRange) string {
-	var strSlice []string
-	for _, pr := range portRange {
-		strSlice = append(strSlice, fmt.Sprintf("%s %d-%d->%d-%d", pr.Protocol, pr.VMStartPort, pr.VMEndPortNum, pr.HostStartPortNum, pr.HostEndPortNum))
-	}
-	return strings.Join(strSlice, ", ")
-}
-*/
@@ -3,7 +3,7 @@ package ssh
 import (
 	"bytes"
 	"fmt"
-	"kvmgo/constants"
+	"kvmgo/config"
 	"kvmgo/lib"
 	"log"
 	"net"
@@ -58,7 +58,7 @@ func TestCheckdom(t *testing.T) {
 }
 
 func GetJoinCmd(domain string) string {
-	privateKeyPath := constants.SshPriv
+	privateKeyPath := config.Current().SSHPrivateKey
 
 	if domain == "" {
 		domain = "ubuntu-base-vm"
@@ -123,7 +123,7 @@ func GetJoinCmd(domain string) string {
 }
 
 func TestSSHConnection(t *testing.T) {
-	privateKeyPath := constants.SshPriv
+	privateKeyPath := config.Current().SSHPrivateKey
 	domain := "ubuntu-base-vm"
 	qconn, _ := lib.ConnectLibvirt()
 	dom, _ := qconn.GetDomain(domain)
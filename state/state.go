@@ -0,0 +1,331 @@
+package state
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"kvmgo/config"
+)
+
+/*
+Persistent record of the VMs kvmetal has created - one JSON document shared by every
+invocation (and the qemu hook) at
+
+	<state_dir>/state.json   (~/.local/state/kvmetal/state.json - see config.Config)
+
+Writers take an exclusive flock on state.json.lock and replace the file atomically so a
+crashed or concurrent launch never leaves a truncated document behind.
+
+Usage:
+
+	store := state.Default()
+
+	err := store.Put(&state.VMRecord{Name: "kafka", Preset: "kafka", CPUCores: 4, Memory: 8192})
+
+	rec, err := store.Get("kafka")
+
+	err = store.Update(func(s *state.State) error {
+		s.VMs["kafka"].Exposures = append(s.VMs["kafka"].Exposures, exposure)
+		return nil
+	})
+*/
+
+const stateVersion = 1
+
+// State is the on disk document
+type State struct {
+	Version int                  `json:"version"`
+	VMs     map[string]*VMRecord `json:"vms"`
+}
+
+// VMRecord is everything recorded for a VM at creation and updated as it is exposed
+type VMRecord struct {
+	Name          string       `json:"name"`
+	Preset        string       `json:"preset,omitempty"`
+	CPUCores      int          `json:"cpu_cores"`
+	Memory        int          `json:"memory"`
+	Disks         []DiskRecord `json:"disks,omitempty"`
+	Image         ImageLineage `json:"image"`
+	CloudInitHash string       `json:"cloud_init_hash,omitempty"`
+	Exposures     []Exposure   `json:"exposures,omitempty"`
+	URI           string       `json:"uri,omitempty"`
+	CreatedAt     time.Time    `json:"created_at"`
+	UpdatedAt     time.Time    `json:"updated_at"`
+}
+
+// DiskRecord is an additional disk attached to the VM - Size in GB
+type DiskRecord struct {
+	Name string `json:"name,omitempty"`
+	Path string `json:"path"`
+	Size int    `json:"size"`
+}
+
+// ImageLineage traces the VM disk back to the downloaded cloud image
+type ImageLineage struct {
+	SourceURL string `json:"source_url,omitempty"` // https://cloud-images.ubuntu.com/...img
+	BaseImage string `json:"base_image,omitempty"` // data/images/ubuntu-22.04-server-cloudimg-amd64.img
+	VMImage   string `json:"vm_image,omitempty"`   // data/images/<vm>-vm-disk.qcow2
+	CloudInit string `json:"cloud_init,omitempty"` // data/artifacts/<vm>/userdata/user-data.img
+}
+
+// Exposure is a host -> vm port forward applied through the qemu hooks
+type Exposure struct {
+	HostPort    int    `json:"hostport"`
+	VMPort      int    `json:"port"`
+	HostEndPort int    `json:"hostport_end,omitempty"` // set for a port range
+	VMEndPort   int    `json:"port_end,omitempty"`
+	Protocol    string `json:"protocol"`
+	ExternalIP  string `json:"external_ip,omitempty"`
+}
+
+// Store reads and writes the state document at Path
+type Store struct {
+	Path string
+	mu   sync.Mutex
+}
+
+var (
+	defaultStore *Store
+	defaultOnce  sync.Once
+)
+
+// DefaultPath resolves the state file under the configured state_dir
+func DefaultPath() string {
+	return config.Current().StateFile()
+}
+
+// Default returns the process wide store at DefaultPath
+func Default() *Store {
+	defaultOnce.Do(func() {
+		defaultStore = NewStore(DefaultPath())
+	})
+	return defaultStore
+}
+
+// NewStore returns a store backed by the file at path - the file is created on first write
+func NewStore(path string) *Store {
+	return &Store{Path: path}
+}
+
+// Load reads the current state - a missing file is an empty state
+func (s *Store) Load() (*State, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	unlock, err := s.lock(syscall.LOCK_SH)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	return s.read()
+}
+
+// Update applies fn to the state under an exclusive lock and persists the result
+func (s *Store) Update(fn func(*State) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	unlock, err := s.lock(syscall.LOCK_EX)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	st, err := s.read()
+	if err != nil {
+		return err
+	}
+
+	if err := fn(st); err != nil {
+		return err
+	}
+
+	return s.write(st)
+}
+
+// Put creates or replaces the record for a VM
+func (s *Store) Put(rec *VMRecord) error {
+	return s.Update(func(st *State) error {
+		now := time.Now().UTC()
+		if prev, ok := st.VMs[rec.Name]; ok && rec.CreatedAt.IsZero() {
+			rec.CreatedAt = prev.CreatedAt
+		}
+		if rec.CreatedAt.IsZero() {
+			rec.CreatedAt = now
+		}
+		rec.UpdatedAt = now
+		st.VMs[rec.Name] = rec
+		return nil
+	})
+}
+
+// Delete removes the record for a VM - deleting an unknown VM is not an error
+func (s *Store) Delete(name string) error {
+	return s.Update(func(st *State) error {
+		delete(st.VMs, name)
+		return nil
+	})
+}
+
+// Get returns the record for a VM or nil if it is not tracked
+func (s *Store) Get(name string) (*VMRecord, error) {
+	st, err := s.Load()
+	if err != nil {
+		return nil, err
+	}
+	return st.VMs[name], nil
+}
+
+// List returns all records sorted by name
+func (s *Store) List() ([]*VMRecord, error) {
+	st, err := s.Load()
+	if err != nil {
+		return nil, err
+	}
+
+	records := make([]*VMRecord, 0, len(st.VMs))
+	for _, rec := range st.VMs {
+		records = append(records, rec)
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].Name < records[j].Name })
+
+	return records, nil
+}
+
+// AddExposure records a port forward for a VM - replacing those whose host ports overlap it on the same
+// protocol, as network.WithoutHostPorts does for the forwarding config
+func (s *Store) AddExposure(name string, exp Exposure) error {
+	return s.Update(func(st *State) error {
+		rec, ok := st.VMs[name]
+		if !ok {
+			rec = &VMRecord{Name: name, CreatedAt: time.Now().UTC()}
+			st.VMs[name] = rec
+		}
+
+		first, last := exp.HostPort, max(exp.HostPort, exp.HostEndPort)
+		exposures := rec.Exposures[:0]
+		for _, e := range rec.Exposures {
+			if e.Protocol != exp.Protocol || max(e.HostPort, e.HostEndPort) < first || e.HostPort > last {
+				exposures = append(exposures, e)
+			}
+		}
+		rec.Exposures = append(exposures, exp)
+		rec.UpdatedAt = time.Now().UTC()
+
+		return nil
+	})
+}
+
+// RemoveExposures drops the port forwards on hostPort/protocol for a VM, ranges containing it included -
+// hostPort 0 drops all of them
+func (s *Store) RemoveExposures(name string, hostPort int, protocol string) error {
+	return s.Update(func(st *State) error {
+		rec, ok := st.VMs[name]
+		if !ok {
+			return nil
+		}
+
+		exposures := rec.Exposures[:0]
+		for _, e := range rec.Exposures {
+			last := max(e.HostPort, e.HostEndPort)
+			if hostPort != 0 && (hostPort < e.HostPort || hostPort > last || e.Protocol != protocol) {
+				exposures = append(exposures, e)
+			}
+		}
+		rec.Exposures = exposures
+		rec.UpdatedAt = time.Now().UTC()
+
+		return nil
+	})
+}
+
+// HashCloudInit fingerprints rendered user-data so changes can be detected later
+func HashCloudInit(userdata []byte) string {
+	sum := sha256.Sum256(userdata)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+func (s *Store) read() (*State, error) {
+	st := &State{Version: stateVersion, VMs: map[string]*VMRecord{}}
+
+	data, err := os.ReadFile(s.Path)
+	if os.IsNotExist(err) {
+		return st, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read state %s: %v", s.Path, err)
+	}
+
+	if len(data) == 0 {
+		return st, nil
+	}
+
+	if err := json.Unmarshal(data, st); err != nil {
+		return nil, fmt.Errorf("failed to parse state %s: %v", s.Path, err)
+	}
+	if st.VMs == nil {
+		st.VMs = map[string]*VMRecord{}
+	}
+
+	return st, nil
+}
+
+func (s *Store) write(st *State) error {
+	st.Version = stateVersion
+
+	data, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal state: %v", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.Path), ".state-*.json")
+	if err != nil {
+		return fmt.Errorf("failed to write state: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write state: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write state: %v", err)
+	}
+
+	if err := os.Rename(tmp.Name(), s.Path); err != nil {
+		return fmt.Errorf("failed to replace state %s: %v", s.Path, err)
+	}
+
+	return nil
+}
+
+// lock takes a flock on <path>.lock - shared for reads, exclusive for updates
+func (s *Store) lock(how int) (func(), error) {
+	if err := os.MkdirAll(filepath.Dir(s.Path), 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create state dir: %v", err)
+	}
+
+	f, err := os.OpenFile(s.Path+".lock", os.O_CREATE|os.O_RDWR, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open state lock: %v", err)
+	}
+
+	if err := syscall.Flock(int(f.Fd()), how); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to lock state: %v", err)
+	}
+
+	return func() {
+		_ = syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+	}, nil
+}
@@ -0,0 +1,204 @@
+package tests
+
+import (
+	"strings"
+	"testing"
+
+	"kvmgo/cloudinit"
+	"kvmgo/configuration/presets"
+	"kvmgo/constants"
+	"kvmgo/constants/kafka"
+)
+
+func TestPresetUserdataIsValidCloudConfig(t *testing.T) {
+	sshpub := "ssh-rsa AAAAB3 kuro@host"
+	for name, userdata := range map[string]string{
+		"kafka":       presets.CreateKafkaUserData(constants.Ubuntu, "ubuntu", "password", "kafka", sshpub),
+		"hadoop":      presets.CreateHadoopUserData(constants.Ubuntu, "ubuntu", "password", "hadoop", sshpub),
+		"clickhouse":  presets.CreateClickhouseUserData(constants.Ubuntu, "ubuntu", "password", "clickhouse", sshpub),
+		"kubecontrol": presets.CreateKubeControlPlaneUserData(constants.Ubuntu, "ubuntu", "password", "control", sshpub, "", true),
+		"kubeworker":  presets.CreateKubeWorkerUserData(constants.Rocky, "ubuntu", "password", "worker", sshpub),
+	} {
+		if !strings.HasPrefix(userdata, cloudinit.Header+"\n") {
+			t.Fatalf("%s: missing %s header\n%s", name, cloudinit.Header, userdata)
+		}
+		if n := strings.Count(userdata, "\npackages:"); n != 1 {
+			t.Errorf("%s: %d packages keys, want 1\n%s", name, n, userdata)
+		}
+
+		cfg, err := cloudinit.Parse(userdata)
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		if cfg.FQDN != cfg.Hostname+".kuro.com" || len(cfg.RunCmd) == 0 || len(cfg.Packages) == 0 {
+			t.Errorf("%s: hostname %q fqdn %q, %d runcmds, packages %v", name, cfg.Hostname, cfg.FQDN, len(cfg.RunCmd), cfg.Packages)
+		}
+		if cfg.PowerState == nil || cfg.PowerState.Mode != "reboot" {
+			t.Errorf("%s: restart init svc not rendered as power_state", name)
+		}
+	}
+}
+
+func TestKraftFragmentMergesAfterBaseRunCmds(t *testing.T) {
+	userdata := presets.CreateKafkaKraftCluster(constants.Ubuntu, "ubuntu", "password", "kraft", "ssh-rsa AAAAB3 kuro@host", "",
+		9095, "192.168.1.10", 9094, "192.168.1.225", 1, kafka.BrokerController)
+
+	cfg, err := cloudinit.Parse(userdata)
+	if err != nil {
+		t.Fatalf("%s\n%s", err, userdata)
+	}
+	last := cfg.RunCmd[len(cfg.RunCmd)-1]
+	if !strings.Contains(last.Shell, "kafka-server-start.sh") {
+		t.Errorf("last runcmd = %q, want kafka started last", last.Shell)
+	}
+	if cfg.FinalMessage != "Kafka has been successfully installed and started." {
+		t.Errorf("final_message = %q", cfg.FinalMessage)
+	}
+	for _, cmd := range cfg.RunCmd {
+		if strings.Contains(cmd.Shell, "server.properties > /dev/null <<EOL") && !strings.Contains(cmd.Shell, "process.roles=") {
+			t.Errorf("kraft settings lost from the heredoc:\n%s", cmd.Shell)
+		}
+	}
+}
+
+func TestMergeUserdataFileOverPreset(t *testing.T) {
+	base, err := cloudinit.Parse(presets.CreateKubeWorkerUserData(constants.Debian, "ubuntu", "password", "worker", "ssh-rsa AAAAB3 kuro@host"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	baseRunCmds := len(base.RunCmd)
+
+	overlay, err := cloudinit.Parse(`#cloud-config
+hostname: custom
+packages: [zsh, htop]
+users:
+  - default
+  - name: ubuntu
+    ssh_authorized_keys:
+      - ssh-ed25519 AAAAC3 laptop
+  - name: ops
+    groups: wheel
+runcmd:
+  - [touch, /var/lib/done]
+power_state:
+  mode: poweroff
+write_files:
+  - path: /etc/motd
+    content: hello
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	base.Merge(overlay)
+
+	if base.Hostname != "custom" || base.FQDN != "worker.kuro.com" {
+		t.Errorf("hostname %q fqdn %q, want the file's hostname and the preset's fqdn", base.Hostname, base.FQDN)
+	}
+	if n := strings.Count(strings.Join(base.Packages, " "), "zsh"); n != 1 || base.Packages[len(base.Packages)-1] != "htop" {
+		t.Errorf("packages = %v, want zsh once and htop appended", base.Packages)
+	}
+	if len(base.RunCmd) != baseRunCmds+1 || strings.Join(base.RunCmd[baseRunCmds].Args, " ") != "touch /var/lib/done" {
+		t.Errorf("runcmd = %v, want the file's command after the preset's %d", base.RunCmd, baseRunCmds)
+	}
+	if base.PowerState.Mode != "poweroff" || len(base.WriteFiles) != 1 {
+		t.Errorf("power_state %+v write_files %v", base.PowerState, base.WriteFiles)
+	}
+
+	if len(base.Users) != 3 || !base.Users[0].Default {
+		t.Fatalf("users = %+v, want default, ubuntu and ops", base.Users)
+	}
+	ubuntu := base.Users[1]
+	if ubuntu.Shell != "/bin/bash" || strings.Join(ubuntu.SSHAuthorizedKeys, ",") != "ssh-rsa AAAAB3 kuro@host,ssh-ed25519 AAAAC3 laptop" {
+		t.Errorf("ubuntu user not merged: %+v", ubuntu)
+	}
+	if base.Users[2].Name != "ops" || strings.Join(base.Users[2].Groups, ",") != "wheel" {
+		t.Errorf("ops user = %+v", base.Users[2])
+	}
+
+	if _, err := cloudinit.Parse(base.String()); err != nil {
+		t.Errorf("merged userdata does not parse: %s\n%s", err, base.String())
+	}
+}
+
+func TestCloudConfigKeepsUnmodelledKeys(t *testing.T) {
+	cfg, err := cloudinit.Parse(`#cloud-config
+users:
+  - default
+timezone: Europe/Berlin
+bootcmd:
+  - [cloud-init-per, once, mkdir, mkdir, -p, /data]
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := cfg.String()
+	for _, want := range []string{"- default\n", "timezone: Europe/Berlin\n", "- - cloud-init-per\n"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("rendered userdata missing %q\n%s", want, out)
+		}
+	}
+}
+
+func TestValidateReportsLines(t *testing.T) {
+	err := cloudinit.Validate(`hostname: broken
+package-update: true
+runcmd:
+  - echo ok
+  - {cmd: echo nested}
+write_files:
+  - content: no path
+packages: zsh
+`)
+	errs, ok := err.(cloudinit.ValidationErrors)
+	if !ok {
+		t.Fatalf("Validate = %v, want ValidationErrors", err)
+	}
+
+	want := []string{
+		`line 1: first line must be #cloud-config, got "hostname: broken"`,
+		`line 2: unknown key "package-update"`,
+		`line 5: runcmd[1] must be a shell string or a list of arguments`,
+		`line 7: write_files[0] file has no path`,
+		`line 8: packages must be a list`,
+	}
+	if len(errs) != len(want) {
+		t.Fatalf("got %d errors, want %d:\n%s", len(errs), len(want), err)
+	}
+	for i := range want {
+		if errs[i].Error() != want[i] {
+			t.Errorf("error %d = %q, want %q", i, errs[i].Error(), want[i])
+		}
+	}
+
+	err = cloudinit.Validate("#cloud-config\nruncmd:\n  - echo\n bad: indent\n")
+	if errs, ok := err.(cloudinit.ValidationErrors); !ok || errs[0].Line != 4 {
+		t.Errorf("malformed yaml = %v, want an error on line 4", err)
+	}
+}
+
+func TestPresetAndDistroUserdataValidates(t *testing.T) {
+	sshpub := "ssh-rsa AAAAB3 kuro@host"
+	for _, distro := range []constants.Distro{constants.Ubuntu, constants.Debian, constants.Fedora, constants.Rocky, constants.Alpine} {
+		userdata := presets.CreateKubeControlPlaneUserData(distro, "ubuntu", "password", "control", sshpub, "", false)
+		if err := cloudinit.Validate(userdata); err != nil {
+			t.Errorf("%s kubecontrol:\n%s", distro, err)
+		}
+	}
+	for name, userdata := range map[string]string{
+		"kafka":    presets.CreateKafkaUserData(constants.Ubuntu, "ubuntu", "password", "kafka", sshpub),
+		"hadoop":   presets.CreateHadoopUserData(constants.Ubuntu, "ubuntu", "password", "hadoop", sshpub),
+		"redpanda": presets.CreateRedpandaUserdata(constants.Ubuntu, "ubuntu", "password", "rp", sshpub, "rp.kuro.com", "9095", "192.168.1.10", "8090"),
+	} {
+		if err := cloudinit.Validate(userdata); err != nil {
+			t.Errorf("%s:\n%s", name, err)
+		}
+	}
+
+	if err := cloudinit.ValidateMetaData("instance-id: kafka\nlocal-hostname: kafka\n"); err != nil {
+		t.Error(err)
+	}
+	if err := cloudinit.ValidateMetaData("local-hostname: kafka\n"); err == nil || !strings.Contains(err.Error(), "instance-id") {
+		t.Errorf("meta-data without instance-id = %v", err)
+	}
+}
@@ -0,0 +1,147 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"kvmgo/cli"
+	"kvmgo/config"
+)
+
+func TestCommandExitCodes(t *testing.T) {
+	var wg sync.WaitGroup
+
+	for _, tc := range []struct {
+		args []string
+		want int
+	}{
+		{[]string{"help"}, cli.ExitOK},
+		{[]string{"vm", "create", "--help"}, cli.ExitOK},
+		{[]string{"vm"}, cli.ExitUsage},
+		{[]string{"nosuchcommand"}, cli.ExitUsage},
+		{[]string{"vm", "create"}, cli.ExitUsage},
+		{[]string{"vm", "create", "a", "b"}, cli.ExitUsage},
+		{[]string{"vm", "create", "test", "--nosuchflag"}, cli.ExitUsage},
+		{[]string{"vm", "create", "test", "--distro=gentoo"}, cli.ExitUsage},
+		{[]string{"vm", "create", "test", "--distro=flatcar", "--preset=kafka"}, cli.ExitUsage},
+		{[]string{"vm", "create", "test", "--nic", "ip=192.168.122.50"}, cli.ExitUsage},
+		{[]string{"vm", "create", "fc", "--distro=flatcar", "--nic", "ip=192.168.122.50/24"}, cli.ExitUsage},
+		{[]string{"vm", "list", "--output=xml"}, cli.ExitUsage},
+		{[]string{"net", "create", "lab"}, cli.ExitUsage},
+		{[]string{"net", "create", "lab", "--cidr=10.20.0.0/24", "--mode=bridge"}, cli.ExitUsage},
+		{[]string{"net", "create", "lab", "--cidr=10.20.0.0/24", "--host=52:54:00:12:34:56,control"}, cli.ExitUsage},
+		{[]string{"net", "create", "lab", "--cidr=10.20.0.0/24", "--dry-run"}, cli.ExitOK},
+		{[]string{"net", "delete"}, cli.ExitUsage},
+		{[]string{"snapshot", "revert", "spark"}, cli.ExitUsage},
+		{[]string{"userdata", "render", "--preset=kafka"}, cli.ExitUsage},
+		{[]string{"hooks", "run", "kafka"}, cli.ExitUsage},
+		{[]string{"expose", "rm", "kafka"}, cli.ExitUsage},
+		{[]string{"expose", "set", "kafka", "--port=80", "--hostport=8080", "--protocol=sctp"}, cli.ExitUsage},
+		{[]string{"expose", "list", "a", "b"}, cli.ExitUsage},
+		{[]string{"expose", "set", "kafka", "--map", "8000-8010:9000-9005/tcp"}, cli.ExitUsage},
+		{[]string{"net", "expose", "kafka", "--map", "53:5353/sctp"}, cli.ExitUsage},
+		{[]string{"expose", "set", "kafka", "--port=80"}, cli.ExitUsage},
+		{[]string{"hooks", "status", "--output=xml"}, cli.ExitUsage},
+		{[]string{"hooks", "uninstall", "--hooks-dir=" + t.TempDir(), "--no-restart"}, cli.ExitNotFound},
+		{[]string{"userdata", "render", "--name=fc", "--distro=flatcar", "--preset=kubeworker", "--userdata=extra.yaml"}, cli.ExitUsage},
+	} {
+		if got := cli.RunCommand(context.Background(), &wg, tc.args); got != tc.want {
+			t.Errorf("%v exited %d, want %d", tc.args, got, tc.want)
+		}
+	}
+}
+
+func TestCommandHelpListsSubcommands(t *testing.T) {
+	var out bytes.Buffer
+	cli.Root().PrintHelp(&out)
+
+	for _, sub := range []string{"vm", "net", "cluster", "image", "snapshot", "apply", "hooks", "expose"} {
+		if !strings.Contains(out.String(), "\n  "+sub+" ") {
+			t.Errorf("root help is missing %s:\n%s", sub, out.String())
+		}
+	}
+}
+
+func TestImageListOutput(t *testing.T) {
+	prev := config.Current()
+	t.Cleanup(func() { config.Set(prev) })
+
+	dataDir := t.TempDir()
+	t.Setenv(config.EnvConfig, "")
+	t.Setenv(config.EnvImagesDir, "")
+
+	images := filepath.Join(dataDir, "images")
+	if err := os.MkdirAll(images, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	for name, data := range map[string]string{"base.img": "base", "kafka-vm-disk.qcow2": "disk!"} {
+		if err := os.WriteFile(filepath.Join(images, name), []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// flags after the subcommand path, as users type them
+	var out bytes.Buffer
+	env := &cli.Env{Ctx: context.Background(), WG: &sync.WaitGroup{}, Out: &out}
+	if err := cli.Root().Execute(env, []string{"image", "list", "--output=json", "--data-dir=" + dataDir}); err != nil {
+		t.Fatalf("image list: %s", err)
+	}
+
+	var got []cli.ImageInfo
+	if err := json.Unmarshal(out.Bytes(), &got); err != nil {
+		t.Fatalf("output is not json: %s\n%s", err, out.String())
+	}
+	if len(got) != 2 || got[0].Name != "base.img" || got[1].VM != "kafka" || got[1].Size != 5 {
+		t.Errorf("unexpected images %+v", got)
+	}
+
+	// a missing image is a not found exit, not a failure
+	err := cli.Root().Execute(env, []string{"image", "rm", "nope.img", "--data-dir=" + dataDir})
+	if code := cli.ExitCode(err); code != cli.ExitNotFound {
+		t.Errorf("image rm of a missing image exited %d (%v), want %d", code, err, cli.ExitNotFound)
+	}
+}
+
+func TestUserdataRenderMergesFile(t *testing.T) {
+	// --ssh-key is a path flag and changes the global config
+	prev := config.Current()
+	t.Cleanup(func() { config.Set(prev) })
+
+	dir := t.TempDir()
+	extra := filepath.Join(dir, "extra.yaml")
+	if err := os.WriteFile(extra, []byte("#cloud-config\npackages: [htop]\nruncmd:\n  - touch /var/lib/done\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	key := filepath.Join(dir, "id_ed25519.pub")
+	if err := os.WriteFile(key, []byte("ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIKvmetalTestKey test@kvmetal\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	env := &cli.Env{Ctx: context.Background(), WG: &sync.WaitGroup{}, Out: &out}
+	args := []string{"userdata", "render", "--preset=hadoop", "--name=hdfs", "--userdata=" + extra, "--ssh-key=" + key}
+	if err := cli.Root().Execute(env, args); err != nil {
+		t.Fatalf("userdata render: %s\n%s", err, out.String())
+	}
+
+	rendered := out.String()
+	for _, want := range []string{"#cloud-config\n", "hostname: hdfs\n", "- htop\n", "- touch /var/lib/done\n"} {
+		if !strings.Contains(rendered, want) {
+			t.Errorf("rendered userdata missing %q\n%s", want, rendered)
+		}
+	}
+
+	if err := os.WriteFile(extra, []byte("#cloud-config\nruncmd: echo\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	err := cli.Root().Execute(env, args)
+	if cli.ExitCode(err) != cli.ExitUsage || !strings.Contains(err.Error(), "line 2: runcmd must be a list") {
+		t.Errorf("invalid --userdata file = %v, want a usage error naming line 2", err)
+	}
+}
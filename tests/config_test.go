@@ -11,6 +11,7 @@ import (
 	"testing"
 
 	"kvmgo/cli"
+	"kvmgo/config"
 	"kvmgo/configuration/presets"
 	"kvmgo/constants"
 	"kvmgo/utils"
@@ -23,10 +24,10 @@ func TestMinimal(t *testing.T) {
 }
 
 func TestCloudInitValidSchema(t *testing.T) {
-	hadoop_userdata := presets.CreateKafkaUserData("ubuntu",
+	hadoop_userdata := presets.CreateKafkaUserData(constants.Ubuntu, "ubuntu",
 		"password",
 		"kafka",
-		utils.ReadFileFatal(constants.SshPub))
+		utils.ReadFileFatal(config.Current().SSHPublicKey))
 
 	//	os.WriteFile("testfile.yaml", []byte(hadoop_userdata), 0o644)
 	tmpfile, err := os.CreateTemp("", "testfile.yaml")
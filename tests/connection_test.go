@@ -0,0 +1,37 @@
+package tests
+
+import (
+	"strings"
+	"testing"
+
+	"kvmgo/lib/connection"
+)
+
+func TestConnectionURIPrecedence(t *testing.T) {
+	t.Setenv("LIBVIRT_DEFAULT_URI", "")
+	t.Setenv(connection.EnvURI, "")
+	defer connection.SetURI("")
+
+	if uri := connection.URI(); uri != connection.DefaultURI {
+		t.Errorf("default uri = %s, want %s", uri, connection.DefaultURI)
+	}
+
+	t.Setenv("LIBVIRT_DEFAULT_URI", "qemu:///session")
+	if uri := connection.URI(); uri != "qemu:///session" {
+		t.Errorf("LIBVIRT_DEFAULT_URI not honoured: %s", uri)
+	}
+
+	t.Setenv(connection.EnvURI, "qemu+ssh://kuro@host/system")
+	if uri := connection.URI(); uri != "qemu+ssh://kuro@host/system" {
+		t.Errorf("%s not honoured: %s", connection.EnvURI, uri)
+	}
+
+	connection.SetURI("test:///default")
+	if uri := connection.URI(); uri != "test:///default" {
+		t.Errorf("SetURI not honoured: %s", uri)
+	}
+
+	if cmd := connection.Virsh("list", "--all"); !strings.Contains(cmd.String(), "virsh -c test:///default list --all") {
+		t.Errorf("virsh not pointed at the uri: %s", cmd.String())
+	}
+}
@@ -0,0 +1,265 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"kvmgo/cli"
+	"kvmgo/config"
+	"kvmgo/daemon"
+	"kvmgo/jobs"
+	"kvmgo/state"
+	kvm "kvmgo/vm"
+)
+
+// fakeBackend answers the calls these tests make - anything else panics through the nil interface
+type fakeBackend struct {
+	daemon.Backend
+	vms     []kvm.VMStatus
+	created chan daemon.CreateVMRequest
+}
+
+func (f *fakeBackend) ListVMs(ctx context.Context) ([]kvm.VMStatus, error) {
+	return f.vms, nil
+}
+
+func (f *fakeBackend) GetVM(ctx context.Context, name string) (*kvm.VMStatus, error) {
+	for _, v := range f.vms {
+		if v.Name == name {
+			return &v, nil
+		}
+	}
+	return nil, errors.Join(daemon.ErrNotFound, errors.New("VM "+name+" does not exist"))
+}
+
+func (f *fakeBackend) CreateVM(ctx context.Context, req daemon.CreateVMRequest) (*daemon.CreateVMResponse, error) {
+	f.created <- req
+	<-ctx.Done() // held until the client gives up so a second create sees the VM busy
+	return nil, ctx.Err()
+}
+
+func startDaemon(t *testing.T, backend daemon.Backend) *daemon.Client {
+	t.Helper()
+
+	socket := filepath.Join(t.TempDir(), "kvmetald.sock")
+	ctx, cancel := context.WithCancel(context.Background())
+
+	done := make(chan error, 1)
+	go func() { done <- daemon.NewServer(backend, socket).ListenAndServe(ctx) }()
+	t.Cleanup(func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Errorf("ListenAndServe: %s", err)
+		}
+	})
+
+	client := daemon.NewClient(socket)
+	for i := 0; !client.Available(context.Background()); i++ {
+		if i == 50 {
+			t.Fatalf("daemon did not come up on %s", socket)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	return client
+}
+
+func TestDaemonClientRoundTrip(t *testing.T) {
+	backend := &fakeBackend{
+		vms:     []kvm.VMStatus{{Name: "kafka", State: "running", Record: &state.VMRecord{Name: "kafka", Preset: "kafka"}}},
+		created: make(chan daemon.CreateVMRequest, 1),
+	}
+	client := startDaemon(t, backend)
+	ctx := context.Background()
+
+	vms, err := client.ListVMs(ctx)
+	if err != nil || len(vms) != 1 || vms[0].Record.Preset != "kafka" {
+		t.Fatalf("ListVMs = %+v, %v", vms, err)
+	}
+
+	_, err = client.GetVM(ctx, "missing")
+	if !errors.Is(err, daemon.ErrNotFound) || cli.ExitCode(err) != cli.ExitNotFound {
+		t.Errorf("GetVM of a missing VM returned %v (exit %d), want not found", err, cli.ExitCode(err))
+	}
+
+	_, err = client.CreateVM(ctx, daemon.CreateVMRequest{})
+	if !errors.Is(err, daemon.ErrInvalid) {
+		t.Errorf("CreateVM without a name returned %v, want invalid", err)
+	}
+	// names end up in image, artifact and /mnt paths
+	for _, name := range []string{"../etc", "Kafka", "-kafka", "kafka/data"} {
+		if _, err = client.CreateVM(ctx, daemon.CreateVMRequest{Name: name}); !errors.Is(err, daemon.ErrInvalid) {
+			t.Errorf("CreateVM of %q returned %v, want invalid", name, err)
+		}
+		_, err = cli.LocalBackend(ctx, &sync.WaitGroup{}).CreateVM(ctx, daemon.CreateVMRequest{Name: name, DryRun: true})
+		if cli.ExitCode(err) != cli.ExitUsage {
+			t.Errorf("local CreateVM of %q returned %v, want a usage error", name, err)
+		}
+	}
+
+	// a second mutating request for the same VM is rejected while the first runs
+	createCtx, cancelCreate := context.WithCancel(ctx)
+	go client.CreateVM(createCtx, daemon.CreateVMRequest{Name: "ci-1", Preset: "kafka"})
+	if req := <-backend.created; req.Preset != "kafka" {
+		t.Errorf("daemon received %+v", req)
+	}
+
+	_, err = client.CreateVM(ctx, daemon.CreateVMRequest{Name: "ci-1"})
+	var apiErr *daemon.Error
+	if !errors.As(err, &apiErr) || apiErr.Status != 409 {
+		t.Errorf("concurrent CreateVM returned %v, want 409", err)
+	}
+	cancelCreate()
+}
+
+func TestCLIUsesRunningDaemon(t *testing.T) {
+	backend := &fakeBackend{vms: []kvm.VMStatus{{Name: "from-daemon", State: "running"}}}
+	client := startDaemon(t, backend)
+
+	prev := config.Current()
+	t.Cleanup(func() { config.Set(prev) })
+	t.Setenv(config.EnvConfig, "")
+	t.Setenv(config.EnvSocket, client.Socket)
+
+	var out bytes.Buffer
+	env := &cli.Env{Ctx: context.Background(), WG: &sync.WaitGroup{}, Out: &out}
+	if err := cli.Root().Execute(env, []string{"vm", "list", "--output=json"}); err != nil {
+		t.Fatalf("vm list: %s", err)
+	}
+
+	var vms []kvm.VMStatus
+	if err := json.Unmarshal(out.Bytes(), &vms); err != nil || len(vms) != 1 || vms[0].Name != "from-daemon" {
+		t.Errorf("vm list did not go through the daemon: %s", out.String())
+	}
+}
+
+// createRecorder keeps the last CreateVM request and answers it right away
+type createRecorder struct {
+	daemon.Backend
+	req     daemon.CreateVMRequest
+	cluster daemon.ClusterRequest
+}
+
+func (r *createRecorder) CreateVM(ctx context.Context, req daemon.CreateVMRequest) (*daemon.CreateVMResponse, error) {
+	r.req = req
+	if req.DryRun {
+		return &daemon.CreateVMResponse{Plan: &kvm.Plan{VM: req.Name, Operation: "launch"}}, nil
+	}
+	return &daemon.CreateVMResponse{}, nil
+}
+
+func (r *createRecorder) CreateCluster(ctx context.Context, req daemon.ClusterRequest) ([]*kvm.Plan, error) {
+	r.cluster = req
+	return []*kvm.Plan{}, nil
+}
+
+func TestLegacyLaunchPassesKeepOnFailure(t *testing.T) {
+	backend := &createRecorder{}
+	client := startDaemon(t, backend)
+
+	prev := config.Current()
+	t.Cleanup(func() { config.Set(prev) })
+	t.Setenv(config.EnvConfig, "")
+	t.Setenv(config.EnvSocket, client.Socket)
+
+	// ParseFlags registers its flags on the global set and reads os.Args
+	prevArgs, prevFlags := os.Args, flag.CommandLine
+	t.Cleanup(func() { os.Args, flag.CommandLine = prevArgs, prevFlags })
+	flag.CommandLine = flag.NewFlagSet("kvmetal", flag.ContinueOnError)
+	os.Args = []string{"kvmetal", "--launch-vm=broken", "--mem=2048", "--cpu=2", "--keep-on-failure"}
+
+	cli.Evaluate(context.Background(), &sync.WaitGroup{})
+	if backend.req.Name != "broken" || !backend.req.KeepOnFailure {
+		t.Errorf("--keep-on-failure did not reach CreateVM: %+v", backend.req)
+	}
+}
+
+func TestLegacyClusterPassesNodeNames(t *testing.T) {
+	backend := &createRecorder{}
+	client := startDaemon(t, backend)
+
+	prev := config.Current()
+	t.Cleanup(func() { config.Set(prev) })
+	t.Setenv(config.EnvConfig, "")
+	t.Setenv(config.EnvSocket, client.Socket)
+
+	prevArgs, prevFlags := os.Args, flag.CommandLine
+	t.Cleanup(func() { os.Args, flag.CommandLine = prevArgs, prevFlags })
+	flag.CommandLine = flag.NewFlagSet("kvmetal", flag.ContinueOnError)
+	os.Args = []string{"kvmetal", "--cluster", "--control=cp", "--workers=w1,w2", "--dry-run", "--output=json"}
+
+	cli.Evaluate(context.Background(), &sync.WaitGroup{})
+	if got := backend.cluster; got.Control != "cp" || strings.Join(got.Workers, ",") != "w1,w2" || !got.DryRun {
+		t.Errorf("--control and --workers did not reach CreateCluster: %+v", got)
+	}
+}
+
+func TestVMCreateSendsFileContents(t *testing.T) {
+	backend := &createRecorder{}
+	client := startDaemon(t, backend)
+
+	prev := config.Current()
+	t.Cleanup(func() { config.Set(prev) })
+	t.Setenv(config.EnvConfig, "")
+	t.Setenv(config.EnvSocket, client.Socket)
+
+	dir := t.TempDir()
+	userdata, boot := filepath.Join(dir, "extra.yaml"), filepath.Join(dir, "boot.sh")
+	os.WriteFile(userdata, []byte("#cloud-config\npackages: [htop]\n"), 0o644)
+	os.WriteFile(boot, []byte("#!/bin/sh\necho booted\n"), 0o644)
+
+	var out bytes.Buffer
+	env := &cli.Env{Ctx: context.Background(), WG: &sync.WaitGroup{}, Out: &out}
+	args := []string{"vm", "create", "web", "--userdata=" + userdata, "--boot=" + boot, "--dry-run", "--output=json"}
+	if err := cli.Root().Execute(env, args); err != nil {
+		t.Fatalf("vm create: %s", err)
+	}
+	if backend.req.Userdata != "#cloud-config\npackages: [htop]\n" || backend.req.BootScript != "#!/bin/sh\necho booted\n" {
+		t.Errorf("expected the file contents in the request, got %+v", backend.req)
+	}
+
+	err := cli.Root().Execute(env, []string{"vm", "create", "web", "--userdata=" + filepath.Join(dir, "missing.yaml"), "--dry-run"})
+	if cli.ExitCode(err) != cli.ExitUsage {
+		t.Errorf("a missing --userdata returned %v, want a usage error", err)
+	}
+}
+
+// jobsBackend answers job list with a job only the daemon knows
+type jobsBackend struct{ daemon.Backend }
+
+func (jobsBackend) ListJobs(ctx context.Context) ([]jobs.Job, error) {
+	return []jobs.Job{{ID: "from-daemon", Kind: "launch", Target: "kafka"}}, nil
+}
+
+func TestCLIRunsInProcessWithConnect(t *testing.T) {
+	client := startDaemon(t, jobsBackend{})
+
+	prev := config.Current()
+	t.Cleanup(func() { config.Set(prev) })
+	t.Setenv(config.EnvConfig, "")
+	t.Setenv(config.EnvSocket, client.Socket)
+
+	var out bytes.Buffer
+	env := &cli.Env{Ctx: context.Background(), WG: &sync.WaitGroup{}, Out: &out}
+	if err := cli.Root().Execute(env, []string{"job", "list", "--output=json"}); err != nil || !strings.Contains(out.String(), "from-daemon") {
+		t.Fatalf("job list did not go through the daemon: %v %s", err, out.String())
+	}
+
+	// the daemon would list its own libvirt's jobs, not those of the URI asked for
+	out.Reset()
+	env = &cli.Env{Ctx: context.Background(), WG: &sync.WaitGroup{}, Out: &out}
+	if err := cli.Root().Execute(env, []string{"job", "list", "--output=json", "--connect=test:///default"}); err != nil {
+		t.Fatalf("job list --connect: %s", err)
+	}
+	if _, viaDaemon := env.Backend().(*daemon.Client); viaDaemon || strings.Contains(out.String(), "from-daemon") {
+		t.Errorf("--connect went through the daemon: %s", out.String())
+	}
+}
@@ -0,0 +1,102 @@
+package tests
+
+import (
+	"strings"
+	"testing"
+
+	"kvmgo/cloudinit"
+	"kvmgo/configuration"
+	"kvmgo/constants"
+
+	"gopkg.in/yaml.v2"
+)
+
+func TestParseDistro(t *testing.T) {
+	for i, name := range constants.DistroNames {
+		d, err := constants.ParseDistro(strings.ToUpper(name))
+		if err != nil || d != constants.Distro(i) || d.String() != name {
+			t.Errorf("ParseDistro(%s) = %v, %v", name, d, err)
+		}
+	}
+
+	if _, err := constants.ParseDistro("gentoo"); err == nil {
+		t.Error("ParseDistro(gentoo) succeeded, want an error listing the distros")
+	}
+}
+
+func TestDistrosDefineImageAndVariant(t *testing.T) {
+	for i := range constants.DistroNames {
+		distro, err := configuration.GetImage(constants.Distro(i))
+		if err != nil {
+			t.Fatalf("GetImage(%d): %s", i, err)
+		}
+		if !strings.HasPrefix(distro.GetImageUrl(), "https://") || distro.GetOSVariant() == "" {
+			t.Errorf("%s: image %q variant %q", constants.Distro(i), distro.GetImageUrl(), distro.GetOSVariant())
+		}
+	}
+}
+
+// cloudConfig is the part of the generated user-data the distros differ in
+type cloudConfig struct {
+	Packages []string `yaml:"packages"`
+	RunCmd   []any    `yaml:"runcmd"`
+}
+
+func TestDistroUserdataUsesItsPackageManager(t *testing.T) {
+	for _, tc := range []struct {
+		distro   constants.Distro
+		packages string
+	}{
+		{constants.Debian, "zsh openjdk-17-jdk apt-transport-https qemu-guest-agent"},
+		{constants.Fedora, "zsh java-11-openjdk-devel qemu-guest-agent"},
+		{constants.Rocky, "zsh java-11-openjdk-devel qemu-guest-agent"},
+		{constants.Alpine, "zsh openjdk11-jdk qemu-guest-agent"},
+	} {
+		builder, err := configuration.NewConfigBuilder(
+			configuration.DefaultPreset{},
+			tc.distro,
+			[]constants.Dependency{constants.Zsh, constants.KubeWorker},
+			[]constants.CloudInitPkg{constants.ZSH, constants.OpenJDK11, constants.TransportHttps},
+			nil,
+			"ubuntu", "password", "repro", "ssh-rsa AAAAB3 kuro@host")
+		if err != nil {
+			t.Fatalf("%s: %s", tc.distro, err)
+		}
+		userdata := builder.CreateCloudInitData()
+
+		var cfg cloudConfig
+		if err := yaml.Unmarshal([]byte(userdata), &cfg); err != nil {
+			t.Fatalf("%s: user-data is not valid yaml: %s\n%s", tc.distro, err, userdata)
+		}
+
+		if got := strings.Join(cfg.Packages, " "); got != tc.packages {
+			t.Errorf("%s packages = %q, want %q", tc.distro, got, tc.packages)
+		}
+		// kvmetal's ssh and the preset runcmds log in as ubuntu whatever the image's default user is
+		parsed, err := cloudinit.Parse(userdata)
+		if err != nil {
+			t.Fatalf("%s: %s", tc.distro, err)
+		}
+		if len(parsed.Users) != 2 || parsed.Users[1].Name != "ubuntu" ||
+			strings.Join(parsed.Users[1].SSHAuthorizedKeys, ",") != "ssh-rsa AAAAB3 kuro@host" {
+			t.Errorf("%s: ubuntu user with the ssh key missing\n%s", tc.distro, userdata)
+		}
+		if !strings.Contains(userdata, "hostname: repro") {
+			t.Errorf("%s: hostname not substituted", tc.distro)
+		}
+		// vm ip and ssh fall back to the agent for static and IPv6 addresses - it has to start first
+		if len(cfg.RunCmd) == 0 {
+			t.Errorf("%s: no runcmd for zsh", tc.distro)
+		} else if first, _ := cfg.RunCmd[0].(string); !strings.Contains(first, "qemu-guest-agent") {
+			t.Errorf("%s: first runcmd %v should start qemu-guest-agent", tc.distro, cfg.RunCmd[0])
+		}
+
+		rpm := tc.distro == constants.Fedora || tc.distro == constants.Rocky
+		if rpm != strings.Contains(userdata, "dnf install -y kubelet kubeadm kubectl") {
+			t.Errorf("%s: kube worker runcmd uses the wrong package manager", tc.distro)
+		}
+		if rpm && strings.Contains(userdata, "apt-get") {
+			t.Errorf("%s: apt-get in dnf userdata", tc.distro)
+		}
+	}
+}
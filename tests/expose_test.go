@@ -0,0 +1,175 @@
+package tests
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	"kvmgo/config"
+	"kvmgo/network"
+	"kvmgo/network/qemu_hooks"
+)
+
+func useTempForwardingConfig(t *testing.T) {
+	prev := config.Current()
+	t.Cleanup(func() { config.Set(prev) })
+	config.Set(&config.Config{DataDir: t.TempDir(), StateDir: t.TempDir()})
+}
+
+func TestSetPortMappingReplacesHostPort(t *testing.T) {
+	useTempForwardingConfig(t)
+	if err := qemu_hooks.WriteConfigToFile(*goldenForwardingConfig()); err != nil {
+		t.Fatal(err)
+	}
+
+	before, after, err := qemu_hooks.SetPortMapping(network.ForwardingConfig{
+		VMName:  "kafka",
+		PortMap: []network.PortMapping{{Protocol: network.TCP, HostPort: 9092, VMPort: 9093}},
+	})
+	if err != nil {
+		t.Fatalf("SetPortMapping failed: %s", err)
+	}
+	if before == nil || before.PortMap[0].VMPort != 9092 {
+		t.Errorf("Expected before to hold the original forward, got %+v", before)
+	}
+
+	saved, err := qemu_hooks.ReadVMConfigFromFile("kafka")
+	if err != nil || saved == nil {
+		t.Fatalf("Reading the saved config failed: %v", err)
+	}
+	expected := []network.PortMapping{
+		{Protocol: network.UDP, HostPort: 5353, VMPort: 53},
+		{Protocol: network.TCP, HostPort: 9092, VMPort: 9093},
+	}
+	for _, cfg := range []*network.ForwardingConfig{after, saved} {
+		if len(cfg.PortMap) != len(expected) || cfg.PortMap[0] != expected[0] || cfg.PortMap[1] != expected[1] {
+			t.Errorf("Expected host port 9092 to be replaced, got %+v", cfg.PortMap)
+		}
+		if len(cfg.PortRange) != 1 || !cfg.HostIP.Equal(net.ParseIP("192.168.1.10")) {
+			t.Errorf("Expected the ranges and addresses to be kept, got %+v", cfg)
+		}
+	}
+
+	// a VM without a config gets the one it is given
+	_, after, err = qemu_hooks.SetPortMapping(network.ForwardingConfig{
+		VMName:    "spark",
+		HostIP:    net.ParseIP("192.168.1.10"),
+		PrivateIP: net.ParseIP("192.168.122.60"),
+		PortMap:   []network.PortMapping{{Protocol: network.TCP, HostPort: 8081, VMPort: 8080}},
+	})
+	if err != nil || after == nil || len(after.PortMap) != 1 {
+		t.Fatalf("Expected a new config for spark, got %+v %v", after, err)
+	}
+	configs, _ := qemu_hooks.ReadConfigsFromFile()
+	if len(configs.Configs) != 2 {
+		t.Errorf("Expected configs for kafka and spark, got %d", len(configs.Configs))
+	}
+}
+
+func TestSetPortMappingConcurrent(t *testing.T) {
+	useTempForwardingConfig(t)
+
+	// every VM gets its own port and all of them claim 7000 - one claim may win
+	var wg sync.WaitGroup
+	errs := make([]error, 32)
+	for i := range errs {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			_, _, errs[i] = qemu_hooks.SetPortMapping(network.ForwardingConfig{
+				VMName:    fmt.Sprintf("vm-%d", i),
+				HostIP:    net.ParseIP("192.168.1.10"),
+				PrivateIP: net.ParseIP(fmt.Sprintf("192.168.122.%d", 100+i)),
+				PortMap:   []network.PortMapping{{Protocol: network.TCP, HostPort: 8000 + i, VMPort: 80}},
+			})
+		}(i)
+		go func(i int) {
+			defer wg.Done()
+			qemu_hooks.SetPortMapping(network.ForwardingConfig{
+				VMName:    fmt.Sprintf("vm-%d", i),
+				HostIP:    net.ParseIP("192.168.1.10"),
+				PrivateIP: net.ParseIP(fmt.Sprintf("192.168.122.%d", 100+i)),
+				PortMap:   []network.PortMapping{{Protocol: network.TCP, HostPort: 7000, VMPort: 22}},
+			})
+		}(i)
+	}
+	wg.Wait()
+
+	configs, err := qemu_hooks.ReadConfigsFromFile()
+	if err != nil {
+		t.Fatalf("Reading the configs failed: %v", err)
+	}
+	if len(configs.Configs) != len(errs) {
+		t.Fatalf("Expected a config per VM, got %d", len(configs.Configs))
+	}
+	claims := 0
+	for _, cfg := range configs.Configs {
+		for _, pm := range cfg.PortMap {
+			if pm.HostPort == 7000 {
+				claims++
+			}
+		}
+	}
+	if claims != 1 {
+		t.Errorf("Expected host port 7000 forwarded once, got %d", claims)
+	}
+	for i, err := range errs {
+		if err != nil {
+			t.Errorf("vm-%d: %v", i, err)
+		}
+	}
+}
+
+func TestRemovePortMapping(t *testing.T) {
+	useTempForwardingConfig(t)
+	if err := qemu_hooks.WriteConfigToFile(*goldenForwardingConfig()); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := qemu_hooks.RemovePortMapping("kafka", 5353, network.TCP); !errors.Is(err, qemu_hooks.ErrNoForward) {
+		t.Errorf("Expected ErrNoForward for a forward on the wrong protocol, got %v", err)
+	}
+	if _, _, err := qemu_hooks.RemovePortMapping("spark", 0, network.TCP); !errors.Is(err, qemu_hooks.ErrNoForward) {
+		t.Errorf("Expected ErrNoForward for a VM without a config, got %v", err)
+	}
+
+	before, after, err := qemu_hooks.RemovePortMapping("kafka", 5353, network.UDP)
+	if err != nil {
+		t.Fatalf("RemovePortMapping failed: %s", err)
+	}
+	if len(before.PortMap) != 2 || len(after.PortMap) != 1 || after.PortMap[0].HostPort != 9092 {
+		t.Errorf("Expected only the udp forward to be removed, before %+v after %+v", before.PortMap, after.PortMap)
+	}
+
+	// any host port of a range removes the whole range
+	_, after, err = qemu_hooks.RemovePortMapping("kafka", 8005, network.TCP)
+	if err != nil || len(after.PortRange) != 0 || len(after.PortMap) != 1 {
+		t.Fatalf("Expected the 8000-8010 range to be removed, got %+v %v", after, err)
+	}
+	if _, _, err := qemu_hooks.RemovePortMapping("kafka", 8005, network.TCP); !errors.Is(err, qemu_hooks.ErrNoForward) {
+		t.Errorf("Expected ErrNoForward for a removed range, got %v", err)
+	}
+
+	before, after, err = qemu_hooks.RemovePortMapping("kafka", 0, network.TCP)
+	if err != nil || before == nil || after != nil {
+		t.Fatalf("Expected every forward to be removed, got before %+v after %+v %v", before, after, err)
+	}
+	if saved, err := qemu_hooks.ReadVMConfigFromFile("kafka"); err != nil || saved != nil {
+		t.Errorf("Expected the config of kafka to be removed, got %+v %v", saved, err)
+	}
+}
+
+func TestForwardingTableListsRanges(t *testing.T) {
+	fwd := goldenForwardingConfig()
+	fwd.LastUpdated = "2024-03-01T10:30:00Z"
+
+	table := network.CreateTableFromConfig(*fwd)
+	for _, want := range []string{"tcp (VM->Host) 9092->9092", "tcp (VM->Host) 9000-9010->8000-8010", "2024-03-01 10:30"} {
+		if !strings.Contains(table, want) {
+			t.Errorf("Table is missing %q:\n%s", want, table)
+		}
+	}
+}
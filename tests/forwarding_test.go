@@ -0,0 +1,233 @@
+package tests
+
+import (
+	"flag"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"kvmgo/config"
+	"kvmgo/network"
+	"kvmgo/network/qemu_hooks"
+)
+
+var updateGolden = flag.Bool("update", false, "rewrite the golden files under testdata")
+
+func goldenForwardingConfig() *network.ForwardingConfig {
+	return &network.ForwardingConfig{
+		VMName:     "kafka",
+		HostIP:     net.ParseIP("192.168.1.10"),
+		PrivateIP:  net.ParseIP("192.168.122.50"),
+		ExternalIP: net.ParseIP("203.0.113.7"),
+		Interface:  "virbr0",
+		PortMap: []network.PortMapping{
+			{Protocol: network.TCP, HostPort: 9092, VMPort: 9092},
+			{Protocol: network.UDP, HostPort: 5353, VMPort: 53},
+		},
+		PortRange: []network.PortRange{
+			{Protocol: network.TCP, HostStartPortNum: 8000, HostEndPortNum: 8010, VMStartPort: 9000, VMEndPortNum: 9010},
+		},
+	}
+}
+
+// compares got with testdata/forwarding/<name>.golden - go test -run TestForwarding -update rewrites them
+func assertGolden(t *testing.T, name, got string) {
+	t.Helper()
+	path := filepath.Join("testdata", "forwarding", name+".golden")
+	if *updateGolden {
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(got), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("missing golden file - run with -update: %s", err)
+	}
+	if got != string(want) {
+		t.Errorf("%s differs from %s:\n%s", name, path, got)
+	}
+}
+
+func TestForwardingBackendsGolden(t *testing.T) {
+	fwd := goldenForwardingConfig()
+	for _, name := range []string{config.ForwardingIPTables, config.ForwardingNFTables} {
+		backend, err := qemu_hooks.NewForwardingBackend(name)
+		if err != nil {
+			t.Fatalf("NewForwardingBackend(%s): %s", name, err)
+		}
+		if backend.Name() != name {
+			t.Errorf("backend %s reports %s", name, backend.Name())
+		}
+
+		assertGolden(t, name+"-start", strings.Join(qemu_hooks.CommandStrings(backend.Start(fwd)), "\n")+"\n")
+		assertGolden(t, name+"-stop", strings.Join(qemu_hooks.CommandStrings(backend.Stop(fwd)), "\n")+"\n")
+
+		// expose without --external-ip stores 0.0.0.0 - forwarded from anywhere, no source match
+		open := goldenForwardingConfig()
+		open.ExternalIP = net.IPv4zero
+		assertGolden(t, name+"-start-any", strings.Join(qemu_hooks.CommandStrings(backend.Start(open)), "\n")+"\n")
+	}
+
+	if _, err := qemu_hooks.NewForwardingBackend("pf"); err == nil {
+		t.Error("an unknown backend should fail")
+	}
+}
+
+func TestIPTablesRangeKeepsOffset(t *testing.T) {
+	fwd := goldenForwardingConfig()
+	rules := strings.Join(qemu_hooks.CommandStrings(qemu_hooks.IPTables{}.Start(fwd)), "\n")
+	for _, want := range []string{
+		"--dport 8000:8010 -j DNAT --to-destination 192.168.122.50:9000-9010/8000 -s 203.0.113.7",
+		"-d 192.168.122.50 --dport 9000:9010 -j MASQUERADE",
+		"FWD-kafka -p tcp -d 192.168.122.50 --dport 9000:9010 -j ACCEPT",
+	} {
+		if !strings.Contains(rules, want) {
+			t.Errorf("iptables rules are missing %q:\n%s", want, rules)
+		}
+	}
+
+	// a range on the same ports needs no offset
+	fwd.PortRange[0].VMStartPort, fwd.PortRange[0].VMEndPortNum = 8000, 8010
+	rules = strings.Join(qemu_hooks.CommandStrings(qemu_hooks.IPTables{}.Start(fwd)), "\n")
+	if !strings.Contains(rules, "--dport 8000:8010 -j DNAT --to-destination 192.168.122.50 -s 203.0.113.7") {
+		t.Errorf("expected a plain DNAT for an unshifted range:\n%s", rules)
+	}
+}
+
+func TestNFTablesRuleset(t *testing.T) {
+	fwd := goldenForwardingConfig()
+	ruleset := qemu_hooks.NFTables{}.Ruleset(fwd)
+
+	if ruleset.Family != "ip" || ruleset.Table != "kvmetal-kafka" || len(ruleset.Chains) != 7 {
+		t.Fatalf("unexpected table %s %s with %d chains", ruleset.Family, ruleset.Table, len(ruleset.Chains))
+	}
+	chains := map[string]qemu_hooks.NFTChain{}
+	for _, chain := range ruleset.Chains {
+		chains[chain.Name] = chain
+	}
+	if dnat := chains["dnat"].Rules; len(dnat) != 3 ||
+		dnat[0] != "ip saddr 203.0.113.7 ip daddr 192.168.1.10 tcp dport 9092 dnat to 192.168.122.50:9092" {
+		t.Errorf("unexpected dnat rules %q", dnat)
+	}
+	if rangeRule := chains["dnat"].Rules[2]; !strings.HasSuffix(rangeRule, "tcp dport 8000-8010 dnat to 192.168.122.50:tcp dport map { 8000 : 9000, 8001 : 9001, 8002 : 9002, 8003 : 9003, 8004 : 9004, 8005 : 9005, 8006 : 9006, 8007 : 9007, 8008 : 9008, 8009 : 9009, 8010 : 9010 }") {
+		t.Errorf("expected the range to be mapped port by port, got %q", rangeRule)
+	}
+	if snat := chains["snat"].Rules; len(snat) != 6 || snat[5] != "ip saddr 192.168.122.50 ip daddr 192.168.122.50 tcp dport 9000-9010 masquerade" {
+		t.Errorf("expected masquerade on the VM ports, got %q", snat)
+	}
+	if fwdRules := chains["fwd"].Rules; len(fwdRules) != 3 || fwdRules[2] != `ip daddr 192.168.122.50 tcp dport 9000-9010 oifname "virbr0" accept` {
+		t.Errorf("unexpected fwd rules %q", fwdRules)
+	}
+
+	// a range on the same ports keeps them
+	unshifted := goldenForwardingConfig()
+	unshifted.PortRange[0].VMStartPort, unshifted.PortRange[0].VMEndPortNum = 8000, 8010
+	ruleset = qemu_hooks.NFTables{}.Ruleset(unshifted)
+	for _, chain := range ruleset.Chains {
+		if chain.Name == "dnat" && !strings.HasSuffix(chain.Rules[2], "tcp dport 8000-8010 dnat to 192.168.122.50") {
+			t.Errorf("expected a plain dnat for an unshifted range, got %q", chain.Rules[2])
+		}
+	}
+
+	// an unspecified external IP forwards from anywhere, an IPv6 VM gets an ip6 table
+	fwd.ExternalIP = net.IPv4zero
+	fwd.HostIP, fwd.PrivateIP = net.ParseIP("fd00::1"), net.ParseIP("fd00:122::50")
+	ruleset = qemu_hooks.NFTables{}.Ruleset(fwd)
+	for _, chain := range ruleset.Chains {
+		if chain.Name == "dnat" && chain.Rules[0] != "ip6 daddr fd00::1 tcp dport 9092 dnat to [fd00:122::50]:9092" {
+			t.Errorf("unexpected ip6 dnat rule %q", chain.Rules[0])
+		}
+	}
+	if !strings.HasPrefix(ruleset.Render(), "table ip6 kvmetal-kafka\ndelete table ip6 kvmetal-kafka\n") {
+		t.Errorf("the table must be replaced in the same transaction:\n%s", ruleset.Render())
+	}
+}
+
+func TestConfigForwarding(t *testing.T) {
+	t.Setenv(config.EnvForwarding, "")
+	if cfg := config.Defaults(); cfg.Forwarding != config.ForwardingIPTables {
+		t.Errorf("default forwarding %s, want iptables", cfg.Forwarding)
+	}
+
+	file := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(file, []byte("forwarding: nftables\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if cfg, err := config.Load(file); err != nil || cfg.Forwarding != config.ForwardingNFTables {
+		t.Errorf("forwarding from file: %v %v", cfg, err)
+	}
+
+	t.Setenv(config.EnvForwarding, "ipchains")
+	if _, err := config.Load(file); err == nil {
+		t.Error("an unknown forwarding backend should be rejected")
+	}
+}
+
+func TestHookEventCommands(t *testing.T) {
+	prev := config.Current()
+	t.Cleanup(func() { config.Set(prev) })
+	config.Set(&config.Config{DataDir: t.TempDir(), StateDir: t.TempDir(), Forwarding: config.ForwardingIPTables})
+
+	if err := qemu_hooks.WriteConfigToFile(*goldenForwardingConfig()); err != nil {
+		t.Fatal(err)
+	}
+
+	start, err := qemu_hooks.HookEventCommands("start", "kafka")
+	if err != nil || len(start) == 0 {
+		t.Fatalf("start: %d commands, %v", len(start), err)
+	}
+	for _, cmd := range start {
+		// chains and jumps are looked up first - a second start neither fails nor duplicates them
+		if strings.Contains(cmd.String(), " -N ") && len(cmd.Unless) == 0 || strings.Contains(cmd.String(), " -I ") && len(cmd.Unless) == 0 {
+			t.Errorf("%s would fail or duplicate on a second start", cmd)
+		}
+	}
+
+	for _, action := range []string{"stopped", "release"} {
+		stop, err := qemu_hooks.HookEventCommands(action, "kafka")
+		if err != nil || len(stop) == 0 {
+			t.Fatalf("%s: %d commands, %v", action, len(stop), err)
+		}
+		for _, cmd := range stop {
+			if len(cmd.OnlyIf) == 0 {
+				t.Errorf("%s: %s fails when the rules are already gone", action, cmd)
+			}
+		}
+	}
+
+	for action, domain := range map[string]string{"prepare": "kafka", "start": "redpanda"} {
+		if cmds, err := qemu_hooks.HookEventCommands(action, domain); err != nil || len(cmds) != 0 {
+			t.Errorf("%s %s should need no commands, got %d %v", action, domain, len(cmds), err)
+		}
+	}
+}
+
+func TestApplyCommandsReportsEachFailure(t *testing.T) {
+	cmds := []qemu_hooks.Command{
+		{Args: []string{"false"}},
+		{Args: []string{"false"}, Unless: []string{"true"}},
+		{Args: []string{"false"}, OnlyIf: []string{"false"}},
+		{Args: []string{"grep", "-q", "kvmetal-kafka"}, Stdin: "table ip kvmetal-kafka\n"},
+		{Args: []string{"sh", "-c", "echo no such chain >&2; exit 1"}},
+	}
+
+	results, err := qemu_hooks.ApplyCommands(cmds)
+	if err == nil || !strings.Contains(err.Error(), "2 of 5") {
+		t.Fatalf("expected 2 of 5 commands to fail, got %v", err)
+	}
+	if len(results) != len(cmds) {
+		t.Fatalf("every command should be reported, got %d results", len(results))
+	}
+	if results[0].Err == nil || !results[1].Skipped || !results[2].Skipped || results[3].Err != nil {
+		t.Errorf("unexpected results %+v", results)
+	}
+	if results[4].Err == nil || !strings.Contains(results[4].Err.Error(), "no such chain") {
+		t.Errorf("a failure should carry the command's output, got %v", results[4].Err)
+	}
+}
@@ -0,0 +1,199 @@
+package tests
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"kvmgo/gc"
+	"kvmgo/network"
+	"kvmgo/state"
+)
+
+func touch(t *testing.T, path string, size int, mod time.Time) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, make([]byte, size), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, mod, mod); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// age backdates the directories under root - creating files in them made them look fresh
+func age(t *testing.T, root string, mod time.Time) {
+	t.Helper()
+	filepath.WalkDir(root, func(path string, d os.DirEntry, err error) error {
+		if err == nil && d.IsDir() && path != root {
+			os.Chtimes(path, mod, mod)
+		}
+		return nil
+	})
+}
+
+func orphanKeys(orphans []gc.Orphan) string {
+	var keys []string
+	for _, o := range orphans {
+		keys = append(keys, fmt.Sprintf("%s:%s", o.Kind, o.VM))
+	}
+	return strings.Join(keys, " ")
+}
+
+func TestGcFindsOrphansOfUndefinedVMs(t *testing.T) {
+	now := time.Now()
+	old := now.Add(-2 * time.Hour)
+	images, artifacts, mnt := t.TempDir(), t.TempDir(), t.TempDir()
+
+	touch(t, filepath.Join(images, "kafka-vm-disk.qcow2"), 10, old)    // defined
+	touch(t, filepath.Join(images, "crashed-vm-disk.qcow2"), 100, old) // orphan
+	touch(t, filepath.Join(images, "launching-vm-disk.qcow2"), 5, now) // too recent
+	touch(t, filepath.Join(images, "jammy-server-cloudimg-amd64.img"), 5, old)
+	touch(t, filepath.Join(artifacts, "crashed", "userdata", "user-data.txt"), 20, old)
+	touch(t, filepath.Join(artifacts, "kafka", "userdata", "user-data.txt"), 20, old)
+	age(t, artifacts, old)
+	os.MkdirAll(filepath.Join(mnt, "crashed"), 0o755)
+	os.MkdirAll(filepath.Join(mnt, "unrelated"), 0o755)
+
+	inv := gc.Inventory{
+		Domains:      map[string][]string{"kafka": {filepath.Join(images, "kafka-vm-disk.qcow2")}},
+		ImagesDir:    images,
+		ArtifactsDir: artifacts,
+		MountRoot:    mnt,
+		Forwarding: []network.ForwardingConfig{
+			{VMName: "kafka"},
+			{VMName: "crashed", PortMap: []network.PortMapping{{HostPort: 8080, VMPort: 80, Protocol: "tcp"}}},
+		},
+		ForwardingFile: "/etc/kvmfwding_config.json",
+		Chains: []gc.IptablesChain{
+			{Table: "nat", Name: "DNAT-crashed", VM: "crashed"},
+			{Table: "nat", Name: "DNAT-kafka", VM: "kafka"},
+		},
+		NFTTables: []gc.NFTTable{
+			{Family: "ip", Name: "kvmetal-crashed", VM: "crashed"},
+			{Family: "ip", Name: "kvmetal-kafka", VM: "kafka"},
+		},
+		Records: []*state.VMRecord{{Name: "crashed"}, {Name: "kafka"}},
+		Mounted: func(vm string) bool { return vm == "crashed" },
+		MinAge:  time.Hour,
+		Now:     now,
+	}
+
+	orphans := gc.Find(inv)
+	want := "mount:crashed iptables-chain:crashed nft-table:crashed forwarding:crashed vm-image:crashed artifacts:crashed state:crashed"
+	if got := orphanKeys(orphans); got != want {
+		t.Fatalf("orphans\n got  %s\n want %s", got, want)
+	}
+
+	if orphans[0].Detail != "mounted" {
+		t.Errorf("mount detail = %q, want mounted", orphans[0].Detail)
+	}
+	if orphans[2].Path != "kvmetal-crashed" || orphans[2].Table != "ip" {
+		t.Errorf("nft table orphan = %+v", orphans[2])
+	}
+	if orphans[3].Detail != "8080->80/tcp" {
+		t.Errorf("forwarding detail = %q", orphans[3].Detail)
+	}
+	if total := gc.TotalSize(orphans); total != 120 {
+		t.Errorf("TotalSize = %d, want the image plus the artifacts", total)
+	}
+}
+
+func TestGcLeavesLaunchesInProgressMounted(t *testing.T) {
+	now := time.Now()
+	images, artifacts, mnt := t.TempDir(), t.TempDir(), t.TempDir()
+
+	// setup-vm mounted the image before create-vm defined the domain
+	touch(t, filepath.Join(images, "launching-vm-disk.qcow2"), 5, now)
+	touch(t, filepath.Join(artifacts, "launching", "userdata", "user-data.txt"), 5, now)
+	os.MkdirAll(filepath.Join(mnt, "launching"), 0o755)
+
+	orphans := gc.Find(gc.Inventory{
+		Domains:      map[string][]string{},
+		ImagesDir:    images,
+		ArtifactsDir: artifacts,
+		MountRoot:    mnt,
+		Mounted:      func(vm string) bool { return vm == "launching" },
+		MinAge:       time.Hour,
+		Now:          now,
+	})
+	if len(orphans) != 0 {
+		t.Errorf("expected nothing of a launch in progress to be collected, got %s", orphanKeys(orphans))
+	}
+}
+
+func TestGcKeepsVolumesStillReferenced(t *testing.T) {
+	now := time.Now()
+	old := now.Add(-2 * time.Hour)
+	pool := "/var/lib/libvirt/images"
+	vol := func(name, backing string) gc.PoolVolume {
+		return gc.PoolVolume{Pool: "default", Path: filepath.Join(pool, name), Backing: backing, Size: 1, ModTime: old}
+	}
+
+	inv := gc.Inventory{
+		Domains: map[string][]string{
+			"kafka-kraft": {filepath.Join(pool, "kafka-kraft-data-disk.qcow2")},
+		},
+		Volumes: []gc.PoolVolume{
+			vol("kafka-kraft-data-disk.qcow2", ""),
+			vol("kafka-kraft-openebs-disk.qcow2", ""), // attached elsewhere but named for a defined VM
+			vol("crashed-openebs-disk.qcow2", ""),
+			vol("golden-base-disk.qcow2", ""), // a snapshot layers on it
+			vol("snap-overlay.qcow2", filepath.Join(pool, "golden-base-disk.qcow2")),
+			vol("ubuntu.img", ""),
+			{Pool: "default", Path: filepath.Join(pool, "fresh-data-disk.qcow2"), ModTime: now},
+		},
+		MinAge: time.Hour,
+		Now:    now,
+	}
+
+	orphans := gc.Find(inv)
+	if got := orphanKeys(orphans); got != "volume:crashed" {
+		t.Fatalf("orphans = %s, want only the crashed volume", got)
+	}
+	if orphans[0].Pool != "default" {
+		t.Errorf("pool = %q", orphans[0].Pool)
+	}
+}
+
+func TestGcParseChains(t *testing.T) {
+	out := `-P PREROUTING ACCEPT
+-N DNAT-kafka-kraft
+-N SNAT-kafka-kraft
+-N LIBVIRT_PRT
+-A PREROUTING -j DNAT-kafka-kraft
+`
+	chains := gc.ParseChains("nat", out)
+	if len(chains) != 2 {
+		t.Fatalf("chains = %+v, want DNAT and SNAT", chains)
+	}
+	for _, c := range chains {
+		if c.VM != "kafka-kraft" || c.Table != "nat" {
+			t.Errorf("chain = %+v", c)
+		}
+	}
+
+	if chains := gc.ParseChains("filter", "-N FWD-kafka\n-N DNAT-kafka\n"); len(chains) != 1 || chains[0].Name != "FWD-kafka" {
+		t.Errorf("filter chains = %+v, want only FWD-kafka", chains)
+	}
+}
+
+func TestGcParseNFTTables(t *testing.T) {
+	out := `table inet firewalld
+table ip kvmetal-kafka-kraft
+table ip6 kvmetal-spark
+table ip libvirt_network
+`
+	tables := gc.ParseNFTTables(out)
+	if len(tables) != 2 {
+		t.Fatalf("tables = %+v, want kafka-kraft and spark", tables)
+	}
+	if tables[0] != (gc.NFTTable{Family: "ip", Name: "kvmetal-kafka-kraft", VM: "kafka-kraft"}) || tables[1].Family != "ip6" || tables[1].VM != "spark" {
+		t.Errorf("tables = %+v", tables)
+	}
+}
@@ -0,0 +1,159 @@
+package tests
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"kvmgo/network/qemu_hooks"
+)
+
+// writeScript writes an executable that appends its name, args and stdin to log
+func writeScript(t *testing.T, path, name, log string) {
+	t.Helper()
+	script := "#!/bin/sh\necho \"" + name + " $*\" >> " + log + "\ncat >> " + log + "\n"
+	if err := os.WriteFile(path, []byte(script), 0o755); err != nil {
+		t.Fatalf("Failed to write %s: %s", path, err)
+	}
+}
+
+func TestHookInstallChainsExistingHook(t *testing.T) {
+	dir := t.TempDir()
+	hooks := filepath.Join(dir, "hooks")
+	if err := os.Mkdir(hooks, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	log := filepath.Join(dir, "calls.log")
+	binary := filepath.Join(dir, "kvmetal")
+	writeScript(t, binary, "kvmetal", log)
+	writeScript(t, filepath.Join(hooks, "qemu"), "previous", log)
+	original, _ := os.ReadFile(filepath.Join(hooks, "qemu"))
+
+	installer := qemu_hooks.NewHookInstaller().SetDir(hooks).SetBinary(binary)
+	status, err := installer.Install()
+	if err != nil {
+		t.Fatalf("Install failed: %s", err)
+	}
+	if !status.Installed || !status.UpToDate || status.Previous != filepath.Join(hooks, "qemu.kvmetal-prev") {
+		t.Errorf("Unexpected status after install: %+v", status)
+	}
+	if len(status.Problems) != 0 {
+		t.Errorf("Expected no permission problems, got %v", status.Problems)
+	}
+
+	// libvirt runs the hook with the domain XML on stdin - both hooks must see it, the previous one first
+	cmd := exec.Command(filepath.Join(hooks, "qemu"), "kafka", "start", "begin", "-")
+	cmd.Stdin = strings.NewReader("<domain/>\n")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("Running the hook failed: %s %s", err, out)
+	}
+	calls, _ := os.ReadFile(log)
+	expected := "previous kafka start begin -\n<domain/>\nkvmetal hooks run kafka start begin -\n<domain/>\n"
+	if string(calls) != expected {
+		t.Errorf("Unexpected hook calls:\n%s\nexpected:\n%s", calls, expected)
+	}
+
+	if err := installer.Uninstall(); err != nil {
+		t.Fatalf("Uninstall failed: %s", err)
+	}
+	restored, err := os.ReadFile(filepath.Join(hooks, "qemu"))
+	if err != nil || string(restored) != string(original) {
+		t.Errorf("Previous hook was not restored: %q %v", restored, err)
+	}
+	for _, name := range []string{"qemu.kvmetal-prev", "kvmetal"} {
+		if _, err := os.Stat(filepath.Join(hooks, name)); !os.IsNotExist(err) {
+			t.Errorf("Expected %s to be removed, got %v", name, err)
+		}
+	}
+	if err := installer.Uninstall(); err == nil || !strings.Contains(err.Error(), "not installed by kvmetal") {
+		t.Errorf("Expected uninstall to leave a foreign hook alone, got %v", err)
+	}
+}
+
+func TestHookReinstallAndStatus(t *testing.T) {
+	dir := t.TempDir()
+	hooks := filepath.Join(dir, "hooks")
+	log := filepath.Join(dir, "calls.log")
+	binary := filepath.Join(dir, "kvmetal")
+	writeScript(t, binary, "kvmetal", log)
+
+	installer := qemu_hooks.NewHookInstaller().SetDir(hooks).SetBinary(binary)
+	status, err := installer.Status()
+	if err != nil {
+		t.Fatalf("Status failed: %s", err)
+	}
+	if status.Installed || status.Foreign {
+		t.Errorf("Expected nothing installed in a missing dir, got %+v", status)
+	}
+	if err := installer.Uninstall(); !errors.Is(err, qemu_hooks.ErrHookNotInstalled) {
+		t.Errorf("Expected ErrHookNotInstalled, got %v", err)
+	}
+
+	if _, err := installer.Install(); err != nil {
+		t.Fatalf("Install failed: %s", err)
+	}
+	// installing again replaces kvmetal's own shim instead of chaining it
+	status, err = installer.Install()
+	if err != nil {
+		t.Fatalf("Reinstall failed: %s", err)
+	}
+	if status.Previous != "" {
+		t.Errorf("Reinstall chained the kvmetal shim as the previous hook: %+v", status)
+	}
+
+	writeScript(t, binary, "kvmetal-new", log)
+	status, _ = installer.Status()
+	if status.UpToDate || status.Version == status.Current {
+		t.Errorf("Expected a changed binary to be reported out of date: %+v", status)
+	}
+
+	if err := os.Chmod(filepath.Join(hooks, "qemu"), 0o777); err != nil {
+		t.Fatal(err)
+	}
+	status, _ = installer.Status()
+	if len(status.Problems) != 1 || !strings.Contains(status.Problems[0], "writable by group or others") {
+		t.Errorf("Expected a world writable hook to be reported, got %v", status.Problems)
+	}
+}
+
+func TestHookPinsForwardingConfig(t *testing.T) {
+	dir := t.TempDir()
+	hooks := filepath.Join(dir, "hooks")
+	networkDir := filepath.Join(dir, "user's network")
+	log := filepath.Join(dir, "calls.log")
+	binary := filepath.Join(dir, "kvmetal")
+	script := "#!/bin/sh\necho \"$KVMETAL_NETWORK_DIR $KVMETAL_FORWARDING\" >> " + log + "\ncat > /dev/null\n"
+	if err := os.WriteFile(binary, []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	installer := qemu_hooks.NewHookInstaller().SetDir(hooks).SetBinary(binary).SetNetworkDir(networkDir)
+	installer.Forwarding = "nftables"
+	status, err := installer.Install()
+	if err != nil {
+		t.Fatalf("Install failed: %s", err)
+	}
+	if want := filepath.Join(networkDir, "kvmfwding_config.json"); status.ForwardingConfig != want || len(status.Problems) != 0 {
+		t.Errorf("Expected the hook to read %s without problems, got %+v", want, status)
+	}
+
+	// libvirt runs the hook without the installing user's environment
+	cmd := exec.Command(filepath.Join(hooks, "qemu"), "kafka", "start", "begin", "-")
+	cmd.Env = []string{"PATH=" + os.Getenv("PATH")}
+	cmd.Stdin = strings.NewReader("<domain/>\n")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("Running the hook failed: %s %s", err, out)
+	}
+	if calls, _ := os.ReadFile(log); string(calls) != networkDir+" nftables\n" {
+		t.Errorf("Expected the pinned config to reach kvmetal, got %q", calls)
+	}
+
+	// someone resolving another forwarding config is told the hook does not read theirs
+	status, _ = qemu_hooks.NewHookInstaller().SetDir(hooks).SetBinary(binary).SetNetworkDir(filepath.Join(dir, "root")).Status()
+	if len(status.Problems) != 1 || !strings.Contains(status.Problems[0], "the hook reads "+status.ForwardingConfig) {
+		t.Errorf("Expected the mismatch to be reported, got %v", status.Problems)
+	}
+}
@@ -0,0 +1,145 @@
+package tests
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"kvmgo/constants"
+	"kvmgo/coreos"
+	kvm "kvmgo/vm"
+)
+
+func TestSHA512CryptMatchesReference(t *testing.T) {
+	// test vector from the SHA-crypt spec
+	want := "$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1"
+	if got := coreos.SHA512Crypt("Hello world!", "saltstring"); got != want {
+		t.Errorf("SHA512Crypt = %s, want %s", got, want)
+	}
+
+	hash, err := coreos.HashPassword("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	salt := strings.Split(hash, "$")[2]
+	if coreos.SHA512Crypt("password", salt) != hash {
+		t.Errorf("HashPassword(password) = %s does not verify", hash)
+	}
+}
+
+func TestIgnitionConfigForKubeWorker(t *testing.T) {
+	for _, distro := range []constants.Distro{constants.FedoraCoreOS, constants.Flatcar} {
+		builder, err := coreos.NewConfigBuilder(distro,
+			[]constants.Dependency{constants.KubeWorker, constants.Kafka},
+			nil,
+			"ubuntu", "password", "worker", "ssh-ed25519 AAAAC3 kuro@host\n")
+		if err != nil {
+			t.Fatalf("%s: %s", distro, err)
+		}
+		ignition, err := builder.CreateIgnitionData()
+		if err != nil {
+			t.Fatalf("%s: %s", distro, err)
+		}
+
+		var cfg coreos.Config
+		if err := json.Unmarshal([]byte(ignition), &cfg); err != nil {
+			t.Fatalf("%s: config does not parse back: %s\n%s", distro, err, ignition)
+		}
+
+		if cfg.Ignition.Version != coreos.IgnitionVersion {
+			t.Errorf("%s: ignition version %q", distro, cfg.Ignition.Version)
+		}
+
+		users := cfg.Passwd.Users
+		if len(users) != 2 || users[0].Name != "ubuntu" || users[1].Name != "core" {
+			t.Fatalf("%s: expected the ubuntu and core users, got %+v", distro, users)
+		}
+		if !strings.HasPrefix(users[0].PasswordHash, "$6$") || strings.Contains(ignition, `"password"`) {
+			t.Errorf("%s: password must only be passed hashed", distro)
+		}
+		if len(users[0].SSHAuthorizedKeys) != 1 || users[0].SSHAuthorizedKeys[0] != "ssh-ed25519 AAAAC3 kuro@host" {
+			t.Errorf("%s: ssh key %v", distro, users[0].SSHAuthorizedKeys)
+		}
+
+		files := map[string]string{}
+		for _, f := range cfg.Storage.Files {
+			files[f.Path] = f.Contents
+		}
+		if files["/etc/hostname"] != "worker\n" {
+			t.Errorf("%s: hostname file %q", distro, files["/etc/hostname"])
+		}
+		if !strings.Contains(files["/etc/containerd/config.toml"], "SystemdCgroup = true") {
+			t.Errorf("%s: containerd not switched to the systemd cgroup driver", distro)
+		}
+
+		units := map[string]coreos.Unit{}
+		for _, u := range cfg.Systemd.Units {
+			units[u.Name] = u
+		}
+		for _, name := range []string{"containerd.service", "install-kubernetes.service", "kubelet.service"} {
+			if u, ok := units[name]; !ok || u.Enabled == nil || !*u.Enabled {
+				t.Errorf("%s: %s missing or not enabled", distro, name)
+			}
+		}
+		if _, ok := units["kubeadm-init.service"]; ok {
+			t.Errorf("%s: workers must not run kubeadm init", distro)
+		}
+		// Flatcar only reads /etc/containerd/config.toml through a drop-in
+		if flatcar := len(units["containerd.service"].Dropins) == 1; flatcar != (distro == constants.Flatcar) {
+			t.Errorf("%s: containerd drop-ins %+v", distro, units["containerd.service"].Dropins)
+		}
+	}
+}
+
+func TestIgnitionButaneVariant(t *testing.T) {
+	builder, err := coreos.NewConfigBuilder(constants.FedoraCoreOS,
+		[]constants.Dependency{constants.KubernetesControlCilium},
+		[]constants.CloudInitPkg{constants.ZSH, constants.TransportHttps},
+		"ubuntu", "", "control", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	butane, err := builder.CreateButaneData()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{
+		"variant: fcos",
+		"version: 1.4.0",
+		"path: /opt/kvmetal/kubeadm-init.sh",
+		"--skip-phases=addon/kube-proxy",
+		"rpm-ostree install --idempotent --apply-live --allow-inactive zsh\n",
+	} {
+		if !strings.Contains(butane, want) {
+			t.Errorf("butane config missing %q\n%s", want, butane)
+		}
+	}
+	if strings.Contains(butane, "password_hash") || strings.Contains(butane, "name: core") {
+		t.Errorf("no password or ssh key given - expected only the bare ubuntu user\n%s", butane)
+	}
+
+	if _, err := coreos.NewConfigBuilder(constants.Fedora, nil, nil, "ubuntu", "", "vm", ""); err == nil {
+		t.Error("NewConfigBuilder accepted a cloud-init distro")
+	}
+}
+
+func TestLaunchStagesIgnition(t *testing.T) {
+	vmConfig := kvm.NewVMConfig("fcos").
+		SetArtifactsDir(t.TempDir()).
+		SetImagesDir(t.TempDir()).
+		SetDistro(constants.FedoraCoreOS)
+
+	var names []string
+	for _, st := range vmConfig.LaunchStages() {
+		names = append(names, st.Name)
+	}
+	if got := strings.Join(names, ","); strings.Contains(got, kvm.StageCloudInit) || !strings.Contains(got, kvm.StageIgnition) {
+		t.Errorf("stages = %s, want %s in place of %s", got, kvm.StageIgnition, kvm.StageCloudInit)
+	}
+
+	domain := vmConfig.DomainConfig()
+	if domain.UserDataPath != "" || !strings.HasSuffix(domain.IgnitionPath, "/userdata/config.ign") {
+		t.Errorf("domain userdata %q ignition %q", domain.UserDataPath, domain.IgnitionPath)
+	}
+}
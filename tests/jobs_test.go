@@ -0,0 +1,320 @@
+package tests
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"kvmgo/daemon"
+	"kvmgo/jobs"
+	kvm "kvmgo/vm"
+)
+
+func stage(name string, err error) jobs.Stage {
+	return jobs.Stage{Name: name, Run: func(ctx context.Context) error { return err }}
+}
+
+func eventTypes(events []jobs.Event) string {
+	var types []string
+	for _, ev := range events {
+		if ev.Stage != "" {
+			types = append(types, fmt.Sprintf("%s:%s", ev.Stage, ev.Type))
+		} else {
+			types = append(types, string(ev.Type))
+		}
+	}
+	return strings.Join(types, " ")
+}
+
+func TestJobStagesEmitEventsInOrder(t *testing.T) {
+	engine := jobs.NewEngine()
+
+	var mu sync.Mutex
+	var events []jobs.Event
+	engine.OnEvent(func(ev jobs.Event) {
+		mu.Lock()
+		defer mu.Unlock()
+		events = append(events, ev)
+	})
+
+	job, err := engine.Run(context.Background(), "launch", "kafka", []jobs.Stage{stage("pull-image", nil), stage("create-vm", nil)})
+	if err != nil {
+		t.Fatalf("Run: %s", err)
+	}
+	if job.Status != jobs.Succeeded || job.FinishedAt == nil {
+		t.Errorf("job = %+v, want succeeded with a finish time", job)
+	}
+
+	want := "job_started pull-image:stage_started pull-image:stage_succeeded create-vm:stage_started create-vm:stage_succeeded job_succeeded"
+	if got := eventTypes(events); got != want {
+		t.Errorf("events\n got  %s\n want %s", got, want)
+	}
+	for i, ev := range events {
+		if ev.Seq != i+1 || ev.JobID != job.ID || ev.Target != "kafka" || ev.Total != 2 {
+			t.Errorf("event %d = %+v", i, ev)
+		}
+	}
+}
+
+func TestJobFailureSkipsRemainingStages(t *testing.T) {
+	engine := jobs.NewEngine()
+
+	job, err := engine.Run(context.Background(), "launch", "kafka", []jobs.Stage{
+		stage("pull-image", nil),
+		stage("create-disks", errors.New("qemu-img: no space left on device")),
+		stage("create-vm", nil),
+	})
+	if err == nil || !strings.Contains(err.Error(), "no space left") {
+		t.Fatalf("Run error = %v, want the stage error", err)
+	}
+
+	statuses := []jobs.Status{jobs.Succeeded, jobs.Failed, jobs.Skipped}
+	for i, st := range job.Stages {
+		if st.Status != statuses[i] {
+			t.Errorf("stage %s = %s, want %s", st.Name, st.Status, statuses[i])
+		}
+	}
+	if failed := job.FailedStage(); failed == nil || failed.Name != "create-disks" {
+		t.Errorf("FailedStage = %+v, want create-disks", failed)
+	}
+}
+
+func TestJobCancelStopsRunningStage(t *testing.T) {
+	engine := jobs.NewEngine()
+
+	started := make(chan struct{})
+	job := engine.Submit(context.Background(), "launch", "kafka", []jobs.Stage{
+		{Name: "pull-image", Run: func(ctx context.Context) error {
+			close(started)
+			<-ctx.Done()
+			return ctx.Err()
+		}},
+		stage("create-vm", nil),
+	})
+
+	<-started
+	if err := engine.Cancel(job.ID); err != nil {
+		t.Fatalf("Cancel: %s", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	final, err := engine.Wait(ctx, job.ID)
+	if err != nil {
+		t.Fatalf("Wait: %s", err)
+	}
+
+	if final.Status != jobs.Cancelled || !errors.Is(final.Err(), context.Canceled) {
+		t.Errorf("job = %s (%v), want cancelled", final.Status, final.Err())
+	}
+	if final.Stages[0].Status != jobs.Cancelled || final.Stages[1].Status != jobs.Skipped {
+		t.Errorf("stages = %+v", final.Stages)
+	}
+
+	if err := engine.Cancel("missing"); !errors.Is(err, jobs.ErrUnknownJob) {
+		t.Errorf("Cancel(missing) = %v, want ErrUnknownJob", err)
+	}
+}
+
+func TestJobWatchReplaysHistory(t *testing.T) {
+	engine := jobs.NewEngine()
+
+	job, _ := engine.Run(context.Background(), "launch", "kafka", []jobs.Stage{stage("pull-image", nil)})
+
+	var events []jobs.Event
+	err := engine.Watch(context.Background(), job.ID, func(ev jobs.Event) error {
+		events = append(events, ev)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Watch: %s", err)
+	}
+	if len(events) != 4 || !events[len(events)-1].Final() {
+		t.Errorf("replayed %s, want the full history ending in job_succeeded", eventTypes(events))
+	}
+}
+
+func TestJobFailureRollsBackInReverse(t *testing.T) {
+	engine := jobs.NewEngine()
+
+	var undone []string
+	undoable := func(name string, err error) jobs.Stage {
+		st := stage(name, err)
+		st.Undo = func(ctx context.Context) error {
+			if ctx.Err() != nil {
+				t.Errorf("undo %s ran with a done context", name)
+			}
+			undone = append(undone, name)
+			return nil
+		}
+		return st
+	}
+
+	var events []jobs.Event
+	engine.OnEvent(func(ev jobs.Event) { events = append(events, ev) })
+
+	job, _ := engine.Run(context.Background(), "launch", "kafka", []jobs.Stage{
+		stage("pull-image", nil), // shared cache - nothing to undo
+		undoable("create-base-image", nil),
+		undoable("create-disks", errors.New("qemu-img failed")),
+		undoable("create-vm", nil),
+	})
+
+	if got := strings.Join(undone, ","); got != "create-disks,create-base-image" {
+		t.Errorf("undo order = %s, want the failed stage then earlier stages", got)
+	}
+
+	statuses := []jobs.Status{jobs.Succeeded, jobs.RolledBack, jobs.Failed, jobs.Skipped}
+	for i, st := range job.Stages {
+		if st.Status != statuses[i] {
+			t.Errorf("stage %s = %s, want %s", st.Name, st.Status, statuses[i])
+		}
+	}
+
+	want := "create-disks:stage_failed create-disks:stage_rolled_back create-base-image:stage_rolled_back job_failed"
+	if got := eventTypes(events[len(events)-4:]); got != want {
+		t.Errorf("events\n got  %s\n want %s", got, want)
+	}
+}
+
+func TestJobCancelBetweenStagesRollsBack(t *testing.T) {
+	engine := jobs.NewEngine()
+	ctx, cancel := context.WithCancel(context.Background())
+
+	var undone []string
+	undoErr := errors.New("device busy")
+	job, err := engine.Run(ctx, "launch", "kafka", []jobs.Stage{
+		{
+			Name: "create-base-image",
+			Run:  func(context.Context) error { return nil },
+			Undo: func(context.Context) error { undone = append(undone, "create-base-image"); return nil },
+		},
+		{
+			Name: "setup-vm",
+			// finishes despite the cancel - the next stage is never started
+			Run:  func(context.Context) error { cancel(); return nil },
+			Undo: func(context.Context) error { undone = append(undone, "setup-vm"); return undoErr },
+		},
+		stage("create-vm", nil),
+	})
+
+	if !errors.Is(err, context.Canceled) || job.Status != jobs.Cancelled {
+		t.Fatalf("Run = %s, %v - want cancelled", job.Status, err)
+	}
+	if got := strings.Join(undone, ","); got != "setup-vm,create-base-image" {
+		t.Errorf("undo order = %s", got)
+	}
+	if st := job.Stages[1]; st.Status != jobs.Succeeded || st.RollbackError != undoErr.Error() {
+		t.Errorf("setup-vm = %+v, want succeeded with the rollback error recorded", st)
+	}
+	if job.Stages[2].Status != jobs.Skipped {
+		t.Errorf("create-vm = %s, want skipped", job.Stages[2].Status)
+	}
+}
+
+func TestLaunchStagesKeepOnFailure(t *testing.T) {
+	undos := func(stages []jobs.Stage) []string {
+		var names []string
+		for _, st := range stages {
+			if st.Undo != nil {
+				names = append(names, st.Name)
+			}
+		}
+		return names
+	}
+
+	vmConfig := kvm.NewVMConfig("rollback").SetArtifactsDir(t.TempDir()).SetImagesDir(t.TempDir())
+	want := []string{kvm.StageCreateBaseImage, kvm.StageCreateDisks, kvm.StageSetupVM, kvm.StageCloudInit, kvm.StageCreateVM}
+	if got := undos(vmConfig.LaunchStages()); strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("stages with undo = %v, want %v", got, want)
+	}
+
+	if got := undos(vmConfig.SetKeepOnFailure(true).LaunchStages()); len(got) != 0 {
+		t.Errorf("--keep-on-failure still registers undo for %v", got)
+	}
+}
+
+// jobBackend submits launches whose only stage waits for release
+type jobBackend struct {
+	daemon.Backend
+	engine  *jobs.Engine
+	release chan struct{}
+}
+
+func (b *jobBackend) SubmitVM(ctx context.Context, req daemon.CreateVMRequest) (*jobs.Job, error) {
+	job := b.engine.Submit(context.Background(), "launch", req.Name, []jobs.Stage{
+		{Name: "pull-image", Run: func(ctx context.Context) error {
+			select {
+			case <-b.release:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}},
+	})
+	return &job, nil
+}
+
+func (b *jobBackend) GetJob(ctx context.Context, id string) (*jobs.Job, error) {
+	job, err := b.engine.Get(id)
+	if err != nil {
+		return nil, errors.Join(daemon.ErrNotFound, err)
+	}
+	return &job, nil
+}
+
+func (b *jobBackend) WatchJob(ctx context.Context, id string, fn func(jobs.Event) error) error {
+	return b.engine.Watch(ctx, id, fn)
+}
+
+func TestDaemonStreamsJobEvents(t *testing.T) {
+	backend := &jobBackend{engine: jobs.NewEngine(), release: make(chan struct{})}
+	client := startDaemon(t, backend)
+	ctx := context.Background()
+
+	job, err := client.SubmitVM(ctx, daemon.CreateVMRequest{Name: "ci-1"})
+	if err != nil {
+		t.Fatalf("SubmitVM: %s", err)
+	}
+
+	// the VM is held by the job, not by the request that submitted it
+	_, err = client.SubmitVM(ctx, daemon.CreateVMRequest{Name: "ci-1"})
+	var apiErr *daemon.Error
+	if !errors.As(err, &apiErr) || apiErr.Status != 409 {
+		t.Errorf("second SubmitVM = %v, want 409", err)
+	}
+
+	var events []jobs.Event
+	watched := make(chan error, 1)
+	go func() {
+		watched <- client.WatchJob(ctx, job.ID, func(ev jobs.Event) error {
+			events = append(events, ev)
+			if ev.Type == jobs.StageStarted {
+				close(backend.release)
+			}
+			return nil
+		})
+	}()
+
+	select {
+	case err := <-watched:
+		if err != nil {
+			t.Fatalf("WatchJob: %s", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("event stream did not finish")
+	}
+
+	want := "job_started pull-image:stage_started pull-image:stage_succeeded job_succeeded"
+	if got := eventTypes(events); got != want {
+		t.Errorf("streamed\n got  %s\n want %s", got, want)
+	}
+
+	if _, err := client.GetJob(ctx, "missing"); !errors.Is(err, daemon.ErrNotFound) {
+		t.Errorf("GetJob(missing) = %v, want ErrNotFound", err)
+	}
+}
@@ -0,0 +1,151 @@
+package tests
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"kvmgo/config"
+)
+
+func TestConfigXDGDefaults(t *testing.T) {
+	tmp := t.TempDir()
+	t.Setenv("XDG_CONFIG_HOME", filepath.Join(tmp, "config"))
+	t.Setenv("XDG_DATA_HOME", filepath.Join(tmp, "data"))
+	t.Setenv("XDG_STATE_HOME", filepath.Join(tmp, "state"))
+	t.Setenv(config.EnvConfig, "")
+
+	cfg, err := config.Load("")
+	if err != nil {
+		t.Fatalf("Load: %s", err)
+	}
+
+	// /etc/kvmetal/config.yaml may exist on a dev machine - only check what it cannot override
+	if cfg.File == "" {
+		if want := filepath.Join(tmp, "data", "kvmetal", "images"); cfg.ImagesDir != want {
+			t.Errorf("images_dir %s, want %s", cfg.ImagesDir, want)
+		}
+		if want := filepath.Join(tmp, "state", "kvmetal", "state.json"); cfg.StateFile() != want {
+			t.Errorf("state file %s, want %s", cfg.StateFile(), want)
+		}
+		if cfg.SSHPublicKey != cfg.SSHPrivateKey+".pub" {
+			t.Errorf("public key should default to <private>.pub, got %s", cfg.SSHPublicKey)
+		}
+	}
+}
+
+func TestConfigFileAndEnvPrecedence(t *testing.T) {
+	tmp := t.TempDir()
+	file := filepath.Join(tmp, "config.yaml")
+
+	data := "data_dir: " + filepath.Join(tmp, "kvm") + "\n" +
+		"network_dir: /var/lib/kvmetal/network\n" +
+		"ssh_private_key: " + filepath.Join(tmp, "keys", "id_ed25519") + "\n"
+	if err := os.WriteFile(file, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv(config.EnvConfig, file)
+	t.Setenv(config.EnvArtifacts, filepath.Join(tmp, "artifacts-env"))
+
+	cfg, err := config.Load("")
+	if err != nil {
+		t.Fatalf("Load: %s", err)
+	}
+
+	if cfg.File != file {
+		t.Errorf("expected %s to be read, got %q", file, cfg.File)
+	}
+	if want := filepath.Join(tmp, "kvm", "images"); cfg.ImagesDir != want {
+		t.Errorf("images_dir should follow data_dir: %s, want %s", cfg.ImagesDir, want)
+	}
+	if want := filepath.Join(tmp, "artifacts-env", "kafka"); cfg.ArtifactsPath("kafka") != want {
+		t.Errorf("env should override file: %s, want %s", cfg.ArtifactsPath("kafka"), want)
+	}
+	if cfg.ForwardingConfigFile() != "/var/lib/kvmetal/network/kvmfwding_config.json" {
+		t.Errorf("unexpected forwarding config %s", cfg.ForwardingConfigFile())
+	}
+	if want := filepath.Join(tmp, "keys", "id_ed25519.pub"); cfg.SSHPublicKey != want {
+		t.Errorf("ssh_public_key %s, want %s", cfg.SSHPublicKey, want)
+	}
+
+	if err := os.WriteFile(file, []byte("datadir: /tmp\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := config.Load(file); err == nil {
+		t.Errorf("unknown keys should be rejected")
+	}
+
+	if _, err := config.Load(filepath.Join(tmp, "missing.yaml")); err == nil {
+		t.Errorf("an explicit config file that does not exist should fail")
+	}
+}
+
+func TestConfigDomain(t *testing.T) {
+	tmp := t.TempDir()
+	file := filepath.Join(tmp, "config.yaml")
+	if err := os.WriteFile(file, []byte("domain: lab.internal.\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := config.Defaults().FQDN("kafka"); got != "kafka."+config.DefaultDomain {
+		t.Errorf("default fqdn %s, want kafka.%s", got, config.DefaultDomain)
+	}
+
+	t.Setenv(config.EnvDomain, "")
+	cfg, err := config.Load(file)
+	if err != nil {
+		t.Fatalf("Load: %s", err)
+	}
+	if got := cfg.FQDN("kafka"); got != "kafka.lab.internal" {
+		t.Errorf("fqdn from file %s, want kafka.lab.internal", got)
+	}
+
+	t.Setenv(config.EnvDomain, "cluster1.local")
+	if cfg, err = config.Load(file); err != nil {
+		t.Fatalf("Load: %s", err)
+	}
+	if got := cfg.FQDN("kafka"); got != "kafka.cluster1.local" {
+		t.Errorf("env should override file: %s, want kafka.cluster1.local", got)
+	}
+}
+
+func TestConfigIPSources(t *testing.T) {
+	tmp := t.TempDir()
+	file := filepath.Join(tmp, "config.yaml")
+	t.Setenv(config.EnvIPSources, "")
+	t.Setenv(config.EnvIPTimeout, "")
+
+	cfg := config.Defaults()
+	if strings.Join(cfg.IPSources, ",") != "lease,agent,arp" || cfg.IPWait() != 2*time.Minute {
+		t.Errorf("unexpected defaults %v %s", cfg.IPSources, cfg.IPWait())
+	}
+
+	if err := os.WriteFile(file, []byte("ip_sources: [agent, lease]\nip_timeout: 30s\nipv6: true\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if cfg, err := config.Load(file); err != nil {
+		t.Fatalf("Load: %s", err)
+	} else if strings.Join(cfg.IPSources, ",") != "agent,lease" || cfg.IPWait() != 30*time.Second || !cfg.IPv6 {
+		t.Errorf("file not applied: %v %s ipv6=%t", cfg.IPSources, cfg.IPWait(), cfg.IPv6)
+	}
+
+	t.Setenv(config.EnvIPSources, " arp, agent ")
+	t.Setenv(config.EnvIPTimeout, "5s")
+	if cfg, err := config.Load(file); err != nil {
+		t.Fatalf("Load: %s", err)
+	} else if strings.Join(cfg.IPSources, ",") != "arp,agent" || cfg.IPWait() != 5*time.Second {
+		t.Errorf("env should override file: %v %s", cfg.IPSources, cfg.IPWait())
+	}
+
+	for _, env := range [][2]string{{config.EnvIPSources, "lease,mdns"}, {config.EnvIPTimeout, "soon"}, {config.EnvIPTimeout, "-1m"}} {
+		t.Setenv(config.EnvIPSources, "")
+		t.Setenv(config.EnvIPTimeout, "")
+		t.Setenv(env[0], env[1])
+		if _, err := config.Load(file); err == nil {
+			t.Errorf("%s=%s should be rejected", env[0], env[1])
+		}
+	}
+}
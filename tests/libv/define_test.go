@@ -0,0 +1,187 @@
+package libv_test
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"kvmgo/lib"
+	"kvmgo/types/nic"
+
+	"libvirt.org/go/libvirt"
+	libvirtxml "libvirt.org/libvirt-go-xml"
+)
+
+func testDomainConfig(name string) *lib.VMConfig {
+	return lib.NewVMConfig(name).
+		SetMemory(2048).
+		SetCores(2).
+		SetBaseImage("/var/lib/kvmetal/images/" + name + "-vm-disk.qcow2").
+		SetUserDataPath("/var/lib/kvmetal/artifacts/" + name + "/userdata/user-data.img").
+		AddDisk("/var/lib/kvmetal/artifacts/" + name + "/" + name + "-openebs-disk.qcow2").
+		SetNetwork("default").
+		SetOSVariant("ubuntu22.04")
+}
+
+func TestDomainXMLDevices(t *testing.T) {
+	domainXML, err := testDomainConfig("xmltest").GenerateDomainXML()
+	if err != nil {
+		t.Fatalf("GenerateDomainXML: %s", err)
+	}
+
+	domcfg := &libvirtxml.Domain{}
+	if err := domcfg.Unmarshal(domainXML); err != nil {
+		t.Fatalf("generated xml does not parse: %s\n%s", err, domainXML)
+	}
+
+	if domcfg.Type != "kvm" || domcfg.VCPU.Value != 2 || domcfg.Memory.Value != 2048 {
+		t.Errorf("unexpected domain resources: %s", domainXML)
+	}
+
+	disks := domcfg.Devices.Disks
+	if len(disks) != 3 {
+		t.Fatalf("expected primary, extra and cloud-init disks, got %d", len(disks))
+	}
+
+	if disks[0].Target.Dev != "vda" || disks[1].Target.Dev != "vdb" {
+		t.Errorf("unexpected disk targets %s %s", disks[0].Target.Dev, disks[1].Target.Dev)
+	}
+
+	if disks[2].Device != "cdrom" || disks[2].ReadOnly == nil {
+		t.Errorf("cloud-init seed must be a readonly cdrom")
+	}
+
+	if len(domcfg.Devices.Serials) != 1 || len(domcfg.Devices.Consoles) != 1 {
+		t.Errorf("expected a serial console")
+	}
+
+	if !strings.Contains(domainXML, "http://ubuntu.com/ubuntu/22.04") {
+		t.Errorf("os-variant missing from libosinfo metadata:\n%s", domainXML)
+	}
+
+	channels := domcfg.Devices.Channels
+	if len(channels) != 1 || channels[0].Target == nil || channels[0].Target.VirtIO == nil ||
+		channels[0].Target.VirtIO.Name != lib.GuestAgentChannel {
+		t.Errorf("expected the qemu-guest-agent channel:\n%s", domainXML)
+	}
+}
+
+func TestDomainXMLManyDisks(t *testing.T) {
+	config := testDomainConfig("many")
+	for i := 0; i < 30; i++ {
+		config.AddDisk(fmt.Sprintf("/var/lib/kvmetal/artifacts/many/many-%d-disk.qcow2", i))
+	}
+
+	domcfg := config.DomainDefinition()
+	targets := map[string]bool{}
+	for _, disk := range domcfg.Devices.Disks {
+		if targets[disk.Target.Dev] {
+			t.Errorf("target %s used twice", disk.Target.Dev)
+		}
+		targets[disk.Target.Dev] = true
+	}
+
+	// vda, the openebs disk as vdb and 30 more - past vdz the names get a second letter
+	disks := domcfg.Devices.Disks
+	if disks[25].Target.Dev != "vdz" || disks[26].Target.Dev != "vdaa" || disks[31].Target.Dev != "vdaf" {
+		t.Errorf("unexpected targets %s %s %s", disks[25].Target.Dev, disks[26].Target.Dev, disks[31].Target.Dev)
+	}
+}
+
+func TestDomainXMLIgnitionFWCfg(t *testing.T) {
+	ignition := "/var/lib/kvmetal/artifacts/fcos/userdata/config.ign"
+	domainXML, err := lib.NewVMConfig("fcos").
+		SetMemory(2048).
+		SetCores(2).
+		SetBaseImage("/var/lib/kvmetal/images/fcos-vm-disk.qcow2").
+		SetIgnitionPath(ignition).
+		SetOSVariant("fedora-coreos-stable").
+		GenerateDomainXML()
+	if err != nil {
+		t.Fatalf("GenerateDomainXML: %s", err)
+	}
+
+	domcfg := &libvirtxml.Domain{}
+	if err := domcfg.Unmarshal(domainXML); err != nil {
+		t.Fatalf("generated xml does not parse: %s\n%s", err, domainXML)
+	}
+
+	if len(domcfg.SysInfo) != 1 || domcfg.SysInfo[0].FWCfg == nil {
+		t.Fatalf("expected a fwcfg sysinfo:\n%s", domainXML)
+	}
+	entries := domcfg.SysInfo[0].FWCfg.Entry
+	if len(entries) != 1 || entries[0].Name != "opt/com.coreos/config" || entries[0].File != ignition {
+		t.Errorf("unexpected fw_cfg entries %+v", entries)
+	}
+
+	for _, disk := range domcfg.Devices.Disks {
+		if disk.Device == "cdrom" {
+			t.Errorf("ignition guests must not get a cloud-init seed")
+		}
+	}
+	if !strings.Contains(domainXML, "http://fedoraproject.org/coreos/stable") {
+		t.Errorf("os-variant missing from libosinfo metadata:\n%s", domainXML)
+	}
+}
+
+func TestDomainXMLInterfaces(t *testing.T) {
+	ifaces := nic.AssignMACs("kafka", []nic.Interface{
+		{Addresses: []string{"192.168.122.50/24"}, Gateway4: "192.168.122.1"},
+		{Network: "storage", MAC: "52:54:00:12:34:56", VLAN: 100},
+	})
+	domainXML, err := testDomainConfig("kafka").SetInterfaces(ifaces).GenerateDomainXML()
+	if err != nil {
+		t.Fatalf("GenerateDomainXML: %s", err)
+	}
+
+	domcfg := &libvirtxml.Domain{}
+	if err := domcfg.Unmarshal(domainXML); err != nil {
+		t.Fatalf("generated xml does not parse: %s\n%s", err, domainXML)
+	}
+
+	got := domcfg.Devices.Interfaces
+	if len(got) != 2 {
+		t.Fatalf("expected 2 interfaces, got %d:\n%s", len(got), domainXML)
+	}
+	for i, want := range []struct{ network, mac string }{
+		{"default", nic.GenerateMAC("kafka", 0)},
+		{"storage", "52:54:00:12:34:56"},
+	} {
+		if got[i].Source.Network.Network != want.network || got[i].MAC == nil || got[i].MAC.Address != want.mac {
+			t.Errorf("interface %d = %+v %+v, want network %s mac %s", i, got[i].Source.Network, got[i].MAC, want.network, want.mac)
+		}
+	}
+
+	if ifaces[0].MAC != nic.AssignMACs("kafka", []nic.Interface{{}})[0].MAC {
+		t.Errorf("generated macs must be stable across launches")
+	}
+}
+
+// Defines and boots the domain against the libvirt test driver - no hypervisor required
+func TestDefineDomainTestDriver(t *testing.T) {
+	conn, err := libvirt.NewConnect("test:///default")
+	if err != nil {
+		t.Skipf("libvirt test driver unavailable: %s", err)
+	}
+	defer conn.Close()
+
+	vm := testDomainConfig("definetest").SetDomainType("test")
+
+	if err := vm.CreateAndStartVM(conn); err != nil {
+		t.Fatalf("CreateAndStartVM: %s", err)
+	}
+
+	dom, err := conn.LookupDomainByName("definetest")
+	if err != nil {
+		t.Fatalf("domain not defined: %s", err)
+	}
+	defer dom.Free()
+
+	if active, _ := dom.IsActive(); !active {
+		t.Errorf("domain defined but not started")
+	}
+
+	if err := vm.CreateAndStartVM(conn); err == nil {
+		t.Errorf("defining an existing domain should fail")
+	}
+}
@@ -0,0 +1,194 @@
+package libv_test
+
+import (
+	"testing"
+
+	"kvmgo/lib"
+
+	"libvirt.org/go/libvirt"
+	libvirtxml "libvirt.org/libvirt-go-xml"
+)
+
+func TestNetworkXML(t *testing.T) {
+	networkXML, err := lib.NewNetworkConfig("cluster1").
+		SetCIDR("10.20.0.0/24").
+		SetDomain("cluster1.local").
+		AddHost("52:54:00:12:34:56", "control", "10.20.0.10").
+		GenerateNetworkXML()
+	if err != nil {
+		t.Fatalf("GenerateNetworkXML: %s", err)
+	}
+
+	netcfg := &libvirtxml.Network{}
+	if err := netcfg.Unmarshal(networkXML); err != nil {
+		t.Fatalf("generated xml does not parse: %s\n%s", err, networkXML)
+	}
+
+	if netcfg.Forward == nil || netcfg.Forward.Mode != "nat" || netcfg.Domain.Name != "cluster1.local" {
+		t.Errorf("unexpected forward or domain:\n%s", networkXML)
+	}
+	if len(netcfg.IPs) != 1 || netcfg.IPs[0].Address != "10.20.0.1" || netcfg.IPs[0].Prefix != 24 {
+		t.Fatalf("expected the host on 10.20.0.1/24:\n%s", networkXML)
+	}
+	dhcp := netcfg.IPs[0].DHCP
+	if dhcp == nil || dhcp.Ranges[0].Start != "10.20.0.128" || dhcp.Ranges[0].End != "10.20.0.254" {
+		t.Errorf("default dhcp range must be the upper half:\n%s", networkXML)
+	}
+	if len(dhcp.Hosts) != 1 || dhcp.Hosts[0].IP != "10.20.0.10" || dhcp.Hosts[0].Name != "control" {
+		t.Errorf("reservation missing:\n%s", networkXML)
+	}
+
+	isolated, err := lib.NewNetworkConfig("lab").SetMode(lib.NetworkIsolated).SetCIDR("10.30.0.254/24").DisableDHCP().NetworkDefinition()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if isolated.Forward != nil || isolated.IPs[0].Address != "10.30.0.254" || isolated.IPs[0].DHCP != nil {
+		t.Errorf("isolated network = %+v %+v", isolated.Forward, isolated.IPs)
+	}
+}
+
+func TestNetworkConfigValidate(t *testing.T) {
+	for name, cfg := range map[string]*lib.NetworkConfig{
+		"mode":        lib.NewNetworkConfig("n").SetMode("bridge").SetCIDR("10.20.0.0/24"),
+		"cidr":        lib.NewNetworkConfig("n").SetCIDR("10.20.0.0"),
+		"ipv6":        lib.NewNetworkConfig("n").SetCIDR("fd00::/64"),
+		"tiny":        lib.NewNetworkConfig("n").SetCIDR("10.20.0.0/31"),
+		"range":       lib.NewNetworkConfig("n").SetCIDR("10.20.0.0/24").SetDHCPRange("10.20.0.100", "10.21.0.10"),
+		"reversed":    lib.NewNetworkConfig("n").SetCIDR("10.20.0.0/24").SetDHCPRange("10.20.0.200", "10.20.0.100"),
+		"gateway":     lib.NewNetworkConfig("n").SetCIDR("10.20.0.0/24").SetDHCPRange("10.20.0.1", "10.20.0.100"),
+		"outside":     lib.NewNetworkConfig("n").SetCIDR("10.20.0.0/24").AddHost("52:54:00:12:34:56", "a", "10.30.0.10"),
+		"duplicate":   lib.NewNetworkConfig("n").SetCIDR("10.20.0.0/24").AddHost("52:54:00:12:34:56", "a", "10.20.0.10").AddHost("52:54:00:12:34:57", "b", "10.20.0.10"),
+		"forward dev": lib.NewNetworkConfig("n").SetMode(lib.NetworkIsolated).SetCIDR("10.20.0.0/24").SetForwardDev("eth0"),
+	} {
+		if err := cfg.Validate(); err == nil {
+			t.Errorf("%s: invalid network accepted", name)
+		}
+	}
+}
+
+// Defines, lists and deletes a network against the libvirt test driver
+func TestDefineNetworkTestDriver(t *testing.T) {
+	conn, err := libvirt.NewConnect("test:///default")
+	if err != nil {
+		t.Skipf("libvirt test driver unavailable: %s", err)
+	}
+	defer conn.Close()
+
+	cfg := lib.NewNetworkConfig("nettest").SetMode(lib.NetworkIsolated).SetCIDR("10.40.0.0/24")
+	if err := cfg.CreateAndStartNetwork(conn); err != nil {
+		t.Fatalf("CreateAndStartNetwork: %s", err)
+	}
+	if err := cfg.CreateAndStartNetwork(conn); err == nil {
+		t.Errorf("defining an existing network should fail")
+	}
+
+	networks, err := lib.ListNetworks(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var found bool
+	for _, n := range networks {
+		if n.Name == "nettest" {
+			found = n.Active && n.Mode == lib.NetworkIsolated && n.CIDR == "10.40.0.1/24"
+		}
+	}
+	if !found {
+		t.Errorf("nettest not listed as an active isolated network: %+v", networks)
+	}
+
+	if err := lib.DeleteNetwork(conn, "nettest"); err != nil {
+		t.Fatalf("DeleteNetwork: %s", err)
+	}
+	if err := lib.DeleteNetwork(conn, "nettest"); err == nil {
+		t.Errorf("deleting a missing network should fail")
+	}
+}
+
+func TestReservationXML(t *testing.T) {
+	r := lib.Reservation{MAC: "52:54:00:3A:1F:9C", Name: "kafka", IP: "192.168.122.130", Hostnames: []string{"kafka.kuro.com", "kafka"}}
+
+	hostXML, err := r.DHCPHostXML()
+	if err != nil {
+		t.Fatal(err)
+	}
+	host := &libvirtxml.NetworkDHCPHost{}
+	if err := host.Unmarshal(hostXML); err != nil {
+		t.Fatalf("dhcp host does not parse: %s\n%s", err, hostXML)
+	}
+	if host.MAC != "52:54:00:3a:1f:9c" || host.Name != "kafka" || host.IP != "192.168.122.130" {
+		t.Errorf("unexpected dhcp host:\n%s", hostXML)
+	}
+
+	dnsXML, err := r.DNSHostXML()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dns := &libvirtxml.NetworkDNSHost{}
+	if err := dns.Unmarshal(dnsXML); err != nil {
+		t.Fatalf("dns host does not parse: %s\n%s", err, dnsXML)
+	}
+	if dns.IP != "192.168.122.130" || len(dns.Hostnames) != 2 || dns.Hostnames[0].Hostname != "kafka.kuro.com" {
+		t.Errorf("unexpected dns host:\n%s", dnsXML)
+	}
+}
+
+func TestFreeDHCPAddress(t *testing.T) {
+	netcfg, err := lib.NewNetworkConfig("cluster1").
+		SetCIDR("10.20.0.0/24").
+		SetDHCPRange("10.20.0.10", "10.20.0.12").
+		AddHost("52:54:00:12:34:56", "control", "10.20.0.10").
+		NetworkDefinition()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ip, err := lib.FreeDHCPAddress(netcfg, []string{"10.20.0.11"})
+	if err != nil || ip != "10.20.0.12" {
+		t.Errorf("expected 10.20.0.12 past the reserved and leased addresses, got %q %v", ip, err)
+	}
+	if _, err := lib.FreeDHCPAddress(netcfg, []string{"10.20.0.11", "10.20.0.12"}); err == nil {
+		t.Errorf("a full range should fail")
+	}
+
+	isolated, _ := lib.NewNetworkConfig("static").SetCIDR("10.30.0.0/24").DisableDHCP().NetworkDefinition()
+	if _, err := lib.FreeDHCPAddress(isolated, nil); err == nil {
+		t.Errorf("a network without dhcp has no address to hand out")
+	}
+}
+
+// Reserves and releases a VM's address and names against the libvirt test driver
+func TestReserveHostTestDriver(t *testing.T) {
+	conn, err := libvirt.NewConnect("test:///default")
+	if err != nil {
+		t.Skipf("libvirt test driver unavailable: %s", err)
+	}
+	defer conn.Close()
+
+	cfg := lib.NewNetworkConfig("resvtest").SetCIDR("10.50.0.0/24")
+	if err := cfg.CreateAndStartNetwork(conn); err != nil {
+		t.Fatalf("CreateAndStartNetwork: %s", err)
+	}
+	defer lib.DeleteNetwork(conn, "resvtest")
+
+	r := lib.Reservation{Network: "resvtest", MAC: "52:54:00:aa:bb:cc", Name: "kafka", Hostnames: []string{"kafka.kuro.com", "kafka"}}
+	ip, err := r.Reserve(conn)
+	if err != nil {
+		t.Fatalf("Reserve: %s", err)
+	}
+	if ip != "10.50.0.128" {
+		t.Errorf("expected the first address of the dhcp range, got %s", ip)
+	}
+	if again, err := r.Reserve(conn); err != nil || again != ip {
+		t.Errorf("reserving the same mac again should keep %s, got %s %v", ip, again, err)
+	}
+
+	if err := lib.ReleaseHost(conn, "kafka", "kafka.kuro.com"); err != nil {
+		t.Fatalf("ReleaseHost: %s", err)
+	}
+	networks, _ := lib.ListNetworks(conn)
+	for _, n := range networks {
+		if n.Name == "resvtest" && n.Hosts != 0 {
+			t.Errorf("dhcp host left after release: %+v", n)
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package tests
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"kvmgo/cli"
+	"kvmgo/config"
+	kvm "kvmgo/vm"
+
+	libvirtxml "libvirt.org/libvirt-go-xml"
+)
+
+func TestManifestParseYAML(t *testing.T) {
+	manifest, err := cli.ParseManifest([]byte(`
+vms:
+  - name: control
+    preset: kubecontrol
+    cpu_cores: 4
+    memory: 4096
+  - name: kafka
+    preset: kafka
+    cpu_cores: 2
+    memory: 8192
+    disks:
+      - name: data
+        size: 20
+    expose:
+      - port: 9095
+        hostport: 9094
+        protocol: tcp
+`))
+	if err != nil {
+		t.Fatalf("ParseManifest: %v", err)
+	}
+
+	if len(manifest.VMs) != 2 {
+		t.Fatalf("expected 2 vms, got %d", len(manifest.VMs))
+	}
+
+	kafka := manifest.VMs[1]
+	if kafka.Memory != 8192 || kafka.Disks[0].Size != 20 || kafka.Expose[0].HostPort != 9094 {
+		t.Errorf("unexpected kafka spec: %+v", kafka)
+	}
+}
+
+func TestManifestParseJSONList(t *testing.T) {
+	manifest, err := cli.ParseManifest([]byte(`[{"name":"worker","cpu_cores":2,"memory":2048}]`))
+	if err != nil {
+		t.Fatalf("ParseManifest: %v", err)
+	}
+
+	if manifest.VMs[0].Name != "worker" || manifest.VMs[0].CPUCores != 2 {
+		t.Errorf("unexpected spec: %+v", manifest.VMs[0])
+	}
+}
+
+func TestManifestValidate(t *testing.T) {
+	cases := map[string]string{
+		"duplicate":     "vms:\n  - name: a\n  - name: a\n",
+		"preset":        "vms:\n  - name: a\n    preset: nope\n",
+		"disk":          "vms:\n  - name: a\n    disks:\n      - name: d\n",
+		"expose":        "vms:\n  - name: a\n    expose:\n      - port: 0\n        hostport: 80\n",
+		"map range":     "vms:\n  - name: a\n    expose:\n      - map: 8000-8010:9000-9005/tcp\n",
+		"map and port":  "vms:\n  - name: a\n    expose:\n      - map: 53:5353/udp\n        port: 53\n",
+		"map collision": "vms:\n  - name: a\n    expose:\n      - map: 8000-8010:9000-9010/tcp\n  - name: b\n    expose:\n      - port: 9092\n        hostport: 8005\n",
+		"unknown field": "vms:\n  - name: a\n    cpus: 2\n",
+	}
+
+	for name, doc := range cases {
+		if _, err := cli.ParseManifest([]byte(doc)); err == nil {
+			t.Errorf("%s: expected validation error", name)
+		}
+	}
+}
+
+func TestManifestExposeMaps(t *testing.T) {
+	doc := "vms:\n  - name: kafka\n    expose:\n      - port: 9092\n        hostport: 9092\n      - map: 8000-8010:9000-9010/tcp\n" +
+		"  - name: dns\n    expose:\n      - map: 53:5353/udp\n      - map: 8000:8000/udp\n"
+	manifest, err := cli.ParseManifest([]byte(doc))
+	if err != nil {
+		t.Fatalf("ParseManifest: %v", err)
+	}
+
+	portMap, portRange, err := manifest.VMs[0].PortMappings()
+	if err != nil || len(portMap) != 1 || len(portRange) != 1 || portRange[0].VMEndPortNum != 9010 {
+		t.Errorf("kafka mappings = %+v %+v %v", portMap, portRange, err)
+	}
+	// udp 8000 on another VM does not collide with the tcp range
+	portMap, _, err = manifest.VMs[1].PortMappings()
+	if err != nil || len(portMap) != 2 || portMap[0].Protocol != "udp" || portMap[0].VMPort != 5353 {
+		t.Errorf("dns mappings = %+v %v", portMap, err)
+	}
+}
+
+func TestManifestRelativeUserdata(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "cluster.yaml")
+
+	if err := os.WriteFile(path, []byte("vms:\n  - name: a\n    user_data: ud/a.txt\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	os.MkdirAll(filepath.Join(dir, "ud"), 0o755)
+	if err := os.WriteFile(filepath.Join(dir, "ud/a.txt"), []byte("#cloud-config\npackages:\n  - jq\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	manifest, err := cli.LoadManifest(path)
+	if err != nil {
+		t.Fatalf("LoadManifest: %v", err)
+	}
+
+	if want := filepath.Join(dir, "ud/a.txt"); manifest.VMs[0].UserData != want {
+		t.Errorf("user_data = %s, want %s", manifest.VMs[0].UserData, want)
+	}
+}
+
+func TestManifestValidatesUserdata(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "cluster.yaml")
+	doc := "vms:\n  - name: a\n    user_data: a.txt\n  - name: b\n    user_data: missing.txt\n"
+	if err := os.WriteFile(path, []byte(doc), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "a.txt"), []byte("#cloud-config\nruncmd: true\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := cli.LoadManifest(path)
+	if err == nil {
+		t.Fatal("expected the invalid and the missing user_data to be rejected")
+	}
+	for _, want := range []string{"a: user_data", "runcmd", "b: failed to read user_data"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q does not mention %q", err, want)
+		}
+	}
+}
+
+func TestSpecToVMConfigMissingKey(t *testing.T) {
+	prev := config.Current()
+	t.Cleanup(func() { config.Set(prev) })
+	dir := t.TempDir()
+	config.Set(&config.Config{DataDir: dir, StateDir: dir, SSHPublicKey: filepath.Join(dir, "missing.pub")})
+
+	// returned so apply records the VM as failed and carries on with the rest
+	if _, err := cli.SpecToVMConfig(context.Background(), &sync.WaitGroup{}, cli.VMSpec{Name: "nokey"}); err == nil {
+		t.Error("expected an error for a missing ssh public key")
+	}
+}
+
+func TestDomainDrift(t *testing.T) {
+	domcfg := &libvirtxml.Domain{
+		VCPU:   &libvirtxml.DomainVCPU{Value: 2},
+		Memory: &libvirtxml.DomainMemory{Value: 4096 * 1024, Unit: "KiB"},
+	}
+
+	desired := kvm.NewVMConfig("drift").SetCores(2).SetMemory(4096)
+	if drift := cli.DomainDrift(domcfg, desired); len(drift) != 0 {
+		t.Errorf("expected no drift, got %v", drift)
+	}
+
+	desired.SetCores(4).SetMemory(8192)
+	if drift := cli.DomainDrift(domcfg, desired); len(drift) != 2 {
+		t.Errorf("expected cpu and memory drift, got %v", drift)
+	}
+}
+
+func TestDesiredVMConfigSkipsUserdata(t *testing.T) {
+	prev := config.Current()
+	t.Cleanup(func() { config.Set(prev) })
+	dir := t.TempDir()
+	// a missing key would exit through ReadFileFatal if the preset userdata were rendered
+	config.Set(&config.Config{DataDir: dir, StateDir: dir, SSHPublicKey: filepath.Join(dir, "missing.pub")})
+
+	desired := cli.DesiredVMConfig(cli.VMSpec{
+		Name: "kraft", Preset: "kafka-kraft", CPUCores: 4, Memory: 8192,
+		Disks: []cli.DiskSpec{{Name: "data", Size: 20}},
+	})
+	if desired.CPUCores != 4 || desired.Memory != 8192 || len(desired.Disks) != 1 {
+		t.Errorf("expected cpu, memory and disks from the spec, got %d %d %+v", desired.CPUCores, desired.Memory, desired.Disks)
+	}
+	if desired.InlineUserdata != "" {
+		t.Errorf("expected no userdata for drift detection, got %q", desired.InlineUserdata)
+	}
+}
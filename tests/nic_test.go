@@ -0,0 +1,137 @@
+package tests
+
+import (
+	"strings"
+	"testing"
+
+	"kvmgo/cloudinit"
+	"kvmgo/configuration/presets"
+	"kvmgo/constants"
+	"kvmgo/constants/kafka"
+	"kvmgo/types/nic"
+
+	"gopkg.in/yaml.v2"
+)
+
+func TestParseNic(t *testing.T) {
+	iface, err := nic.Parse("network=default,ip=192.168.122.50/24,gw=192.168.122.1,dns=1.1.1.1,dns=8.8.8.8,search=kuro.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if iface.NetworkName() != "default" || iface.IPv4() != "192.168.122.50" || iface.Gateway4 != "192.168.122.1" ||
+		strings.Join(iface.DNS, ",") != "1.1.1.1,8.8.8.8" || strings.Join(iface.Search, ",") != "kuro.com" {
+		t.Errorf("parsed %+v", iface)
+	}
+
+	for _, spec := range []string{
+		"ip=192.168.122.50",             // no prefix
+		"gw=192.168.122.1",              // gateway without a static address
+		"ip=fd00::50/64,gw=192.168.1.1", // gateway of the wrong family
+		"dns=resolver",
+		"mac=52:54:00:zz:00:01",
+		"vlan=4095",
+		"bridge=br0",
+		"network",
+	} {
+		if _, err := nic.Parse(spec); err == nil {
+			t.Errorf("Parse(%q) accepted", spec)
+		}
+	}
+
+	if _, err := nic.ParseAll([]string{"mac=52:54:00:00:00:01", "network=storage,mac=52:54:00:00:00:01"}); err == nil {
+		t.Errorf("duplicate macs accepted")
+	}
+}
+
+func TestAssignMACsIsStable(t *testing.T) {
+	ifaces := nic.AssignMACs("kafka", []nic.Interface{{}, {MAC: "52:54:00:12:34:56"}, {}})
+	again := nic.AssignMACs("kafka", []nic.Interface{{}, {}, {}})
+
+	if ifaces[0].MAC != again[0].MAC || ifaces[2].MAC != again[2].MAC {
+		t.Errorf("macs differ between launches: %v %v", ifaces, again)
+	}
+	if ifaces[1].MAC != "52:54:00:12:34:56" {
+		t.Errorf("explicit mac replaced with %s", ifaces[1].MAC)
+	}
+	if !strings.HasPrefix(ifaces[0].MAC, "52:54:00:") || ifaces[0].MAC == ifaces[2].MAC {
+		t.Errorf("generated macs %s %s", ifaces[0].MAC, ifaces[2].MAC)
+	}
+	if err := nic.ValidateAll(ifaces); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestNetworkConfigRendersNetplan(t *testing.T) {
+	ifaces := []nic.Interface{
+		{MAC: "52:54:00:00:00:01", Addresses: []string{"192.168.122.50/24", "fd00::50/64"}, Gateway4: "192.168.122.1", Gateway6: "fd00::1", DNS: []string{"192.168.122.1"}},
+		{Network: "storage", MAC: "52:54:00:00:00:02", VLAN: 100, Addresses: []string{"10.0.100.5/24"}},
+		{MAC: "52:54:00:00:00:03"},
+	}
+	rendered, err := cloudinit.NetworkConfig(ifaces)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var doc struct {
+		Version   int                               `yaml:"version"`
+		Ethernets map[string]map[string]interface{} `yaml:"ethernets"`
+		VLANs     map[string]map[string]interface{} `yaml:"vlans"`
+	}
+	if err := yaml.Unmarshal([]byte(rendered), &doc); err != nil {
+		t.Fatalf("%s\n%s", err, rendered)
+	}
+	if doc.Version != 2 || len(doc.Ethernets) != 3 || len(doc.VLANs) != 1 {
+		t.Fatalf("unexpected network-config:\n%s", rendered)
+	}
+
+	eth0 := doc.Ethernets["eth0"]
+	if eth0["set-name"] != "eth0" || eth0["dhcp4"] != false || eth0["gateway4"] != "192.168.122.1" || eth0["gateway6"] != "fd00::1" {
+		t.Errorf("eth0 = %v", eth0)
+	}
+	if !strings.Contains(rendered, "macaddress: \"52:54:00:00:00:01\"\n") || !strings.Contains(rendered, "- 192.168.122.1\n") {
+		t.Errorf("eth0 match or nameservers missing:\n%s", rendered)
+	}
+
+	if _, ok := doc.Ethernets["eth1"]["addresses"]; ok {
+		t.Errorf("tagged nic must leave its addresses to the vlan:\n%s", rendered)
+	}
+	vlan := doc.VLANs["eth1.100"]
+	if vlan["id"] != 100 || vlan["link"] != "eth1" || vlan["dhcp4"] != false {
+		t.Errorf("eth1.100 = %v", vlan)
+	}
+
+	if doc.Ethernets["eth2"]["dhcp4"] != true {
+		t.Errorf("interface without addresses must use dhcp:\n%s", rendered)
+	}
+
+	if _, err := cloudinit.NetworkConfig([]nic.Interface{{Addresses: []string{"192.168.122.50/24"}}}); err == nil {
+		t.Errorf("interface without a mac accepted")
+	}
+}
+
+func TestPresetsAdvertiseStaticAddress(t *testing.T) {
+	sshpub := "ssh-rsa AAAAB3 kuro@host"
+
+	kraft := presets.CreateKafkaKraftCluster(constants.Ubuntu, "ubuntu", "password", "kraft", sshpub, "192.168.122.50",
+		9095, "192.168.1.10", 9094, "192.168.1.225", 1, kafka.BrokerController)
+	if !strings.Contains(kraft, "PLAINTEXT://192.168.122.50:") || strings.Contains(kraft, "PLAINTEXT://kraft.kuro.com") {
+		t.Errorf("kraft does not advertise the static address:\n%s", kraft)
+	}
+
+	control, err := cloudinit.Parse(presets.CreateKubeControlPlaneUserData(constants.Ubuntu, "ubuntu", "password", "control", sshpub, "192.168.122.10", false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var inits int
+	for _, cmd := range control.RunCmd {
+		if strings.HasPrefix(cmd.Shell, "kubeadm init") {
+			inits++
+			if !strings.Contains(cmd.Shell, "--apiserver-advertise-address=192.168.122.10 --control-plane-endpoint=192.168.122.10:6443") {
+				t.Errorf("kubeadm init without the endpoint: %s", cmd.Shell)
+			}
+		}
+	}
+	if inits == 0 {
+		t.Errorf("no kubeadm init in the control plane runcmds")
+	}
+}
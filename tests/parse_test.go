@@ -5,10 +5,11 @@ import (
 	"testing"
 
 	"kvmgo/configuration/presets"
+	"kvmgo/constants"
 )
 
 func TestConfigParse(t *testing.T) {
-	ans := presets.CreateKafkaUserData("ubuntu", "password", "customdomain", "1234xxx444")
+	ans := presets.CreateKafkaUserData(constants.Ubuntu, "ubuntu", "password", "customdomain", "1234xxx444")
 	fmt.Println(ans)
 
 	t.Error(ans)
@@ -0,0 +1,63 @@
+package tests
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"kvmgo/config"
+	kvm "kvmgo/vm"
+)
+
+func TestLaunchPlan(t *testing.T) {
+	dir := t.TempDir()
+
+	vmConfig := kvm.NewVMConfig("plantest").
+		SetImageURL("https://cloud-images.ubuntu.com/releases/jammy/release/ubuntu-22.04-server-cloudimg-amd64.img").
+		SetImagesDir(dir).
+		SetArtifactsDir(dir + "/artifacts/plantest").
+		SetCores(2).
+		SetMemory(4096)
+
+	plan := vmConfig.LaunchPlan()
+
+	want := map[string]bool{"pull image": false, "create qcow2": false, "write artifact": false, "define domain": false}
+	for _, step := range plan.Steps {
+		key := step.Action + " " + step.Kind
+		if _, ok := want[key]; ok {
+			want[key] = true
+		}
+	}
+	for key, found := range want {
+		if !found {
+			t.Errorf("plan missing step %q: %+v", key, plan.Steps)
+		}
+	}
+
+	out, err := kvm.PlansJSON([]*kvm.Plan{plan})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var decoded []kvm.Plan
+	if err := json.Unmarshal([]byte(out), &decoded); err != nil || decoded[0].VM != "plantest" {
+		t.Errorf("plan json did not round trip: %v %s", err, out)
+	}
+
+	if table := kvm.PlansTable([]*kvm.Plan{plan}); !strings.Contains(table, "plantest-vm-disk.qcow2") {
+		t.Errorf("plan table missing vm image:\n%s", table)
+	}
+}
+
+func TestDefaultUserDataFollowsDataDir(t *testing.T) {
+	prev := config.Current()
+	t.Cleanup(func() { config.Set(prev) })
+	dir := t.TempDir()
+	config.Set(&config.Config{DataDir: dir, StateDir: dir})
+
+	vmConfig := kvm.NewVMConfig("defaults").SetUserData("")
+	if want := filepath.Join(dir, "userdata", "default", "user-data.txt"); vmConfig.UserData != want {
+		t.Errorf("UserData = %s, want %s", vmConfig.UserData, want)
+	}
+}
@@ -0,0 +1,98 @@
+package tests
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"kvmgo/network"
+	"kvmgo/network/qemu_hooks"
+)
+
+func TestCreatePortMappings(t *testing.T) {
+	portMap, portRange, err := network.CreatePortMappings([]string{"8000-8010:9000-9010/tcp", "53:5353/udp", "9092:9092"})
+	if err != nil {
+		t.Fatalf("CreatePortMappings failed: %s", err)
+	}
+
+	expectedMap := []network.PortMapping{
+		{Protocol: network.UDP, HostPort: 53, VMPort: 5353},
+		{Protocol: network.TCP, HostPort: 9092, VMPort: 9092},
+	}
+	if len(portMap) != 2 || portMap[0] != expectedMap[0] || portMap[1] != expectedMap[1] {
+		t.Errorf("Unexpected port mappings %+v", portMap)
+	}
+	expectedRange := network.PortRange{Protocol: network.TCP, HostStartPortNum: 8000, HostEndPortNum: 8010, VMStartPort: 9000, VMEndPortNum: 9010}
+	if len(portRange) != 1 || portRange[0] != expectedRange {
+		t.Errorf("Unexpected port ranges %+v", portRange)
+	}
+
+	for spec, want := range map[string]string{
+		"8000-8010:9000-9005/tcp": "host range has 11 ports, vm range 6",
+		"53:5353/sctp":            "protocol must be tcp or udp",
+		"9092":                    "must be hostport:vmport/protocol",
+		"70000:80":                "between 1 and 65535",
+		"8010-8000:9010-9000":     "ends before it starts",
+	} {
+		if _, _, err := network.CreatePortMappings([]string{spec}); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%s: expected an error containing %q, got %v", spec, want, err)
+		}
+	}
+
+	_, _, err = network.CreatePortMappings([]string{"8000-8010:9000-9010/tcp", "8005:80/tcp"})
+	if err == nil || !strings.Contains(err.Error(), "host port 8005 is mapped twice") {
+		t.Errorf("Expected an overlap within the specs to be rejected, got %v", err)
+	}
+	if _, _, err := network.CreatePortMappings([]string{"8000-8010:9000-9010/tcp", "8005:80/udp"}); err != nil {
+		t.Errorf("Expected the same port on another protocol to be accepted, got %v", err)
+	}
+}
+
+func TestCheckPortCollisions(t *testing.T) {
+	configs := network.ForwardingConfigs{Configs: []network.ForwardingConfig{*goldenForwardingConfig()}}
+	portMap, portRange, _ := network.CreatePortMappings([]string{"8008-8020:9008-9020/tcp"})
+
+	err := network.CheckPortCollisions(configs, "redpanda", portMap, portRange)
+	if !errors.Is(err, network.ErrPortCollision) || !strings.Contains(err.Error(), "tcp host port 8008-8010 is forwarded to kafka") {
+		t.Errorf("Expected a collision with kafka, got %v", err)
+	}
+	if err := network.CheckPortCollisions(configs, "kafka", portMap, portRange); err != nil {
+		t.Errorf("Expected the VM's own forwards not to collide, got %v", err)
+	}
+
+	warnings := network.PrivilegedPortWarnings(configs.Configs[0].PortMap, nil)
+	if len(warnings) != 0 {
+		t.Errorf("Expected no warnings for unprivileged ports, got %v", warnings)
+	}
+	portMap, portRange, _ = network.CreatePortMappings([]string{"53:5353/udp", "1000-1030:2000-2030"})
+	if warnings := network.PrivilegedPortWarnings(portMap, portRange); len(warnings) != 2 {
+		t.Errorf("Expected warnings for 53 and 1000-1030, got %v", warnings)
+	}
+}
+
+func TestSetPortMappingRanges(t *testing.T) {
+	useTempForwardingConfig(t)
+	if err := qemu_hooks.WriteConfigToFile(*goldenForwardingConfig()); err != nil {
+		t.Fatal(err)
+	}
+
+	// a VM on the host ports of kafka's range is rejected and nothing is written
+	portMap, portRange, _ := network.CreatePortMappings([]string{"8010:80"})
+	_, _, err := qemu_hooks.SetPortMapping(network.ForwardingConfig{VMName: "web", PortMap: portMap, PortRange: portRange})
+	if !errors.Is(err, network.ErrPortCollision) {
+		t.Errorf("Expected ErrPortCollision, got %v", err)
+	}
+	if saved, _ := qemu_hooks.ReadVMConfigFromFile("web"); saved != nil {
+		t.Errorf("Expected no config for the rejected VM, got %+v", saved)
+	}
+
+	// kafka setting a range over its own 9092 forward and old range replaces both
+	portMap, portRange, _ = network.CreatePortMappings([]string{"8005-9092:10005-11092/tcp"})
+	_, after, err := qemu_hooks.SetPortMapping(network.ForwardingConfig{VMName: "kafka", PortMap: portMap, PortRange: portRange})
+	if err != nil {
+		t.Fatalf("SetPortMapping failed: %s", err)
+	}
+	if len(after.PortMap) != 1 || after.PortMap[0].Protocol != network.UDP || len(after.PortRange) != 1 || after.PortRange[0].HostStartPortNum != 8005 {
+		t.Errorf("Expected only the udp forward and the new range, got %+v %+v", after.PortMap, after.PortRange)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"testing"
 
 	"kvmgo/configuration/presets"
+	"kvmgo/constants"
 )
 
 func TestRedPandaConfig(t *testing.T) {
@@ -16,7 +17,7 @@ func TestRedPandaConfig(t *testing.T) {
 	config := presets.GenerateRedpandaUserdata(vmIP, vmPort, hostIP, hostPort)
 	fmt.Println(config)
 
-	fullConfig := presets.CreateRedpandaUserdata("ubuntu", "password", "redpanda", "ssheky12341413123",
+	fullConfig := presets.CreateRedpandaUserdata(constants.Ubuntu, "ubuntu", "password", "redpanda", "ssheky12341413123",
 		vmIP, vmPort, hostIP, hostPort)
 
 	fmt.Println(fullConfig)
@@ -0,0 +1,126 @@
+package tests
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"kvmgo/network"
+
+	"libvirt.org/go/libvirt"
+)
+
+// fakeDomain answers ListAllInterfaceAddresses per source like a running domain would
+type fakeDomain struct {
+	ifaces map[libvirt.DomainInterfaceAddressesSource][]libvirt.DomainInterface
+	errs   map[libvirt.DomainInterfaceAddressesSource]error
+	asked  []libvirt.DomainInterfaceAddressesSource
+}
+
+func (d *fakeDomain) ListAllInterfaceAddresses(src libvirt.DomainInterfaceAddressesSource) ([]libvirt.DomainInterface, error) {
+	d.asked = append(d.asked, src)
+	if err := d.errs[src]; err != nil {
+		return nil, err
+	}
+	return d.ifaces[src], nil
+}
+
+func agentInterfaces() []libvirt.DomainInterface {
+	return []libvirt.DomainInterface{
+		{Name: "lo", Addrs: []libvirt.DomainIPAddress{
+			{Type: libvirt.IP_ADDR_TYPE_IPV4, Addr: "127.0.0.1", Prefix: 8},
+			{Type: libvirt.IP_ADDR_TYPE_IPV6, Addr: "::1", Prefix: 128},
+		}},
+		{Name: "eth0", Hwaddr: "52:54:00:3a:1f:9c", Addrs: []libvirt.DomainIPAddress{
+			{Type: libvirt.IP_ADDR_TYPE_IPV6, Addr: "fe80::5054:ff:fe3a:1f9c", Prefix: 64},
+			{Type: libvirt.IP_ADDR_TYPE_IPV6, Addr: "fd00:122::50", Prefix: 64},
+			{Type: libvirt.IP_ADDR_TYPE_IPV4, Addr: "192.168.122.50", Prefix: 24},
+		}},
+	}
+}
+
+func TestIPResolverSourceOrder(t *testing.T) {
+	dom := &fakeDomain{
+		ifaces: map[libvirt.DomainInterfaceAddressesSource][]libvirt.DomainInterface{
+			libvirt.DOMAIN_INTERFACE_ADDRESSES_SRC_AGENT: agentInterfaces(),
+		},
+	}
+
+	// a static guest has no lease - the agent answers with every routable address
+	addrs, err := (&network.IPResolver{}).Lookup(dom)
+	if err != nil {
+		t.Fatalf("Lookup: %s", err)
+	}
+	if len(dom.asked) != 2 || dom.asked[0] != libvirt.DOMAIN_INTERFACE_ADDRESSES_SRC_LEASE {
+		t.Errorf("expected lease then agent to be asked, got %v", dom.asked)
+	}
+
+	var got []string
+	for _, addr := range addrs {
+		if addr.Source != network.IPSourceAgent || addr.Interface != "eth0" || addr.MAC != "52:54:00:3a:1f:9c" {
+			t.Errorf("unexpected address %+v", addr)
+		}
+		got = append(got, addr.CIDR())
+	}
+	if strings.Join(got, " ") != "fd00:122::50/64 192.168.122.50/24" {
+		t.Errorf("loopback and link-local should be dropped, got %v", got)
+	}
+
+	dom.asked = nil
+	arpOnly := network.IPResolver{Sources: []string{network.IPSourceARP}}
+	if _, err := arpOnly.Lookup(dom); err == nil || !strings.Contains(err.Error(), "arp: no addresses") {
+		t.Errorf("an empty source should be reported, got %v", err)
+	}
+	if len(dom.asked) != 1 || dom.asked[0] != libvirt.DOMAIN_INTERFACE_ADDRESSES_SRC_ARP {
+		t.Errorf("only arp should be asked, got %v", dom.asked)
+	}
+}
+
+func TestIPResolverErrors(t *testing.T) {
+	dom := &fakeDomain{
+		errs: map[libvirt.DomainInterfaceAddressesSource]error{
+			libvirt.DOMAIN_INTERFACE_ADDRESSES_SRC_AGENT: errors.New("Guest agent is not responding"),
+		},
+	}
+
+	_, err := (&network.IPResolver{}).Lookup(dom)
+	if err == nil {
+		t.Fatal("a domain without addresses resolved")
+	}
+	for _, want := range []string{"lease: no addresses", "agent: Guest agent is not responding", "arp: no addresses"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q should mention %q", err, want)
+		}
+	}
+
+	if _, err := (&network.IPResolver{Sources: []string{"mdns"}}).Lookup(dom); err == nil {
+		t.Error("an unknown source should fail")
+	}
+}
+
+func TestIPResolverPrimary(t *testing.T) {
+	dom := &fakeDomain{
+		ifaces: map[libvirt.DomainInterfaceAddressesSource][]libvirt.DomainInterface{
+			libvirt.DOMAIN_INTERFACE_ADDRESSES_SRC_AGENT: agentInterfaces(),
+		},
+	}
+	resolver := (&network.IPResolver{}).SetSources(network.IPSourceAgent).SetTimeout(time.Second)
+
+	addrs, err := resolver.Lookup(dom)
+	if err != nil {
+		t.Fatalf("Lookup: %s", err)
+	}
+	if primary, _ := resolver.Primary(addrs); primary.IP != "192.168.122.50" {
+		t.Errorf("primary %s, want the IPv4 address", primary.IP)
+	}
+	if primary, _ := resolver.SetIPv6(true).Primary(addrs); primary.IP != "fd00:122::50" || !primary.IPv6 {
+		t.Errorf("primary %s, want the IPv6 address when preferred", primary.IP)
+	}
+	if primary, _ := resolver.Primary(addrs[1:]); primary.IP != "192.168.122.50" {
+		t.Errorf("an IPv4-only VM should still have a primary, got %s", primary.IP)
+	}
+	if _, ok := resolver.Primary(nil); ok {
+		t.Error("no addresses should have no primary")
+	}
+}
@@ -3,7 +3,7 @@ package tests
 import (
 	"bytes"
 	"fmt"
-	"kvmgo/constants"
+	"kvmgo/config"
 	"kvmgo/lib"
 	"log"
 	"net"
@@ -44,7 +44,7 @@ func extractJoinCommand(input string) (string, error) {
 }
 
 func TestSSHConnection(t *testing.T) {
-	privateKeyPath := constants.SshPriv
+	privateKeyPath := config.Current().SSHPrivateKey
 	domain := "ubuntu-base-vm"
 	qconn, _ := lib.ConnectLibvirt()
 	dom, _ := qconn.GetDomain(domain)
@@ -0,0 +1,123 @@
+package tests
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"testing"
+	"time"
+
+	"kvmgo/cloudinit"
+)
+
+// readSeed walks an ISO 9660 image and returns the root directory's files by their Rock Ridge names
+func readSeed(t *testing.T, image []byte) (label string, files map[string]string) {
+	t.Helper()
+	const sector = 2048
+
+	pvd := image[16*sector:]
+	if pvd[0] != 1 || string(pvd[1:6]) != "CD001" {
+		t.Fatalf("no primary volume descriptor at sector 16")
+	}
+	if total := binary.LittleEndian.Uint32(pvd[80:84]); int(total)*sector != len(image) {
+		t.Errorf("volume space size %d sectors, image is %d bytes", total, len(image))
+	}
+	if binary.LittleEndian.Uint32(pvd[80:84]) != binary.BigEndian.Uint32(pvd[84:88]) {
+		t.Error("volume space size differs between byte orders")
+	}
+	if term := image[17*sector:]; term[0] != 255 || string(term[1:6]) != "CD001" {
+		t.Error("no volume descriptor set terminator at sector 17")
+	}
+
+	rootRecord := pvd[156:190]
+	rootLBA := binary.LittleEndian.Uint32(rootRecord[2:6])
+	rootLen := binary.LittleEndian.Uint32(rootRecord[10:14])
+	dir := image[int(rootLBA)*sector : int(rootLBA)*sector+int(rootLen)]
+
+	files = map[string]string{}
+	for off := 0; off < len(dir) && dir[off] != 0; off += int(dir[off]) {
+		rec := dir[off:]
+		name := string(rec[33 : 33+int(rec[32])])
+		if rec[25]&2 != 0 {
+			continue // . and ..
+		}
+		extent := binary.LittleEndian.Uint32(rec[2:6])
+		size := binary.LittleEndian.Uint32(rec[10:14])
+
+		// the Rock Ridge NM entry carries the name cloud-init opens
+		su := rec[33+len(name)+(1-len(name)%2) : rec[0]]
+		rrName := ""
+		for i := 0; i+4 <= len(su) && su[i+2] > 0; i += int(su[i+2]) {
+			if string(su[i:i+2]) == "NM" {
+				rrName = string(su[i+5 : i+int(su[i+2])])
+			}
+		}
+		if rrName != strings.ToLower(strings.TrimSuffix(name, ";1")) {
+			t.Errorf("identifier %q has Rock Ridge name %q", name, rrName)
+		}
+		files[rrName] = string(image[int(extent)*sector : int(extent)*sector+int(size)])
+	}
+	return strings.TrimSpace(string(pvd[40:72])), files
+}
+
+func TestSeedISOContainsNoCloudFiles(t *testing.T) {
+	seed := cloudinit.Seed{
+		UserData:      "#cloud-config\nhostname: kafka\n",
+		MetaData:      "instance-id: kafka\nlocal-hostname: kafka\n",
+		NetworkConfig: "version: 2\nethernets:\n  eth0:\n    dhcp4: true\n",
+		VendorData:    strings.Repeat("#", 5000), // spans three sectors
+		ModTime:       time.Date(2024, 5, 1, 12, 30, 0, 0, time.UTC),
+	}
+
+	var buf bytes.Buffer
+	if err := seed.WriteISO(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	label, files := readSeed(t, buf.Bytes())
+	if label != cloudinit.SeedLabel {
+		t.Errorf("volume label %q, want %q", label, cloudinit.SeedLabel)
+	}
+	want := map[string]string{
+		"user-data":      seed.UserData,
+		"meta-data":      seed.MetaData,
+		"network-config": seed.NetworkConfig,
+		"vendor-data":    seed.VendorData,
+	}
+	if len(files) != len(want) {
+		t.Errorf("seed files %v", files)
+	}
+	for name, content := range want {
+		if files[name] != content {
+			t.Errorf("%s = %q, want %q", name, files[name], content)
+		}
+	}
+
+	if got := string(buf.Bytes()[16*2048+813 : 16*2048+829]); got != "2024050112300000" {
+		t.Errorf("volume creation date %q", got)
+	}
+
+	var again bytes.Buffer
+	if err := seed.WriteISO(&again); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), again.Bytes()) {
+		t.Error("the same seed produced different images")
+	}
+}
+
+func TestSeedISODefaultsMetaData(t *testing.T) {
+	var buf bytes.Buffer
+	if err := (cloudinit.Seed{UserData: "#cloud-config\n"}).WriteISO(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	// system area, descriptors, path tables and root directory, then one sector each for user-data and meta-data
+	if buf.Len() != 23*2048 {
+		t.Errorf("image is %d bytes, want %d", buf.Len(), 23*2048)
+	}
+	_, files := readSeed(t, buf.Bytes())
+	if len(files) != 2 || files["meta-data"] != "instance-id: "+cloudinit.DefaultInstanceID+"\n" {
+		t.Errorf("seed files %v", files)
+	}
+}
@@ -0,0 +1,115 @@
+package tests
+
+import (
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"kvmgo/state"
+)
+
+func TestStatePutGetDelete(t *testing.T) {
+	store := state.NewStore(filepath.Join(t.TempDir(), "kvmetal", "state.json"))
+
+	if rec, err := store.Get("kafka"); err != nil || rec != nil {
+		t.Fatalf("empty store should have no records: %v %v", rec, err)
+	}
+
+	rec := &state.VMRecord{
+		Name:          "kafka",
+		Preset:        "kafka",
+		CPUCores:      4,
+		Memory:        8192,
+		Disks:         []state.DiskRecord{{Name: "data", Path: "/var/lib/kvmetal/kafka-data-disk.qcow2", Size: 20}},
+		CloudInitHash: state.HashCloudInit([]byte("#cloud-config\n")),
+	}
+	if err := store.Put(rec); err != nil {
+		t.Fatalf("Put: %s", err)
+	}
+
+	got, err := store.Get("kafka")
+	if err != nil || got == nil {
+		t.Fatalf("Get: %v %v", got, err)
+	}
+	if got.Preset != "kafka" || got.CPUCores != 4 || len(got.Disks) != 1 || got.CreatedAt.IsZero() {
+		t.Errorf("record not persisted: %+v", got)
+	}
+
+	if err := store.AddExposure("kafka", state.Exposure{HostPort: 9094, VMPort: 9095, Protocol: "tcp"}); err != nil {
+		t.Fatalf("AddExposure: %s", err)
+	}
+	if err := store.AddExposure("kafka", state.Exposure{HostPort: 9094, VMPort: 9092, Protocol: "tcp"}); err != nil {
+		t.Fatalf("AddExposure: %s", err)
+	}
+
+	got, _ = store.Get("kafka")
+	if len(got.Exposures) != 1 || got.Exposures[0].VMPort != 9092 {
+		t.Errorf("exposure on the same host port should be replaced: %+v", got.Exposures)
+	}
+	if !got.CreatedAt.Equal(rec.CreatedAt) {
+		t.Errorf("CreatedAt changed on update")
+	}
+
+	if err := store.Delete("kafka"); err != nil {
+		t.Fatalf("Delete: %s", err)
+	}
+	if records, _ := store.List(); len(records) != 0 {
+		t.Errorf("expected empty state after delete, got %d records", len(records))
+	}
+}
+
+func TestStateAddExposureInsideRange(t *testing.T) {
+	store := state.NewStore(filepath.Join(t.TempDir(), "state.json"))
+
+	for _, exp := range []state.Exposure{
+		{HostPort: 8000, HostEndPort: 8010, VMPort: 9000, VMEndPort: 9010, Protocol: "tcp"},
+		{HostPort: 8005, HostEndPort: 8005, VMPort: 9005, VMEndPort: 9005, Protocol: "udp"},
+		{HostPort: 8080, VMPort: 80, Protocol: "tcp"},
+		// inside the tcp range - forwarding drops the whole range, so does the record
+		{HostPort: 8005, VMPort: 22, Protocol: "tcp"},
+	} {
+		if err := store.AddExposure("kafka", exp); err != nil {
+			t.Fatalf("AddExposure: %s", err)
+		}
+	}
+
+	got, _ := store.Get("kafka")
+	if len(got.Exposures) != 3 || got.Exposures[0].Protocol != "udp" || got.Exposures[1].HostPort != 8080 || got.Exposures[2].VMPort != 22 {
+		t.Errorf("expected the tcp range to be replaced, got %+v", got.Exposures)
+	}
+
+	// a range over single ports replaces them too
+	if err := store.AddExposure("kafka", state.Exposure{HostPort: 8000, HostEndPort: 8100, VMPort: 8000, VMEndPort: 8100, Protocol: "tcp"}); err != nil {
+		t.Fatalf("AddExposure: %s", err)
+	}
+	got, _ = store.Get("kafka")
+	if len(got.Exposures) != 2 || got.Exposures[0].Protocol != "udp" || got.Exposures[1].HostEndPort != 8100 {
+		t.Errorf("expected 8080 and 8005 to be replaced by the range, got %+v", got.Exposures)
+	}
+}
+
+func TestStateConcurrentUpdates(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			// separate stores share only the file - exercises the flock rather than the mutex
+			store := state.NewStore(path)
+			if err := store.Put(&state.VMRecord{Name: string(rune('a' + i))}); err != nil {
+				t.Errorf("Put: %s", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	records, err := state.NewStore(path).List()
+	if err != nil {
+		t.Fatalf("List: %s", err)
+	}
+	if len(records) != 20 || records[0].Name != "a" {
+		t.Errorf("expected 20 sorted records, got %d", len(records))
+	}
+}
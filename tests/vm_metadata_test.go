@@ -60,7 +60,7 @@ func TestGeneratingForwardingActionsFromExistingConfig(t *testing.T) {
 		t.Errorf("Failed to Handle Qemu Start Event Hook ERROR:%s", err)
 	}
 
-	if err := utils.WriteArraytoFile(cmds, qemu_hooks.CmdsFilePath); err != nil {
+	if err := utils.WriteArraytoFile(cmds, qemu_hooks.CmdsFilePath()); err != nil {
 		t.Errorf("Failed writing generated forwarding commands to file ERROR:%s,", err)
 	}
 }
@@ -0,0 +1,214 @@
+/*
+Package nic describes the network interfaces of a VM - the domain gets one <interface> per entry
+and the cloud-init seed a netplan v2 network-config matching them by MAC.
+
+Usage:
+
+	ifaces, _ := nic.ParseAll([]string{
+		"network=default,ip=192.168.122.50/24,gw=192.168.122.1,dns=192.168.122.1",
+		"network=storage,vlan=100,ip=10.0.100.5/24",
+	})
+	ifaces = nic.AssignMACs("kafka", ifaces)
+*/
+package nic
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// DefaultNetwork is the libvirt NAT network interfaces attach to unless told otherwise
+const DefaultNetwork = "default"
+
+type Interface struct {
+	Network   string   `json:"network,omitempty" yaml:"network,omitempty"`
+	MAC       string   `json:"mac,omitempty" yaml:"mac,omitempty"`
+	Addresses []string `json:"addresses,omitempty" yaml:"addresses,omitempty"` // CIDR - DHCP when empty
+	Gateway4  string   `json:"gateway4,omitempty" yaml:"gateway4,omitempty"`
+	Gateway6  string   `json:"gateway6,omitempty" yaml:"gateway6,omitempty"`
+	DNS       []string `json:"dns,omitempty" yaml:"dns,omitempty"`
+	Search    []string `json:"search,omitempty" yaml:"search,omitempty"`
+	VLAN      int      `json:"vlan,omitempty" yaml:"vlan,omitempty"` // tagged by the guest on top of the NIC
+}
+
+// NetworkName is the libvirt network the interface attaches to
+func (i Interface) NetworkName() string {
+	if i.Network == "" {
+		return DefaultNetwork
+	}
+	return i.Network
+}
+
+// Static reports whether the interface has addresses instead of using DHCP
+func (i Interface) Static() bool { return len(i.Addresses) > 0 }
+
+// IPv4 is the first static IPv4 address without its prefix - empty for DHCP interfaces
+func (i Interface) IPv4() string {
+	for _, addr := range i.Addresses {
+		if ip, _, err := net.ParseCIDR(addr); err == nil && ip.To4() != nil {
+			return ip.String()
+		}
+	}
+	return ""
+}
+
+// Validate checks addresses are CIDRs, gateways and nameservers are IPs, the MAC and VLAN are usable
+func (i Interface) Validate() error {
+	var v4, v6 bool
+	for _, addr := range i.Addresses {
+		ip, _, err := net.ParseCIDR(addr)
+		if err != nil {
+			return fmt.Errorf("address %q must be in CIDR notation such as 192.168.122.50/24", addr)
+		}
+		if ip.To4() != nil {
+			v4 = true
+		} else {
+			v6 = true
+		}
+	}
+	if i.Gateway4 != "" {
+		if ip := net.ParseIP(i.Gateway4); ip == nil || ip.To4() == nil {
+			return fmt.Errorf("gateway4 %q is not an IPv4 address", i.Gateway4)
+		}
+		if !v4 {
+			return fmt.Errorf("gateway4 %s requires a static IPv4 address", i.Gateway4)
+		}
+	}
+	if i.Gateway6 != "" {
+		if ip := net.ParseIP(i.Gateway6); ip == nil || ip.To4() != nil {
+			return fmt.Errorf("gateway6 %q is not an IPv6 address", i.Gateway6)
+		}
+		if !v6 {
+			return fmt.Errorf("gateway6 %s requires a static IPv6 address", i.Gateway6)
+		}
+	}
+	for _, dns := range i.DNS {
+		if net.ParseIP(dns) == nil {
+			return fmt.Errorf("nameserver %q is not an IP address", dns)
+		}
+	}
+	if i.MAC != "" {
+		if _, err := net.ParseMAC(i.MAC); err != nil {
+			return fmt.Errorf("invalid mac %q: %v", i.MAC, err)
+		}
+	}
+	if i.VLAN < 0 || i.VLAN > 4094 {
+		return fmt.Errorf("vlan %d must be between 1 and 4094", i.VLAN)
+	}
+	return nil
+}
+
+// ValidateAll validates every interface and that no two share a MAC
+func ValidateAll(ifaces []Interface) error {
+	macs := map[string]int{}
+	for n, iface := range ifaces {
+		if err := iface.Validate(); err != nil {
+			return fmt.Errorf("interface %d: %v", n, err)
+		}
+		if iface.MAC == "" {
+			continue
+		}
+		mac := strings.ToLower(iface.MAC)
+		if prev, ok := macs[mac]; ok {
+			return fmt.Errorf("interface %d: mac %s is already used by interface %d", n, iface.MAC, prev)
+		}
+		macs[mac] = n
+	}
+	return nil
+}
+
+/*
+Parse reads the --nic flag - comma separated key=value pairs, repeatable keys for lists
+
+	network=default,ip=192.168.122.50/24,gw=192.168.122.1,dns=1.1.1.1,dns=8.8.8.8
+	network=br0,mac=52:54:00:12:34:56,vlan=100
+	ip=fd00::50/64,gw6=fd00::1
+*/
+func Parse(spec string) (Interface, error) {
+	var iface Interface
+	for _, field := range strings.Split(spec, ",") {
+		if field == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(field, "=")
+		if !ok || value == "" {
+			return iface, fmt.Errorf("invalid nic option %q: want key=value", field)
+		}
+
+		switch key {
+		case "network", "net":
+			iface.Network = value
+		case "mac":
+			iface.MAC = value
+		case "ip", "address":
+			iface.Addresses = append(iface.Addresses, value)
+		case "gw", "gateway", "gateway4":
+			iface.Gateway4 = value
+		case "gw6", "gateway6":
+			iface.Gateway6 = value
+		case "dns":
+			iface.DNS = append(iface.DNS, value)
+		case "search":
+			iface.Search = append(iface.Search, value)
+		case "vlan":
+			vlan, err := strconv.Atoi(value)
+			if err != nil || vlan < 1 {
+				return iface, fmt.Errorf("invalid vlan %q", value)
+			}
+			iface.VLAN = vlan
+		default:
+			return iface, fmt.Errorf("unknown nic option %q - use network, mac, ip, gw, gw6, dns, search or vlan", key)
+		}
+	}
+	return iface, iface.Validate()
+}
+
+// ParseAll parses every --nic flag and checks them together
+func ParseAll(specs []string) ([]Interface, error) {
+	var ifaces []Interface
+	for _, spec := range specs {
+		iface, err := Parse(spec)
+		if err != nil {
+			return nil, fmt.Errorf("--nic %s: %v", spec, err)
+		}
+		ifaces = append(ifaces, iface)
+	}
+	return ifaces, ValidateAll(ifaces)
+}
+
+/*
+AssignMACs fills in missing MACs - derived from the VM name and position under QEMU's 52:54:00
+prefix, so a relaunched VM keeps its MAC and with it any DHCP lease or reservation.
+*/
+func AssignMACs(vmName string, ifaces []Interface) []Interface {
+	out := make([]Interface, len(ifaces))
+	for n, iface := range ifaces {
+		if iface.MAC == "" {
+			iface.MAC = GenerateMAC(vmName, n)
+		}
+		out[n] = iface
+	}
+	return out
+}
+
+// GenerateMAC is the MAC AssignMACs gives the n-th interface of a VM
+func GenerateMAC(vmName string, n int) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s/%d", vmName, n)))
+	return fmt.Sprintf("52:54:00:%02x:%02x:%02x", sum[0], sum[1], sum[2])
+}
+
+// Name is the name the guest gives the n-th interface through netplan's set-name
+func Name(n int) string { return fmt.Sprintf("eth%d", n) }
+
+// StaticIPv4 is the first static IPv4 address across the interfaces - the address presets advertise
+func StaticIPv4(ifaces []Interface) string {
+	for _, iface := range ifaces {
+		if ip := iface.IPv4(); ip != "" {
+			return ip
+		}
+	}
+	return ""
+}
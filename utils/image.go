@@ -3,6 +3,7 @@ package utils
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"log"
@@ -13,14 +14,25 @@ import (
 	"strings"
 	"time"
 
+	"kvmgo/config"
+	"kvmgo/lib/connection"
 	"kvmgo/types/fpath"
 )
 
-const artifacts = "data/artifacts"
-
 // Downloads Base Linux Cloud Image to data/images - only done once and shared among VM's in data/images/ubuntu.img
 func PullImage(url, dir string) error {
-	imageName := filepath.Base(url)
+	return PullImageContext(context.Background(), url, dir)
+}
+
+// ImageFileName is the name a pulled image is cached under - compressed images such as Fedora
+// CoreOS' .qcow2.xz are stored decompressed without the suffix
+func ImageFileName(url string) string {
+	return strings.TrimSuffix(filepath.Base(url), ".xz")
+}
+
+// PullImageContext is PullImage that stops the download when ctx is cancelled - a partial image is removed
+func PullImageContext(ctx context.Context, url, dir string) error {
+	imageName := ImageFileName(url)
 	imagePath := filepath.Join(dir, imageName)
 
 	pullImgsStr := fmt.Sprintf("Pulling Base Image: URL:%s, Dir:%s, ImgPath: %s\n", url, dir, imagePath)
@@ -32,20 +44,59 @@ func PullImage(url, dir string) error {
 		return nil
 	}
 
-	resp, err := http.Get(url)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		return err
 	}
 	defer resp.Body.Close()
 
-	out, err := os.Create(imagePath)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to download %s: %s", url, resp.Status)
+	}
+
+	// downloaded next to the image and renamed once complete so a cancelled pull is not mistaken for a cached image
+	out, err := os.CreateTemp(dir, imageName+".partial-*")
 	if err != nil {
 		return err
 	}
-	defer out.Close()
+	defer os.Remove(out.Name())
+
+	var body io.Reader = resp.Body
+	var xz *exec.Cmd
+	if strings.HasSuffix(url, ".xz") {
+		// decompressed while downloading - no Go xz reader in the standard library
+		xz = exec.CommandContext(ctx, "xz", "--decompress", "--stdout")
+		xz.Stdin = resp.Body
+		if body, err = xz.StdoutPipe(); err != nil {
+			return err
+		}
+		if err := xz.Start(); err != nil {
+			return fmt.Errorf("failed to run xz to decompress %s: %v", imageName, err)
+		}
+	}
 
-	_, err = io.Copy(out, resp.Body)
-	return err
+	if _, err := io.Copy(out, body); err != nil {
+		out.Close()
+		if xz != nil {
+			xz.Wait()
+		}
+		return err
+	}
+	// a truncated download still ends the copy cleanly - only xz's exit status tells
+	if xz != nil {
+		if err := xz.Wait(); err != nil {
+			out.Close()
+			return fmt.Errorf("failed to decompress %s: %v", imageName, err)
+		}
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Rename(out.Name(), imagePath)
 }
 
 // MountImage mounts the generated image at data/images/control-vm-disk.qcow2
@@ -131,34 +182,28 @@ func ModifiedImageName(vmName string) string {
 
 This has the OS in data/images/control-vm-disk.qcow2
 
-	qemu-img create -b <base_img>_cloudimg-amd64.img -F qcow2 -f qcow2 <new_vm>-vm-disk.qcow2 20G
+	qemu-img create -b <dir>/<base_img>_cloudimg-amd64.img -F qcow2 -f qcow2 <dir>/<new_vm>-vm-disk.qcow2 20G
 
-Input  : imageURL (to extract name for the OS Image)
+Input  : imageURL (to extract name for the OS Image), dir where the OS Image is cached
 Output : Error if Img was generated and the Name of the VM's Image we created
 */
-func CreateBaseImage(imageURL, vmName string) (string, error) {
-	log.Printf("utils.CBI(vm.ImageURL,vm.VMName) - utils.CBI(%s,%s)", imageURL, vmName)
+func CreateBaseImage(imageURL, vmName, dir string) (string, error) {
+	log.Printf("utils.CBI(vm.ImageURL,vm.VMName,dir) - utils.CBI(%s,%s,%s)", imageURL, vmName, dir)
 
-	backingImageName := filepath.Base(imageURL)
+	backingImage := filepath.Join(dir, ImageFileName(imageURL))
 
-	if f, _ := fpath.FileExists(backingImageName); !f {
-		log.Println(TurnError(fmt.Sprintf("Backing OS Image File not found: %s", backingImageName)))
+	if f, _ := fpath.FileExists(backingImage); !f {
+		log.Println(TurnError(fmt.Sprintf("Backing OS Image File not found: %s", backingImage)))
 	}
 
-	desiredVMImgName := vmName + "-vm-disk.qcow2"
-
-	fpath.LogCwd()
+	desiredVMImgName := ModifiedImageName(vmName)
+	desiredVMImg := filepath.Join(dir, desiredVMImgName)
 
 	// Generate the modified image - from a Base Image in the QCOW2 format
-	qemuCmd := fmt.Sprintf("qemu-img create -b %s -F qcow2 -f qcow2 %s 20G",
-		backingImageName, desiredVMImgName)
+	cmd := exec.Command("qemu-img", "create", "-b", backingImage, "-F", "qcow2", "-f", "qcow2", desiredVMImg, "20G")
 
-	log.Println(TurnBlueDelimited(fmt.Sprintf("Base Image Creation. Qemu cmd: %s, baseImageName:%s, modifiedImgName:%s", qemuCmd, backingImageName, desiredVMImgName)))
+	log.Printf("Running qemu-img: %s", cmd.String())
 
-	log.Printf("Running qemu-img: %s", qemuCmd)
-	// investigate why it's not created in data/artifacts/vm/disks/
-	// instead created in data/artifacts/vm/
-	cmd := exec.Command("sh", "-c", qemuCmd)
 	output, err := cmd.CombinedOutput()
 	if err != nil {
 		log.Printf("Failed to generate modified image: %v", err)
@@ -166,7 +211,7 @@ func CreateBaseImage(imageURL, vmName string) (string, error) {
 		return "", err
 	}
 
-	log.Print(TurnSuccess(fmt.Sprintf("Successfully Generated Modified Image: %s", desiredVMImgName)))
+	log.Print(TurnSuccess(fmt.Sprintf("Successfully Generated Modified Image: %s", desiredVMImg)))
 
 	return desiredVMImgName, nil
 }
@@ -196,13 +241,13 @@ func CreateDiskQCow(diskPath string, diskSize int) error {
 Static Function to pull files from a running VM
 Usage:
 
-	// Pulls the data to data/artifacts/kubecontrol by default
+	// Pulls the data to <artifacts_dir>/kubecontrol by default
 	err := PullFromRunningVM("vm_name", "/home/ubuntu/init.log")
 
 	if err!=nil {...}
 */
 func PullFromRunningVM(vm_name, path string) error {
-	local := filepath.Join(artifacts, vm_name)
+	local := config.Current().ArtifactsPath(vm_name)
 
 	if err := CreateDirIfNotExist(local); err != nil {
 		log.Printf("Failed 	utils.CreateDirIfNotExist(local) ERROR:%s,", err)
@@ -220,7 +265,7 @@ func PullFromRunningVM(vm_name, path string) error {
 
 // RebootVM restarts the VM. This is useful for rebooting once boot scripts are finished : virsh reboot vmname
 func RebootVM(vm_name, path string) error {
-	cmd := exec.Command("virsh", "reboot", vm_name)
+	cmd := connection.Virsh("reboot", vm_name)
 	log.Printf("Running command: %s\n", cmd.String())
 	_ = cmd.Run()
 
@@ -261,7 +306,7 @@ func FileExistsInVM(vmName, filePath string) bool {
 }
 
 func IsVMRunning(vmName string) (bool, error) {
-	cmd := exec.Command("virsh", "list", "--all")
+	cmd := connection.Virsh("list", "--all")
 
 	output, err := cmd.Output()
 	if err != nil {
@@ -280,7 +325,7 @@ func IsVMRunning(vmName string) (bool, error) {
 
 // RemoveVM shuts down the running VM : virsh shutdown <vm_name>
 func ShutdownVM(vmName string) error {
-	destroyCmd := exec.Command("virsh", "shutdown", vmName)
+	destroyCmd := connection.Virsh("shutdown", vmName)
 	if _, err := destroyCmd.Output(); err != nil {
 		log.Printf("Attempting to shutdown VM '%s', it might not be running. Error: %v", vmName, err)
 	}
@@ -301,7 +346,7 @@ func ShutdownVM(vmName string) error {
 
 	// If the VM is still running after the waiting period, forcefully destroy it
 	log.Printf("VM '%s' is still running after waiting period, attempting to destroy it forcefully...", vmName)
-	destroyCmd = exec.Command("virsh", "destroy", vmName)
+	destroyCmd = connection.Virsh("destroy", vmName)
 	if _, err := destroyCmd.Output(); err != nil {
 		log.Printf("Failed to forcefully destroy VM '%s'. Error: %v", vmName, err)
 		return err
@@ -317,7 +362,7 @@ func UndefineAndRemoveVM(vmName string) error {
 	}
 
 	log.Printf("Undefining VM '%s' and removing all storage...", vmName)
-	undefineCmd := exec.Command("virsh", "undefine", vmName, "--remove-all-storage")
+	undefineCmd := connection.Virsh("undefine", vmName, "--remove-all-storage")
 	if _, err := undefineCmd.Output(); err != nil {
 		log.Printf("Failed to undefine VM '%s' and remove all storage. Error: %v", vmName, err)
 		return err
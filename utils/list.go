@@ -5,6 +5,8 @@ import (
 	"log"
 	"net"
 
+	"kvmgo/lib/connection"
+
 	"libvirt.org/go/libvirt"
 )
 
@@ -101,7 +103,7 @@ func ListDomainXML(conn *libvirt.Connect, domain *libvirt.Domain) error {
 }
 
 func WaitUntilReady(domains []string) error {
-	conn, err := libvirt.NewConnect("qemu:///system")
+	conn, err := connection.Connect()
 	if err != nil {
 		return fmt.Errorf("Error Connecting %s", err)
 	}
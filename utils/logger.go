@@ -677,7 +677,7 @@ func Help() {
 	fmt.Println(DIM + SECTION + NC + BOLD + PURPLE_WHITE + "\nHost System Linux Deps\n" + NC + DIM + SECTION + NC)
 
 	fmt.Println(`
-sudo apt install -y qemu qemu-kvm libvirt-daemon libvirt-clients bridge-utils virt-manager cloud-image-utils libguestfs-tools
+sudo apt install -y qemu qemu-kvm libvirt-daemon libvirt-clients bridge-utils virt-manager libguestfs-tools
 
 sudo reboot
 	`)
@@ -771,12 +771,12 @@ sudo reboot
 
 %s%sCLI util to query VM metadata%s
 
-%ssudo apt-get install arp-scan%s
+%skvmetal vm ip worker --output=json%s
 
 %sGetting VM MAC & IP Addr%s
 
-virsh dumpxml worker | grep 'mac address'
-sudo arp-scan --interface=virbr0 --localnet | grep "52:54:00:25:40:cb"
+virsh domifaddr worker --source lease
+virsh domifaddr worker --source agent    # needs qemu-guest-agent running in the VM
 
 %slibvirt utils to read write%s
 
@@ -786,12 +786,9 @@ sudo virt-copy-in -a pathto/vm-disk.qcow2 <file_to_copy> /path/in/vm
 
 %sSingle Command to get the IP of a VM from the domain name%s
 
-VM=mydomain sudo arp-scan --interface=virbr0 --localnet \
-	| grep -f <(virsh dumpxml $VM \
-	| awk -F"'" '/mac address/{print $2}') \
-	| awk '{print $1}'
+virsh domifaddr mydomain --source lease | awk '/ipv4/{print $4}'
 
-128.999.45.100 %s# ip of VM mydomain%s
+128.999.45.100/24 %s# ip of VM mydomain%s
 `, PURPLE_WHITE, NC, PURPLE_WHITE, NC, BOLD, PURPLE_WHITE, NC, BOLD, NC, PURPLE_WHITE, NC, PURPLE_WHITE, NC, PURPLE_WHITE, NC, BOLD, NC)
 
 	fmt.Println()
@@ -942,4 +939,4 @@ func HelpTest() {
 	fmt.Printf("%s%s%s%s", DIM, YELLOW, "Warning Message: Be Careful", NC)
 }
 
-// VM=mydomain sudo arp-scan --interface=virbr0 --localnet | grep -f <(virsh dumpxml $VM | awk -F"'" '/mac address/{print $2}') | awk '{print $1}'
+// virsh domifaddr mydomain --source lease | awk '/ipv4/{print $4}'
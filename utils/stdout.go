@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"log"
 	"strings"
+
+	"kvmgo/lib/connection"
 )
 
 // RunningVMs Parses the names from space seperated output lines - and gets the Middle Element
@@ -89,7 +91,7 @@ type VM struct {
 // If print is true, it also prints the VMs in a formatted table.
 func ListVMs(skipLines int, print bool) ([]VM, error) {
 	var vms []VM
-	output, _ := ExecCmd("virsh list --all", false)
+	output, _ := ExecCmd(connection.VirshCmd("list --all"), false)
 	lines := strings.Split(output, "\n")
 	for _, line := range lines[skipLines:] {
 		if line == "" {
@@ -8,6 +8,7 @@ import (
 	"strings"
 
 	"kvmgo/network/qemu_hooks"
+	"kvmgo/state"
 	"kvmgo/utils"
 )
 
@@ -32,6 +33,10 @@ func RemoveVMCompletely(vmName string) error {
 		return err
 	}
 
+	if err := releaseAddresses(vmName); err != nil {
+		log.Printf("Error releasing DHCP and DNS entries: %v", err)
+	}
+
 	err := qemu_hooks.ClearVMForwardingConfig(vmName)
 	if err != nil {
 		log.Printf("Error clearing VM config: %v", err)
@@ -41,6 +46,10 @@ func RemoveVMCompletely(vmName string) error {
 
 	DeleteMountPathIfExist(vmName)
 
+	if err := state.Default().Delete(vmName); err != nil {
+		log.Printf("Error removing %s from state: %v", vmName, err)
+	}
+
 	log.Printf("VM '%s' and associated resources have been completely removed successfully.", vmName)
 
 	return nil
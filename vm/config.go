@@ -1,9 +1,8 @@
 package vm
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"io/fs"
 	"log"
@@ -14,20 +13,25 @@ import (
 	"strings"
 	"time"
 
+	"kvmgo/cloudinit"
+	kvmconfig "kvmgo/config"
 	"kvmgo/configuration"
 	"kvmgo/constants"
 	"kvmgo/lib"
 	"kvmgo/network"
 	"kvmgo/types/fpath"
+	"kvmgo/types/nic"
 	"kvmgo/utils"
 
 	"gopkg.in/yaml.v2"
+	"libvirt.org/go/libvirt"
 )
 
 type VMConfig struct {
 	VMName         string `json:"vm_name" yaml:"vm_name"`
 	InlineUserdata string `json:"inline_userdata" yaml:"inline_userdata"`
 	ImageURL       string `json:"image_url" yaml:"image_url"`
+	Preset         string `json:"preset" yaml:"preset"`
 
 	// Central Images Dir
 	ImagesDir       string       `json:"images_dir" yaml:"images_dir"`
@@ -38,6 +42,7 @@ type VMConfig struct {
 	UserData        string       `json:"user_data" yaml:"user_data"`
 	RootDir         string       `json:"root_dir" yaml:"root_dir"`
 	CPUCores        int          `json:"cpu_cores" yaml:"cpu_cores"`
+	OSVariant       string       `json:"os_variant" yaml:"os_variant"`
 	Memory          int          `json:"memory" yaml:"memory"`
 	EnableServices  []string     `json:"enable_services" yaml:"enable_services"`
 	Artifacts       []string     `json:"artifacts" yaml:"artifacts"`
@@ -48,6 +53,12 @@ type VMConfig struct {
 	ImagesPathFP    fpath.FilePath `json:"images_path_fp" yaml:"images_path_fp"`
 	DisksPathFP     fpath.FilePath `json:"disks_path_fp" yaml:"disks_path_fp"`
 	CreateDirsInit  bool           `json:"create_dirs_init" yaml:"create_dirs_init"`
+	// KeepOnFailure skips the rollback of a failed launch so its artifacts can be inspected
+	KeepOnFailure bool `json:"keep_on_failure" yaml:"keep_on_failure"`
+	// Distro selects the default userdata - the image and os-variant are set alongside it
+	Distro constants.Distro `json:"distro" yaml:"distro"`
+	// Interfaces replace the single DHCP NIC on network=default - written to the seed as network-config
+	Interfaces []nic.Interface `json:"interfaces" yaml:"interfaces"`
 
 	// kvm img manager
 	imgManager *lib.ImageManager
@@ -74,7 +85,6 @@ Requirements : OS Backing Image must be Present & Reachable from cwd
 
 cmd : qemu-img create -b <backing_img>.img -F qcow2 -f qcow2 <desired_vm_img_nam>.qcow2 20G 
 
-    _ = s.navigateToAbsPath(s.ImagesDir) 
     backing_img := filepath.Base(imageURL) // extracts os name from URL of ubuntu image
     desiredImgName := vmName + "-vm-disk.qcow2"
 
@@ -94,7 +104,7 @@ The backing file is typically a base image that contains a standard installation
 
 	// utils.CBI calls  	modifiedImageOutputPath, err := utils.CreateBaseImage(s.ImageURL, s.VMName)
 
-	backingImgFile := filepath.Base(vm.ImageURL)
+	backingImgFile := utils.ImageFileName(vm.ImageURL)
 	desiredVMImg := vm.VMName + "-vm-disk.qcow2"
 
 	createVMImage := fmt.Sprintf("utils.CBI() expects to find %s and generates the VM Img: %s\n", backingImgFile, desiredVMImg)
@@ -149,7 +159,7 @@ The backing file is typically a base image that contains a standard installation
 	//    log.Println("If
 
 	generatedVmImg := filepath.Join(vm.ImagesDir, vm.VMName+"-vm-disk.qcow2")
-	vm_userdata_img := filepath.Join("data", "artifacts", vm.VMName, "userdata", "user-data.img")
+	vm_userdata_img := filepath.Join(kvmconfig.Current().ArtifactsPath(vm.VMName), "userdata", "user-data.img")
 
 	if f, _ := fpath.FileExists(generatedVmImg); !f {
 		log.Println(utils.TurnError(fmt.Sprintf("VM OS Image not found: %s", generatedVmImg)))
@@ -388,6 +398,36 @@ func (config *VMConfig) SetCloudInitDataInline(cloudInitUserData string) *VMConf
 	return config
 }
 
+// Sets the preset the VM was launched from - recorded in the state store
+func (config *VMConfig) SetPreset(preset string) *VMConfig {
+	config.Preset = preset
+	return config
+}
+
+// Leaves the artifacts of a failed launch in place instead of rolling them back
+func (config *VMConfig) SetKeepOnFailure(keep bool) *VMConfig {
+	config.KeepOnFailure = keep
+	return config
+}
+
+// Sets the guest distro - picks the default userdata when no preset or --userdata is given
+func (config *VMConfig) SetDistro(distro constants.Distro) *VMConfig {
+	config.Distro = distro
+	return config
+}
+
+// Sets the VM's NICs - interfaces without a MAC get a stable one derived from the VM name
+func (config *VMConfig) SetInterfaces(ifaces []nic.Interface) *VMConfig {
+	config.Interfaces = nic.AssignMACs(config.VMName, ifaces)
+	return config
+}
+
+// Sets the os-variant (e.g. ubuntu22.04) recorded in the domain's libosinfo metadata
+func (config *VMConfig) SetOSVariant(osVariant string) *VMConfig {
+	config.OSVariant = osVariant
+	return config
+}
+
 func (config *VMConfig) SetMemory(memory_mb int) *VMConfig {
 	config.Memory = memory_mb
 	if memory_mb == 0 {
@@ -439,30 +479,33 @@ func (config *VMConfig) SmbiosMetadata() string {
 		config.VMName, config.VMName)
 }
 
+// DefaultUserData points UserData at the default cloud-init userdata under the configured data_dir
 func (config *VMConfig) DefaultUserData() *VMConfig {
-	config.UserData = "/home/kuro/Documents/Code/Go/kvmgo/data/userdata/default/user_data.txt"
+	config.UserData = filepath.Join(kvmconfig.Current().DataDir, "userdata", "default", "user-data.txt")
 	return config
 }
 
-func (s *VMConfig) PullImage() {
+// PullImage downloads the base image unless cached - cancelling ctx aborts the download
+func (s *VMConfig) PullImage(ctx context.Context) error {
 	log.Print(utils.TurnSuccess(fmt.Sprintf("Old s.ImagesDir:%s | New ImgsDir %s | Images URL: %s",
 		s.ImagesDir, s.ImagesPathFP.Get(), s.ImageURL)))
 
 	// err := utils.PullImage(s.ImageURL, s.ImagesDir)
-	err := utils.PullImage(s.ImageURL, s.ImagesPathFP.Get())
+	err := utils.PullImageContext(ctx, s.ImageURL, s.ImagesPathFP.Get())
 	if err != nil {
 		slog.Error("Failed HTTP GET", "error", err)
-		os.Exit(1)
+		return fmt.Errorf("failed to pull %s: %w", s.ImageURL, err)
 	}
+	return nil
 }
 
 // Create Image (user-data.img) from UserData for VM
 //
 //  1. Creates user-data & metedata temp files
-//  2. Runs cloud-localds user-data.img user-data meta-data to create the UserData Disk
+//  2. Writes them into user-data.img - a NoCloud seed ISO labelled cidata
 //  3. This is the persistent Disk required to access the VM
 //
-// Artifacts :  user-data.txt, meta-data ,  userdata.img
+// Artifacts :  user-data.txt, meta-data ,  userdata.img, network-config (when Interfaces are set)
 //
 // Dest : data/artifacts/<vmname>/userdata/
 func (config *VMConfig) GenerateCloudInitImgFromPath() error {
@@ -480,14 +523,7 @@ func (config *VMConfig) GenerateCloudInitImgFromPath() error {
 	if config.InlineUserdata != "" {
 		userDataContent = config.InlineUserdata
 	} else {
-
-		log.Print("Using Default userdata with ZSH Shell. Optionally use DefaultUserdata to launch with Bash.")
-
-		userDataContent = configuration.SubstituteHostNameAndFqdnUserdataSSHPublicKey(
-			//			constants.DefaultUserdata,
-			constants.DefaultUserDataShellZsh,
-			config.VMName,
-			config.sshPub)
+		userDataContent = config.defaultUserdata()
 	}
 
 	log.Print(utils.StructureResultWithHeadingAndColoredMsg(
@@ -495,8 +531,13 @@ func (config *VMConfig) GenerateCloudInitImgFromPath() error {
 		userDataContent,
 	))
 
+	// fail before the seed image is built - a broken document only shows up in the guest's cloud-init log
+	if err := cloudinit.Validate(userDataContent); err != nil {
+		return fmt.Errorf("invalid user-data for %s:\n%v", config.VMName, err)
+	}
+
 	/// 1. Creates user-data & metedata temp files
-	//  2. Runs cloud-localds user-data.img user-data meta-data to create the UserData Disk
+	//  2. Writes user-data.img - the NoCloud seed the VM boots with
 	//  3. This is the persistent Disk required to access the VM
 
 	// Create a temporary user-data file
@@ -509,6 +550,9 @@ func (config *VMConfig) GenerateCloudInitImgFromPath() error {
 	// Path for the meta-data file
 	metaDataFilePath := filepath.Join(userdataDirPath, "meta-data")
 	metaDataContent := config.SmbiosMetadata()
+	if err := cloudinit.ValidateMetaData(metaDataContent); err != nil {
+		return fmt.Errorf("invalid meta-data for %s:\n%v", config.VMName, err)
+	}
 
 	// Write the meta-data content to a file
 	err = os.WriteFile(metaDataFilePath, []byte(metaDataContent), 0o644)
@@ -516,11 +560,22 @@ func (config *VMConfig) GenerateCloudInitImgFromPath() error {
 		return fmt.Errorf("failed to write meta-data file: %v", err)
 	}
 
+	// network-config is only written for explicit interfaces - otherwise cloud-init falls back to DHCP on the first NIC
+	var networkConfig string
+	if len(config.Interfaces) > 0 {
+		if networkConfig, err = cloudinit.NetworkConfig(config.Interfaces); err != nil {
+			return fmt.Errorf("invalid interfaces for %s: %v", config.VMName, err)
+		}
+		if err := os.WriteFile(filepath.Join(userdataDirPath, "network-config"), []byte(networkConfig), 0o644); err != nil {
+			return fmt.Errorf("failed to write network-config file: %v", err)
+		}
+	}
+
 	// Now, use both user-data and meta-data to generate the cloud-init disk
 	outputImgPath := filepath.Join(userdataDirPath, "user-data.img")
-	cmd := exec.Command("cloud-localds", outputImgPath, userDataFilePath, metaDataFilePath)
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("failed to run cloud-localds with meta-data: %v", err)
+	seed := cloudinit.Seed{UserData: userDataContent, MetaData: metaDataContent, NetworkConfig: networkConfig, ModTime: time.Now()}
+	if err := seed.WriteFile(outputImgPath); err != nil {
+		return err
 	}
 
 	log.Printf("Successfully created cloud-init disk with user-data and meta-data: %s", outputImgPath)
@@ -535,11 +590,39 @@ func GetUserData(config *VMConfig) string {
 	if config.InlineUserdata != "" {
 		return config.InlineUserdata
 	}
+	return config.defaultUserdata()
+}
+
+// defaultUserdata sets up zsh on the distro - Ubuntu keeps the hand written template
+func (config *VMConfig) defaultUserdata() string {
 	log.Print("Using Default userdata with ZSH Shell. Optionally use DefaultUserdata to launch with Bash.")
-	return configuration.SubstituteHostNameAndFqdnUserdataSSHPublicKey(
-		constants.DefaultUserDataShellZsh,
-		config.VMName,
-		config.sshPub)
+
+	if config.Distro == constants.Ubuntu {
+		userdata, err := cloudinit.Parse(constants.DefaultUserDataShellZsh)
+		if err != nil {
+			log.Printf("Failed to parse default userdata ERROR:%s", err)
+			return ""
+		}
+		userdata.SetIdentity(config.VMName, kvmconfig.Current().FQDN(config.VMName), "ubuntu", config.sshPub)
+		ubuntu, _ := configuration.GetDistro(constants.Ubuntu)
+		if err := configuration.AddGuestAgent(userdata, ubuntu); err != nil {
+			log.Printf("Failed to add the guest agent to the default userdata ERROR:%s", err)
+		}
+		return userdata.String()
+	}
+
+	builder, err := configuration.NewConfigBuilder(
+		configuration.DefaultPreset{},
+		config.Distro,
+		[]constants.Dependency{constants.Zsh},
+		[]constants.CloudInitPkg{constants.ZSH, constants.Git, constants.Curl},
+		nil,
+		"ubuntu", "password", config.VMName, config.sshPub)
+	if err != nil {
+		log.Printf("Failed to build %s userdata ERROR:%s", config.Distro, err)
+		return ""
+	}
+	return builder.CreateCloudInitData()
 }
 
 // GetMetaData for the VM using the Name
@@ -564,9 +647,9 @@ func CreateCloudInitData(userdata, metadata, path string) error {
 	}
 
 	// combine both for the cloud init disk
-	cmd := exec.Command("cloud-localds", outputImgPath, userDataFilePath, metaDataFilePath)
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("failed to run cloud-localds with meta-data: %v", err)
+	seed := cloudinit.Seed{UserData: userdata, MetaData: metadata, ModTime: time.Now()}
+	if err := seed.WriteFile(outputImgPath); err != nil {
+		return err
 	}
 
 	log.Printf("Successfully created cloud-init disk with user-data and meta-data: %s", outputImgPath)
@@ -650,118 +733,50 @@ func (config *VMConfig) GenerateUserDataImgDefault() error {
 
 	utils.PrintCurrentPath()
 
-	log.Printf("Running cloud-localds %s user-data.txt", absoluteOutputImgPath)
-	cmd := exec.Command("cloud-localds", absoluteOutputImgPath, "user-data.txt")
-	return cmd.Run()
+	userdata, err := os.ReadFile("user-data.txt")
+	if err != nil {
+		return fmt.Errorf("failed to read user-data.txt: %v", err)
+	}
+	log.Printf("Writing seed image %s from user-data.txt", absoluteOutputImgPath)
+	seed := cloudinit.Seed{UserData: string(userdata), ModTime: time.Now()}
+	return seed.WriteFile(absoluteOutputImgPath)
 }
 
-// Navigates to Dir for VM and creates the base image using qemu-img create -b
-// Note : Navgates + Creates VM Image in CENTRAL IMAGES dir
+// Creates the VM image in the CENTRAL IMAGES dir backed by the base OS image using qemu-img create -b
 func (s *VMConfig) CreateBaseImage() error {
-	log.Print("Creating Base Image. Navigating to dir with Base OS Image: %s\n", s.ImagesDir)
-
-	// 	_ = s.navigateToDirWithISOImages()
-	_ = s.navigateToAbsPath(s.ImagesDir) // navigate to central images dir
+	log.Printf("Creating Base Image in dir with Base OS Image: %s\n", s.ImagesDir)
 
-	log.Print(utils.TurnSuccess(fmt.Sprintf("CREATBASEIMAGE() Old s.ImagesDir:%s | New ImgsDir %s",
-		s.ImagesDir, s.ImagesPathFP.Get())))
-
-	modifiedImageOutputPath, err := utils.CreateBaseImage(s.ImageURL, s.VMName)
+	modifiedImageOutputPath, err := utils.CreateBaseImage(s.ImageURL, s.VMName, s.ImagesDir)
 	if err != nil {
 		log.Printf("Failed to create base image ERROR:%s", err)
 		return err
 	}
 
-	utils.TurnSuccess(fmt.Sprintf("Successfully Created new Base Image at %s/%s",
-		s.ImagesDir, modifiedImageOutputPath))
-
-	_ = s.navigateToRoot()
+	log.Print(utils.TurnSuccess(fmt.Sprintf("Successfully Created new Base Image at %s/%s",
+		s.ImagesDir, modifiedImageOutputPath)))
 
 	return nil
 }
 
-// Navigates to Dir for VM and creates the base image using qemu-img create -b
+// Creates the additional qcow2 disks for the VM
 // Disk created in data/artifacts/vm/
 func (s *VMConfig) CreateDisks() error {
 	// uses artifacts dir and hcoded + "disks"
 	utils.CreateDirIfNotExist(s.DisksPath())
 
-	fpath.LogCwd()
 	log.Print("Creating VM Disks")
 
-	err := s.navigateToAbsPath(s.DisksPath())
-	if err != nil {
-		log.Fatalf("FAILURE Generating Secondary Disks : %s", err)
-	}
-
-	fmt.Println(utils.LogMainAction("DEBUG PATH ISSUE"))
-
-	diskPath := s.DisksPath()
-
-	a := s.DisksPathFP.Abs()
-	b, _ := s.DisksPathFP.Relative()
-	c := s.DisksPathFP.Base()
-	d := s.DisksPathFP.Get()
-
-	log.Printf("Paths VM: Abs:%s,Relative:%s, Base:%s, Get:%s\n", a, b, c, d)
-
-	if utils.PathResolvable(a) {
-		log.Printf("Abs Path Resolvable: %s\n", a)
-	}
-
-	if utils.PathResolvable(b) {
-		log.Printf("Relative Path Resolvable: %s\n", a)
-	}
-	if utils.PathResolvable(c) {
-		log.Printf("Base Path Resolvable: %s\n", a)
-	}
-
-	if utils.PathResolvable(d) {
-		log.Printf("Get Path Resolvable: %s\n", a)
-	}
-
-	log.Printf("VM Disks Path: %s\n", diskPath)
-
 	for _, disk := range s.Disks {
+		diskPath := disk.DiskPathFP.Abs()
 
-		diskPathQemu, err := disk.DiskPathFP.Relative()
-		absPath := disk.DiskPathFP.Abs()
-		base := disk.DiskPathFP.Base()
-
-		if utils.PathResolvable(diskPathQemu) {
-			log.Printf("InnerRelative Path Resolvable: %s\n", a)
-		}
-
-		if utils.PathResolvable(absPath) {
-			log.Printf("InnerAbs Path Resolvable: %s\n", a)
-		}
-		if utils.PathResolvable(base) {
-			log.Printf("InnerBase Path Resolvable: %s\n", a)
-		}
-
-		log.Printf("Relative Path returned for disk creation:%s", diskPathQemu)
-
-		log.Printf("Paths: Relative:%s , Abs:%s, Base:%s\n", diskPathQemu, absPath, base)
+		log.Printf("Creating disk for VM at %s", diskPath)
 
-		/*
-					   Wrong : Relative Path returned for disk creation:../../../images/data/artifacts/worker/worker-openebs-disk.qcow2
-					   Running qemu-img to create disk : qemu-img create -f qcow2 ../../../images/data/artifacts/worker/worker-openebs-disk.qcow2 10G
-			Relative Path returned for disk creation:../control-openebs-disk.qcow2
-			2024/07/03 01:57:49 image.go:158: Running q
-				fpath.LogCwd()
-		*/
-		if err != nil {
-			log.Fatalf("Failed to Get Relative Disk Path for QEMU Create. ERROR:%s", err)
-		}
-
-		if err := utils.CreateDiskQCow(diskPathQemu, disk.Size); err != nil {
-			log.Printf(utils.TurnError(fmt.Sprintf("Failed to Create Disk for VM. ERROR:%s,", err)))
+		if err := utils.CreateDiskQCow(diskPath, disk.Size); err != nil {
+			log.Print(utils.TurnError(fmt.Sprintf("Failed to Create Disk for VM. ERROR:%s,", err)))
 			return err
 		}
 	}
 
-	_ = s.navigateToRoot()
-
 	return nil
 }
 
@@ -774,15 +789,13 @@ Patches the Hostname FQDN not being set during Boot
 See: https://bugs.launchpad.net/cloud-init/+bug/1739516
 */
 func (s *VMConfig) ResolveFQDNBootBehaviorImg() error {
-	log.Print("Creating Base Image")
-
-	_ = s.navigateToDirWithISOImages()
+	log.Print("Truncating machine-id on VM Image")
 
 	if err := exec.Command(
 		"sudo",
 		"virt-customize",
 		"-a",
-		utils.ModifiedImageName(s.VMName),
+		s.vmImagePath(),
 		"--truncate",
 		"/etc/machine-id",
 	).Run(); err != nil {
@@ -800,14 +813,7 @@ func (s *VMConfig) ResolveFQDNBootBehaviorImg() error {
 func (s *VMConfig) SetupVM() error {
 	utils.LogStep("MOUNTING IMAGE")
 
-	if err := s.navigateToDirWithISOImages(); err != nil {
-		errStr := utils.TurnError(fmt.Sprintf("Failed to navigate to Dir with VM Base Image (central repo) to modify the VM Base Image"))
-		log.Println(errStr)
-		return errors.New(errStr)
-
-	}
-
-	modifiedImagePath := filepath.Join(s.VMName + "-vm-disk.qcow2")
+	modifiedImagePath := s.vmImagePath()
 	log.Printf("modified Image Path %s", modifiedImagePath)
 	mountPath := "/mnt/" + s.VMName
 
@@ -824,8 +830,6 @@ func (s *VMConfig) SetupVM() error {
 		return err
 	}
 
-	_ = s.navigateToRoot()
-
 	// If Boot Files Present Copy Them
 	if s.BootFilesDir != "" {
 		utils.LogStep("COPYING SCRIPTS AND SYSTEMD SERVICES")
@@ -858,92 +862,103 @@ func (s *VMConfig) SetupVM() error {
 		return err
 	}
 
-	_ = s.navigateToRoot()
-
 	return nil
 }
 
-// CreateVM() runs virt-install - needs paths for the VM Image and the user-data.img files
-// uses libvirtd to create the VM and boot it.
+// CreateVM() defines the domain through libvirt and boots it - needs paths for the VM Image
+// and the user-data.img files.
 // The state will change to Running and the boot scripts will run followed by systemd services
 // Uses the image from data/images/control-vm-disk.qcow2
 // Adds any extra disks defined on the Struct
 func (s *VMConfig) CreateVM() error {
-	err := s.navigateToRoot()
+	client, err := lib.ConnectLibvirt()
 	if err != nil {
-		log.Printf("Failed to Navigate to Root Dir. Virt-install must be ran with relative pathing. :%s", err)
+		return fmt.Errorf("failed to connect to libvirt: %v", err)
 	}
+	defer client.Close()
 
-	// Currently vm images generated in data/images/<vmaame> itself
-	generatedVmImg := filepath.Join(s.ImagesDir, s.VMName+"-vm-disk.qcow2")
-	vm_userdata_img := filepath.Join("data", "artifacts", s.VMName, "userdata", "user-data.img")
+	domainConfig := s.DomainConfig()
 
-	cmdArgs := []string{
-		"--name", s.VMName,
-		"--virt-type", "kvm",
-		"--memory", fmt.Sprint(s.Memory),
-		"--vcpus", fmt.Sprint(s.CPUCores),
-		"--disk", "path=" + generatedVmImg + ",device=disk",
-		"--disk", "path=" + vm_userdata_img + ",format=raw",
-		"--graphics", "none",
-		"--boot", "hd,menu=on",
-		"--network", "network=default",
-		"--os-variant", "ubuntu18.04",
-		"--noautoconsole",
+	domainXML, err := domainConfig.GenerateDomainXML()
+	if err != nil {
+		return err
 	}
 
-	// Dynamically add disks to the command
+	log.Printf("%sCreating Virtual Machine%s %s%s%s%s:\n%s\n", utils.BOLD, utils.NC, utils.BOLD, utils.COOLBLUE, s.VMName, utils.NC, domainXML)
 
-	// Add Disks to the VM
-	// Using FilePath type to get the Relative Command Path
-	for _, diskPath := range s.Disks {
-		relativePath, err := diskPath.DiskPathFP.Relative()
-		if err != nil {
-			log.Fatalf("ERROR:%s", err)
-		}
-		fmt.Println(utils.TurnBoldBlueDelimited(relativePath))
+	// the lease is pinned before the first boot so the guest's DHCP request already gets it
+	if err := s.ReserveAddresses(client.Conn()); err != nil {
+		utils.LogWarning(fmt.Sprintf("Failed to reserve addresses for %s - it keeps a dynamic lease and is not resolvable by name ERROR:%s", s.VMName, err))
+	}
 
-		cmdArgs = append(cmdArgs, "--disk", "path="+relativePath+",device=disk")
+	if err := domainConfig.CreateAndStartVM(client.Conn()); err != nil {
+		log.Printf("ERROR Failed to Create VM error=%q", err)
+		return err
+	}
 
+	return nil
+}
+
+// DomainConfig maps the VM onto the libvirt domain definition used by CreateVM
+func (s *VMConfig) DomainConfig() *lib.VMConfig {
+	domainConfig := lib.NewVMConfig(s.VMName).
+		SetMemory(s.Memory).
+		SetCores(s.CPUCores).
+		SetBaseImage(s.vmImagePath()).
+		SetNetwork("default").
+		SetInterfaces(s.nics()).
+		SetOSVariant(s.OSVariant)
+
+	if s.Distro.UsesIgnition() {
+		domainConfig.SetIgnitionPath(s.IgnitionPath())
+	} else {
+		userdataImg, _ := s.GetImageUserDataPath()
+		domainConfig.SetUserDataPath(userdataImg)
 	}
 
-	// for _, diskPath := range s.GetDiskPaths() {
-	// 	cmdArgs = append(cmdArgs, "--disk", "path="+diskPath+",device=disk")
-	// }
+	for _, disk := range s.Disks {
+		domainConfig.AddDisk(disk.DiskPathFP.Abs())
+	}
 
-	log.Printf("%sCreating Virtual Machine%s %s%s%s%s:\nvirt-install %s\n", utils.BOLD, utils.NC, utils.BOLD, utils.COOLBLUE, s.VMName, utils.NC, strings.Join(cmdArgs, " "))
-
-	/*
-		cmd := exec.Command("virt-install", "--name", s.VMName,
-			"--virt-type", "kvm",
-			"--memory", fmt.Sprint(s.Memory),
-			"--vcpus", fmt.Sprint(s.CPUCores),
-			"--disk", "path="+modifiedImagePath+",device=disk",
-			"--disk", "path="+vm_userdata_img+",format=raw",
-			"--graphics", "none",
-			"--boot", "hd,menu=on",
-			"--network", "network=default",
-			"--os-variant", "ubuntu18.04", "--noautoconsole",
-			// "--print-xml", // to test the XML structure
-		)
-	*/
-
-	cmd := exec.Command("virt-install", cmdArgs...)
-
-	var stderr bytes.Buffer // Capture stderr
-	cmd.Stderr = &stderr
-	// cmd.Stdout = &stderr if we need to print XML
-
-	err = cmd.Run()
-	if err != nil {
-		log.Printf("ERROR Failed to Create VM error=%q", stderr.String())
-		return err
+	return domainConfig
+}
+
+// nics are the VM's interfaces - without any configured the DHCP NIC on default still gets a stable MAC to reserve
+func (s *VMConfig) nics() []nic.Interface {
+	if len(s.Interfaces) > 0 {
+		return s.Interfaces
 	}
-	//	log.Printf("VM XML Description:\n%s", stderr.String())
+	return nic.AssignMACs(s.VMName, []nic.Interface{{}})
+}
 
+/*
+ReserveAddresses adds a DHCP host for each NIC on its libvirt network and names the first one
+<vm>.<domain> and <vm> in that network's DNS - see lib.Reservation. VLAN NICs are skipped as the
+network's dnsmasq never sees their tagged traffic.
+*/
+func (s *VMConfig) ReserveAddresses(conn *libvirt.Connect) error {
+	named := false
+	for _, iface := range s.nics() {
+		if iface.VLAN != 0 {
+			continue
+		}
+		reservation := lib.Reservation{Network: iface.NetworkName(), MAC: iface.MAC, Name: s.VMName, IP: iface.IPv4()}
+		if !named {
+			reservation.Hostnames = []string{kvmconfig.Current().FQDN(s.VMName), s.VMName}
+			named = true
+		}
+		if _, err := reservation.Reserve(conn); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+// vmImagePath is the primary disk generated from the base image - data/images/<vm>-vm-disk.qcow2
+func (s *VMConfig) vmImagePath() string {
+	return filepath.Join(s.ImagesDir, utils.ModifiedImageName(s.VMName))
+}
+
 func (s *VMConfig) EnableSystemdServices() error {
 	mountPath := "/mnt/" + s.VMName
 
@@ -1103,11 +1118,6 @@ func (s *VMConfig) PullArtifactsOg() error {
 
 func (s *VMConfig) CopyVMSetupFiles() error {
 	mountPath := "/mnt/" + s.VMName
-	log.Printf("Navigating to boot directory for VM setup files")
-	if err := s.navigateToBootupDir(); err != nil {
-		log.Printf("Error navigating to boot directory: %v", err)
-		return err
-	}
 
 	setupDir := filepath.Join(s.RootDir, s.BootFilesDir)
 	ubuntuUserPath := filepath.Join(mountPath, "home", "ubuntu")
@@ -1213,9 +1223,12 @@ func (s *VMConfig) GetSSHClient() (*network.VMClient, error) {
 
 	username := "ubuntu"
 	password := "password"
-	ip, _ := network.GetVMIPAddr(s.VMName)
+	ip, err := network.GetVMIPAddr(s.VMName)
+	if err != nil {
+		return nil, err
+	}
 
-	client, err := network.NewInsecureSSHClientVM(s.VMName, ip.StringWithSubnet(), username, password)
+	client, err := network.NewInsecureSSHClientVM(s.VMName, ip.String(), username, password)
 	if err != nil {
 		log.Printf("Error creating SSH client:%s", err)
 		return nil, err
@@ -1243,46 +1256,6 @@ func (s *VMConfig) PullFromVMToPath(path, local string) error {
 	return nil
 }
 
-func (s *VMConfig) navigateToBootupDir() error {
-	if err := os.Chdir(s.BootFilesDir); err != nil {
-
-		log.Printf("Failed to change directory: %v", err)
-
-		return err
-	}
-
-	return nil
-}
-
-// Navigates to the Path where we cache all the Base OS Images - so we can extend it to create an Image for the VM (data/images)
-func (s *VMConfig) navigateToDirWithISOImages() error {
-	if err := os.Chdir(s.ImagesDir); err != nil {
-		log.Printf(utils.TurnError(fmt.Sprintf("Failed to change directory: %v", err)))
-		return err
-	}
-	return nil
-}
-
-/* Naviagate to a Path */
-func (s *VMConfig) navigateToAbsPath(absPath string) error {
-	if err := os.Chdir(absPath); err != nil {
-		return fmt.Errorf("Failed to Navigate to %s. ERROR:%s", absPath, err.Error())
-	}
-	return nil
-}
-
-// Navigate back to Root Dir as Commands are Path Relevant for QEMU/KVM
-func (s *VMConfig) navigateToRoot() error {
-	if err := os.Chdir(s.RootDir); err != nil {
-
-		log.Printf("Failed to change directory: %v", err)
-
-		return err
-	}
-
-	return nil
-}
-
 // func (s *VMConfig) SetArtifactDir(path string) {
 // 	s.artifactPath = path
 // }
@@ -0,0 +1,92 @@
+package vm
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"kvmgo/coreos"
+	"kvmgo/utils"
+)
+
+// IgnitionPath is the config Fedora CoreOS and Flatcar read through fw_cfg - data/artifacts/<vm>/userdata/config.ign
+func (config *VMConfig) IgnitionPath() string {
+	path, err := filepath.Abs(filepath.Join(config.ArtifactPath, "userdata", "config.ign"))
+	if err != nil {
+		log.Printf("Error getting absolute path: %v", err)
+	}
+	return path
+}
+
+// provisioningArtifacts are the files the userdata stage writes into data/artifacts/<vm>/userdata
+func (config *VMConfig) provisioningArtifacts() []string {
+	if config.Distro.UsesIgnition() {
+		return []string{"config.ign", "config.bu", config.VMName + "-vmconfig.yaml"}
+	}
+	artifacts := []string{"user-data.txt", "meta-data", "user-data.img", config.VMName + "-vmconfig.yaml"}
+	if len(config.Interfaces) > 0 {
+		artifacts = append(artifacts, "network-config")
+	}
+	return artifacts
+}
+
+/*
+GenerateIgnitionConfig is GenerateCloudInitImgFromPath for the Ignition distros.
+
+InlineUserdata holds the Ignition JSON a preset generated - without one the VM only gets the
+ubuntu login, the ssh key and its hostname. The config is checked to parse before it is written.
+
+Artifacts : config.ign, config.bu (the same config as Butane, for reading and editing)
+
+Dest : data/artifacts/<vmname>/userdata/
+*/
+func (config *VMConfig) GenerateIgnitionConfig() error {
+	userdataDirPath := filepath.Join(config.ArtifactPath, "userdata")
+	if err := os.MkdirAll(userdataDirPath, 0o755); err != nil {
+		return fmt.Errorf("failed to create userdata directory: %v", err)
+	}
+
+	ignition := &coreos.Config{}
+	if config.InlineUserdata != "" {
+		if err := json.Unmarshal([]byte(config.InlineUserdata), ignition); err != nil {
+			return fmt.Errorf("invalid ignition config for %s: %v", config.VMName, err)
+		}
+	} else {
+		builder, err := coreos.NewConfigBuilder(config.Distro, nil, nil, "ubuntu", "password", config.VMName, config.sshPub)
+		if err != nil {
+			return err
+		}
+		if ignition, err = builder.Config(); err != nil {
+			return err
+		}
+	}
+
+	ignitionJSON, err := ignition.JSON()
+	if err != nil {
+		return err
+	}
+	butane, err := ignition.Butane(config.Distro)
+	if err != nil {
+		return err
+	}
+
+	log.Print(utils.StructureResultWithHeadingAndColoredMsg(
+		"Ignition Config Set To", utils.PEACH,
+		butane,
+	))
+
+	if err := os.WriteFile(config.IgnitionPath(), []byte(ignitionJSON), 0o644); err != nil {
+		return fmt.Errorf("failed to write ignition config: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(userdataDirPath, "config.bu"), []byte(butane), 0o644); err != nil {
+		return fmt.Errorf("failed to write butane config: %v", err)
+	}
+
+	log.Printf("Successfully created ignition config: %s", config.IgnitionPath())
+
+	config.WriteConfigYaml()
+
+	return nil
+}
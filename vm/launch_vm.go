@@ -1,89 +1,229 @@
 package vm
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"log/slog"
+	"path/filepath"
 
+	"kvmgo/jobs"
 	"kvmgo/utils"
 )
 
+// Launch stage names - reported in job events and by job list
+const (
+	StagePullImage       = "pull-image"
+	StageCreateBaseImage = "create-base-image"
+	StageCreateDisks     = "create-disks"
+	StagePatchBootFQDN   = "patch-boot-fqdn"
+	StageSetupVM         = "setup-vm"
+	StageCloudInit       = "generate-cloud-init"
+	StageIgnition        = "generate-ignition" // replaces generate-cloud-init for Fedora CoreOS and Flatcar
+	StageCreateVM        = "create-vm"
+)
+
 /* Launches a new Ubuntu VM with nothing setup */
 func LaunchNewVM(vmConfig *VMConfig) (*VMConfig, error) {
-	LogLaunchInit(vmConfig.VMName, vmConfig.Memory, vmConfig.CPUCores)
-
-	// Pulls Base ubuntu image if not cached
-	vmConfig.PullImage()
+	return LaunchNewVMContext(context.Background(), vmConfig, nil)
+}
 
-	// Creates base image with OS defined in data/images/control-vm-disk.qcow2
-	if err := vmConfig.CreateBaseImage(); err != nil {
-		log.Print(utils.TurnError(fmt.Sprintf("Failed to Setup VM ERROR:%s", err)))
-		_ = Cleanup(vmConfig.VMName)
-		return nil, err
-	}
+/*
+LaunchNewVMContext runs the launch stages as a job - cancelling ctx stops the launch and onEvent
+(optional) receives every stage transition.
 
-	//	return nil, errors.New("Testing Base Image Creation Path")
+Usage:
 
-	// Create additional disks required by the VM (data/artifacts/vm/<disk>.qcow2
-	if err := vmConfig.CreateDisks(); err != nil {
-		log.Print(utils.TurnError(fmt.Sprintf("Failed to Create Disks. ERROR:%s", err)))
-		_ = Cleanup(vmConfig.VMName)
-		return nil, err
+	_, err := vm.LaunchNewVMContext(ctx, vmConfig, func(ev jobs.Event) {
+		fmt.Printf("[%d/%d] %s %s\n", ev.Index+1, ev.Total, ev.Stage, ev.Type)
+	})
+*/
+func LaunchNewVMContext(ctx context.Context, vmConfig *VMConfig, onEvent func(jobs.Event)) (*VMConfig, error) {
+	engine := jobs.NewEngine()
+	if onEvent != nil {
+		engine.OnEvent(onEvent)
 	}
 
-	/* Necessary in order for Domain to send the DHCP Request at Boot Time */
-	if err := vmConfig.ResolveFQDNBootBehaviorImg(); err != nil {
-		log.Print(utils.TurnError(fmt.Sprintf("Failed to Truncate Cloud Image to Patch Hostname Not being set on Boot Behavior ERROR:%s", err)))
-		_ = Cleanup(vmConfig.VMName)
+	if _, err := engine.Run(ctx, "launch", vmConfig.VMName, vmConfig.LaunchStages()); err != nil {
 		return nil, err
 	}
+	return vmConfig, nil
+}
 
-	fmt.Print(utils.LogSection("SETTING UP VM"))
+/*
+LaunchStages are the steps of LaunchNewVM in order. Submit them to a jobs.Engine to launch in the
+background and follow progress.
 
-	// Mounts the generated primary disk at /mnt/vmname and if present
-	// copies systemd scripts into it
-	// If no boot scripts or systemd services defined - this does nothing
-	if err := vmConfig.SetupVM(); err != nil {
-		utils.LogError(fmt.Sprintf("Failed to Setup VM ERROR:%s", err))
-		_ = Cleanup(vmConfig.VMName)
-		return nil, err
-	}
+	pull-image -> create-base-image -> create-disks -> patch-boot-fqdn -> setup-vm -> generate-cloud-init -> create-vm
 
-	fmt.Print(utils.LogSection("GENERATING CLOUDINIT USERDATA"))
+Fedora CoreOS and Flatcar run generate-ignition in place of generate-cloud-init.
 
-	// Produces user-data.txt, meta-data, and user-data.img
-	// Uses dynamic logic for user-data.txt to setup boot logic
-	// user-data.txt and meta-data used to generate user-data.img
-	if err := vmConfig.GenerateCloudInitImgFromPath(); err != nil {
-		utils.LogError(fmt.Sprintf("Failed to Generate Cloud-Init Disk ERROR:%s", err))
-		_ = Cleanup(vmConfig.VMName)
-		return nil, err
-	}
+Every stage that creates something registers an undo, so a failure or cancel rolls back the VM
+image, extra disks, the setup mount, cloud-init artifacts and a half defined domain - files that
+existed before the launch are left alone. The pulled base image is a shared cache and is kept.
 
-	fmt.Print(utils.LogSection("LAUNCHING VM"))
+With KeepOnFailure set no undo is registered and everything is left in place for inspection.
+*/
+func (vmConfig *VMConfig) LaunchStages() []jobs.Stage {
+	userdataDir := vmConfig.UserdataPath()
 
-	// Runs libvirt command - requires
-	// 1. Primary disk from data/images/control-vm-disk.qcow2
-	// 2. user-data.img from above step
-	// 3. Optional - attaches additional disks defined
-	if err := vmConfig.CreateVM(); err != nil {
-		utils.LogError(fmt.Sprintf("Failed to Create VM ERROR:%s", err))
-		log.Printf("Check sudo cat /var/log/libvirt/qemu/%s.log for verbose failure logs", vmConfig.VMName)
-		return nil, err
+	image := newCreatedFiles(vmConfig.vmImagePath())
+	disks := newCreatedFiles(vmConfig.DisksPath())
+	for _, disk := range vmConfig.Disks {
+		disks.paths = append(disks.paths, disk.DiskPathFP.Abs())
+	}
+	mount := newCreatedFiles("/mnt/" + vmConfig.VMName)
+	cloudInit := newCreatedFiles(userdataDir)
+	for _, artifact := range vmConfig.provisioningArtifacts() {
+		cloudInit.paths = append(cloudInit.paths, filepath.Join(userdataDir, artifact))
+	}
+	var defined bool
+
+	userdataStage := jobs.Stage{
+		// Produces user-data.txt, meta-data, and user-data.img
+		// Uses dynamic logic for user-data.txt to setup boot logic
+		// user-data.txt and meta-data used to generate user-data.img
+		Name: StageCloudInit,
+		Run: vmConfig.logOnError("Failed to Generate Cloud-Init Disk", func() error {
+			fmt.Print(utils.LogSection("GENERATING CLOUDINIT USERDATA"))
+			return cloudInit.run(vmConfig.GenerateCloudInitImgFromPath)
+		}),
+		Undo: cloudInit.remove,
+	}
+	if vmConfig.Distro.UsesIgnition() {
+		// Produces config.ign - passed through fw_cfg by create-vm instead of a seed disk
+		userdataStage.Name = StageIgnition
+		userdataStage.Run = vmConfig.logOnError("Failed to Generate Ignition Config", func() error {
+			fmt.Print(utils.LogSection("GENERATING IGNITION CONFIG"))
+			return cloudInit.run(vmConfig.GenerateIgnitionConfig)
+		})
 	}
 
-	// for now create a default forwarding config
-	// if err := qemu_hooks.DomainAddForwardingConfigIfRunning(vmConfig.VMName); err != nil {
-	// 	log.Printf("Could Not Generate Default Forwarding Commands. ERROR:%s,", err)
-	// }
-
-	slog.Info("VM created successfully")
+	stages := []jobs.Stage{
+		{
+			// Pulls Base ubuntu image if not cached
+			Name: StagePullImage,
+			Run: func(ctx context.Context) error {
+				LogLaunchInit(vmConfig.VMName, vmConfig.Memory, vmConfig.CPUCores)
+				return vmConfig.PullImage(ctx)
+			},
+		},
+		{
+			// Creates base image with OS defined in data/images/control-vm-disk.qcow2
+			Name: StageCreateBaseImage,
+			Run: vmConfig.logOnError("Failed to Setup VM", func() error {
+				return image.run(vmConfig.CreateBaseImage)
+			}),
+			Undo: image.remove,
+		},
+		{
+			// Create additional disks required by the VM (data/artifacts/vm/<disk>.qcow2
+			Name: StageCreateDisks,
+			Run: vmConfig.logOnError("Failed to Create Disks.", func() error {
+				return disks.run(vmConfig.CreateDisks)
+			}),
+			Undo: disks.remove,
+		},
+		{
+			/* Necessary in order for Domain to send the DHCP Request at Boot Time */
+			// patches the image in place - undone together with create-base-image
+			Name: StagePatchBootFQDN,
+			Run: vmConfig.logOnError("Failed to Truncate Cloud Image to Patch Hostname Not being set on Boot Behavior",
+				func() error {
+					// Ignition guests generate their machine-id on first boot
+					if vmConfig.Distro.UsesIgnition() {
+						return nil
+					}
+					return vmConfig.ResolveFQDNBootBehaviorImg()
+				}),
+		},
+		{
+			// Mounts the generated primary disk at /mnt/vmname and if present
+			// copies systemd scripts into it
+			// If no boot scripts or systemd services defined - this does nothing
+			Name: StageSetupVM,
+			Run: vmConfig.logOnError("Failed to Setup VM", func() error {
+				fmt.Print(utils.LogSection("SETTING UP VM"))
+				return mount.run(vmConfig.SetupVM)
+			}),
+			Undo: func(context.Context) error {
+				// the mount dir is created with sudo - unmount and remove it the same way
+				if !mount.any() {
+					return nil
+				}
+				if IsMounted(vmConfig.VMName) {
+					if err := UnmountVM(vmConfig.VMName); err != nil {
+						return fmt.Errorf("failed to unmount /mnt/%s: %v", vmConfig.VMName, err)
+					}
+				}
+				return utils.ClearMountPath(vmConfig.VMName)
+			},
+		},
+		userdataStage,
+		{
+			// Runs libvirt command - requires
+			// 1. Primary disk from data/images/control-vm-disk.qcow2
+			// 2. user-data.img from above step
+			// 3. Optional - attaches additional disks defined
+			Name: StageCreateVM,
+			Run: func(ctx context.Context) error {
+				fmt.Print(utils.LogSection("LAUNCHING VM"))
+
+				// an existing domain makes CreateVM fail - it must survive the rollback
+				defined = !domainExists(vmConfig.VMName)
+
+				if err := vmConfig.CreateVM(); err != nil {
+					utils.LogError(fmt.Sprintf("Failed to Create VM ERROR:%s", err))
+					log.Printf("Check sudo cat /var/log/libvirt/qemu/%s.log for verbose failure logs", vmConfig.VMName)
+					return err
+				}
+
+				// Record preset, resources, disks and image lineage in the state store
+				vmConfig.recordLaunch()
+
+				slog.Info("VM created successfully")
+
+				if vmConfig.Distro.UsesIgnition() {
+					log.Print(utils.TurnBold("For VM Boot Logs: Check journalctl -t ignition and the units in config.bu."))
+				} else {
+					log.Print(utils.TurnBold(
+						"For VM Boot Logs: Check /var/log/cloud-init-output.log to view boot logs.\n" +
+							"To view UserData file used: /var/lib/cloud/instance/user-data.txt"))
+				}
+				return nil
+			},
+			Undo: func(context.Context) error {
+				if !defined {
+					return nil
+				}
+				if err := releaseAddresses(vmConfig.VMName); err != nil {
+					log.Printf("Failed to release addresses of %s ERROR:%s", vmConfig.VMName, err)
+				}
+				return undefineDomain(vmConfig.VMName)
+			},
+		},
+	}
 
-	log.Print(utils.TurnBold(
-		"For VM Boot Logs: Check /var/log/cloud-init-output.log to view boot logs.\n" +
-			"To view UserData file used: /var/lib/cloud/instance/user-data.txt"))
+	if vmConfig.KeepOnFailure {
+		for i := range stages {
+			stages[i].Undo = nil
+		}
+	}
+	return stages
+}
 
-	return vmConfig, nil
+// logOnError adapts a launch step to a stage - rollback of what it created is left to the stage's Undo
+func (vmConfig *VMConfig) logOnError(msg string, step func() error) func(context.Context) error {
+	return func(context.Context) error {
+		if err := step(); err != nil {
+			log.Print(utils.TurnError(fmt.Sprintf("%s ERROR:%s", msg, err)))
+			if vmConfig.KeepOnFailure {
+				utils.LogWarning(fmt.Sprintf("Keeping artifacts of %s for debugging - remove them with kvmetal vm delete %s", vmConfig.VMName, vmConfig.VMName))
+			}
+			return err
+		}
+		return nil
+	}
 }
 
 func LogLaunchInit(vmName string, mem, cores int) {
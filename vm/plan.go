@@ -0,0 +1,243 @@
+package vm
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"kvmgo/cloudinit"
+	kvmconfig "kvmgo/config"
+	"kvmgo/lib"
+	"kvmgo/network/qemu_hooks"
+	"kvmgo/utils"
+
+	"github.com/jedib0t/go-pretty/table"
+)
+
+// PlanStep is a single side effect a launch or cleanup would perform
+type PlanStep struct {
+	Action string `json:"action"` // pull, create, write, modify, mount, define, delete, keep
+	Kind   string `json:"kind"`   // image, qcow2, disk, artifact, domain, mount, forwarding
+	Target string `json:"target"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// Plan lists the steps --dry-run reports for a VM without touching the system
+type Plan struct {
+	VM        string     `json:"vm"`
+	Operation string     `json:"operation"`
+	Steps     []PlanStep `json:"steps"`
+}
+
+func (p *Plan) add(action, kind, target, detail string) {
+	p.Steps = append(p.Steps, PlanStep{Action: action, Kind: kind, Target: target, Detail: detail})
+}
+
+/*
+LaunchPlan mirrors the stages of LaunchNewVM and reports what each would produce.
+
+	pull   image    data/images/ubuntu-22.04-server-cloudimg-amd64.img
+	create qcow2    data/images/<vm>-vm-disk.qcow2
+	create disk     data/artifacts/<vm>/<vm>-openebs-disk.qcow2
+	write  artifact data/artifacts/<vm>/userdata/user-data.img
+	reserve dhcp-host default
+	reserve dns-host <vm>.kuro.com
+	define domain   <vm>
+*/
+func (config *VMConfig) LaunchPlan() *Plan {
+	plan := &Plan{VM: config.VMName, Operation: "launch"}
+
+	imagesDir := config.ImagesPathFP.Get()
+	if imagesDir == "" {
+		imagesDir = config.ImagesDir
+	}
+
+	// 1. PullImage
+	baseImg := utils.ImageFileName(config.ImageURL)
+	if utils.ImageExists(baseImg, imagesDir) {
+		plan.add("keep", "image", filepath.Join(imagesDir, baseImg), "cached")
+	} else {
+		plan.add("pull", "image", filepath.Join(imagesDir, baseImg), config.ImageURL)
+	}
+
+	// 2. CreateBaseImage
+	vmImg := filepath.Join(imagesDir, utils.ModifiedImageName(config.VMName))
+	if exists, _ := fileExists(vmImg); exists {
+		plan.add("create", "qcow2", vmImg, "already exists - qemu-img will fail")
+	} else {
+		plan.add("create", "qcow2", vmImg, fmt.Sprintf("backing file %s, 20G", baseImg))
+	}
+
+	// 3. CreateDisks
+	for _, disk := range config.Disks {
+		plan.add("create", "disk", disk.DiskPathFP.Abs(), fmt.Sprintf("%dG", disk.Size))
+	}
+
+	// 4. ResolveFQDNBootBehaviorImg - Ignition guests generate their machine-id on first boot
+	if !config.Distro.UsesIgnition() {
+		plan.add("modify", "qcow2", vmImg, "virt-customize --truncate /etc/machine-id")
+	}
+
+	// 5. SetupVM - only mounts when files need to be copied in
+	if config.BootFilesDir != "" || config.SystemdScript != "" {
+		plan.add("mount", "mount", "/mnt/"+config.VMName, "guestmount to copy boot files and systemd units")
+	}
+
+	// 6. GenerateCloudInitImgFromPath or GenerateIgnitionConfig
+	userdataDir := config.UserdataPath()
+	for _, artifact := range config.provisioningArtifacts() {
+		detail := ""
+		if artifact == "user-data.txt" && config.InlineUserdata != "" {
+			if err := cloudinit.Validate(config.InlineUserdata); err != nil {
+				detail = "invalid - launch will fail: " + strings.ReplaceAll(err.Error(), "\n", "; ")
+			}
+		}
+		if artifact == "network-config" {
+			if _, err := cloudinit.NetworkConfig(config.Interfaces); err != nil {
+				detail = "invalid - launch will fail: " + err.Error()
+			}
+		}
+		plan.add("write", "artifact", filepath.Join(userdataDir, artifact), detail)
+	}
+
+	// 7. CreateVM - reserves the NICs' addresses and names, then defines the domain
+	named := false
+	for _, iface := range config.nics() {
+		if iface.VLAN != 0 {
+			continue
+		}
+		address := iface.IPv4()
+		if address == "" {
+			address = "next free address in the dhcp range"
+		}
+		plan.add("reserve", "dhcp-host", iface.NetworkName(), iface.MAC+" "+address)
+		if !named {
+			plan.add("reserve", "dns-host", kvmconfig.Current().FQDN(config.VMName), "on network "+iface.NetworkName())
+			named = true
+		}
+	}
+	plan.add("define", "domain", config.VMName,
+		fmt.Sprintf("%d vcpu, %d MiB, %d extra disks, %s", config.CPUCores, config.Memory, len(config.Disks), config.interfacesSummary()))
+
+	return plan
+}
+
+// interfacesSummary is network=default for the single DHCP NIC, otherwise one network=..[,ip=..] per interface
+func (config *VMConfig) interfacesSummary() string {
+	if len(config.Interfaces) == 0 {
+		return "network=default"
+	}
+	nics := make([]string, len(config.Interfaces))
+	for i, iface := range config.Interfaces {
+		nics[i] = "network=" + iface.NetworkName()
+		if ip := iface.IPv4(); ip != "" {
+			nics[i] += ",ip=" + ip
+		}
+	}
+	return strings.Join(nics, " ")
+}
+
+/*
+RemovalPlan mirrors RemoveVMCompletely for a defined domain.
+
+Attached storage is read from libvirt when reachable - otherwise the conventional
+images_dir and artifacts_dir paths from the config are reported.
+*/
+func RemovalPlan(vmName string) *Plan {
+	plan := &Plan{VM: vmName, Operation: "cleanup"}
+
+	plan.add("delete", "domain", vmName, "shutdown (destroy after 15s) and undefine")
+	plan.add("delete", "dns-host", kvmconfig.Current().FQDN(vmName), "dhcp hosts and dns entries on every network")
+
+	for _, disk := range domainStorage(vmName) {
+		plan.add("delete", "disk", disk, "virsh undefine --remove-all-storage")
+	}
+
+	fwd, err := qemu_hooks.ReadVMConfigFromFile(vmName)
+	if err == nil && fwd != nil {
+		for _, pm := range fwd.PortMap {
+			plan.add("delete", "forwarding", fmt.Sprintf("%s host:%d -> vm:%d", pm.Protocol, pm.HostPort, pm.VMPort), "kvmfwding_config.json entry")
+		}
+		for _, pr := range fwd.PortRange {
+			plan.add("delete", "forwarding", fmt.Sprintf("%s host:%d-%d -> vm:%d-%d", pr.Protocol,
+				pr.HostStartPortNum, pr.HostEndPortNum, pr.VMStartPort, pr.VMEndPortNum), "kvmfwding_config.json entry")
+		}
+	}
+
+	mountPath := "/mnt/" + vmName
+	if IsMounted(vmName) {
+		plan.add("delete", "mount", mountPath, "guestunmount and remove")
+	} else if exists, _ := fileExists(mountPath); exists {
+		plan.add("delete", "mount", mountPath, "remove")
+	}
+
+	artifacts := kvmconfig.Current().ArtifactsPath(vmName)
+	if exists, _ := fileExists(artifacts); exists {
+		plan.add("keep", "artifact", artifacts, "not removed by cleanup")
+	}
+
+	return plan
+}
+
+// domainStorage returns the file backed disks attached to a domain
+func domainStorage(vmName string) []string {
+	client, err := lib.ConnectLibvirt()
+	if err == nil {
+		defer client.Close()
+
+		if domcfg, err := client.ParseXML(vmName); err == nil && domcfg.Devices != nil {
+			var disks []string
+			for _, disk := range domcfg.Devices.Disks {
+				if disk.Source != nil && disk.Source.File != nil {
+					disks = append(disks, disk.Source.File.File)
+				}
+			}
+			return disks
+		}
+	}
+
+	cfg := kvmconfig.Current()
+	return []string{
+		filepath.Join(cfg.ImagesDir, utils.ModifiedImageName(vmName)),
+		filepath.Join(cfg.ArtifactsPath(vmName), "userdata", "user-data.img"),
+	}
+}
+
+func fileExists(path string) (bool, error) {
+	_, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// PlansTable renders plans as a single table - one row per step
+func PlansTable(plans []*Plan) string {
+	var stringBuilder strings.Builder
+	t := table.NewWriter()
+	t.SetOutputMirror(&stringBuilder)
+	t.SetStyle(table.StyleLight)
+
+	t.AppendHeader(table.Row{"VM Name", "Operation", "Action", "Kind", "Target", "Detail"})
+
+	for _, plan := range plans {
+		for _, step := range plan.Steps {
+			t.AppendRow(table.Row{plan.VM, plan.Operation, step.Action, step.Kind, step.Target, step.Detail})
+		}
+	}
+
+	t.Render()
+
+	return stringBuilder.String()
+}
+
+// PlansJSON renders plans for --output=json
+func PlansJSON(plans []*Plan) (string, error) {
+	data, err := json.MarshalIndent(plans, "", "  ")
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal plan: %v", err)
+	}
+	return string(data), nil
+}
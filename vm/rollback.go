@@ -0,0 +1,131 @@
+package vm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+
+	kvmconfig "kvmgo/config"
+	"kvmgo/lib"
+	ldom "kvmgo/lib/domain"
+	"kvmgo/utils"
+)
+
+/*
+createdFiles remembers which of a stage's output paths did not exist before the stage ran, so
+its undo removes exactly those and never a file left by an earlier launch or another VM.
+
+List a directory before the files inside it - remove works backwards and only deletes
+directories once they are empty.
+
+Usage:
+
+	img := newCreatedFiles(vmConfig.vmImagePath())
+	stage := jobs.Stage{
+		Run:  func(context.Context) error { return img.run(vmConfig.CreateBaseImage) },
+		Undo: img.remove,
+	}
+*/
+type createdFiles struct {
+	mu      sync.Mutex
+	paths   []string
+	created []string
+}
+
+func newCreatedFiles(paths ...string) *createdFiles {
+	return &createdFiles{paths: paths}
+}
+
+// run calls step and records the paths it brought into existence - also when step fails part way
+func (c *createdFiles) run(step func() error) error {
+	existed := make(map[string]bool, len(c.paths))
+	for _, p := range c.paths {
+		existed[p] = pathExists(p)
+	}
+
+	err := step()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, p := range c.paths {
+		if !existed[p] && pathExists(p) {
+			c.created = append(c.created, p)
+		}
+	}
+	return err
+}
+
+// remove deletes the recorded paths, newest first
+func (c *createdFiles) remove(context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var errs []error
+	for i := len(c.created) - 1; i >= 0; i-- {
+		p := c.created[i]
+		if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+			errs = append(errs, fmt.Errorf("failed to remove %s: %v", p, err))
+			continue
+		}
+		LogDeletion(p)
+	}
+	c.created = nil
+	return errors.Join(errs...)
+}
+
+func (c *createdFiles) any() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.created) > 0
+}
+
+func pathExists(p string) bool {
+	_, err := os.Stat(p)
+	return err == nil
+}
+
+// domainExists reports whether libvirt has a domain named vmName - false if it cannot be asked
+func domainExists(vmName string) bool {
+	client, err := lib.ConnectLibvirt()
+	if err != nil {
+		log.Printf("Failed to connect to libvirt to check for %s ERROR:%s", vmName, err)
+		return false
+	}
+	defer client.Close()
+
+	exists, _ := ldom.DomainExists(client.Conn(), vmName)
+	return exists
+}
+
+// releaseAddresses removes the DHCP hosts and DNS entries CreateVM reserved for the VM
+func releaseAddresses(vmName string) error {
+	client, err := lib.ConnectLibvirt()
+	if err != nil {
+		return fmt.Errorf("failed to connect to libvirt: %v", err)
+	}
+	defer client.Close()
+
+	return lib.ReleaseHost(client.Conn(), vmName, kvmconfig.Current().FQDN(vmName))
+}
+
+// undefineDomain stops and undefines a domain CreateVM defined - its disks are removed by the earlier stages' undo
+func undefineDomain(vmName string) error {
+	if !domainExists(vmName) {
+		return nil
+	}
+
+	client, err := lib.ConnectLibvirt()
+	if err != nil {
+		return fmt.Errorf("failed to connect to libvirt: %v", err)
+	}
+	defer client.Close()
+
+	if err := lib.DeleteVM(client.Conn(), vmName); err != nil {
+		return err
+	}
+	log.Print(utils.TurnSuccess(fmt.Sprintf("Undefined partially created domain %s", vmName)))
+	return nil
+}
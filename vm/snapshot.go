@@ -1,12 +1,20 @@
 package vm
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"log/slog"
-	"os/exec"
+	"sort"
+	"strconv"
+	"time"
 
+	"kvmgo/lib"
+	"kvmgo/lib/connection"
 	"kvmgo/utils"
+
+	"libvirt.org/go/libvirt"
+	libvirtxml "libvirt.org/libvirt-go-xml"
 )
 
 /*
@@ -63,7 +71,7 @@ func SnapshotBegin(vmName, snapshotName, userdataAbsPath, desc string) error {
 
 // DetachDisk temporarily detaches the raw Disk as Point In Time snapshots can only be taken for qCow2 Disks
 func DetachDisk(vmName string) error {
-	detachCmd := exec.Command("virsh", "detach-disk", vmName, "--target", "vdb")
+	detachCmd := connection.Virsh("detach-disk", vmName, "--target", "vdb")
 	if err := detachCmd.Run(); err != nil {
 		log.Printf("Failed to Detach user-data.img raw disk for VM %s: %v", vmName, err)
 		return err
@@ -74,7 +82,7 @@ func DetachDisk(vmName string) error {
 
 // SnapshotVM takes the snapshot of an Image once the Raw disk has been detached: virsh snapshot-create-as --domain vm_name snap_name --description "My Snapshot"
 func SnapshotVM(vmName, snapshotName, desc string) error {
-	snapshotCmd := exec.Command("virsh", "snapshot-create-as", vmName, snapshotName, "vdb", "--description", desc)
+	snapshotCmd := connection.Virsh("snapshot-create-as", vmName, snapshotName, "vdb", "--description", desc)
 	if err := snapshotCmd.Run(); err != nil {
 		log.Printf("Failed Taking Snapshot of VM %s: %v", vmName, err)
 		return err
@@ -86,7 +94,7 @@ func SnapshotVM(vmName, snapshotName, desc string) error {
 
 // ReAttachDisk attaches the userdata raw disk back to the VM once the Snapshot has been completed
 func ReAttachDisk(vmName, userdataimgAbsPath string) error {
-	reAttachCmd := exec.Command("virsh", "attach-disk", vmName, userdataimgAbsPath, "vdb", "--cache", "none")
+	reAttachCmd := connection.Virsh("attach-disk", vmName, userdataimgAbsPath, "vdb", "--cache", "none")
 	if err := reAttachCmd.Run(); err != nil {
 		log.Printf("Failed to Reattach user-data.img raw disk for VM %s: %v", vmName, err)
 		return err
@@ -95,3 +103,177 @@ func ReAttachDisk(vmName, userdataimgAbsPath string) error {
 	log.Printf("User Data Attached Successfully for VM %s", vmName)
 	return nil
 }
+
+var (
+	ErrDomainNotFound   = errors.New("domain not found")
+	ErrSnapshotNotFound = errors.New("snapshot not found")
+)
+
+// SnapshotInfo describes an internal snapshot of a domain
+type SnapshotInfo struct {
+	Name        string    `json:"name"`
+	Description string    `json:"description,omitempty"`
+	State       string    `json:"state"` // domain state when the snapshot was taken
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+/*
+CreateSnapshot takes an internal snapshot of a running or stopped VM through libvirt.
+
+Internal snapshots only cover qcow2 disks - the cloud-init seed cdrom and any raw or readonly
+disk is excluded from the snapshot instead of being detached and reattached.
+
+Usage:
+
+	err := vm.CreateSnapshot("spark", "spark_hadoop", "Machine with Spark,Hadoop,Java,Scala configured")
+*/
+func CreateSnapshot(vmName, snapshotName, desc string) error {
+	return withDomain(vmName, func(domain *libvirt.Domain) error {
+		domXML, err := domain.GetXMLDesc(0)
+		if err != nil {
+			return fmt.Errorf("failed to get XML for %s: %v", vmName, err)
+		}
+
+		domcfg := &libvirtxml.Domain{}
+		if err := domcfg.Unmarshal(domXML); err != nil {
+			return fmt.Errorf("failed to parse XML for %s: %v", vmName, err)
+		}
+
+		snapshot := &libvirtxml.DomainSnapshot{
+			Name:        snapshotName,
+			Description: desc,
+			Disks:       snapshotDisks(domcfg),
+		}
+
+		snapXML, err := snapshot.Marshal()
+		if err != nil {
+			return fmt.Errorf("failed to marshal snapshot XML: %v", err)
+		}
+
+		snap, err := domain.CreateSnapshotXML(snapXML, 0)
+		if err != nil {
+			return fmt.Errorf("failed to snapshot %s: %v", vmName, err)
+		}
+		defer snap.Free()
+
+		log.Printf("Snapshot %s Successfully Generated for VM %s", snapshotName, vmName)
+		return nil
+	})
+}
+
+// snapshotDisks excludes every disk an internal snapshot cannot cover
+func snapshotDisks(domcfg *libvirtxml.Domain) *libvirtxml.DomainSnapshotDisks {
+	if domcfg.Devices == nil {
+		return nil
+	}
+
+	disks := &libvirtxml.DomainSnapshotDisks{}
+	for _, disk := range domcfg.Devices.Disks {
+		if disk.Target == nil {
+			continue
+		}
+		qcow2 := disk.Driver != nil && disk.Driver.Type == "qcow2"
+		if disk.Device == "cdrom" || disk.ReadOnly != nil || !qcow2 {
+			disks.Disks = append(disks.Disks, libvirtxml.DomainSnapshotDisk{Name: disk.Target.Dev, Snapshot: "no"})
+		}
+	}
+
+	if len(disks.Disks) == 0 {
+		return nil
+	}
+	return disks
+}
+
+// ListSnapshots returns the snapshots of a VM oldest first
+func ListSnapshots(vmName string) ([]SnapshotInfo, error) {
+	var infos []SnapshotInfo
+
+	err := withDomain(vmName, func(domain *libvirt.Domain) error {
+		snaps, err := domain.ListAllSnapshots(0)
+		if err != nil {
+			return fmt.Errorf("failed to list snapshots for %s: %v", vmName, err)
+		}
+
+		for _, snap := range snaps {
+			snapXML, err := snap.GetXMLDesc(0)
+			snap.Free()
+			if err != nil {
+				return fmt.Errorf("failed to get snapshot XML for %s: %v", vmName, err)
+			}
+
+			snapcfg := &libvirtxml.DomainSnapshot{}
+			if err := snapcfg.Unmarshal(snapXML); err != nil {
+				return fmt.Errorf("failed to parse snapshot XML for %s: %v", vmName, err)
+			}
+
+			info := SnapshotInfo{Name: snapcfg.Name, Description: snapcfg.Description, State: snapcfg.State}
+			if secs, err := strconv.ParseInt(snapcfg.CreationTime, 10, 64); err == nil {
+				info.CreatedAt = time.Unix(secs, 0)
+			}
+			infos = append(infos, info)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(infos, func(i, j int) bool { return infos[i].CreatedAt.Before(infos[j].CreatedAt) })
+	return infos, nil
+}
+
+// RevertSnapshot restores a VM to a snapshot - the domain is left in the state it was snapshotted in
+func RevertSnapshot(vmName, snapshotName string) error {
+	return withSnapshot(vmName, snapshotName, func(snap *libvirt.DomainSnapshot) error {
+		if err := snap.RevertToSnapshot(0); err != nil {
+			return fmt.Errorf("failed to revert %s to %s: %v", vmName, snapshotName, err)
+		}
+		log.Printf("VM %s Reverted to Snapshot %s", vmName, snapshotName)
+		return nil
+	})
+}
+
+// DeleteSnapshot permanently removes a snapshot - the VM keeps its current state
+func DeleteSnapshot(vmName, snapshotName string) error {
+	return withSnapshot(vmName, snapshotName, func(snap *libvirt.DomainSnapshot) error {
+		if err := snap.Delete(0); err != nil {
+			return fmt.Errorf("failed to delete snapshot %s of %s: %v", snapshotName, vmName, err)
+		}
+		log.Printf("Snapshot %s of VM %s Deleted", snapshotName, vmName)
+		return nil
+	})
+}
+
+func withDomain(vmName string, fn func(domain *libvirt.Domain) error) error {
+	client, err := lib.ConnectLibvirt()
+	if err != nil {
+		return fmt.Errorf("failed to connect to libvirt: %v", err)
+	}
+	defer client.Close()
+
+	domain, err := client.Conn().LookupDomainByName(vmName)
+	if err != nil {
+		if libvirtError, ok := err.(libvirt.Error); ok && libvirtError.Code == libvirt.ERR_NO_DOMAIN {
+			return fmt.Errorf("%w: %s", ErrDomainNotFound, vmName)
+		}
+		return fmt.Errorf("failed to lookup %s: %v", vmName, err)
+	}
+	defer domain.Free()
+
+	return fn(domain)
+}
+
+func withSnapshot(vmName, snapshotName string, fn func(snap *libvirt.DomainSnapshot) error) error {
+	return withDomain(vmName, func(domain *libvirt.Domain) error {
+		snap, err := domain.SnapshotLookupByName(snapshotName, 0)
+		if err != nil {
+			if libvirtError, ok := err.(libvirt.Error); ok && libvirtError.Code == libvirt.ERR_NO_DOMAIN_SNAPSHOT {
+				return fmt.Errorf("%w: %s has no snapshot %s", ErrSnapshotNotFound, vmName, snapshotName)
+			}
+			return fmt.Errorf("failed to lookup snapshot %s of %s: %v", snapshotName, vmName, err)
+		}
+		defer snap.Free()
+
+		return fn(snap)
+	})
+}
@@ -0,0 +1,174 @@
+package vm
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"kvmgo/lib"
+	"kvmgo/lib/connection"
+	"kvmgo/state"
+	"kvmgo/utils"
+
+	"github.com/jedib0t/go-pretty/table"
+)
+
+// VMStatus joins what kvmetal recorded for a VM with what libvirt currently reports
+type VMStatus struct {
+	Name   string          `json:"name"`
+	State  string          `json:"state"` // running, shut off ... or "missing" when tracked but not defined
+	Record *state.VMRecord `json:"record,omitempty"`
+}
+
+// Defined reports whether libvirt knows the domain
+func (s VMStatus) Defined() bool {
+	return s.State != "missing"
+}
+
+// StateRecord captures the launched VM - resources, disks, image lineage and the cloud-init hash
+func (config *VMConfig) StateRecord() *state.VMRecord {
+	imagesDir := config.ImagesPathFP.Get()
+	if imagesDir == "" {
+		imagesDir = config.ImagesDir
+	}
+
+	rec := &state.VMRecord{
+		Name:     config.VMName,
+		Preset:   config.Preset,
+		CPUCores: config.CPUCores,
+		Memory:   config.Memory,
+		Image: state.ImageLineage{
+			SourceURL: config.ImageURL,
+			BaseImage: filepath.Join(imagesDir, utils.ImageFileName(config.ImageURL)),
+			VMImage:   filepath.Join(imagesDir, utils.ModifiedImageName(config.VMName)),
+			CloudInit: filepath.Join(config.UserdataPath(), "user-data.img"),
+		},
+		URI: connection.URI(),
+	}
+
+	for _, disk := range config.Disks {
+		rec.Disks = append(rec.Disks, state.DiskRecord{
+			Name: disk.DiskName,
+			Path: disk.DiskPathFP.Abs(),
+			Size: disk.Size,
+		})
+	}
+
+	if userdata, err := os.ReadFile(filepath.Join(config.UserdataPath(), "user-data.txt")); err == nil {
+		rec.CloudInitHash = state.HashCloudInit(userdata)
+	}
+
+	return rec
+}
+
+// recordLaunch persists the VM once libvirt has accepted the domain - a failed write is not fatal
+func (config *VMConfig) recordLaunch() {
+	if err := state.Default().Put(config.StateRecord()); err != nil {
+		log.Printf("Failed to record %s in %s ERROR:%s", config.VMName, state.Default().Path, err)
+	}
+}
+
+/*
+Inventory lists every VM kvmetal tracks along with any other domain libvirt has defined.
+
+State comes from the state store - libvirt only supplies the live domain state. If libvirt
+cannot be reached the virsh list output is used instead.
+
+Usage:
+
+	vms, err := vm.Inventory()
+
+	for _, v := range vms {
+		if v.Record != nil && v.Defined() { ... }
+	}
+*/
+func Inventory() ([]VMStatus, error) {
+	records, err := state.Default().List()
+	if err != nil {
+		log.Printf("Failed to read state - listing libvirt domains only. ERROR:%s", err)
+	}
+
+	live, err := liveDomainStates()
+	if err != nil {
+		return nil, err
+	}
+
+	byName := make(map[string]*VMStatus)
+	for name, domState := range live {
+		byName[name] = &VMStatus{Name: name, State: domState}
+	}
+
+	for _, rec := range records {
+		if st, ok := byName[rec.Name]; ok {
+			st.Record = rec
+		} else {
+			byName[rec.Name] = &VMStatus{Name: rec.Name, State: "missing", Record: rec}
+		}
+	}
+
+	statuses := make([]VMStatus, 0, len(byName))
+	for _, st := range byName {
+		statuses = append(statuses, *st)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+
+	return statuses, nil
+}
+
+func liveDomainStates() (map[string]string, error) {
+	client, err := lib.ConnectLibvirt()
+	if err == nil {
+		defer client.Close()
+		return client.DomainStates()
+	}
+
+	vms, err := utils.ListVMs(2, false)
+	if err != nil {
+		return nil, err
+	}
+
+	states := make(map[string]string, len(vms))
+	for _, vm := range vms {
+		states[vm.Name] = vm.State
+	}
+	return states, nil
+}
+
+// InventoryTable renders Inventory for --running
+func InventoryTable(statuses []VMStatus) string {
+	var stringBuilder strings.Builder
+	t := table.NewWriter()
+	t.SetOutputMirror(&stringBuilder)
+	t.SetStyle(table.StyleLight)
+
+	t.AppendHeader(table.Row{"VM Name", "State", "Preset", "vCPU", "Memory", "Disks", "Exposed", "Created"})
+
+	for _, st := range statuses {
+		rec := st.Record
+		if rec == nil {
+			t.AppendRow(table.Row{st.Name, st.State, "-", "-", "-", "-", "-", "untracked"})
+			continue
+		}
+
+		var exposed []string
+		for _, exp := range rec.Exposures {
+			if exp.HostEndPort != 0 {
+				exposed = append(exposed, fmt.Sprintf("%d-%d->%d-%d/%s", exp.HostPort, exp.HostEndPort, exp.VMPort, exp.VMEndPort, exp.Protocol))
+				continue
+			}
+			exposed = append(exposed, fmt.Sprintf("%d->%d/%s", exp.HostPort, exp.VMPort, exp.Protocol))
+		}
+
+		t.AppendRow(table.Row{
+			st.Name, st.State, rec.Preset, rec.CPUCores, rec.Memory, len(rec.Disks),
+			strings.Join(exposed, "\n"), rec.CreatedAt.Local().Format("2006-01-02 15:04"),
+		})
+	}
+
+	t.Render()
+
+	return stringBuilder.String()
+}